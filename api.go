@@ -83,6 +83,11 @@ type Input interface {
 
 // Filter represents a data filter; a filter is a function that processes
 // records. A filter can discard, transform, forward and even create records.
+//
+// A filter may also implement io.Closer, in which case Close is called once,
+// when the topology shuts down, after the last record has gone through the
+// filter chain. This gives filters a chance to release resources or persist
+// their state.
 type Filter interface {
 	// Process processes a single Record, and then optionally sends it to
 	// next filter in the chain.
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"html/template"
+	"io"
 	"math/rand"
 	"net"
 	"net/http"
@@ -23,6 +24,8 @@ import (
 //  -q: quiet logging (not compatible with -v)
 //  -pretty: logs in textual format instead of JSON format
 //  -pprof: run a pprof server on the provided host:port address
+//  -check: check the topology configuration (see CheckConfig) and exit
+//  -test-records: run the records of a file through the filter chain only and print a trace (see TraceFilterChain)
 //
 // The function also expects the first non-positional argument to represent the path to
 // the Baker Topology file
@@ -38,6 +41,8 @@ func MainCLI(components Components) error {
 		flagQuiet      = flag.Bool("q", false, "quiet logging (warn level)")
 		flagPretty     = flag.Bool("pretty", false, "human-readable logging (unstructured logging)")
 		flagPProf      = flag.String("pprof", "", `run pprof server on host port provided (disabled if ""), use "localhost:"  for a free port`)
+		flagCheck      = flag.Bool("check", false, "check the topology configuration, creating all components without running them, and exit")
+		flagTestRecs   = flag.String("test-records", "", "run the records in `file` through the filter chain only (no input nor output) and print a trace of what each filter did")
 	)
 
 	// Seed pseudo-random number generation using seconds since the epoch
@@ -95,6 +100,14 @@ func MainCLI(components Components) error {
 
 	log.WithField("c", cfg.String()).Info("configuration")
 
+	if *flagCheck {
+		return checkConfig(os.Stderr, cfg)
+	}
+
+	if *flagTestRecs != "" {
+		return traceRecords(os.Stdout, cfg, *flagTestRecs)
+	}
+
 	if err := Main(cfg); err != nil {
 		return err
 	}
@@ -102,6 +115,36 @@ func MainCLI(components Components) error {
 	return nil
 }
 
+// checkConfig checks cfg, prints all the errors and warnings found to w
+// and returns a non-nil error if the configuration is not valid.
+func checkConfig(w io.Writer, cfg *Config) error {
+	errs, unused := CheckConfig(cfg)
+	for _, name := range unused {
+		fmt.Fprintf(w, "warning: field %q is declared in [fields] but never used\n", name)
+	}
+	for _, err := range errs {
+		fmt.Fprintf(w, "error: %v\n", err)
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("configuration check failed: %d error(s)", len(errs))
+	}
+
+	fmt.Fprintln(w, "configuration OK")
+	return nil
+}
+
+// traceRecords runs the records in the file at path through the filter chain
+// described in cfg, writing the trace to w.
+func traceRecords(w io.Writer, cfg *Config, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("can't open test records: %v", err)
+	}
+	defer f.Close()
+
+	return TraceFilterChain(cfg, f, w)
+}
+
 var programUsageTemplate = template.Must(template.New("Program usage").Parse(`
 Usage: {{ .ExecName }} [options] TOPOLOGY
 
@@ -0,0 +1,88 @@
+package baker
+
+import (
+	"strings"
+)
+
+// CheckConfig verifies that a topology can be built from cfg, without
+// running it. It creates every component described in the configuration, by
+// calling their New function, and returns all the errors encountered in the
+// process (not only the first one).
+//
+// When the record fields have been declared in the [fields] section of the
+// configuration, CheckConfig also returns the names of the fields that have
+// not been looked up by any component, nor used for validation, output or
+// sharding.
+//
+// Components are created the same way NewTopologyFromConfig creates them, but
+// with ComponentParams.DryRun set. They are only created, their Run method is
+// never called, though they might still perform some initialization in New.
+// Filters implementing io.Closer are closed before returning.
+func CheckConfig(cfg *Config) (errs []error, unusedFields []string) {
+	// Track which fields are looked up by components.
+	used := make(map[string]bool)
+	b := newComponentBuilder(cfg)
+	b.dryRun = true
+	b.fieldByName = func(name string) (FieldIndex, bool) {
+		used[name] = true
+		return cfg.fieldByName(name)
+	}
+	for name := range cfg.Validation {
+		used[name] = true
+	}
+	for name := range cfg.Schema {
+		used[name] = true
+	}
+
+	if metrics, err := b.newMetrics(); err != nil {
+		errs = append(errs, err)
+	} else {
+		defer metrics.Close()
+	}
+
+	if _, err := b.newInput(); err != nil {
+		errs = append(errs, err)
+	}
+
+	var (
+		filters []Filter
+		names   []string
+	)
+	defer func() { closeFilters(filters, names) }()
+	for idx := range cfg.Filter {
+		fil, err := b.newFilter(idx)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		filters = append(filters, fil)
+		names = append(names, strings.ToLower(cfg.Filter[idx].Name))
+	}
+
+	outFields, outErrs := b.outputFields()
+	errs = append(errs, outErrs...)
+
+	// Only create one output, whatever the number of procs, since all outputs
+	// share the same configuration.
+	out, err := b.newOutput(0, outFields)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := b.shardingFunc(out); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := b.newUpload(); err != nil {
+		errs = append(errs, err)
+	}
+
+	// Unused fields only make sense if they've been declared in the TOML.
+	for _, name := range cfg.Fields.Names {
+		if !used[name] {
+			unusedFields = append(unusedFields, name)
+		}
+	}
+
+	return errs, unusedFields
+}
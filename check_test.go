@@ -0,0 +1,251 @@
+package baker_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/filter"
+	"github.com/AdRoll/baker/input/inputtest"
+	"github.com/AdRoll/baker/output"
+)
+
+func TestCheckConfig(t *testing.T) {
+	components := baker.Components{
+		Inputs:  []baker.InputDesc{inputtest.LogLineDesc},
+		Filters: []baker.FilterDesc{filter.NotNullDesc, filter.RegexMatchDesc},
+		Outputs: []baker.OutputDesc{output.NopDesc},
+	}
+
+	tests := []struct {
+		name       string
+		toml       string
+		wantErrs   []string
+		wantUnused []string
+	}{
+		{
+			name: "valid",
+			toml: `
+[fields]
+names=["f0", "f1", "f2"]
+
+[input]
+name="logline"
+
+[[filter]]
+name="notnull"
+	[filter.config]
+	fields=["f1"]
+
+[output]
+name="nop"
+fields=["f0", "f2"]
+`,
+		},
+		{
+			name: "unused fields",
+			toml: `
+[fields]
+names=["f0", "f1", "f2", "f3"]
+
+[input]
+name="logline"
+
+[[filter]]
+name="notnull"
+	[filter.config]
+	fields=["f1"]
+
+[output]
+name="nop"
+fields=["f0"]
+`,
+			wantUnused: []string{"f2", "f3"},
+		},
+		{
+			name: "validation uses fields",
+			toml: `
+[fields]
+names=["f0", "f1"]
+
+[validation]
+f1="^a"
+
+[input]
+name="logline"
+
+[output]
+name="nop"
+fields=["f0"]
+`,
+		},
+		{
+			name: "schema uses fields",
+			toml: `
+[fields]
+names=["f0", "f1"]
+
+[schema.f1]
+type="int"
+
+[input]
+name="logline"
+
+[output]
+name="nop"
+fields=["f0"]
+`,
+		},
+		{
+			name: "multiple errors",
+			toml: `
+[fields]
+names=["f0", "f1"]
+
+[input]
+name="logline"
+
+[[filter]]
+name="notnull"
+	[filter.config]
+	fields=["unknown"]
+
+[[filter]]
+name="regexmatch"
+	[filter.config]
+	fields=["f0"]
+	regexs=["("]
+
+[output]
+name="nop"
+fields=["f0", "f2"]
+`,
+			wantErrs: []string{
+				`error creating filter #1 (notnull)`,
+				`error creating filter #2 (regexmatch)`,
+				`error creating output: unknown field: "f2"`,
+			},
+			wantUnused: []string{"f1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := baker.NewConfigFromToml(strings.NewReader(tt.toml), components)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			errs, unused := baker.CheckConfig(cfg)
+			if len(errs) != len(tt.wantErrs) {
+				t.Fatalf("got %d errors %q, want %d", len(errs), errs, len(tt.wantErrs))
+			}
+			for i, err := range errs {
+				if !strings.Contains(err.Error(), tt.wantErrs[i]) {
+					t.Errorf("error #%d = %q, want it to contain %q", i, err, tt.wantErrs[i])
+				}
+			}
+			if !reflect.DeepEqual(unused, tt.wantUnused) {
+				t.Errorf("unused fields = %q, want %q", unused, tt.wantUnused)
+			}
+
+			// The topology fails with the first error reported by CheckConfig.
+			_, err = baker.NewTopologyFromConfig(cfg)
+			switch {
+			case len(errs) == 0 && err != nil:
+				t.Errorf("NewTopologyFromConfig error = %q, want nil", err)
+			case len(errs) != 0 && (err == nil || err.Error() != errs[0].Error()):
+				t.Errorf("NewTopologyFromConfig error = %v, want %q", err, errs[0])
+			}
+		})
+	}
+}
+
+func TestCheckConfigDryRun(t *testing.T) {
+	toml := `
+[fields]
+names=["f0", "f1"]
+
+[input]
+name="logline"
+
+[[filter]]
+name="closer"
+
+[output]
+name="nop"
+fields=["f0", "f1"]
+`
+	closer := &closerFilter{}
+	components := baker.Components{
+		Inputs: []baker.InputDesc{inputtest.LogLineDesc},
+		Filters: []baker.FilterDesc{
+			{
+				Name:   "closer",
+				Config: &struct{}{},
+				New: func(cfg baker.FilterParams) (baker.Filter, error) {
+					closer.dryRun = cfg.DryRun
+					return closer, nil
+				},
+			},
+		},
+		Outputs: []baker.OutputDesc{output.NopDesc},
+	}
+
+	cfg, err := baker.NewConfigFromToml(strings.NewReader(toml), components)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if errs, _ := baker.CheckConfig(cfg); len(errs) != 0 {
+		t.Fatalf("got errors %q, want none", errs)
+	}
+	if !closer.dryRun {
+		t.Errorf("filter created with DryRun = false, want true")
+	}
+	if !closer.closed {
+		t.Errorf("filter not closed after checking")
+	}
+}
+
+func TestNewTopologyFromConfigClosesFilters(t *testing.T) {
+	toml := `
+[fields]
+names=["f0", "f1"]
+
+[input]
+name="logline"
+
+[[filter]]
+name="closer"
+
+[output]
+name="nop"
+fields=["f0", "unknown"]
+`
+	closer := &closerFilter{}
+	components := baker.Components{
+		Inputs: []baker.InputDesc{inputtest.LogLineDesc},
+		Filters: []baker.FilterDesc{
+			{
+				Name:   "closer",
+				Config: &struct{}{},
+				New:    func(baker.FilterParams) (baker.Filter, error) { return closer, nil },
+			},
+		},
+		Outputs: []baker.OutputDesc{output.NopDesc},
+	}
+
+	cfg, err := baker.NewConfigFromToml(strings.NewReader(toml), components)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := baker.NewTopologyFromConfig(cfg); err == nil {
+		t.Fatal("NewTopologyFromConfig succeeded, want an error")
+	}
+	if !closer.closed {
+		t.Errorf("filter not closed after the topology creation failed")
+	}
+}
@@ -135,12 +135,14 @@ type Config struct {
 	General    ConfigGeneral
 	Fields     ConfigFields
 	Validation ConfigValidation
+	Schema     Schema
 	Metrics    ConfigMetrics
 	CSV        ConfigCSV
 	User       []ConfigUser
 
 	shardingFuncs map[FieldIndex]ShardingFunc
 	validate      ValidationFunc
+	invalidFields func(Record, []FieldIndex) []FieldIndex // set when all invalid fields can be reported
 	createRecord  func() Record
 
 	fieldByName func(string) (FieldIndex, bool)
@@ -467,19 +469,28 @@ func assignFieldMapping(cfg *Config, comp Components) error {
 	return nil
 }
 
-// assignValidationMapping verifies that validation has been set once either in comp or in cfg.
+// assignValidationMapping verifies that validation has been set once either in comp or in cfg
+// (as regular expressions or as a typed schema).
 // If validation has not been set assignValidationMapping generates a dummy function.
-// Finally, assignValidationMapping sets validate in cfg.
+// Finally, assignValidationMapping sets validate in cfg, and invalidFields if
+// validation is done with a schema, or if set in comp.
 // assignValidationMapping requires that the fieldByName function in cfg has been set.
 func assignValidationMapping(cfg *Config, comp Components) error {
-	cfgOk := len(cfg.Validation) != 0
+	regexOk := len(cfg.Validation) != 0
+	schemaOk := len(cfg.Schema) != 0
 	compOk := comp.Validate != nil
 
-	if cfgOk && compOk {
+	if (regexOk || schemaOk) && compOk {
 		return fmt.Errorf("validation can't both be set in TOML and in Components")
 	}
+	if regexOk && schemaOk {
+		return fmt.Errorf("validation and schema can't both be set in TOML")
+	}
+	if comp.InvalidFields != nil && !compOk {
+		return fmt.Errorf("Components.InvalidFields requires Components.Validate")
+	}
 
-	if !cfgOk && !compOk {
+	if !regexOk && !schemaOk && !compOk {
 		// Ok, validation not present, set a dummy funcition.
 		cfg.validate = func(r Record) (bool, FieldIndex) {
 			return true, 0
@@ -490,6 +501,17 @@ func assignValidationMapping(cfg *Config, comp Components) error {
 	if compOk {
 		// Ok, validation has been set from Components.
 		cfg.validate = comp.Validate
+		cfg.invalidFields = comp.InvalidFields
+		return nil
+	}
+
+	if schemaOk {
+		v, err := NewSchemaValidator(cfg.Schema, cfg.fieldByName)
+		if err != nil {
+			return err
+		}
+		cfg.validate = v.Validate
+		cfg.invalidFields = v.InvalidFields
 		return nil
 	}
 
@@ -293,6 +293,29 @@ func Test_assignValidationMapping(t *testing.T) {
 				Validate: validate,
 			},
 		},
+		{
+			name: "schema in Config",
+			cfg: &Config{
+				Schema: Schema{
+					"name0": {Type: "enum", Values: []string{"val"}, Required: true},
+					"name1": {Type: "enum", Values: []string{"val"}, Required: true},
+				},
+				fieldByName: fieldByName, // needed by func assignValidationMapping
+			},
+			comp: Components{},
+		},
+		{
+			name: "Components with InvalidFields",
+			cfg: &Config{
+				fieldByName: fieldByName, // needed by func assignValidationMapping
+			},
+			comp: Components{
+				Validate: validate,
+				InvalidFields: func(r Record, dst []FieldIndex) []FieldIndex {
+					return dst
+				},
+			},
+		},
 		{
 			name:      "nothing set",
 			cfg:       &Config{},
@@ -312,6 +335,47 @@ func Test_assignValidationMapping(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "schema set both in Config and Components",
+			cfg: &Config{
+				Schema:      Schema{"name0": {Required: true}},
+				fieldByName: fieldByName, // needed by func assignValidationMapping
+			},
+			comp: Components{
+				Validate: validate,
+			},
+			wantErr: true,
+		},
+		{
+			name: "validation and schema set in Config",
+			cfg: &Config{
+				Validation:  cfgValidation,
+				Schema:      Schema{"name0": {Required: true}},
+				fieldByName: fieldByName, // needed by func assignValidationMapping
+			},
+			comp:    Components{},
+			wantErr: true,
+		},
+		{
+			name: "invalid schema",
+			cfg: &Config{
+				Schema:      Schema{"name0": {Type: "date"}},
+				fieldByName: fieldByName, // needed by func assignValidationMapping
+			},
+			comp:    Components{},
+			wantErr: true,
+		},
+		{
+			name: "InvalidFields without Validate in Components",
+			cfg: &Config{
+				Validation:  cfgValidation,
+				fieldByName: fieldByName, // needed by func assignValidationMapping
+			},
+			comp: Components{
+				InvalidFields: func(r Record, dst []FieldIndex) []FieldIndex { return dst },
+			},
+			wantErr: true,
+		},
 		{
 			name: "not existing field name",
 			cfg: &Config{
@@ -343,6 +407,9 @@ func Test_assignValidationMapping(t *testing.T) {
 			if tt.cfg.validate == nil {
 				t.Errorf("cfg.validate should always be set")
 			}
+			if wantInvalid := tt.cfg.Schema != nil || tt.comp.InvalidFields != nil; (tt.cfg.invalidFields != nil) != wantInvalid {
+				t.Errorf("cfg.invalidFields set = %v, want %v", tt.cfg.invalidFields != nil, wantInvalid)
+			}
 			if tt.skipCheck {
 				return
 			}
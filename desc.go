@@ -11,9 +11,10 @@ type Components struct {
 	Metrics []MetricsDesc // Metrics represents the list of available metrics clients
 	User    []UserDesc    // User represents the list of user-defined configurations
 
-	ShardingFuncs map[FieldIndex]ShardingFunc // ShardingFuncs are functions to calculate sharding based on field index
-	Validate      ValidationFunc              // Validate is the function used to validate a Record
-	CreateRecord  func() Record               // CreateRecord creates a new record
+	ShardingFuncs map[FieldIndex]ShardingFunc             // ShardingFuncs are functions to calculate sharding based on field index
+	Validate      ValidationFunc                          // Validate is the function used to validate a Record
+	InvalidFields func(Record, []FieldIndex) []FieldIndex // InvalidFields, optional, appends all the invalid fields of a Record to a slice (requires Validate)
+	CreateRecord  func() Record                           // CreateRecord creates a new record
 
 	FieldByName func(string) (FieldIndex, bool) // FieldByName gets a field index by its name
 	FieldNames  []string                        // FieldNames holds field names, indexed by their FieldIndex
@@ -27,6 +28,7 @@ type ComponentParams struct {
 	FieldNames     []string                        // FieldNames holds field names, indexed by their FieldIndex
 	ValidateRecord ValidationFunc                  // function to validate a record
 	Metrics        MetricsClient                   // Metrics allows components to add code instrumentation and have metrics exported to the configured backend, if any?
+	DryRun         bool                            // DryRun is set when the component is only created to check or trace the configuration, it must not persist any state
 }
 
 // InputParams holds the parameters passed to Input constructor.
@@ -9,21 +9,33 @@ import (
 var All = []baker.FilterDesc{
 	ClauseFilterDesc,
 	ClearFieldsDesc,
+	ComputeDesc,
 	ConcatenateDesc,
 	CountAndTagDesc,
 	CryptDesc,
 	DedupDesc,
+	ExplodeDesc,
 	ExpandJSONDesc,
 	ExpandListDesc,
 	ExternalMatchDesc,
 	FormatTimeDesc,
+	GeoIPDesc,
 	HashDesc,
+	LookupDesc,
 	MetadataLastModifiedDesc,
 	MetadataUrlDesc,
+	NormalizeDesc,
 	NotNullDesc,
+	ParseURLDesc,
 	PartialCloneDesc,
+	RateLimitDesc,
 	RegexMatchDesc,
+	RegexReplaceDesc,
+	RedactDesc,
 	ReplaceFieldsDesc,
+	SampleDesc,
+	ScriptDesc,
+	SetIfDesc,
 	SetStringFromURLDesc,
 	SliceDesc,
 	StringMatchDesc,
@@ -31,4 +43,5 @@ var All = []baker.FilterDesc{
 	TimestampRangeDesc,
 	URLEscapeDesc,
 	URLParamDesc,
+	UserAgentDesc,
 }
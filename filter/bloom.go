@@ -0,0 +1,177 @@
+package filter
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+)
+
+// bloomHash returns the two base hashes of key from which the bit positions
+// of all the Bloom filter hash functions are derived (double hashing).
+func bloomHash(key string) (h1, h2 uint64) {
+	h := fnv.New128a()
+	h.Write([]byte(key))
+	var sum [16]byte
+	h.Sum(sum[:0])
+	return binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:]) | 1
+}
+
+// bloomFilter is a fixed-size Bloom filter.
+type bloomFilter struct {
+	bits     []uint64
+	m        uint64 // number of bits
+	k        uint64 // number of hash functions
+	n        uint64 // number of added keys
+	capacity uint64 // number of keys after which fpRate isn't guaranteed anymore
+}
+
+// newBloomFilter returns a Bloom filter sized so that its false positive rate
+// is fpRate after capacity keys have been added.
+func newBloomFilter(capacity uint64, fpRate float64) *bloomFilter {
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint64(math.Round(float64(m) / float64(capacity) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		bits:     make([]uint64, (m+63)/64),
+		m:        m,
+		k:        k,
+		capacity: capacity,
+	}
+}
+
+func (b *bloomFilter) test(h1, h2 uint64) bool {
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % b.m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloomFilter) add(h1, h2 uint64) {
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % b.m
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+	b.n++
+}
+
+const (
+	// scalableBloomGrowth is the capacity ratio between successive filters.
+	scalableBloomGrowth = 2
+	// scalableBloomTightening is the false positive rate ratio between
+	// successive filters.
+	scalableBloomTightening = 0.5
+)
+
+// scalableBloom is a scalable Bloom filter: it starts with a single Bloom
+// filter and adds larger ones, with tighter false positive rates, as the
+// previous ones fill up, so that the overall false positive rate stays
+// under the configured one whatever the number of keys.
+type scalableBloom struct {
+	filters  []*bloomFilter
+	capacity uint64
+	fpRate   float64
+}
+
+func newScalableBloom(capacity uint64, fpRate float64) *scalableBloom {
+	s := &scalableBloom{capacity: capacity, fpRate: fpRate}
+	s.grow()
+	return s
+}
+
+func (s *scalableBloom) grow() {
+	i := len(s.filters)
+	capacity := s.capacity * uint64(math.Pow(scalableBloomGrowth, float64(i)))
+	fpRate := s.fpRate * (1 - scalableBloomTightening) * math.Pow(scalableBloomTightening, float64(i))
+	s.filters = append(s.filters, newBloomFilter(capacity, fpRate))
+}
+
+func (s *scalableBloom) test(h1, h2 uint64) bool {
+	for _, b := range s.filters {
+		if b.test(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *scalableBloom) add(h1, h2 uint64) {
+	last := s.filters[len(s.filters)-1]
+	if last.n >= last.capacity {
+		s.grow()
+		last = s.filters[len(s.filters)-1]
+	}
+	last.add(h1, h2)
+}
+
+// count returns the number of keys added to the filter.
+func (s *scalableBloom) count() uint64 {
+	var n uint64
+	for _, b := range s.filters {
+		n += b.n
+	}
+	return n
+}
+
+// size returns the memory used by the filter bit arrays, in bytes.
+func (s *scalableBloom) size() uint64 {
+	var n uint64
+	for _, b := range s.filters {
+		n += uint64(len(b.bits)) * 8
+	}
+	return n
+}
+
+// bloomFilterState and scalableBloomState hold the state of Bloom filters in a
+// form that can be gob-encoded.
+type bloomFilterState struct {
+	Bits     []uint64
+	M, K, N  uint64
+	Capacity uint64
+}
+
+type scalableBloomState struct {
+	Filters  []bloomFilterState
+	Capacity uint64
+	FPRate   float64
+}
+
+// state returns a copy of the filter state.
+func (s *scalableBloom) state() scalableBloomState {
+	state := scalableBloomState{Capacity: s.capacity, FPRate: s.fpRate}
+	for _, b := range s.filters {
+		state.Filters = append(state.Filters, bloomFilterState{
+			Bits:     append([]uint64(nil), b.bits...),
+			M:        b.m,
+			K:        b.k,
+			N:        b.n,
+			Capacity: b.capacity,
+		})
+	}
+	return state
+}
+
+// newScalableBloomFromState returns a filter from a state returned by state.
+func newScalableBloomFromState(state scalableBloomState) *scalableBloom {
+	s := &scalableBloom{capacity: state.Capacity, fpRate: state.FPRate}
+	for _, b := range state.Filters {
+		s.filters = append(s.filters, &bloomFilter{
+			bits:     b.Bits,
+			m:        b.M,
+			k:        b.K,
+			n:        b.N,
+			capacity: b.Capacity,
+		})
+	}
+	if len(s.filters) == 0 {
+		s.grow()
+	}
+	return s
+}
@@ -0,0 +1,46 @@
+package filter
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestScalableBloom(t *testing.T) {
+	const (
+		capacity = 1000
+		fpRate   = 0.01
+		nkeys    = 10 * capacity
+	)
+
+	s := newScalableBloom(capacity, fpRate)
+	for i := 0; i < nkeys; i++ {
+		s.add(bloomHash(strconv.Itoa(i)))
+	}
+
+	// No false negatives.
+	for i := 0; i < nkeys; i++ {
+		if !s.test(bloomHash(strconv.Itoa(i))) {
+			t.Fatalf("key %d not found", i)
+		}
+	}
+
+	if len(s.filters) < 2 {
+		t.Errorf("filter didn't grow, got %d filters", len(s.filters))
+	}
+	if s.count() != nkeys {
+		t.Errorf("count() = %d, want %d", s.count(), nkeys)
+	}
+
+	// The false positive rate must be under the configured one (with some
+	// margin since it's a probabilistic property).
+	var fp int
+	const ntests = 100000
+	for i := nkeys; i < nkeys+ntests; i++ {
+		if s.test(bloomHash(strconv.Itoa(i))) {
+			fp++
+		}
+	}
+	if rate := float64(fp) / ntests; rate > 1.5*fpRate {
+		t.Errorf("false positive rate = %v, want <= %v", rate, fpRate)
+	}
+}
@@ -2,8 +2,13 @@ package filter
 
 import (
 	"bytes"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/nsf/sexp"
 	log "github.com/sirupsen/logrus"
@@ -21,10 +26,7 @@ This document describes the s-expression format used in ClauseFilter.
 The format uses s-expressions. Empty string matches anything (i.e. all records
 will pass the expression).
 
-There are only three keywords: and, or, not
-
-If an s-expression starts with any other name, it is assumed to be the name of
-a field and it should be paired with the desired value to match against.
+The logical keywords are: and, or, not
 
     Must match both X and Y to pass:
     (and X Y)
@@ -38,12 +40,6 @@ a field and it should be paired with the desired value to match against.
     Must NOT match X to pass:
     (not X)
 
-    Field must equal value to pass:
-    (FIELD VALUE)
-
-    example:
-    (fieldName somevalue)
-
     Matches anything (because only one argument)
     (and X)
 
@@ -53,19 +49,76 @@ a field and it should be paired with the desired value to match against.
     Matches anything
     (or)
 
+If an s-expression starts with any other name that is not an operator (see
+below), it is assumed to be the name of a field and it should be paired with
+the desired value to match against.
+
+    Field must equal value to pass:
+    (FIELD VALUE)
+
+    example:
+    (fieldName somevalue)
+
+A field named after an operator (like "in" or "empty") can still be matched
+that way: (FIELD VALUE) takes precedence over operators taking a single
+argument.
+
+    Metadata value must equal value to pass:
+    (meta KEY VALUE)
+
+    example:
+    (meta url s3://bucket/path/to/file.log.gz)
+
+Values containing spaces or parentheses can be double-quoted: "some value".
+
+Operators apply to an operand, which is either a field name or a metadata
+value, written (meta KEY):
+
+    Operand compares to value (numerically if value is a number, or as a
+    timestamp if value is a RFC3339 date, in which case the operand can either
+    be a RFC3339 date or a unix timestamp):
+    (< OPERAND VALUE)
+    (> OPERAND VALUE)
+    (<= OPERAND VALUE)
+    (>= OPERAND VALUE)
+
+    Operand starts with, ends with, or contains value:
+    (prefix OPERAND VALUE)
+    (suffix OPERAND VALUE)
+    (contains OPERAND VALUE)
+
+    Operand matches the regular expression:
+    (match OPERAND REGEX)
+
+    Operand equals any of the values:
+    (in OPERAND VALUE1 VALUE2 ...)
+
+    Operand is empty, or not:
+    (empty OPERAND)
+    (notempty OPERAND)
+
+Records whose operand can't be parsed as a number (or as a timestamp) never
+match comparison operators.
+
 Examples:
 
     (and (fieldName value1) (anotherFieldName value2))
 
     (or (fieldName value1) (fieldName value2))
 
-	(not (or (fieldName value1) (fieldName value2)))
+    (not (or (fieldName value1) (fieldName value2)))
 
     (or
       (and (fieldName value1)
            (anotherFieldName value3))
       (and (fieldName value2)
            (anotherFieldName value4)))
+
+    (and (>= price 1.5) (in country US CA MX) (notempty user_id))
+
+    (and (prefix (meta url) s3://bucket/) (match domain "^(www\\.)?example\\.com$"))
+
+    (< timestamp 2021-06-01T00:00:00Z)
 `
 
 // ClauseFilterDesc describes the ClauseFilter filter
@@ -86,20 +139,8 @@ type ClauseFilter struct {
 	topClause        Clause
 	numFilteredLines int64
 	fieldByName      func(string) (baker.FieldIndex, bool)
-	aaa              baker.FilterParams
 }
 
-type clauseType int
-
-const (
-	not_clause clauseType = iota
-	and_clause
-	or_clause
-	atom_clause
-	true_clause
-	false_clause
-)
-
 func NewClauseFilter(cfg baker.FilterParams) (baker.Filter, error) {
 	dcfg := cfg.DecodedConfig.(*ClauseFilterConfig)
 	if dcfg.Clause == "" {
@@ -107,27 +148,31 @@ func NewClauseFilter(cfg baker.FilterParams) (baker.Filter, error) {
 	}
 
 	cf := &ClauseFilter{
-		aaa:         cfg,
 		cfg:         dcfg,
 		fieldByName: cfg.FieldByName,
 	}
-	cf.topClause = cf.parseClause(dcfg.Clause)
+
+	var err error
+	cf.topClause, err = cf.parseClause(dcfg.Clause)
+	if err != nil {
+		return nil, err
+	}
 	return cf, nil
 }
 
-// Will real sum types ever make it to go?
-//
-// Validness of the fields in this structure depend on clauseType
+// A Clause is a boolean expression, compiled from its s-expression
+// representation, that can be evaluated against records.
 type Clause struct {
-	clauseType         clauseType
-	leftClause         *Clause
-	rightClause        *Clause
-	matchField         baker.FieldIndex
-	matchFieldContents []byte
+	match func(baker.Record) bool
+}
+
+// Match reports whether r matches the clause.
+func (c *Clause) Match(r baker.Record) bool {
+	return c.match(r)
 }
 
 func (f *ClauseFilter) Process(l baker.Record, next func(baker.Record)) {
-	if f.matchClause(l, &f.topClause) {
+	if f.topClause.Match(l) {
 		next(l)
 	} else {
 		atomic.AddInt64(&f.numFilteredLines, 1)
@@ -140,143 +185,382 @@ func (f *ClauseFilter) Stats() baker.FilterStats {
 	}
 }
 
-func (f *ClauseFilter) parseClauseSexp(node *sexp.Node) Clause {
-	if node.Children != nil && (node.Children.Value == "and" || node.Children.Value == "or") {
-		clause_type := or_clause
-		if node.Children.Value == "and" {
-			clause_type = and_clause
-		}
+func (f *ClauseFilter) parseClause(clause string) (Clause, error) {
+	return compileClause(clause, f.fieldByName)
+}
 
-		if node.NumChildren() == 1 {
-			if node.Children.Value == "or" {
-				return Clause{clauseType: true_clause}
-			} else {
-				return Clause{clauseType: false_clause}
-			}
+// compileClause parses a clause s-expression and compiles it into a Clause.
+// The returned error, if any, contains the line and column at which the
+// problem has been found.
+func compileClause(clause string, fieldByName func(string) (baker.FieldIndex, bool)) (Clause, error) {
+	clause = strings.TrimSpace(clause)
+	if len(clause) == 0 {
+		return Clause{match: matchAll}, nil
+	}
+
+	c := &clauseCompiler{name: "clause", fieldByName: fieldByName}
+	top, err := c.parse(clause)
+	if err != nil {
+		return Clause{}, err
+	}
+	if top == nil {
+		return Clause{match: matchAll}, nil
+	}
+
+	match, err := c.compile(top)
+	if err != nil {
+		return Clause{}, err
+	}
+	return Clause{match: match}, nil
+}
+
+func matchAll(baker.Record) bool  { return true }
+func matchNone(baker.Record) bool { return false }
+
+// clauseCompiler compiles s-expression nodes into functions.
+type clauseCompiler struct {
+	name        string // name of the source, used in error messages
+	ctx         sexp.SourceContext
+	fieldByName func(string) (baker.FieldIndex, bool)
+}
+
+// parse parses src, which must contain at most one s-expression, and returns
+// it, or nil if src is empty.
+func (c *clauseCompiler) parse(src string) (*sexp.Node, error) {
+	file := c.ctx.AddFile(c.name, len(src))
+	top, err := sexp.Parse(strings.NewReader(src), file)
+	if err != nil {
+		if perr, ok := err.(*sexp.ParseError); ok {
+			return nil, c.errorf(&sexp.Node{Location: perr.Location}, "%v", perr)
 		}
-		if node.NumChildren() == 2 {
-			second, err := node.Nth(1)
-			if err != nil {
-				panic(err)
-			}
-			return f.parseClauseSexp(second)
+		return nil, fmt.Errorf("%s: %v", c.name, err)
+	}
+
+	switch top.NumChildren() {
+	case 0:
+		return nil, nil
+	case 1:
+		return top.Children, nil
+	default:
+		return nil, c.errorf(top.Children.Next, "unexpected expression after the end of the %s", c.name)
+	}
+}
+
+// errorf returns an error prefixed with the position of node in the source.
+func (c *clauseCompiler) errorf(node *sexp.Node, format string, args ...interface{}) error {
+	loc := c.ctx.Decode(node.Location)
+	col := loc.Offset - loc.LineOffset + 1
+	return fmt.Errorf("%s:%d:%d: %s", c.name, loc.Line, col, fmt.Sprintf(format, args...))
+}
+
+// children returns the children of a list node.
+func children(node *sexp.Node) []*sexp.Node {
+	var nodes []*sexp.Node
+	for n := node.Children; n != nil; n = n.Next {
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+func (c *clauseCompiler) compile(node *sexp.Node) (func(baker.Record) bool, error) {
+	if node.IsScalar() {
+		return nil, c.errorf(node, "expected an expression between parentheses, got %q", node.Value)
+	}
+
+	args := children(node)
+	head := args[0]
+	if head.IsList() {
+		return nil, c.errorf(head, "expected an operator or a field name, got an expression")
+	}
+
+	switch head.Value {
+	case "and", "or":
+		return c.compileLogical(head.Value, args[1:])
+	case "not":
+		if len(args) != 2 {
+			return nil, c.errorf(head, "'not' takes exactly 1 argument, got %d", len(args)-1)
 		}
-		if node.NumChildren() == 3 {
-			first, err1 := node.Nth(1)
-			if err1 != nil {
-				panic(err1)
-			}
-			second, err2 := node.Nth(2)
-			if err2 != nil {
-				panic(err2)
-			}
-			lclause := f.parseClauseSexp(first)
-			rclause := f.parseClauseSexp(second)
-			return Clause{clauseType: clause_type,
-				leftClause:  &lclause,
-				rightClause: &rclause}
+		sub, err := c.compile(args[1])
+		if err != nil {
+			return nil, err
 		}
+		return func(r baker.Record) bool { return !sub(r) }, nil
+	}
 
-		second, err2 := node.Nth(2)
-		if err2 != nil {
-			log.WithError(err2).Fatal("Cannot interpret child for and/or clause")
+	// (FIELD VALUE) is checked before the other operators, which came later,
+	// so that fields named after them keep matching as they used to.
+	if len(args) == 2 && args[1].IsScalar() {
+		if idx, ok := c.fieldByName(head.Value); ok {
+			value := []byte(args[1].Value)
+			return func(r baker.Record) bool { return bytes.Equal(r.Get(idx), value) }, nil
 		}
+	}
 
-		inner_node := sexp.Node{Value: node.Children.Value, Next: second}
-		rnode := sexp.Node{Children: &inner_node}
-
-		first, err1 := node.Nth(1)
-		if err1 != nil {
-			log.WithError(err1).Fatal("Cannot interpret child for and/or clause")
+	switch head.Value {
+	case "meta":
+		if len(args) == 3 {
+			// (meta KEY VALUE) is a shorthand for equality.
+			if args[1].IsList() || args[2].IsList() {
+				return nil, c.errorf(head, "expected (meta KEY VALUE)")
+			}
+			get := metaOperand(args[1].Value)
+			value := []byte(args[2].Value)
+			return func(r baker.Record) bool { return bytes.Equal(get(r), value) }, nil
 		}
+		return nil, c.errorf(head, "expected (meta KEY VALUE)")
+	case "<", ">", "<=", ">=":
+		return c.compileComparison(head, args[1:])
+	case "prefix", "suffix", "contains", "match":
+		return c.compileStringOp(head, args[1:])
+	case "in":
+		return c.compileIn(head, args[1:])
+	case "empty", "notempty":
+		if len(args) != 2 {
+			return nil, c.errorf(head, "'%s' takes exactly 1 argument, got %d", head.Value, len(args)-1)
+		}
+		get, err := c.operand(args[1])
+		if err != nil {
+			return nil, err
+		}
+		if head.Value == "empty" {
+			return func(r baker.Record) bool { return len(get(r)) == 0 }, nil
+		}
+		return func(r baker.Record) bool { return len(get(r)) != 0 }, nil
+	}
 
-		lclause := f.parseClauseSexp(first)
-		rclause := f.parseClauseSexp(&rnode)
+	// (FIELD VALUE)
+	if len(args) != 2 {
+		return nil, c.errorf(head, "unknown operator %q (or field followed by %d values, want 1)", head.Value, len(args)-1)
+	}
+	get, err := c.operand(head)
+	if err != nil {
+		return nil, err
+	}
+	if args[1].IsList() {
+		return nil, c.errorf(args[1], "expected a value, got an expression")
+	}
+	value := []byte(args[1].Value)
+	return func(r baker.Record) bool { return bytes.Equal(get(r), value) }, nil
+}
 
-		return Clause{clauseType: clause_type,
-			leftClause:  &lclause,
-			rightClause: &rclause}
+func (c *clauseCompiler) compileLogical(op string, args []*sexp.Node) (func(baker.Record) bool, error) {
+	switch len(args) {
+	case 0:
+		if op == "or" {
+			return matchAll, nil
+		}
+		return matchNone, nil
+	case 1:
+		return c.compile(args[0])
 	}
-	if node.NumChildren() == 2 && node.Children.Value == "not" {
-		child_node, err := node.Nth(1)
+
+	subs := make([]func(baker.Record) bool, len(args))
+	for i, arg := range args {
+		sub, err := c.compile(arg)
 		if err != nil {
-			log.WithError(err).Fatal("Cannot interpret child for not-clause")
+			return nil, err
 		}
-		child := f.parseClauseSexp(child_node)
-		return Clause{clauseType: not_clause,
-			leftClause: &child}
-	}
-	if node.NumChildren() == 2 {
-		field_node, err1 := node.Nth(0)
-		value_node, err2 := node.Nth(1)
-		if err1 != nil {
-			log.WithError(err1).Fatal("Cannot interpret clause s-expression")
+		subs[i] = sub
+	}
+
+	if op == "and" {
+		return func(r baker.Record) bool {
+			for _, sub := range subs {
+				if !sub(r) {
+					return false
+				}
+			}
+			return true
+		}, nil
+	}
+	return func(r baker.Record) bool {
+		for _, sub := range subs {
+			if sub(r) {
+				return true
+			}
 		}
-		if err2 != nil {
-			log.WithError(err2).Fatal("Cannot interpret clause s-expression")
+		return false
+	}, nil
+}
+
+// operand returns a function retrieving the value referred to by node, either
+// a field name or a metadata value (meta KEY).
+func (c *clauseCompiler) operand(node *sexp.Node) (func(baker.Record) []byte, error) {
+	if node.IsList() {
+		args := children(node)
+		if len(args) != 2 || args[0].Value != "meta" || args[1].IsList() {
+			return nil, c.errorf(node, "expected a field name or (meta KEY)")
 		}
+		return metaOperand(args[1].Value), nil
+	}
 
-		field := field_node.Value
-		value := value_node.Value
+	idx, ok := c.fieldByName(node.Value)
+	if !ok {
+		return nil, c.errorf(node, "no such field: %q", node.Value)
+	}
+	return func(r baker.Record) []byte { return r.Get(idx) }, nil
+}
 
-		idx, ok := f.fieldByName(field)
+// metaOperand returns a function retrieving the record metadata value
+// associated to key, as a byte slice.
+func metaOperand(key string) func(baker.Record) []byte {
+	return func(r baker.Record) []byte {
+		v, ok := r.Meta(key)
 		if !ok {
-			log.Fatal("No such field: ", field)
+			return nil
+		}
+		switch v := v.(type) {
+		case []byte:
+			return v
+		case string:
+			return []byte(v)
+		case *url.URL:
+			if v == nil {
+				return nil
+			}
+			return []byte(v.String())
+		case time.Time:
+			return []byte(v.Format(time.RFC3339Nano))
+		case fmt.Stringer:
+			return []byte(v.String())
 		}
+		return []byte(fmt.Sprint(v))
+	}
+}
+
+// binaryArgs checks that an operator has 2 arguments, an operand and a value.
+func (c *clauseCompiler) binaryArgs(op *sexp.Node, args []*sexp.Node) (func(baker.Record) []byte, *sexp.Node, error) {
+	if len(args) != 2 {
+		return nil, nil, c.errorf(op, "'%s' takes exactly 2 arguments, got %d", op.Value, len(args))
+	}
+	get, err := c.operand(args[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if args[1].IsList() {
+		return nil, nil, c.errorf(args[1], "expected a value, got an expression")
+	}
+	return get, args[1], nil
+}
+
+func (c *clauseCompiler) compileComparison(op *sexp.Node, args []*sexp.Node) (func(baker.Record) bool, error) {
+	get, valNode, err := c.binaryArgs(op, args)
+	if err != nil {
+		return nil, err
+	}
+
+	// cmp compares a (the operand) and b (the value), returning -1, 0 or +1.
+	var test func(cmp int) bool
+	switch op.Value {
+	case "<":
+		test = func(cmp int) bool { return cmp < 0 }
+	case ">":
+		test = func(cmp int) bool { return cmp > 0 }
+	case "<=":
+		test = func(cmp int) bool { return cmp <= 0 }
+	case ">=":
+		test = func(cmp int) bool { return cmp >= 0 }
+	}
+
+	if num, err := strconv.ParseFloat(valNode.Value, 64); err == nil {
+		return func(r baker.Record) bool {
+			v, err := strconv.ParseFloat(string(get(r)), 64)
+			if err != nil {
+				return false
+			}
+			return test(compareFloats(v, num))
+		}, nil
+	}
+
+	if ts, err := time.Parse(time.RFC3339Nano, valNode.Value); err == nil {
+		return func(r baker.Record) bool {
+			v, ok := parseClauseTime(get(r))
+			if !ok {
+				return false
+			}
+			return test(compareTimes(v, ts))
+		}, nil
+	}
+
+	return nil, c.errorf(valNode, "'%s' expects a number or a RFC3339 timestamp, got %q", op.Value, valNode.Value)
+}
 
-		return Clause{clauseType: atom_clause,
-			matchField:         idx,
-			matchFieldContents: []byte(value)}
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
 	}
+	return 0
+}
 
-	log.Fatal("Cannot interpret s-expression. Verify it's correctly written.")
-	panic("Unreachable")
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
 }
 
-func (f *ClauseFilter) parseClause(ClauseRaw string) Clause {
-	ClauseString := strings.TrimLeft(strings.TrimRight(ClauseRaw, " \r\n\t"), " \r\n\t")
-	if len(ClauseString) == 0 {
-		return Clause{clauseType: true_clause}
+// parseClauseTime parses buf either as a RFC3339 date or as a unix timestamp
+// (in seconds).
+func parseClauseTime(buf []byte) (time.Time, bool) {
+	s := string(buf)
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, true
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), true
 	}
+	return time.Time{}, false
+}
 
-	buf := bytes.NewBufferString(ClauseString)
-	var ctx sexp.SourceContext
-	file := ctx.AddFile("clause", 1)
-	top, _ := sexp.Parse(buf, file)
-	clause := top.Children
+func (c *clauseCompiler) compileStringOp(op *sexp.Node, args []*sexp.Node) (func(baker.Record) bool, error) {
+	get, valNode, err := c.binaryArgs(op, args)
+	if err != nil {
+		return nil, err
+	}
+	value := []byte(valNode.Value)
+
+	switch op.Value {
+	case "prefix":
+		return func(r baker.Record) bool { return bytes.HasPrefix(get(r), value) }, nil
+	case "suffix":
+		return func(r baker.Record) bool { return bytes.HasSuffix(get(r), value) }, nil
+	case "contains":
+		return func(r baker.Record) bool { return bytes.Contains(get(r), value) }, nil
+	}
 
-	return f.parseClauseSexp(clause)
+	// match
+	re, err := regexp.Compile(valNode.Value)
+	if err != nil {
+		return nil, c.errorf(valNode, "invalid regular expression: %v", err)
+	}
+	return func(r baker.Record) bool { return re.Match(get(r)) }, nil
 }
 
-func (f *ClauseFilter) matchClause(l baker.Record, clause *Clause) bool {
-	switch clause.clauseType {
-	case not_clause:
-		result := f.matchClause(l, clause.leftClause)
-		return !result
-	case and_clause:
-		result_left := f.matchClause(l, clause.leftClause)
-		// Shortcircuit the 'and' if we can
-		if !result_left {
-			return false
-		}
-		result_right := f.matchClause(l, clause.rightClause)
-		return result_right
-	case or_clause:
-		result_left := f.matchClause(l, clause.leftClause)
-		// Shortcircuit the 'or' if we can
-		if result_left {
-			return true
+func (c *clauseCompiler) compileIn(op *sexp.Node, args []*sexp.Node) (func(baker.Record) bool, error) {
+	if len(args) < 2 {
+		return nil, c.errorf(op, "'in' takes an operand and at least 1 value, got %d arguments", len(args))
+	}
+	get, err := c.operand(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]struct{}, len(args)-1)
+	for _, arg := range args[1:] {
+		if arg.IsList() {
+			return nil, c.errorf(arg, "expected a value, got an expression")
 		}
-		result_right := f.matchClause(l, clause.rightClause)
-		return result_right
-	case atom_clause:
-		log_field := l.Get(clause.matchField)
-		return bytes.Equal(log_field, clause.matchFieldContents)
-	case true_clause:
-		return true
-	case false_clause:
-		return false
+		values[arg.Value] = struct{}{}
 	}
 
-	panic("case fell through somewhere that should not be possible")
+	return func(r baker.Record) bool {
+		_, ok := values[string(get(r))]
+		return ok
+	}, nil
 }
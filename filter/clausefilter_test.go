@@ -1,7 +1,10 @@
 package filter
 
 import (
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/AdRoll/baker"
 )
@@ -96,3 +99,190 @@ func TestClausesMatchCorrectly(t *testing.T) {
 		t.Errorf("Clause filter filtered a line it should not have.")
 	}
 }
+
+func TestClauseOperators(t *testing.T) {
+	tests := []struct {
+		clause string
+		want   bool
+	}{
+		// equality
+		{clause: `(f0 value0)`, want: true},
+		{clause: `(f0 "value0")`, want: true},
+		{clause: `(f0 value1)`, want: false},
+		{clause: `(meta url s3://bucket/path/file.gz)`, want: true},
+		{clause: `(meta url s3://bucket/path/other.gz)`, want: false},
+		{clause: `(meta unknown "")`, want: true},
+
+		// comparisons
+		{clause: `(< f1 12.5)`, want: true},
+		{clause: `(< f1 12)`, want: false},
+		{clause: `(<= f1 12)`, want: true},
+		{clause: `(> f1 11.9)`, want: true},
+		{clause: `(>= f1 12)`, want: true},
+		{clause: `(> f1 12)`, want: false},
+		{clause: `(< f0 12)`, want: false}, // not a number
+		{clause: `(< f2 2021-06-01T00:00:00Z)`, want: true},
+		{clause: `(> f2 2021-06-01T00:00:00Z)`, want: false},
+		{clause: `(> f3 2021-05-31T23:00:00Z)`, want: true},
+		{clause: `(< f3 2021-05-31T23:00:00Z)`, want: false},
+		{clause: `(< (meta last_modified) 2021-06-01T00:00:00Z)`, want: true},
+
+		// strings
+		{clause: `(prefix f0 val)`, want: true},
+		{clause: `(prefix f0 ue)`, want: false},
+		{clause: `(suffix f0 ue0)`, want: true},
+		{clause: `(suffix f0 val)`, want: false},
+		{clause: `(contains f0 lue)`, want: true},
+		{clause: `(contains f0 foo)`, want: false},
+		{clause: `(prefix (meta url) s3://bucket/)`, want: true},
+		{clause: `(match f0 "^v.*[0-9]$")`, want: true},
+		{clause: `(match f0 "^[0-9]+$")`, want: false},
+
+		// in
+		{clause: `(in f0 foo value0 bar)`, want: true},
+		{clause: `(in f0 foo bar)`, want: false},
+
+		// empty
+		{clause: `(empty f4)`, want: true},
+		{clause: `(empty f0)`, want: false},
+		{clause: `(notempty f0)`, want: true},
+		{clause: `(notempty f4)`, want: false},
+
+		// combinations
+		{clause: `(and (>= f1 10) (in f0 value0 value1) (notempty f0))`, want: true},
+		{clause: `(or (empty f0) (not (prefix f0 v)))`, want: false},
+		{clause: `(and)`, want: false},
+		{clause: `(or)`, want: true},
+	}
+
+	fields := map[string]baker.FieldIndex{"f0": 0, "f1": 1, "f2": 2, "f3": 3, "f4": 4}
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		idx, ok := fields[name]
+		return idx, ok
+	}
+
+	u, _ := url.Parse("s3://bucket/path/file.gz")
+	meta := baker.Metadata{
+		"url":           u,
+		"last_modified": time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC),
+	}
+	l := &baker.LogLine{FieldSeparator: ','}
+	if err := l.Parse([]byte("value0,12,2021-05-31T23:59:59Z,1622505600,"), meta); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.clause, func(t *testing.T) {
+			f, err := NewClauseFilter(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName:   fieldByName,
+					DecodedConfig: &ClauseFilterConfig{Clause: tt.clause},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := false
+			f.Process(l, func(baker.Record) { got = true })
+			if got != tt.want {
+				t.Errorf("got match = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClauseFieldsNamedAsOperators(t *testing.T) {
+	// Fields named after operators keep matching as (FIELD VALUE).
+	names := []string{"in", "match", "prefix", "suffix", "contains", "empty", "notempty", "meta", "f8"}
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		for i, n := range names {
+			if n == name {
+				return baker.FieldIndex(i), true
+			}
+		}
+		return 0, false
+	}
+
+	l := &baker.LogLine{FieldSeparator: ','}
+	if err := l.Parse([]byte("v0,v1,v2,v3,v4,v5,v6,v7,"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		clause string
+		want   bool
+	}{
+		{clause: `(in v0)`, want: true},
+		{clause: `(in v1)`, want: false},
+		{clause: `(match v1)`, want: true},
+		{clause: `(prefix v2)`, want: true},
+		{clause: `(suffix v3)`, want: true},
+		{clause: `(contains v4)`, want: true},
+		{clause: `(empty v5)`, want: true},
+		{clause: `(empty f8)`, want: false},
+		{clause: `(notempty v6)`, want: true},
+		{clause: `(meta v7)`, want: true},
+
+		// Operators are still available with their own number of arguments.
+		{clause: `(in in v0 foo)`, want: true},
+		{clause: `(prefix match v)`, want: true},
+		{clause: `(and (in v0) (notempty v6) (not (contains v0)))`, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.clause, func(t *testing.T) {
+			f, err := NewClauseFilter(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName:   fieldByName,
+					DecodedConfig: &ClauseFilterConfig{Clause: tt.clause},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := false
+			f.Process(l, func(baker.Record) { got = true })
+			if got != tt.want {
+				t.Errorf("got match = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClauseErrors(t *testing.T) {
+	tests := []struct {
+		clause  string
+		wantErr string
+	}{
+		{clause: `(f0 value0`, wantErr: "clause:1:1: "},
+		{clause: `(and (f0 value0) (unknown value))`, wantErr: `clause:1:19: no such field: "unknown"`},
+		{clause: "(and\n  (f0 value0)\n  (< f1 foo))", wantErr: `clause:3:9: '<' expects a number or a RFC3339 timestamp, got "foo"`},
+		{clause: `(match f0 "(")`, wantErr: `clause:1:11: invalid regular expression`},
+		{clause: `(not (f0 value0) (f1 value1))`, wantErr: `clause:1:2: 'not' takes exactly 1 argument, got 2`},
+		{clause: `(prefix f0)`, wantErr: `clause:1:2: 'prefix' takes exactly 2 arguments, got 1`},
+		{clause: `(in f0)`, wantErr: `clause:1:2: 'in' takes an operand`},
+		{clause: `(empty (foo f0))`, wantErr: `clause:1:8: expected a field name or (meta KEY)`},
+		{clause: `(f0 value0) (f1 value1)`, wantErr: `clause:1:13: unexpected expression`},
+		{clause: `f0`, wantErr: `clause:1:1: expected an expression between parentheses`},
+		{clause: `(f0 a b)`, wantErr: `clause:1:2: unknown operator "f0"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.clause, func(t *testing.T) {
+			_, err := NewClauseFilter(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName:   fieldByName,
+					DecodedConfig: &ClauseFilterConfig{Clause: tt.clause},
+				},
+			})
+			if err == nil {
+				t.Fatalf("got no error, want %q", tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %q, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
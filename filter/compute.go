@@ -0,0 +1,551 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/nsf/sexp"
+
+	"github.com/AdRoll/baker"
+)
+
+const computeHelp = `
+This filter evaluates an arithmetic expression over numeric fields, and writes the result into
+` + "`Field`" + `.
+
+Like the ClauseFilter clauses, expressions are written as s-expressions. Arguments are either
+numbers, field names, metadata values (meta KEY) or other expressions. The available operators
+and functions are:
+
+    Addition, subtraction, multiplication, division and remainder
+    (+ X Y ...)
+    (- X Y ...)
+    (* X Y ...)
+    (/ X Y ...)
+    (% X Y)
+
+    Negation
+    (- X)
+
+    Smallest or largest of the arguments
+    (min X Y ...)
+    (max X Y ...)
+
+    Absolute value
+    (abs X)
+
+    X rounded to N decimals (N defaults to 0, and can be negative to round
+    to tens, hundreds, etc.), rounded down, or rounded up
+    (round X N)
+    (floor X)
+    (ceil X)
+
+    X restricted to the [MIN, MAX] interval
+    (clamp X MIN MAX)
+
+In "float" ` + "`Mode`" + ` (default), values are 64-bit floating point numbers. In "int" mode,
+values are 64-bit integers, divisions are truncated, and fields that aren't integers (e.g. "1.5")
+can't be parsed.
+
+When an argument can't be parsed as a number (including when the field is empty), or when the
+result isn't a valid number (e.g. division by zero), ` + "`OnError`" + ` tells what to do:
+
+ - "empty": clear ` + "`Field`" + `, and forward the record (default).
+ - "default": set ` + "`Field`" + ` to ` + "`Default`" + `, and forward the record.
+ - "drop": discard the record.
+
+The number of such errors is exported as the compute.errors metric.
+
+Example, converting micro-dollars into dollars, rounded to the cent:
+
+` + "```toml" + `
+[[filter]]
+name = "Compute"
+    [filter.config]
+    Field = "price"
+    Expression = "(round (/ price_micros 1000000) 2)"
+` + "```" + `
+`
+
+// ComputeDesc describes the Compute filter
+var ComputeDesc = baker.FilterDesc{
+	Name:   "Compute",
+	New:    NewCompute,
+	Config: &ComputeConfig{},
+	Help:   computeHelp,
+}
+
+// ComputeConfig holds config parameters of the Compute filter.
+type ComputeConfig struct {
+	Field      string `help:"Name of the field the result is written into" required:"true"`
+	Expression string `help:"Arithmetic expression, as an s-expression (see above)" required:"true"`
+	Mode       string `help:"Type of the values: \"float\" or \"int\"" default:"float"`
+	OnError    string `help:"What to do when the expression can't be evaluated: \"empty\", \"default\" or \"drop\"" default:"empty"`
+	Default    string `help:"Value written into Field when the expression can't be evaluated, when OnError is \"default\""`
+}
+
+func (cfg *ComputeConfig) fillDefaults() error {
+	if cfg.Mode == "" {
+		cfg.Mode = "float"
+	}
+	cfg.Mode = strings.ToLower(cfg.Mode)
+	if cfg.OnError == "" {
+		cfg.OnError = "empty"
+	}
+	cfg.OnError = strings.ToLower(cfg.OnError)
+
+	if strings.TrimSpace(cfg.Expression) == "" {
+		return errors.New("no Expression")
+	}
+	switch cfg.Mode {
+	case "float", "int":
+	default:
+		return fmt.Errorf("unsupported Mode %q", cfg.Mode)
+	}
+	switch cfg.OnError {
+	case "empty", "default", "drop":
+	default:
+		return fmt.Errorf("unsupported OnError %q", cfg.OnError)
+	}
+	return nil
+}
+
+// Compute is a baker filter that writes the result of an arithmetic
+// expression into a field.
+type Compute struct {
+	cfg *ComputeConfig
+
+	field baker.FieldIndex
+	eval  func(baker.Record) ([]byte, bool)
+
+	numFilteredLines int64
+	errors           int64
+}
+
+// NewCompute returns a Compute filter.
+func NewCompute(cfg baker.FilterParams) (baker.Filter, error) {
+	dcfg := cfg.DecodedConfig.(*ComputeConfig)
+	if err := dcfg.fillDefaults(); err != nil {
+		return nil, err
+	}
+
+	f := &Compute{cfg: dcfg}
+
+	var ok bool
+	if f.field, ok = cfg.FieldByName(dcfg.Field); !ok {
+		return nil, fmt.Errorf("unknown field %q", dcfg.Field)
+	}
+
+	c := &computeCompiler{clauseCompiler{name: "expression", fieldByName: cfg.FieldByName}}
+	top, err := c.parse(dcfg.Expression)
+	if err != nil {
+		return nil, err
+	}
+
+	if dcfg.Mode == "int" {
+		eval, err := c.compileInt(top)
+		if err != nil {
+			return nil, err
+		}
+		f.eval = func(r baker.Record) ([]byte, bool) {
+			v, ok := eval(r)
+			if !ok {
+				return nil, false
+			}
+			return strconv.AppendInt(nil, v, 10), true
+		}
+	} else {
+		eval, err := c.compileFloat(top)
+		if err != nil {
+			return nil, err
+		}
+		f.eval = func(r baker.Record) ([]byte, bool) {
+			v, ok := eval(r)
+			if !ok || math.IsNaN(v) || math.IsInf(v, 0) {
+				return nil, false
+			}
+			return strconv.AppendFloat(nil, v, 'f', -1, 64), true
+		}
+	}
+
+	return f, nil
+}
+
+// Stats implements baker.Filter.
+func (f *Compute) Stats() baker.FilterStats {
+	bag := make(baker.MetricsBag)
+	bag.AddRawCounter("compute.errors", atomic.LoadInt64(&f.errors))
+
+	return baker.FilterStats{
+		NumFilteredLines: atomic.LoadInt64(&f.numFilteredLines),
+		Metrics:          bag,
+	}
+}
+
+// Process implements baker.Filter.
+func (f *Compute) Process(l baker.Record, next func(baker.Record)) {
+	v, ok := f.eval(l)
+	if !ok {
+		atomic.AddInt64(&f.errors, 1)
+		switch f.cfg.OnError {
+		case "drop":
+			atomic.AddInt64(&f.numFilteredLines, 1)
+			return
+		case "default":
+			v = []byte(f.cfg.Default)
+		}
+	}
+
+	l.Set(f.field, v)
+	next(l)
+}
+
+// A computeOp is an operator or a function of the Compute filter, with its
+// float and int implementations, which report false if the result can't be
+// computed.
+type computeOp struct {
+	minArgs, maxArgs int // maxArgs is -1 for variadic operators
+	float            func(args []float64) (float64, bool)
+	int              func(args []int64) (int64, bool)
+}
+
+var computeOps = map[string]computeOp{
+	"+": {
+		minArgs: 2, maxArgs: -1,
+		float: func(args []float64) (float64, bool) {
+			v := args[0]
+			for _, a := range args[1:] {
+				v += a
+			}
+			return v, true
+		},
+		int: func(args []int64) (int64, bool) {
+			v := args[0]
+			for _, a := range args[1:] {
+				v += a
+			}
+			return v, true
+		},
+	},
+	"-": {
+		minArgs: 1, maxArgs: -1,
+		float: func(args []float64) (float64, bool) {
+			if len(args) == 1 {
+				return -args[0], true
+			}
+			v := args[0]
+			for _, a := range args[1:] {
+				v -= a
+			}
+			return v, true
+		},
+		int: func(args []int64) (int64, bool) {
+			if len(args) == 1 {
+				return -args[0], true
+			}
+			v := args[0]
+			for _, a := range args[1:] {
+				v -= a
+			}
+			return v, true
+		},
+	},
+	"*": {
+		minArgs: 2, maxArgs: -1,
+		float: func(args []float64) (float64, bool) {
+			v := args[0]
+			for _, a := range args[1:] {
+				v *= a
+			}
+			return v, true
+		},
+		int: func(args []int64) (int64, bool) {
+			v := args[0]
+			for _, a := range args[1:] {
+				v *= a
+			}
+			return v, true
+		},
+	},
+	"/": {
+		minArgs: 2, maxArgs: -1,
+		float: func(args []float64) (float64, bool) {
+			v := args[0]
+			for _, a := range args[1:] {
+				if a == 0 {
+					return 0, false
+				}
+				v /= a
+			}
+			return v, true
+		},
+		int: func(args []int64) (int64, bool) {
+			v := args[0]
+			for _, a := range args[1:] {
+				if a == 0 {
+					return 0, false
+				}
+				v /= a
+			}
+			return v, true
+		},
+	},
+	"%": {
+		minArgs: 2, maxArgs: 2,
+		float: func(args []float64) (float64, bool) {
+			if args[1] == 0 {
+				return 0, false
+			}
+			return math.Mod(args[0], args[1]), true
+		},
+		int: func(args []int64) (int64, bool) {
+			if args[1] == 0 {
+				return 0, false
+			}
+			return args[0] % args[1], true
+		},
+	},
+	"min": {
+		minArgs: 1, maxArgs: -1,
+		float: func(args []float64) (float64, bool) {
+			v := args[0]
+			for _, a := range args[1:] {
+				v = math.Min(v, a)
+			}
+			return v, true
+		},
+		int: func(args []int64) (int64, bool) {
+			v := args[0]
+			for _, a := range args[1:] {
+				if a < v {
+					v = a
+				}
+			}
+			return v, true
+		},
+	},
+	"max": {
+		minArgs: 1, maxArgs: -1,
+		float: func(args []float64) (float64, bool) {
+			v := args[0]
+			for _, a := range args[1:] {
+				v = math.Max(v, a)
+			}
+			return v, true
+		},
+		int: func(args []int64) (int64, bool) {
+			v := args[0]
+			for _, a := range args[1:] {
+				if a > v {
+					v = a
+				}
+			}
+			return v, true
+		},
+	},
+	"abs": {
+		minArgs: 1, maxArgs: 1,
+		float: func(args []float64) (float64, bool) { return math.Abs(args[0]), true },
+		int: func(args []int64) (int64, bool) {
+			if args[0] < 0 {
+				return -args[0], true
+			}
+			return args[0], true
+		},
+	},
+	"round": {
+		minArgs: 1, maxArgs: 2,
+		float: func(args []float64) (float64, bool) {
+			if len(args) == 1 {
+				return math.Round(args[0]), true
+			}
+			p := math.Pow(10, math.Trunc(args[1]))
+			return math.Round(args[0]*p) / p, true
+		},
+		int: func(args []int64) (int64, bool) {
+			if len(args) == 1 || args[1] >= 0 {
+				return args[0], true
+			}
+			if args[1] < -18 {
+				return 0, true
+			}
+			p := int64(1)
+			for i := args[1]; i < 0; i++ {
+				p *= 10
+			}
+			// Round half away from zero, like math.Round.
+			v, r := args[0]/p, args[0]%p
+			if r >= (p+1)/2 {
+				v++
+			} else if r <= -(p+1)/2 {
+				v--
+			}
+			return v * p, true
+		},
+	},
+	"floor": {
+		minArgs: 1, maxArgs: 1,
+		float: func(args []float64) (float64, bool) { return math.Floor(args[0]), true },
+		int:   func(args []int64) (int64, bool) { return args[0], true },
+	},
+	"ceil": {
+		minArgs: 1, maxArgs: 1,
+		float: func(args []float64) (float64, bool) { return math.Ceil(args[0]), true },
+		int:   func(args []int64) (int64, bool) { return args[0], true },
+	},
+	"clamp": {
+		minArgs: 3, maxArgs: 3,
+		float: func(args []float64) (float64, bool) {
+			return math.Min(math.Max(args[0], args[1]), args[2]), true
+		},
+		int: func(args []int64) (int64, bool) {
+			v := args[0]
+			if v < args[1] {
+				v = args[1]
+			}
+			if v > args[2] {
+				v = args[2]
+			}
+			return v, true
+		},
+	},
+}
+
+// computeCompiler compiles Compute expressions.
+type computeCompiler struct {
+	clauseCompiler
+}
+
+// operation returns the operator of the expression node, after having checked
+// its number of arguments. It returns a nil operator if node is an operand,
+// that is either a scalar or (meta KEY).
+func (c *computeCompiler) operation(node *sexp.Node) (*computeOp, []*sexp.Node, error) {
+	if node.IsScalar() {
+		return nil, nil, nil
+	}
+
+	args := children(node)
+	if len(args) == 0 {
+		return nil, nil, c.errorf(node, "empty expression")
+	}
+	head := args[0]
+	if head.IsList() {
+		return nil, nil, c.errorf(head, "expected an operator, got an expression")
+	}
+	if head.Value == "meta" {
+		return nil, nil, nil
+	}
+
+	op, ok := computeOps[head.Value]
+	if !ok {
+		return nil, nil, c.errorf(head, "unknown operator %q", head.Value)
+	}
+	args = args[1:]
+	if len(args) < op.minArgs || (op.maxArgs != -1 && len(args) > op.maxArgs) {
+		return nil, nil, c.errorf(head, "'%s' takes %s, got %d", head.Value, computeArity(op), len(args))
+	}
+	return &op, args, nil
+}
+
+func computeArity(op computeOp) string {
+	switch {
+	case op.maxArgs == -1:
+		return fmt.Sprintf("at least %d arguments", op.minArgs)
+	case op.minArgs == op.maxArgs && op.minArgs == 1:
+		return "exactly 1 argument"
+	case op.minArgs == op.maxArgs:
+		return fmt.Sprintf("exactly %d arguments", op.minArgs)
+	}
+	return fmt.Sprintf("%d to %d arguments", op.minArgs, op.maxArgs)
+}
+
+func (c *computeCompiler) compileFloat(node *sexp.Node) (func(baker.Record) (float64, bool), error) {
+	op, args, err := c.operation(node)
+	if err != nil {
+		return nil, err
+	}
+
+	if op == nil {
+		if node.IsScalar() {
+			if v, err := strconv.ParseFloat(node.Value, 64); err == nil {
+				return func(baker.Record) (float64, bool) { return v, true }, nil
+			}
+		}
+		get, err := c.operand(node)
+		if err != nil {
+			return nil, err
+		}
+		return func(r baker.Record) (float64, bool) {
+			v, err := strconv.ParseFloat(string(get(r)), 64)
+			return v, err == nil
+		}, nil
+	}
+
+	subs := make([]func(baker.Record) (float64, bool), len(args))
+	for i, arg := range args {
+		if subs[i], err = c.compileFloat(arg); err != nil {
+			return nil, err
+		}
+	}
+	return func(r baker.Record) (float64, bool) {
+		var buf [4]float64
+		vals := buf[:0]
+		for _, sub := range subs {
+			v, ok := sub(r)
+			if !ok {
+				return 0, false
+			}
+			vals = append(vals, v)
+		}
+		return op.float(vals)
+	}, nil
+}
+
+func (c *computeCompiler) compileInt(node *sexp.Node) (func(baker.Record) (int64, bool), error) {
+	op, args, err := c.operation(node)
+	if err != nil {
+		return nil, err
+	}
+
+	if op == nil {
+		if node.IsScalar() {
+			if v, err := strconv.ParseInt(node.Value, 10, 64); err == nil {
+				return func(baker.Record) (int64, bool) { return v, true }, nil
+			}
+			if _, err := strconv.ParseFloat(node.Value, 64); err == nil {
+				return nil, c.errorf(node, "expected an integer, got %q", node.Value)
+			}
+		}
+		get, err := c.operand(node)
+		if err != nil {
+			return nil, err
+		}
+		return func(r baker.Record) (int64, bool) {
+			v, err := strconv.ParseInt(string(get(r)), 10, 64)
+			return v, err == nil
+		}, nil
+	}
+
+	subs := make([]func(baker.Record) (int64, bool), len(args))
+	for i, arg := range args {
+		if subs[i], err = c.compileInt(arg); err != nil {
+			return nil, err
+		}
+	}
+	return func(r baker.Record) (int64, bool) {
+		var buf [4]int64
+		vals := buf[:0]
+		for _, sub := range subs {
+			v, ok := sub(r)
+			if !ok {
+				return 0, false
+			}
+			vals = append(vals, v)
+		}
+		return op.int(vals)
+	}, nil
+}
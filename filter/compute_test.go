@@ -0,0 +1,158 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestCompute(t *testing.T) {
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		switch name {
+		case "a":
+			return 0, true
+		case "b":
+			return 1, true
+		case "c":
+			return 2, true
+		case "res":
+			return 3, true
+		}
+		return 0, false
+	}
+
+	tests := []struct {
+		name       string
+		expression string
+		mode       string
+		onError    string
+		def        string
+		record     string // values of a, b and c
+		want       string
+		wantDrop   bool
+		wantErr    bool
+	}{
+		// float mode
+		{name: "add", expression: "(+ a b c)", record: "1,2.5,-3", want: "0.5"},
+		{name: "sub", expression: "(- a b 1)", record: "10,2.5,", want: "6.5"},
+		{name: "neg", expression: "(- a)", record: "10,,", want: "-10"},
+		{name: "mul", expression: "(* a 2 b)", record: "1.5,3,", want: "9"},
+		{name: "div", expression: "(/ a 1000000)", record: "1234567,,", want: "1.234567"},
+		{name: "mod", expression: "(% a b)", record: "7.5,2,", want: "1.5"},
+		{name: "min", expression: "(min a b c)", record: "3,-1,2", want: "-1"},
+		{name: "max", expression: "(max a b c)", record: "3,-1,2", want: "3"},
+		{name: "abs", expression: "(abs a)", record: "-3.25,,", want: "3.25"},
+		{name: "round", expression: "(round a)", record: "2.5,,", want: "3"},
+		{name: "round decimals", expression: "(round (/ a 1000000) 2)", record: "1234567,,", want: "1.23"},
+		{name: "round tens", expression: "(round a -1)", record: "1234.5,,", want: "1230"},
+		{name: "floor", expression: "(floor a)", record: "-2.5,,", want: "-3"},
+		{name: "ceil", expression: "(ceil a)", record: "2.1,,", want: "3"},
+		{name: "clamp low", expression: "(clamp a 0 100)", record: "-5,,", want: "0"},
+		{name: "clamp high", expression: "(clamp a 0 100)", record: "500,,", want: "100"},
+		{name: "clamp in", expression: "(clamp a 0 100)", record: "50,,", want: "50"},
+		{name: "nested", expression: "(* (+ a b) (- c 1))", record: "1,2,3", want: "6"},
+		{name: "constant", expression: "42", record: ",,", want: "42"},
+		{name: "field", expression: "a", record: "1e3,,", want: "1000"},
+
+		// int mode
+		{name: "int add", expression: "(+ a b)", mode: "int", record: "9007199254740993,1,", want: "9007199254740994"},
+		{name: "int div", expression: "(/ a b)", mode: "int", record: "7,2,", want: "3"},
+		{name: "int mod", expression: "(% a b)", mode: "int", record: "-7,2,", want: "-1"},
+		{name: "int round", expression: "(round a -2)", mode: "int", record: "1250,,", want: "1300"},
+		{name: "int round negative", expression: "(round a -2)", mode: "int", record: "-1249,,", want: "-1200"},
+		{name: "int abs", expression: "(abs a)", mode: "int", record: "-3,,", want: "3"},
+		{name: "int not an integer", expression: "(+ a 1)", mode: "int", record: "1.5,,", want: ""},
+
+		// errors at evaluation
+		{name: "empty field", expression: "(+ a b)", record: "1,,", want: ""},
+		{name: "not a number", expression: "(+ a b)", record: "1,foo,", want: ""},
+		{name: "division by zero", expression: "(/ a b)", record: "1,0,", want: ""},
+		{name: "int division by zero", expression: "(% a b)", mode: "int", record: "1,0,", want: ""},
+		{name: "default", expression: "(+ a b)", onError: "default", def: "0", record: "1,,", want: "0"},
+		{name: "drop", expression: "(+ a b)", onError: "drop", record: "1,,", wantDrop: true},
+
+		// configuration errors
+		{name: "no expression", expression: " ", wantErr: true},
+		{name: "unknown field", expression: "(+ a foo)", wantErr: true},
+		{name: "unknown operator", expression: "(pow a 2)", wantErr: true},
+		{name: "too few arguments", expression: "(+ a)", wantErr: true},
+		{name: "too many arguments", expression: "(abs a b)", wantErr: true},
+		{name: "empty list", expression: "(+ a ())", wantErr: true},
+		{name: "parse error", expression: "(+ a b", wantErr: true},
+		{name: "trailing expression", expression: "(+ a b) c", wantErr: true},
+		{name: "float in int mode", expression: "(* a 1.5)", mode: "int", wantErr: true},
+		{name: "unknown mode", expression: "a", mode: "decimal", wantErr: true},
+		{name: "unknown OnError", expression: "a", onError: "ignore", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewCompute(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName: fieldByName,
+					DecodedConfig: &ComputeConfig{
+						Field:      "res",
+						Expression: tt.expression,
+						Mode:       tt.mode,
+						OnError:    tt.onError,
+						Default:    tt.def,
+					},
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error = %v, want error = %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			l := &baker.LogLine{FieldSeparator: ','}
+			if err := l.Parse([]byte(tt.record+",old"), nil); err != nil {
+				t.Fatal(err)
+			}
+
+			var kept []baker.Record
+			f.Process(l, func(r baker.Record) { kept = append(kept, r) })
+
+			if tt.wantDrop {
+				if len(kept) != 0 {
+					t.Fatalf("record has been forwarded, want dropped")
+				}
+				if got := f.Stats().NumFilteredLines; got != 1 {
+					t.Errorf("NumFilteredLines = %d, want 1", got)
+				}
+				return
+			}
+			if len(kept) != 1 {
+				t.Fatalf("record has been dropped, want forwarded")
+			}
+			if got := string(l.Get(3)); got != tt.want {
+				t.Errorf("res = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestComputeMetrics(t *testing.T) {
+	f, err := NewCompute(baker.FilterParams{
+		ComponentParams: baker.ComponentParams{
+			FieldByName: func(name string) (baker.FieldIndex, bool) {
+				return map[string]baker.FieldIndex{"a": 0, "res": 1}[name], true
+			},
+			DecodedConfig: &ComputeConfig{Field: "res", Expression: "(* a 2)"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []string{"1", "foo", "", "2"} {
+		l := &baker.LogLine{FieldSeparator: ','}
+		l.Set(0, []byte(v))
+		f.Process(l, func(baker.Record) {})
+	}
+
+	if got := f.Stats().Metrics["c:compute.errors"]; got != int64(2) {
+		t.Errorf("compute.errors = %v, want 2", got)
+	}
+}
@@ -1,14 +1,25 @@
 package filter
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"os"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/AdRoll/baker"
 	"github.com/fernet/fernet-go"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 const cryptHelp = `
@@ -16,11 +27,40 @@ This filter encrypts or decrypts a field and writes the resulting value to anoth
 
 Supported algorithms:
  - fernet
+ - aes-gcm: AES-256-GCM, with a random nonce.
+ - chacha20-poly1305: ChaCha20-Poly1305, with a random nonce.
+ - aes-siv: AES-SIV (RFC 5297), which is deterministic: a given value is always encrypted into the
+   same value, so that encrypted values can be used as pseudonyms, for example to join datasets.
+
+### Keys
+
+Keys are base64 encoded (standard or URL-safe alphabet). They can be given inline, or read from a
+file, so that they don't have to appear in the TOML configuration:
+
+ - **Key**: a single key.
+ - **Keys**: several comma-separated keys, each prefixed by its key ID: "ID1:KEY1,ID2:KEY2".
+ - **KeyFile**: path of a file containing either a single key, or one "ID:KEY" key per line. Empty
+   lines and lines starting with # are ignored.
+
+When several keys are given, the last one is used to encrypt, while all of them can be used to
+decrypt, which allows to rotate keys. Except with fernet, the ID of the key is then prepended to
+encrypted values, followed by a colon (e.g. "2023-06:BASE64"), so that the key to decrypt them
+with can be found.
 
 ### Fernet configuration
 
- - **Key**: 256-bit key used to encrypt/decrypt the token.
+ - **Key**, **Keys** or **KeyFile**: 256-bit key(s) used to encrypt/decrypt the token. With
+   several keys, key IDs aren't needed since fernet tries all keys when decrypting.
  - **TTL**: optional duration (in seconds). When set, the key must have been signed at most TTL ago, or decryption will fail. Only applicable for decryption.
+
+### AES-GCM, ChaCha20-Poly1305 and AES-SIV configuration
+
+ - **Key**, **Keys** or **KeyFile**: 256-bit key(s) for aes-gcm and chacha20-poly1305, 512-bit
+   key(s) for aes-siv (which uses 2 AES-256 keys).
+ - **Encoding**: encoding of encrypted values, "base64" (default), "base64url" or "hex".
+
+Encrypted values are the encoding of the nonce (empty for aes-siv), followed by the ciphertext
+and the authentication tag.
 `
 
 var CryptDesc = baker.FilterDesc{
@@ -72,6 +112,12 @@ func NewCrypt(cfg baker.FilterParams) (baker.Filter, error) {
 	switch dcfg.Algorithm {
 	case "fernet":
 		f.algorithm = &cryptFernet{}
+	case "aes-gcm":
+		f.algorithm = &cryptAEAD{keySize: 32, newAEAD: newAESGCM}
+	case "chacha20-poly1305":
+		f.algorithm = &cryptAEAD{keySize: chacha20poly1305.KeySize, newAEAD: chacha20poly1305.New}
+	case "aes-siv":
+		f.algorithm = &cryptAEAD{keySize: 64, newAEAD: newAESSIV}
 	default:
 		return nil, fmt.Errorf("unsupported algorithm %s", dcfg.Algorithm)
 	}
@@ -106,21 +152,22 @@ func (f *Crypt) Process(r baker.Record, next func(baker.Record)) {
 }
 
 type cryptFernet struct {
-	key *fernet.Key
-	ttl time.Duration
+	keys []*fernet.Key // the last one is used to encrypt
+	ttl  time.Duration
 }
 
 func (alg *cryptFernet) parseConf(conf map[string]string) error {
-	keyStr, ok := conf["Key"]
-	if !ok {
-		return fmt.Errorf(`can't find "Key" conf for Fernet algorithm`)
-	}
-
-	key, err := fernet.DecodeKey(keyStr)
+	keys, err := parseCryptKeys(conf)
 	if err != nil {
 		return err
 	}
-	alg.key = key
+	for _, k := range keys {
+		key, err := fernet.DecodeKey(k.key)
+		if err != nil {
+			return err
+		}
+		alg.keys = append(alg.keys, key)
+	}
 
 	ttl := 0
 	ttlStr, ok := conf["TTL"]
@@ -136,13 +183,211 @@ func (alg *cryptFernet) parseConf(conf map[string]string) error {
 }
 
 func (alg *cryptFernet) encrypt(msg []byte) ([]byte, error) {
-	return fernet.EncryptAndSign(msg, alg.key)
+	return fernet.EncryptAndSign(msg, alg.keys[len(alg.keys)-1])
 }
 
 func (alg *cryptFernet) decrypt(crypted []byte) ([]byte, error) {
-	decrypted := fernet.VerifyAndDecrypt(crypted, alg.ttl, []*fernet.Key{alg.key})
+	decrypted := fernet.VerifyAndDecrypt(crypted, alg.ttl, alg.keys)
 	if decrypted == nil {
 		return nil, fmt.Errorf("can't decrypt the field value")
 	}
 	return decrypted, nil
 }
+
+// A cryptKey is a key, as found in the configuration, and its ID.
+type cryptKey struct {
+	id  string
+	key string
+}
+
+// parseCryptKeys returns the keys given either by the "Key", "Keys" or
+// "KeyFile" configuration entries. The last key is the newest.
+func parseCryptKeys(conf map[string]string) ([]cryptKey, error) {
+	var (
+		lines []string
+		set   int
+	)
+	if key, ok := conf["Key"]; ok {
+		lines = []string{key}
+		set++
+	}
+	if keys, ok := conf["Keys"]; ok {
+		lines = strings.Split(keys, ",")
+		set++
+	}
+	if path, ok := conf["KeyFile"]; ok {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("can't read KeyFile: %v", err)
+		}
+		s := bufio.NewScanner(bytes.NewReader(buf))
+		for s.Scan() {
+			line := strings.TrimSpace(s.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			lines = append(lines, line)
+		}
+		set++
+	}
+
+	switch {
+	case set == 0:
+		return nil, errors.New(`one of "Key", "Keys" or "KeyFile" is required`)
+	case set > 1:
+		return nil, errors.New(`only one of "Key", "Keys" or "KeyFile" can be set`)
+	case len(lines) == 0:
+		return nil, errors.New("no keys")
+	}
+
+	if len(lines) == 1 && !strings.Contains(lines[0], ":") {
+		return []cryptKey{{key: strings.TrimSpace(lines[0])}}, nil
+	}
+
+	keys := make([]cryptKey, 0, len(lines))
+	ids := make(map[string]bool, len(lines))
+	for i, line := range lines {
+		id, key, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("key #%d: missing key ID, want ID:KEY", i+1)
+		}
+		if ids[id] {
+			return nil, fmt.Errorf("duplicate key ID %q", id)
+		}
+		ids[id] = true
+		keys = append(keys, cryptKey{id: id, key: key})
+	}
+	return keys, nil
+}
+
+// decodeCryptKey decodes a base64 key, encoded with either the standard or
+// the URL-safe alphabet, with or without padding.
+func decodeCryptKey(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "-_") {
+		return base64.RawURLEncoding.DecodeString(s)
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// cryptAEAD implements cryptAlgorithm with an AEAD cipher, supporting key
+// rotation.
+type cryptAEAD struct {
+	keySize int
+	newAEAD func(key []byte) (cipher.AEAD, error)
+
+	keys    map[string]cipher.AEAD // indexed by key ID
+	current string                 // ID of the key used to encrypt
+
+	encode func([]byte) []byte
+	decode func([]byte) ([]byte, error)
+}
+
+func (alg *cryptAEAD) parseConf(conf map[string]string) error {
+	keys, err := parseCryptKeys(conf)
+	if err != nil {
+		return err
+	}
+
+	alg.keys = make(map[string]cipher.AEAD, len(keys))
+	for _, k := range keys {
+		key, err := decodeCryptKey(k.key)
+		if err != nil {
+			return fmt.Errorf("can't decode key %q: %v", k.id, err)
+		}
+		if len(key) != alg.keySize {
+			return fmt.Errorf("key %q: invalid size %d bits, want %d", k.id, len(key)*8, alg.keySize*8)
+		}
+		if alg.keys[k.id], err = alg.newAEAD(key); err != nil {
+			return fmt.Errorf("key %q: %v", k.id, err)
+		}
+		alg.current = k.id
+	}
+
+	encoding := conf["Encoding"]
+	switch encoding {
+	case "", "base64":
+		alg.encode, alg.decode = cryptEncoding(base64.StdEncoding)
+	case "base64url":
+		alg.encode, alg.decode = cryptEncoding(base64.URLEncoding)
+	case "hex":
+		alg.encode = func(src []byte) []byte {
+			dst := make([]byte, hex.EncodedLen(len(src)))
+			hex.Encode(dst, src)
+			return dst
+		}
+		alg.decode = func(src []byte) ([]byte, error) {
+			dst := make([]byte, hex.DecodedLen(len(src)))
+			n, err := hex.Decode(dst, src)
+			return dst[:n], err
+		}
+	default:
+		return fmt.Errorf("unsupported Encoding %q", encoding)
+	}
+	return nil
+}
+
+func cryptEncoding(enc *base64.Encoding) (func([]byte) []byte, func([]byte) ([]byte, error)) {
+	encode := func(src []byte) []byte {
+		dst := make([]byte, enc.EncodedLen(len(src)))
+		enc.Encode(dst, src)
+		return dst
+	}
+	decode := func(src []byte) ([]byte, error) {
+		dst := make([]byte, enc.DecodedLen(len(src)))
+		n, err := enc.Decode(dst, src)
+		return dst[:n], err
+	}
+	return encode, decode
+}
+
+func (alg *cryptAEAD) encrypt(msg []byte) ([]byte, error) {
+	aead := alg.keys[alg.current]
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(msg)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	encoded := alg.encode(aead.Seal(nonce, nonce, msg, nil))
+
+	if alg.current == "" {
+		return encoded, nil
+	}
+	out := make([]byte, 0, len(alg.current)+1+len(encoded))
+	out = append(out, alg.current...)
+	out = append(out, ':')
+	return append(out, encoded...), nil
+}
+
+func (alg *cryptAEAD) decrypt(crypted []byte) ([]byte, error) {
+	var id string
+	if i := bytes.IndexByte(crypted, ':'); i != -1 {
+		id, crypted = string(crypted[:i]), crypted[i+1:]
+	}
+	aead, ok := alg.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %q", id)
+	}
+
+	buf, err := alg.decode(crypted)
+	if err != nil {
+		return nil, fmt.Errorf("can't decode the field value: %v", err)
+	}
+	if len(buf) < aead.NonceSize() {
+		return nil, errors.New("can't decrypt the field value: too short")
+	}
+	nonce, ciphertext := buf[:aead.NonceSize()], buf[aead.NonceSize():]
+	decrypted, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt the field value")
+	}
+	return decrypted, nil
+}
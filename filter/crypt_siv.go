@@ -0,0 +1,189 @@
+package filter
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+)
+
+// aesSIV implements the deterministic authenticated encryption scheme
+// AES-SIV, as specified in RFC 5297, as a cipher.AEAD whose nonce size is 0.
+// The same plaintext (and additional data) is always encrypted into the same
+// ciphertext, made of the 16-byte synthetic IV followed by the encrypted
+// plaintext.
+type aesSIV struct {
+	mac cipher.Block // for S2V (CMAC)
+	ctr cipher.Block // for CTR encryption
+
+	k1, k2 [aes.BlockSize]byte // CMAC subkeys
+}
+
+// newAESSIV returns an AES-SIV cipher.AEAD. key is the concatenation of
+// the MAC and encryption keys, and must be 32, 48 or 64 bytes long, for
+// AES-128, AES-192 or AES-256 respectively.
+func newAESSIV(key []byte) (cipher.AEAD, error) {
+	switch len(key) {
+	case 32, 48, 64:
+	default:
+		return nil, fmt.Errorf("invalid AES-SIV key size %d, want 32, 48 or 64 bytes", len(key))
+	}
+
+	mac, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return nil, err
+	}
+	ctr, err := aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		return nil, err
+	}
+
+	s := &aesSIV{mac: mac, ctr: ctr}
+	var l [aes.BlockSize]byte
+	mac.Encrypt(l[:], l[:])
+	s.k1 = sivDouble(l)
+	s.k2 = sivDouble(s.k1)
+	return s, nil
+}
+
+func (s *aesSIV) NonceSize() int { return 0 }
+func (s *aesSIV) Overhead() int  { return aes.BlockSize }
+
+// Seal encrypts and authenticates plaintext and additionalData (if not
+// empty) and appends the result to dst. Unlike with other AEADs, dst can't
+// be plaintext[:0], since the synthetic IV precedes the encrypted plaintext.
+func (s *aesSIV) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != 0 {
+		panic("aesSIV: nonce must be empty")
+	}
+
+	v := s.s2v(additionalData, plaintext)
+	ret, out := sliceForAppend(dst, aes.BlockSize+len(plaintext))
+	copy(out, v[:])
+	s.xorKeyStream(out[aes.BlockSize:], plaintext, v)
+	return ret
+}
+
+var errSIVOpen = errors.New("aesSIV: message authentication failed")
+
+// Open decrypts and authenticates ciphertext and additionalData and, if
+// successful, appends the resulting plaintext to dst.
+func (s *aesSIV) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != 0 {
+		panic("aesSIV: nonce must be empty")
+	}
+	if len(ciphertext) < aes.BlockSize {
+		return nil, errSIVOpen
+	}
+
+	var v [aes.BlockSize]byte
+	copy(v[:], ciphertext)
+	ciphertext = ciphertext[aes.BlockSize:]
+
+	// Since the synthetic IV precedes the encrypted plaintext, decrypting in
+	// place (dst = ciphertext[:0]) would make the CTR input and output
+	// overlap inexactly, so decrypt into a separate buffer.
+	plaintext := make([]byte, len(ciphertext))
+	s.xorKeyStream(plaintext, ciphertext, v)
+
+	t := s.s2v(additionalData, plaintext)
+	if subtle.ConstantTimeCompare(t[:], v[:]) != 1 {
+		return nil, errSIVOpen
+	}
+	return append(dst, plaintext...), nil
+}
+
+// xorKeyStream encrypts (or decrypts) src into dst with AES-CTR, using the
+// synthetic IV v whose bits 31 and 63 are cleared as initial counter.
+func (s *aesSIV) xorKeyStream(dst, src []byte, v [aes.BlockSize]byte) {
+	v[8] &= 0x7f
+	v[12] &= 0x7f
+	cipher.NewCTR(s.ctr, v[:]).XORKeyStream(dst, src)
+}
+
+// s2v implements the S2V pseudo-random function over additionalData (if not
+// empty) and plaintext.
+func (s *aesSIV) s2v(additionalData, plaintext []byte) [aes.BlockSize]byte {
+	var zero [aes.BlockSize]byte
+	d := s.cmac(zero[:])
+
+	if len(additionalData) != 0 {
+		d = sivDouble(d)
+		ad := s.cmac(additionalData)
+		xorBytes(d[:], d[:], ad[:])
+	}
+
+	var t []byte
+	if len(plaintext) >= aes.BlockSize {
+		// xorend
+		t = make([]byte, len(plaintext))
+		copy(t, plaintext)
+		end := t[len(t)-aes.BlockSize:]
+		xorBytes(end, end, d[:])
+	} else {
+		d = sivDouble(d)
+		var padded [aes.BlockSize]byte
+		copy(padded[:], plaintext)
+		padded[len(plaintext)] = 0x80
+		xorBytes(d[:], d[:], padded[:])
+		t = d[:]
+	}
+	return s.cmac(t)
+}
+
+// cmac returns the AES-CMAC (RFC 4493) of msg.
+func (s *aesSIV) cmac(msg []byte) [aes.BlockSize]byte {
+	var x [aes.BlockSize]byte
+
+	// Process all the blocks but the last one.
+	for len(msg) > aes.BlockSize {
+		xorBytes(x[:], x[:], msg[:aes.BlockSize])
+		s.mac.Encrypt(x[:], x[:])
+		msg = msg[aes.BlockSize:]
+	}
+
+	var last [aes.BlockSize]byte
+	copy(last[:], msg)
+	if len(msg) == aes.BlockSize {
+		xorBytes(last[:], last[:], s.k1[:])
+	} else {
+		last[len(msg)] = 0x80
+		xorBytes(last[:], last[:], s.k2[:])
+	}
+	xorBytes(x[:], x[:], last[:])
+	s.mac.Encrypt(x[:], x[:])
+	return x
+}
+
+// sivDouble multiplies b by x in GF(2^128).
+func sivDouble(b [aes.BlockSize]byte) [aes.BlockSize]byte {
+	var out [aes.BlockSize]byte
+	carry := b[0] >> 7
+	for i := 0; i < aes.BlockSize-1; i++ {
+		out[i] = b[i]<<1 | b[i+1]>>7
+	}
+	out[aes.BlockSize-1] = b[aes.BlockSize-1]<<1 ^ carry*0x87
+	return out
+}
+
+// xorBytes sets dst[i] = x[i] ^ y[i] for all i < len(dst).
+func xorBytes(dst, x, y []byte) {
+	for i := range dst {
+		dst[i] = x[i] ^ y[i]
+	}
+}
+
+// sliceForAppend takes a slice and a requested number of bytes. It returns a
+// slice with the contents of the given slice followed by that many bytes and
+// a second slice that aliases into it and contains only the extra bytes.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
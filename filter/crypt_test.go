@@ -2,11 +2,20 @@ package filter
 
 import (
 	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/AdRoll/baker"
 )
 
+const (
+	cryptTestKey256 = "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+	cryptTestKey512 = "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8gISIjJCUmJygpKissLS4vMDEyMzQ1Njc4OTo7PD0+Pw=="
+)
+
 func TestCrypt(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -70,6 +79,66 @@ func TestCrypt(t *testing.T) {
 			},
 			wantValue: []byte("asdAAABgAHxm_pT_mAhSxNRb2LHXHZjrIc3eoYLPJxMYGrkRsXrD39EI6fzvs-iwQpiGGesFJ9TagmlBbbhY4NlARAMAIGz90g=="),
 		},
+		{
+			name:      "aes-gcm encrypt",
+			record:    "s3cr3t,def,ghi",
+			algorithm: "aes-gcm",
+			srcField:  "foo",
+			dstField:  "bar",
+			algorithmConfig: map[string]string{
+				"Key": cryptTestKey256,
+			},
+			wantValue: []byte("s3cr3t"),
+		},
+		{
+			name:      "chacha20-poly1305 encrypt",
+			record:    "s3cr3t,def,ghi",
+			algorithm: "chacha20-poly1305",
+			srcField:  "foo",
+			dstField:  "bar",
+			algorithmConfig: map[string]string{
+				"Key":      cryptTestKey256,
+				"Encoding": "hex",
+			},
+			wantValue: []byte("s3cr3t"),
+		},
+		{
+			name:      "aes-siv encrypt",
+			record:    "s3cr3t,def,ghi",
+			algorithm: "aes-siv",
+			srcField:  "foo",
+			dstField:  "bar",
+			algorithmConfig: map[string]string{
+				"Key":      cryptTestKey512,
+				"Encoding": "base64url",
+			},
+			wantValue: []byte("s3cr3t"),
+		},
+		{
+			name:      "aes-siv decrypt",
+			record:    "k1:d2e19ca22c5d3f29d73bcfc4d8547d22dbf21cd07918,def,ghi",
+			algorithm: "aes-siv",
+			decrypt:   true,
+			srcField:  "foo",
+			dstField:  "bar",
+			algorithmConfig: map[string]string{
+				"Keys":     "k1:" + cryptTestKey512,
+				"Encoding": "hex",
+			},
+			wantValue: []byte("s3cr3t"),
+		},
+		{
+			name:      "aes-gcm decrypt error",
+			record:    "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA,def,ghi",
+			algorithm: "aes-gcm",
+			decrypt:   true,
+			srcField:  "foo",
+			dstField:  "bar",
+			algorithmConfig: map[string]string{
+				"Key": cryptTestKey256,
+			},
+			wantValue: []byte("def"), // the record is discarded
+		},
 
 		// config errors
 		{
@@ -122,6 +191,88 @@ func TestCrypt(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name:      "aes-gcm config: invalid key size",
+			algorithm: "aes-gcm",
+			srcField:  "foo",
+			dstField:  "foo",
+			algorithmConfig: map[string]string{
+				"Key": cryptTestKey512,
+			},
+			wantErr: true,
+		},
+		{
+			name:      "aes-siv config: invalid key size",
+			algorithm: "aes-siv",
+			srcField:  "foo",
+			dstField:  "foo",
+			algorithmConfig: map[string]string{
+				"Key": cryptTestKey256,
+			},
+			wantErr: true,
+		},
+		{
+			name:      "aes-gcm config: invalid key",
+			algorithm: "aes-gcm",
+			srcField:  "foo",
+			dstField:  "foo",
+			algorithmConfig: map[string]string{
+				"Key": "not a key",
+			},
+			wantErr: true,
+		},
+		{
+			name:      "aes-gcm config: unsupported encoding",
+			algorithm: "aes-gcm",
+			srcField:  "foo",
+			dstField:  "foo",
+			algorithmConfig: map[string]string{
+				"Key":      cryptTestKey256,
+				"Encoding": "base32",
+			},
+			wantErr: true,
+		},
+		{
+			name:      "aes-gcm config: Key and Keys",
+			algorithm: "aes-gcm",
+			srcField:  "foo",
+			dstField:  "foo",
+			algorithmConfig: map[string]string{
+				"Key":  cryptTestKey256,
+				"Keys": "k1:" + cryptTestKey256,
+			},
+			wantErr: true,
+		},
+		{
+			name:      "aes-gcm config: missing key ID",
+			algorithm: "aes-gcm",
+			srcField:  "foo",
+			dstField:  "foo",
+			algorithmConfig: map[string]string{
+				"Keys": "k1:" + cryptTestKey256 + "," + cryptTestKey256,
+			},
+			wantErr: true,
+		},
+		{
+			name:      "aes-gcm config: duplicate key ID",
+			algorithm: "aes-gcm",
+			srcField:  "foo",
+			dstField:  "foo",
+			algorithmConfig: map[string]string{
+				"Keys": "k1:" + cryptTestKey256 + ",k1:" + cryptTestKey256,
+			},
+			wantErr: true,
+		},
+		{
+			name:      "aes-gcm config: missing KeyFile",
+			algorithm: "aes-gcm",
+			srcField:  "foo",
+			dstField:  "foo",
+			algorithmConfig: map[string]string{
+				"KeyFile": "/does/not/exist",
+			},
+			wantErr: true,
+		},
 	}
 
 	fieldByName := func(name string) (baker.FieldIndex, bool) {
@@ -186,3 +337,151 @@ func TestCrypt(t *testing.T) {
 		})
 	}
 }
+
+func TestAESSIV(t *testing.T) {
+	// Test vectors from RFC 5297, appendix A.1 (deterministic authenticated
+	// encryption).
+	key, _ := hex.DecodeString("fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff")
+	ad, _ := hex.DecodeString("101112131415161718191a1b1c1d1e1f2021222324252627")
+	plaintext, _ := hex.DecodeString("112233445566778899aabbccddee")
+	want, _ := hex.DecodeString("85632d07c6e8f37f950acd320a2ecc9340c02b9690c4dc04daef7f6afe5c")
+
+	aead, err := newAESSIV(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := aead.Seal(nil, nil, plaintext, ad)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("Seal() = %x, want %x", got, want)
+	}
+
+	decrypted, err := aead.Open(nil, nil, got, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("Open() = %x, want %x", decrypted, plaintext)
+	}
+
+	// Tampering with the ciphertext or the additional data fails.
+	got[len(got)-1] ^= 1
+	if _, err := aead.Open(nil, nil, got, ad); err == nil {
+		t.Errorf("Open() with a modified ciphertext succeeded")
+	}
+	got[len(got)-1] ^= 1
+	if _, err := aead.Open(nil, nil, got, ad[1:]); err == nil {
+		t.Errorf("Open() with a modified additional data succeeded")
+	}
+
+	// Round trips, for plaintexts shorter than, equal to, and longer than a
+	// block.
+	for _, n := range []int{0, 1, 15, 16, 17, 32, 100} {
+		msg := bytes.Repeat([]byte{'x'}, n)
+		ct := aead.Seal(nil, nil, msg, nil)
+		if len(ct) != n+aead.Overhead() {
+			t.Errorf("len(Seal(%d bytes)) = %d, want %d", n, len(ct), n+aead.Overhead())
+		}
+		pt, err := aead.Open(nil, nil, ct, nil)
+		if err != nil || !bytes.Equal(pt, msg) {
+			t.Errorf("Open(Seal(%d bytes)) = %q, %v", n, pt, err)
+		}
+	}
+}
+
+func TestCryptKeyRotation(t *testing.T) {
+	const otherKey = "ZGVmZ2hpamtsbW5vcHFyc3R1dnd4eXp7fH1+f4CBgoM="
+
+	newCrypt := func(t *testing.T, algorithm string, decrypt bool, conf map[string]string) *Crypt {
+		t.Helper()
+		f, err := NewCrypt(baker.FilterParams{
+			ComponentParams: baker.ComponentParams{
+				FieldByName: func(name string) (baker.FieldIndex, bool) { return 0, true },
+				DecodedConfig: &CryptConfig{
+					Algorithm:       algorithm,
+					Decrypt:         decrypt,
+					SrcField:        "foo",
+					DstField:        "foo",
+					AlgorithmConfig: conf,
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f.(*Crypt)
+	}
+
+	process := func(t *testing.T, f *Crypt, value string) string {
+		t.Helper()
+		l := &baker.LogLine{FieldSeparator: ','}
+		l.Set(0, []byte(value))
+		forwarded := false
+		f.Process(l, func(baker.Record) { forwarded = true })
+		if !forwarded {
+			t.Fatalf("record with %q has been discarded", value)
+		}
+		return string(l.Get(0))
+	}
+
+	dir := t.TempDir()
+	oldKeys := filepath.Join(dir, "old")
+	newKeys := filepath.Join(dir, "new")
+	if err := os.WriteFile(oldKeys, []byte("k1:"+cryptTestKey256+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(newKeys, []byte("# rotated in June\nk1:"+cryptTestKey256+"\n\nk2:"+otherKey+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, algorithm := range []string{"aes-gcm", "chacha20-poly1305"} {
+		t.Run(algorithm, func(t *testing.T) {
+			encOld := newCrypt(t, algorithm, false, map[string]string{"KeyFile": oldKeys})
+			encNew := newCrypt(t, algorithm, false, map[string]string{"KeyFile": newKeys})
+			dec := newCrypt(t, algorithm, true, map[string]string{"KeyFile": newKeys})
+
+			oldValue := process(t, encOld, "s3cr3t")
+			if !strings.HasPrefix(oldValue, "k1:") {
+				t.Errorf("encrypted value %q doesn't start with the old key ID", oldValue)
+			}
+			newValue := process(t, encNew, "s3cr3t")
+			if !strings.HasPrefix(newValue, "k2:") {
+				t.Errorf("encrypted value %q doesn't start with the new key ID", newValue)
+			}
+
+			for _, v := range []string{oldValue, newValue} {
+				if got := process(t, dec, v); got != "s3cr3t" {
+					t.Errorf("decrypt(%q) = %q, want %q", v, got, "s3cr3t")
+				}
+			}
+
+			// Values encrypted with an unknown key can't be decrypted.
+			if _, err := dec.algorithm.decrypt([]byte("k3" + newValue[2:])); err == nil {
+				t.Errorf("decrypting with an unknown key ID succeeded")
+			}
+		})
+	}
+
+	t.Run("aes-siv is deterministic", func(t *testing.T) {
+		enc := newCrypt(t, "aes-siv", false, map[string]string{"Key": cryptTestKey512})
+		a, b := process(t, enc, "s3cr3t"), process(t, enc, "s3cr3t")
+		if a != b {
+			t.Errorf("aes-siv encrypted the same value into %q and %q", a, b)
+		}
+		if c := process(t, enc, "other"); c == a {
+			t.Errorf("aes-siv encrypted different values into %q", c)
+		}
+	})
+
+	t.Run("fernet", func(t *testing.T) {
+		const (
+			fernetOld = "mp5jfs_We-bngW4srQCwp7nLljXJDyuVCVw1Q8NEo_U="
+			fernetNew = "yMnKy8zNzs_Q0dLT1NXW19jZ2tvc3d7f4OHi4-Tl5uc="
+		)
+		enc := newCrypt(t, "fernet", false, map[string]string{"Key": fernetOld})
+		dec := newCrypt(t, "fernet", true, map[string]string{"Keys": "old:" + fernetOld + ",new:" + fernetNew})
+		if got := process(t, dec, process(t, enc, "s3cr3t")); got != "s3cr3t" {
+			t.Errorf("decrypt(encrypt(%q)) = %q", "s3cr3t", got)
+		}
+	})
+}
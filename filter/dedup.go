@@ -1,23 +1,60 @@
 package filter
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/gob"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unicode"
 
+	log "github.com/sirupsen/logrus"
+
 	"github.com/AdRoll/baker"
 )
 
 const dedupHelp = `
-This filter removes duplicate records. A record is considered a duplicate, and is thus removed by this filter, 
-if another record with the same values has already been _seen_. The comparison is performed on a 
+This filter removes duplicate records. A record is considered a duplicate, and is thus removed by this filter,
+if another record with the same values has already been _seen_. The comparison is performed on a
 user-provided list of fields (` + "`Fields`" + ` setting).
 
-**WARNING**: to remove duplicates, this filter stores one key per unique record in memory, this means 
-that the overall memory grows linearly with the number of unique records in your data set. Depending 
-on your data set, this might lead to OOM (i.e. out of memory) errors.
+**WARNING**: by default, to remove duplicates, this filter stores one key per unique record in memory, this means
+that the overall memory grows linearly with the number of unique records in your data set. Depending
+on your data set, this might lead to OOM (i.e. out of memory) errors. Memory usage can be bounded with
+the following settings:
+
+ - ` + "`TTL`" + `: only records seen within the last ` + "`TTL`" + ` are considered when looking for
+   duplicates, older keys are forgotten. For example, with ` + "`TTL=\"10m\"`" + `, a record is
+   discarded only if a record with the same key has been seen in the last 10 minutes.
+ - ` + "`MaxKeys`" + `: at most ` + "`MaxKeys`" + ` keys are kept in memory, the least recently
+   seen keys being evicted first.
+ - ` + "`Mode=\"bloom\"`" + `: instead of storing keys, a scalable Bloom filter is used. Memory usage
+   is much lower but the filter is probabilistic: a record which isn't a duplicate can be
+   discarded, with a probability of at most ` + "`FalsePositiveRate`" + `. The Bloom filter grows
+   as needed, starting with a size adapted to ` + "`BloomCapacity`" + ` keys. When ` + "`TTL`" + `
+   is set, the Bloom filter is rotated every ` + "`TTL`" + `, which means that keys are remembered
+   for at least ` + "`TTL`" + ` and at most twice that.
+
+The number of keys, an estimation of the memory used and the number of evicted or expired keys are
+exported as metrics.
+
+### Persistence
+
+If ` + "`StateFile`" + ` is set, the set of keys (or the Bloom filter) is saved to that local file when
+the topology shuts down, and every ` + "`SnapshotEvery`" + ` if set, and loaded back when the filter is
+created, so that deduplication survives restarts. The file is replaced atomically so that a crash
+while saving never leaves a corrupted state behind. A state file saved in a different ` + "`Mode`" + `
+than the configured one, or in bloom mode with a different ` + "`BloomCapacity`" + ` or
+` + "`FalsePositiveRate`" + `, is rejected. If ` + "`TTL`" + ` has been removed, the keys of the Bloom filter
+that had already been rotated are forgotten.
+
+When the filter is only created to check or trace the configuration, the state is loaded but never
+saved.
 `
 
 var DedupDesc = baker.FilterDesc{
@@ -28,14 +65,30 @@ var DedupDesc = baker.FilterDesc{
 }
 
 type DedupConfig struct {
-	Fields       []string `help:"fields to consider when comparing records" required:"true"`
-	KeySeparator string   `help:"character separator used to build a key from the fields" default:"\\x1e"`
+	Fields            []string      `help:"fields to consider when comparing records" required:"true"`
+	KeySeparator      string        `help:"character separator used to build a key from the fields" default:"\\x1e"`
+	Mode              string        `help:"deduplication mode, either \"exact\" or \"bloom\" (probabilistic)" default:"exact"`
+	TTL               time.Duration `help:"if set, keys not seen for that long are forgotten. By default keys are never forgotten"`
+	MaxKeys           int           `help:"maximum number of keys kept in memory, in exact mode. 0 means no limit" default:"0"`
+	BloomCapacity     int           `help:"number of keys the Bloom filter is initially sized for, in bloom mode" default:"1000000"`
+	FalsePositiveRate float64       `help:"maximum probability of discarding a record that is not a duplicate, in bloom mode" default:"0.001"`
+	StateFile         string        `help:"path of the local file the filter state is saved to and loaded from. By default the state isn't persisted"`
+	SnapshotEvery     time.Duration `help:"period at which the state is saved to StateFile, in addition to when the topology shuts down. 0 means only at shutdown" default:"0"`
 }
 
 func (cfg *DedupConfig) fillDefaults() {
 	if cfg.KeySeparator == "" {
 		cfg.KeySeparator = "\x1e"
 	}
+	if cfg.Mode == "" {
+		cfg.Mode = "exact"
+	}
+	if cfg.BloomCapacity == 0 {
+		cfg.BloomCapacity = 1000000
+	}
+	if cfg.FalsePositiveRate == 0 {
+		cfg.FalsePositiveRate = 0.001
+	}
 }
 
 type Dedup struct {
@@ -45,8 +98,14 @@ type Dedup struct {
 	sep    []byte
 
 	// Shared state
-	dedupSet         sync.Map // type: map[string]struct{}
+	store            dedupStore
 	numFilteredLines int64
+
+	mode      string // lowercased Mode
+	stateFile string
+	stop      chan struct{} // closed to stop periodic snapshots
+	done      chan struct{} // closed when periodic snapshots have stopped
+	closeOnce sync.Once
 }
 
 func NewDedup(cfg baker.FilterParams) (baker.Filter, error) {
@@ -69,18 +128,174 @@ func NewDedup(cfg baker.FilterParams) (baker.Filter, error) {
 	}
 	f.sep = []byte(dcfg.KeySeparator)
 
+	if dcfg.TTL < 0 {
+		return nil, fmt.Errorf("TTL must be positive, got %v", dcfg.TTL)
+	}
+	if dcfg.MaxKeys < 0 {
+		return nil, fmt.Errorf("MaxKeys must be positive, got %d", dcfg.MaxKeys)
+	}
+	if dcfg.SnapshotEvery < 0 {
+		return nil, fmt.Errorf("SnapshotEvery must be positive, got %v", dcfg.SnapshotEvery)
+	}
+
+	f.mode = strings.ToLower(dcfg.Mode)
+	switch f.mode {
+	case "exact":
+		if dcfg.TTL == 0 && dcfg.MaxKeys == 0 {
+			f.store = &mapStore{}
+		} else {
+			f.store = newLRUStore(dcfg.MaxKeys, dcfg.TTL)
+		}
+	case "bloom":
+		if dcfg.MaxKeys != 0 {
+			return nil, fmt.Errorf("MaxKeys is not supported in bloom mode")
+		}
+		if dcfg.BloomCapacity < 1 {
+			return nil, fmt.Errorf("BloomCapacity must be positive, got %d", dcfg.BloomCapacity)
+		}
+		if dcfg.FalsePositiveRate <= 0 || dcfg.FalsePositiveRate >= 1 {
+			return nil, fmt.Errorf("FalsePositiveRate must be in (0, 1), got %v", dcfg.FalsePositiveRate)
+		}
+		f.store = newBloomStore(uint64(dcfg.BloomCapacity), dcfg.FalsePositiveRate, dcfg.TTL)
+	default:
+		return nil, fmt.Errorf("unsupported mode %q", dcfg.Mode)
+	}
+
+	if dcfg.StateFile != "" {
+		f.stateFile = dcfg.StateFile
+		if err := f.load(); err != nil {
+			return nil, fmt.Errorf("can't load state: %v", err)
+		}
+		if cfg.DryRun {
+			// Use the saved state, but never overwrite it.
+			f.stateFile = ""
+		} else {
+			f.stop, f.done = make(chan struct{}), make(chan struct{})
+			go f.snapshotEvery(dcfg.SnapshotEvery)
+		}
+	}
+
 	return f, nil
 }
 
+// Close saves the filter state, if StateFile is set.
+func (f *Dedup) Close() error {
+	if f.stateFile == "" {
+		return nil
+	}
+
+	var err error
+	f.closeOnce.Do(func() {
+		close(f.stop)
+		<-f.done
+		err = f.save()
+	})
+	return err
+}
+
+// snapshotEvery periodically saves the filter state, until f.stop is closed.
+func (f *Dedup) snapshotEvery(period time.Duration) {
+	defer close(f.done)
+
+	if period == 0 {
+		<-f.stop
+		return
+	}
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.save(); err != nil {
+				log.WithError(err).WithField("file", f.stateFile).Error("Dedup: can't save state")
+			}
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// dedupStateHeader is the first value encoded in a state file.
+type dedupStateHeader struct {
+	Version int
+	Mode    string
+}
+
+const dedupStateVersion = 1
+
+// save writes the filter state to the state file. The state is first written
+// to a temporary file, then renamed, so that the state file is never left
+// half-written.
+func (f *Dedup) save() error {
+	tmp, err := os.CreateTemp(filepath.Dir(f.stateFile), filepath.Base(f.stateFile)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(dedupStateHeader{Version: dedupStateVersion, Mode: f.mode}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := enc.Encode(f.store.snapshot()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.stateFile)
+}
+
+// load loads the filter state from the state file, if it exists.
+func (f *Dedup) load() error {
+	fd, err := os.Open(f.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	dec := gob.NewDecoder(bufio.NewReader(fd))
+	var hdr dedupStateHeader
+	if err := dec.Decode(&hdr); err != nil {
+		return fmt.Errorf("%s: %v", f.stateFile, err)
+	}
+	if hdr.Version != dedupStateVersion {
+		return fmt.Errorf("%s: unsupported version %d", f.stateFile, hdr.Version)
+	}
+	if hdr.Mode != f.mode {
+		return fmt.Errorf("%s: state saved in %s mode, not %s", f.stateFile, hdr.Mode, f.mode)
+	}
+	if err := f.store.restore(dec); err != nil {
+		return fmt.Errorf("%s: %v", f.stateFile, err)
+	}
+	return nil
+}
+
 func (f *Dedup) Stats() baker.FilterStats {
+	bag := make(baker.MetricsBag)
+	f.store.addMetrics(bag)
+
 	return baker.FilterStats{
 		NumFilteredLines: atomic.LoadInt64(&f.numFilteredLines),
+		Metrics:          bag,
 	}
 }
 
 func (f *Dedup) Process(l baker.Record, next func(baker.Record)) {
 	key := f.constructKey(l)
-	if _, found := f.dedupSet.LoadOrStore(key, struct{}{}); found {
+	if f.store.seen(key, time.Now()) {
 		atomic.AddInt64(&f.numFilteredLines, 1)
 		return
 	}
@@ -96,3 +311,305 @@ func (f *Dedup) constructKey(l baker.Record) string {
 	}
 	return string(bytes.Join(fields, f.sep))
 }
+
+// dedupEntryOverhead is a rough estimation of the memory used by each key
+// stored in exact mode, in addition to the key itself.
+const dedupEntryOverhead = 128
+
+// A dedupStore records the keys seen by the Dedup filter. dedupStore
+// implementations are safe for concurrent use.
+type dedupStore interface {
+	// seen reports whether key has already been seen, and records that it has
+	// been seen at time now.
+	seen(key string, now time.Time) bool
+
+	// addMetrics adds the store metrics to bag.
+	addMetrics(bag baker.MetricsBag)
+
+	// snapshot returns a copy of the store state, to be gob-encoded.
+	snapshot() interface{}
+
+	// restore decodes a state returned by snapshot and loads it into the
+	// store. It's only called on an empty store.
+	restore(dec *gob.Decoder) error
+}
+
+// exactState is the state of the stores used in exact mode.
+type exactState struct {
+	Keys []string
+	Seen []int64 // Unix nanoseconds at which Keys have been seen, if known
+}
+
+// mapStore is an unbounded dedupStore which never forgets keys.
+type mapStore struct {
+	keys     sync.Map // type: map[string]struct{}
+	nkeys    int64
+	keyBytes int64
+}
+
+func (s *mapStore) seen(key string, _ time.Time) bool {
+	if _, found := s.keys.LoadOrStore(key, struct{}{}); found {
+		return true
+	}
+	atomic.AddInt64(&s.nkeys, 1)
+	atomic.AddInt64(&s.keyBytes, int64(len(key)))
+	return false
+}
+
+func (s *mapStore) addMetrics(bag baker.MetricsBag) {
+	nkeys := atomic.LoadInt64(&s.nkeys)
+	bag.AddGauge("dedup.keys", float64(nkeys))
+	bag.AddGauge("dedup.memory_bytes", float64(atomic.LoadInt64(&s.keyBytes)+nkeys*dedupEntryOverhead))
+}
+
+func (s *mapStore) snapshot() interface{} {
+	var state exactState
+	s.keys.Range(func(key, _ interface{}) bool {
+		state.Keys = append(state.Keys, key.(string))
+		return true
+	})
+	return state
+}
+
+func (s *mapStore) restore(dec *gob.Decoder) error {
+	var state exactState
+	if err := dec.Decode(&state); err != nil {
+		return err
+	}
+	for _, key := range state.Keys {
+		s.seen(key, time.Time{})
+	}
+	return nil
+}
+
+// lruStore is a dedupStore keeping at most a given number of keys, and/or
+// forgetting keys not seen for a given duration.
+type lruStore struct {
+	ttl time.Duration
+
+	mu      sync.Mutex // protects all fields below
+	keys    *lruCache  // values are the last time keys have been seen
+	expired int64
+}
+
+func newLRUStore(maxKeys int, ttl time.Duration) *lruStore {
+	return &lruStore{
+		ttl:  ttl,
+		keys: newLRUCache(maxKeys),
+	}
+}
+
+func (s *lruStore) seen(key string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(now)
+	_, found := s.keys.Get(key)
+	s.keys.Add(key, now)
+	return found
+}
+
+// expire removes the keys which haven't been seen within the TTL. Since the
+// least recently seen keys are the oldest in the cache, it stops at the first
+// key that hasn't expired. s.mu must be held.
+func (s *lruStore) expire(now time.Time) {
+	if s.ttl == 0 {
+		return
+	}
+	for {
+		_, last, ok := s.keys.Oldest()
+		if !ok || now.Sub(last.(time.Time)) < s.ttl {
+			return
+		}
+		s.keys.RemoveOldest()
+		s.expired++
+	}
+}
+
+func (s *lruStore) addMetrics(bag baker.MetricsBag) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nkeys := int64(s.keys.Len())
+	bag.AddGauge("dedup.keys", float64(nkeys))
+	bag.AddGauge("dedup.memory_bytes", float64(s.keys.keyBytes+nkeys*dedupEntryOverhead))
+	bag.AddRawCounter("dedup.evicted_keys", s.keys.evictions)
+	bag.AddRawCounter("dedup.expired_keys", s.expired)
+}
+
+func (s *lruStore) snapshot() interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := exactState{
+		Keys: make([]string, 0, s.keys.Len()),
+		Seen: make([]int64, 0, s.keys.Len()),
+	}
+	// From the least to the most recently seen, so that restore preserves
+	// the order.
+	for e := s.keys.ll.Back(); e != nil; e = e.Prev() {
+		entry := e.Value.(*lruEntry)
+		state.Keys = append(state.Keys, entry.key)
+		state.Seen = append(state.Seen, entry.value.(time.Time).UnixNano())
+	}
+	return state
+}
+
+func (s *lruStore) restore(dec *gob.Decoder) error {
+	var state exactState
+	if err := dec.Decode(&state); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// States saved by a mapStore don't have timestamps.
+	now := time.Now()
+	for i, key := range state.Keys {
+		seen := now
+		if i < len(state.Seen) {
+			seen = time.Unix(0, state.Seen[i])
+		}
+		s.keys.Add(key, seen)
+	}
+	s.keys.evictions = 0
+	return nil
+}
+
+// bloomStore is a probabilistic dedupStore based on scalable Bloom filters.
+// If a TTL is set, the filters are rotated every TTL: keys are looked up in
+// both the current and previous filter, and only added to the current one.
+type bloomStore struct {
+	capacity   uint64
+	fpRate     float64 // false positive rate of each filter
+	confFPRate float64 // configured false positive rate, fpRate is halved when the TTL is set
+	ttl        time.Duration
+
+	mu      sync.Mutex // protects all fields below
+	cur     *scalableBloom
+	prev    *scalableBloom
+	rotated time.Time // last rotation time
+	expired int64
+}
+
+func newBloomStore(capacity uint64, fpRate float64, ttl time.Duration) *bloomStore {
+	s := &bloomStore{
+		capacity:   capacity,
+		fpRate:     fpRate,
+		confFPRate: fpRate,
+		ttl:        ttl,
+	}
+	// When looking up keys in 2 filters, the false positive rate of each must
+	// be halved to keep the overall rate under fpRate.
+	if ttl != 0 {
+		s.fpRate /= 2
+	}
+	s.cur = newScalableBloom(s.capacity, s.fpRate)
+	return s
+}
+
+func (s *bloomStore) seen(key string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rotate(now)
+
+	h1, h2 := bloomHash(key)
+	if s.cur.test(h1, h2) {
+		return true
+	}
+	s.cur.add(h1, h2)
+	return s.prev != nil && s.prev.test(h1, h2)
+}
+
+// rotate rotates the filters if the TTL has elapsed. s.mu must be held.
+func (s *bloomStore) rotate(now time.Time) {
+	if s.ttl == 0 {
+		return
+	}
+	if s.rotated.IsZero() {
+		s.rotated = now
+		return
+	}
+
+	elapsed := now.Sub(s.rotated)
+	if elapsed < s.ttl {
+		return
+	}
+
+	if s.prev != nil {
+		s.expired += int64(s.prev.count())
+	}
+	s.prev = s.cur
+	if elapsed >= 2*s.ttl {
+		// Nothing has been seen for more than 2 TTLs.
+		s.expired += int64(s.prev.count())
+		s.prev = nil
+	}
+	s.cur = newScalableBloom(s.capacity, s.fpRate)
+	s.rotated = now
+}
+
+func (s *bloomStore) addMetrics(bag baker.MetricsBag) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nkeys, size := s.cur.count(), s.cur.size()
+	if s.prev != nil {
+		nkeys += s.prev.count()
+		size += s.prev.size()
+	}
+	bag.AddGauge("dedup.keys", float64(nkeys))
+	bag.AddGauge("dedup.memory_bytes", float64(size))
+	bag.AddRawCounter("dedup.expired_keys", s.expired)
+}
+
+// bloomState is the state of a bloomStore.
+type bloomState struct {
+	Capacity uint64  // configured capacity
+	FPRate   float64 // configured false positive rate
+	Cur      scalableBloomState
+	Prev     *scalableBloomState
+	Rotated  time.Time
+}
+
+func (s *bloomStore) snapshot() interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := bloomState{
+		Capacity: s.capacity,
+		FPRate:   s.confFPRate,
+		Cur:      s.cur.state(),
+		Rotated:  s.rotated,
+	}
+	if s.prev != nil {
+		prev := s.prev.state()
+		state.Prev = &prev
+	}
+	return state
+}
+
+func (s *bloomStore) restore(dec *gob.Decoder) error {
+	var state bloomState
+	if err := dec.Decode(&state); err != nil {
+		return err
+	}
+	// Bloom filters can't be resized, nor their false positive rate changed.
+	if state.Capacity != s.capacity || state.FPRate != s.confFPRate {
+		return fmt.Errorf("state saved with BloomCapacity %d and FalsePositiveRate %v, not %d and %v",
+			state.Capacity, state.FPRate, s.capacity, s.confFPRate)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cur = newScalableBloomFromState(state.Cur)
+	// Without TTL, the previous filter would never be rotated out.
+	if state.Prev != nil && s.ttl != 0 {
+		s.prev = newScalableBloomFromState(*state.Prev)
+	}
+	s.rotated = state.Rotated
+	return nil
+}
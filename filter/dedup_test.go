@@ -1,7 +1,10 @@
 package filter
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/AdRoll/baker"
 )
@@ -12,6 +15,8 @@ func TestDedup(t *testing.T) {
 		records []string
 		fields  []string
 		sep     string
+		mode    string
+		maxKeys int
 		want    int // number of output records
 		wantErr bool
 	}{
@@ -75,6 +80,31 @@ func TestDedup(t *testing.T) {
 			sep:    "-",
 			want:   1,
 		},
+		{
+			name: "max keys",
+			records: []string{
+				"a,b,c",
+				"b,b,c",
+				"a,b,c",
+				"c,b,c",
+				"a,b,c",
+			},
+			fields:  []string{"f1"},
+			maxKeys: 2,
+			want:    3,
+		},
+		{
+			name: "bloom",
+			records: []string{
+				"abc,def,ghi",
+				"abc,def,ghi",
+				"abc,def,jkl",
+				"abc,xyz,ghi",
+			},
+			fields: []string{"f1", "f2"},
+			mode:   "bloom",
+			want:   2,
+		},
 
 		// errors
 		{
@@ -103,6 +133,19 @@ func TestDedup(t *testing.T) {
 			sep:     string([]byte{132}),
 			wantErr: true,
 		},
+		{
+			name:    "unknown mode",
+			fields:  []string{"f1"},
+			mode:    "foo",
+			wantErr: true,
+		},
+		{
+			name:    "max keys in bloom mode",
+			fields:  []string{"f1"},
+			mode:    "bloom",
+			maxKeys: 10,
+			wantErr: true,
+		},
 	}
 
 	fieldByName := func(name string) (baker.FieldIndex, bool) {
@@ -125,6 +168,8 @@ func TestDedup(t *testing.T) {
 					DecodedConfig: &DedupConfig{
 						Fields:       tt.fields,
 						KeySeparator: tt.sep,
+						Mode:         tt.mode,
+						MaxKeys:      tt.maxKeys,
 					},
 				},
 			}
@@ -154,3 +199,271 @@ func TestDedup(t *testing.T) {
 		})
 	}
 }
+
+func TestDedupStoreTTL(t *testing.T) {
+	const ttl = 10 * time.Minute
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	stores := map[string]dedupStore{
+		"exact": newLRUStore(0, ttl),
+		"bloom": newBloomStore(1000, 0.001, ttl),
+	}
+
+	steps := []struct {
+		key       string
+		at        time.Duration // since start
+		wantExact bool
+		wantBloom bool
+	}{
+		{"a", 0, false, false},
+		{"a", 5 * time.Minute, true, true},
+		{"b", 6 * time.Minute, false, false},
+		{"a", 14 * time.Minute, true, true},
+		{"b", 15 * time.Minute, true, true},
+		// a was last seen 11 minutes ago, but it's still in the previous
+		// Bloom filter, rotated 11 minutes ago.
+		{"a", 25 * time.Minute, false, true},
+		{"b", 40 * time.Minute, false, false},
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			for _, step := range steps {
+				want := step.wantExact
+				if name == "bloom" {
+					want = step.wantBloom
+				}
+				if got := store.seen(step.key, start.Add(step.at)); got != want {
+					t.Errorf("seen(%q) at %v = %t, want %t", step.key, step.at, got, want)
+				}
+			}
+
+			bag := make(baker.MetricsBag)
+			store.addMetrics(bag)
+			if bag["c:dedup.expired_keys"].(int64) == 0 {
+				t.Errorf("no expired keys")
+			}
+		})
+	}
+}
+
+func TestDedupMetrics(t *testing.T) {
+	store := newLRUStore(2, 0)
+	for _, key := range []string{"a", "b", "c", "d", "d"} {
+		store.seen(key, time.Now())
+	}
+
+	bag := make(baker.MetricsBag)
+	store.addMetrics(bag)
+
+	if got := bag["g:dedup.keys"]; got != 2.0 {
+		t.Errorf("dedup.keys = %v, want 2", got)
+	}
+	if got := bag["c:dedup.evicted_keys"]; got != int64(2) {
+		t.Errorf("dedup.evicted_keys = %v, want 2", got)
+	}
+	if got := bag["g:dedup.memory_bytes"]; got != float64(2+2*dedupEntryOverhead) {
+		t.Errorf("dedup.memory_bytes = %v, want %d", got, 2+2*dedupEntryOverhead)
+	}
+}
+
+func TestDedupStateFile(t *testing.T) {
+	fieldByName := func(name string) (baker.FieldIndex, bool) { return 0, name == "f1" }
+	newDedup := func(cfg *DedupConfig) (*Dedup, error) {
+		f, err := NewDedup(baker.FilterParams{
+			ComponentParams: baker.ComponentParams{
+				FieldByName:   fieldByName,
+				DecodedConfig: cfg,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return f.(*Dedup), nil
+	}
+	process := func(f *Dedup, keys ...string) (forwarded []string) {
+		for _, key := range keys {
+			l := &baker.LogLine{FieldSeparator: ','}
+			l.Set(0, []byte(key))
+			f.Process(l, func(r baker.Record) { forwarded = append(forwarded, string(r.Get(0))) })
+		}
+		return forwarded
+	}
+
+	tests := []struct {
+		name string
+		cfg  DedupConfig
+	}{
+		{name: "exact", cfg: DedupConfig{}},
+		{name: "exact with ttl", cfg: DedupConfig{TTL: time.Hour}},
+		{name: "exact with max keys", cfg: DedupConfig{MaxKeys: 10}},
+		{name: "bloom", cfg: DedupConfig{Mode: "bloom", BloomCapacity: 100}},
+		{name: "bloom with ttl", cfg: DedupConfig{Mode: "bloom", BloomCapacity: 100, TTL: time.Hour}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.Fields = []string{"f1"}
+			cfg.StateFile = filepath.Join(t.TempDir(), "dedup.state")
+
+			// No state file yet.
+			c1 := cfg
+			f1, err := newDedup(&c1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			process(f1, "a", "b", "a")
+			if err := f1.Close(); err != nil {
+				t.Fatal(err)
+			}
+			// Close is idempotent
+			if err := f1.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			c2 := cfg
+			f2, err := newDedup(&c2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f2.Close()
+
+			got := process(f2, "a", "b", "c", "c")
+			if len(got) != 1 || got[0] != "c" {
+				t.Errorf("forwarded records = %q, want [c]", got)
+			}
+		})
+	}
+}
+
+func TestDedupStateFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	fieldByName := func(name string) (baker.FieldIndex, bool) { return 0, name == "f1" }
+	newDedup := func(cfg *DedupConfig) (baker.Filter, error) {
+		return NewDedup(baker.FilterParams{
+			ComponentParams: baker.ComponentParams{
+				FieldByName:   fieldByName,
+				DecodedConfig: cfg,
+			},
+		})
+	}
+
+	// Mode mismatch.
+	fn := filepath.Join(dir, "exact.state")
+	f, err := newDedup(&DedupConfig{Fields: []string{"f1"}, StateFile: fn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.(*Dedup).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newDedup(&DedupConfig{Fields: []string{"f1"}, StateFile: fn, Mode: "bloom"}); err == nil {
+		t.Errorf("got no error loading an exact state in bloom mode")
+	}
+
+	// Bloom parameters mismatch.
+	fn = filepath.Join(dir, "bloom.state")
+	f, err = newDedup(&DedupConfig{Fields: []string{"f1"}, StateFile: fn, Mode: "bloom", BloomCapacity: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.(*Dedup).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newDedup(&DedupConfig{Fields: []string{"f1"}, StateFile: fn, Mode: "bloom", BloomCapacity: 200}); err == nil {
+		t.Errorf("got no error loading a bloom state with a different capacity")
+	}
+	if _, err := newDedup(&DedupConfig{Fields: []string{"f1"}, StateFile: fn, Mode: "bloom", BloomCapacity: 100, FalsePositiveRate: 0.01}); err == nil {
+		t.Errorf("got no error loading a bloom state with a different false positive rate")
+	}
+	// The TTL can change.
+	f, err = newDedup(&DedupConfig{Fields: []string{"f1"}, StateFile: fn, Mode: "bloom", BloomCapacity: 100, TTL: time.Hour})
+	if err != nil {
+		t.Errorf("got error loading a bloom state with a TTL: %v", err)
+	} else {
+		f.(*Dedup).Close()
+	}
+
+	// Corrupted file.
+	fn = filepath.Join(dir, "corrupted.state")
+	if err := os.WriteFile(fn, []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newDedup(&DedupConfig{Fields: []string{"f1"}, StateFile: fn}); err == nil {
+		t.Errorf("got no error loading a corrupted state")
+	}
+}
+
+func TestDedupStateFileBloomTTLRemoved(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "bloom.state")
+	newDedup := func(ttl time.Duration) *Dedup {
+		f, err := NewDedup(baker.FilterParams{
+			ComponentParams: baker.ComponentParams{
+				FieldByName:   func(name string) (baker.FieldIndex, bool) { return 0, name == "f1" },
+				DecodedConfig: &DedupConfig{Fields: []string{"f1"}, StateFile: fn, Mode: "bloom", BloomCapacity: 100, TTL: ttl},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f.(*Dedup)
+	}
+	process := func(f *Dedup, key string) bool {
+		forwarded := false
+		l := &baker.LogLine{FieldSeparator: ','}
+		l.Set(0, []byte(key))
+		f.Process(l, func(baker.Record) { forwarded = true })
+		return forwarded
+	}
+
+	f1 := newDedup(time.Hour)
+	process(f1, "a")
+	// Make the next record rotate the filters, "a" is then in the previous one.
+	store := f1.store.(*bloomStore)
+	store.mu.Lock()
+	store.rotated = store.rotated.Add(-90 * time.Minute)
+	store.mu.Unlock()
+	process(f1, "b")
+	if err := f1.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without TTL, the previous filter is dropped.
+	f2 := newDedup(0)
+	defer f2.Close()
+	if f2.store.(*bloomStore).prev != nil {
+		t.Errorf("previous Bloom filter restored without TTL")
+	}
+	if !process(f2, "a") {
+		t.Errorf("key of the previous filter not forgotten")
+	}
+	if process(f2, "b") {
+		t.Errorf("key of the current filter forgotten")
+	}
+}
+
+func TestDedupSnapshotEvery(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "dedup.state")
+	f, err := NewDedup(baker.FilterParams{
+		ComponentParams: baker.ComponentParams{
+			FieldByName:   func(name string) (baker.FieldIndex, bool) { return 0, true },
+			DecodedConfig: &DedupConfig{Fields: []string{"f1"}, StateFile: fn, SnapshotEvery: 10 * time.Millisecond},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.(*Dedup).Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(fn); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("state file hasn't been saved periodically")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,240 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/jmespath/go-jmespath"
+
+	"github.com/AdRoll/baker"
+)
+
+const explodeHelp = `
+This filter turns a record with a list in ` + "`Source`" + ` into one record per element of the list. Each
+record is a copy of the original one, with the element written into ` + "`Target`" + ` (which can be
+` + "`Source`" + ` itself) and, if ` + "`IndexField`" + ` is set, the 0-based index of the element written into
+` + "`IndexField`" + `.
+
+By default, the list is split with ` + "`Separator`" + `. If ` + "`JMESPath`" + ` is set, ` + "`Source`" + ` is
+instead parsed as JSON, and the expression must select an array. Strings are written as is, numbers as
+they appear in the JSON, booleans as "true" or "false", and other values (objects, arrays) as JSON.
+
+At most ` + "`MaxElements`" + ` records are created from a record, the extra elements are discarded and
+counted in the explode.truncated metric.
+
+Records without elements (because ` + "`Source`" + ` is empty, or isn't a JSON array) are forwarded with
+` + "`Target`" + ` (and ` + "`IndexField`" + `) cleared, unless ` + "`DropEmpty`" + ` is set. The number of records
+whose JSON can't be parsed is exported as the explode.errors metric.
+
+### Example
+
+With this configuration, a record with "a;b;c" in the segments field becomes 3 records, with
+"a", "b" and "c" in the segment field, and "0", "1" and "2" in the segment_index field:
+
+` + "```toml" + `
+[[filter]]
+name = "Explode"
+    [filter.config]
+    Source = "segments"
+    Target = "segment"
+    IndexField = "segment_index"
+` + "```" + `
+`
+
+// ExplodeDesc describes the Explode filter
+var ExplodeDesc = baker.FilterDesc{
+	Name:   "Explode",
+	New:    NewExplode,
+	Config: &ExplodeConfig{},
+	Help:   explodeHelp,
+}
+
+// ExplodeConfig holds config parameters of the Explode filter.
+type ExplodeConfig struct {
+	Source      string `help:"Name of the field containing the list" required:"true"`
+	Target      string `help:"Name of the field each element is written into" required:"true"`
+	IndexField  string `help:"Name of the field the index of each element is written into, if set"`
+	Separator   string `help:"Separator of the list elements, unused if JMESPath is set" default:";"`
+	JMESPath    string `help:"JMESPath expression selecting a JSON array in Source"`
+	MaxElements int    `help:"Maximum number of records created from a record. A negative value disables the limit" default:"1000"`
+	SkipEmpty   bool   `help:"Skip empty elements" default:"false"`
+	DropEmpty   bool   `help:"Discard records without elements, instead of forwarding them" default:"false"`
+}
+
+func (cfg *ExplodeConfig) fillDefaults() {
+	if cfg.Separator == "" {
+		cfg.Separator = ";"
+	}
+	if cfg.MaxElements == 0 {
+		cfg.MaxElements = 1000
+	}
+}
+
+// Explode is a baker filter that creates a record per element of a list.
+type Explode struct {
+	cfg *ExplodeConfig
+
+	src, dst baker.FieldIndex
+	index    baker.FieldIndex
+	hasIndex bool
+	sep      []byte
+	jexp     *jmespath.JMESPath
+
+	numFilteredLines int64
+	truncated        int64
+	errors           int64
+}
+
+// NewExplode returns an Explode filter.
+func NewExplode(cfg baker.FilterParams) (baker.Filter, error) {
+	dcfg := cfg.DecodedConfig.(*ExplodeConfig)
+	dcfg.fillDefaults()
+
+	f := &Explode{cfg: dcfg, sep: []byte(dcfg.Separator)}
+
+	var ok bool
+	if f.src, ok = cfg.FieldByName(dcfg.Source); !ok {
+		return nil, fmt.Errorf("unknown field %q", dcfg.Source)
+	}
+	if f.dst, ok = cfg.FieldByName(dcfg.Target); !ok {
+		return nil, fmt.Errorf("unknown field %q", dcfg.Target)
+	}
+	if dcfg.IndexField != "" {
+		if f.index, ok = cfg.FieldByName(dcfg.IndexField); !ok {
+			return nil, fmt.Errorf("unknown field %q", dcfg.IndexField)
+		}
+		if f.index == f.dst {
+			return nil, errors.New("IndexField and Target must be different fields")
+		}
+		f.hasIndex = true
+	}
+
+	if dcfg.JMESPath != "" {
+		jexp, err := jmespath.Compile(dcfg.JMESPath)
+		if err != nil {
+			return nil, fmt.Errorf("malformed JMESPath expression %q: %v", dcfg.JMESPath, err)
+		}
+		f.jexp = jexp
+	}
+
+	return f, nil
+}
+
+// Stats implements baker.Filter.
+func (f *Explode) Stats() baker.FilterStats {
+	bag := make(baker.MetricsBag)
+	bag.AddRawCounter("explode.truncated", atomic.LoadInt64(&f.truncated))
+	bag.AddRawCounter("explode.errors", atomic.LoadInt64(&f.errors))
+
+	return baker.FilterStats{
+		NumFilteredLines: atomic.LoadInt64(&f.numFilteredLines),
+		Metrics:          bag,
+	}
+}
+
+// Process implements baker.Filter.
+func (f *Explode) Process(l baker.Record, next func(baker.Record)) {
+	var elems [][]byte
+	if f.jexp != nil {
+		elems = f.jsonElements(l.Get(f.src))
+	} else {
+		elems = f.splitElements(l.Get(f.src))
+	}
+
+	if f.cfg.SkipEmpty {
+		n := 0
+		for _, e := range elems {
+			if len(e) != 0 {
+				elems[n] = e
+				n++
+			}
+		}
+		elems = elems[:n]
+	}
+
+	if max := f.cfg.MaxElements; max > 0 && len(elems) > max {
+		atomic.AddInt64(&f.truncated, int64(len(elems)-max))
+		elems = elems[:max]
+	}
+
+	if len(elems) == 0 {
+		if f.cfg.DropEmpty {
+			atomic.AddInt64(&f.numFilteredLines, 1)
+			return
+		}
+		l.Set(f.dst, nil)
+		if f.hasIndex {
+			l.Set(f.index, nil)
+		}
+		next(l)
+		return
+	}
+
+	for i, e := range elems {
+		cpy := l.Copy()
+		cpy.Set(f.dst, e)
+		if f.hasIndex {
+			cpy.Set(f.index, []byte(strconv.Itoa(i)))
+		}
+		next(cpy)
+	}
+}
+
+// splitElements returns copies of the elements of the list in v.
+func (f *Explode) splitElements(v []byte) [][]byte {
+	if len(v) == 0 {
+		return nil
+	}
+	elems := bytes.Split(v, f.sep)
+	for i, e := range elems {
+		elems[i] = append([]byte(nil), e...)
+	}
+	return elems
+}
+
+// jsonElements returns the elements of the JSON array selected in v.
+func (f *Explode) jsonElements(v []byte) [][]byte {
+	if len(v) == 0 {
+		return nil
+	}
+
+	d := json.NewDecoder(bytes.NewReader(v))
+	d.UseNumber() // leave numbers as strings
+	var data interface{}
+	if err := d.Decode(&data); err != nil {
+		atomic.AddInt64(&f.errors, 1)
+		return nil
+	}
+
+	res, err := f.jexp.Search(data)
+	if err != nil {
+		atomic.AddInt64(&f.errors, 1)
+		return nil
+	}
+	arr, ok := res.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	elems := make([][]byte, 0, len(arr))
+	for _, x := range arr {
+		switch x := x.(type) {
+		case nil:
+			elems = append(elems, nil)
+		case string:
+			elems = append(elems, []byte(x))
+		case json.Number:
+			elems = append(elems, []byte(x))
+		case bool:
+			elems = append(elems, []byte(strconv.FormatBool(x)))
+		default:
+			buf, _ := json.Marshal(x)
+			elems = append(elems, buf)
+		}
+	}
+	return elems
+}
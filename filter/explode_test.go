@@ -0,0 +1,179 @@
+package filter
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestExplode(t *testing.T) {
+	// Records have 4 fields: id, list, element, index, separated by "|".
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		switch name {
+		case "id":
+			return 0, true
+		case "list":
+			return 1, true
+		case "element":
+			return 2, true
+		case "index":
+			return 3, true
+		}
+		return 0, false
+	}
+
+	tests := []struct {
+		name      string
+		cfg       ExplodeConfig
+		record    string
+		want      []string
+		truncated int64
+		errors    int64
+		wantErr   bool
+	}{
+		{
+			name:   "separator",
+			cfg:    ExplodeConfig{Source: "list", Target: "element", IndexField: "index"},
+			record: "1|a;b;c||",
+			want:   []string{"1|a;b;c|a|0", "1|a;b;c|b|1", "1|a;b;c|c|2"},
+		},
+		{
+			name:   "in place, custom separator",
+			cfg:    ExplodeConfig{Source: "list", Target: "list", Separator: "/"},
+			record: "1|a/b||",
+			want:   []string{"1|a||", "1|b||"},
+		},
+		{
+			name:   "empty elements",
+			cfg:    ExplodeConfig{Source: "list", Target: "element"},
+			record: "1|a;;b||",
+			want:   []string{"1|a;;b|a|", "1|a;;b||", "1|a;;b|b|"},
+		},
+		{
+			name:   "skip empty elements",
+			cfg:    ExplodeConfig{Source: "list", Target: "element", IndexField: "index", SkipEmpty: true},
+			record: "1|a;;b||",
+			want:   []string{"1|a;;b|a|0", "1|a;;b|b|1"},
+		},
+		{
+			name:   "no elements",
+			cfg:    ExplodeConfig{Source: "list", Target: "element", IndexField: "index"},
+			record: "1||x|y",
+			want:   []string{"1|||"},
+		},
+		{
+			name:   "drop empty",
+			cfg:    ExplodeConfig{Source: "list", Target: "element", DropEmpty: true},
+			record: "1|||",
+			want:   nil,
+		},
+		{
+			name:      "max elements",
+			cfg:       ExplodeConfig{Source: "list", Target: "element", MaxElements: 2},
+			record:    "1|a;b;c;d||",
+			want:      []string{"1|a;b;c;d|a|", "1|a;b;c;d|b|"},
+			truncated: 2,
+		},
+		{
+			name:   "json",
+			cfg:    ExplodeConfig{Source: "list", Target: "element", IndexField: "index", JMESPath: "items[].id"},
+			record: `1|{"items":[{"id":"x"},{"id":42},{"id":true}]}||`,
+			want: []string{
+				`1|{"items":[{"id":"x"},{"id":42},{"id":true}]}|x|0`,
+				`1|{"items":[{"id":"x"},{"id":42},{"id":true}]}|42|1`,
+				`1|{"items":[{"id":"x"},{"id":42},{"id":true}]}|true|2`,
+			},
+		},
+		{
+			name:   "json objects",
+			cfg:    ExplodeConfig{Source: "list", Target: "element", JMESPath: "@"},
+			record: `1|[{"a":1},[2,3],null]||`,
+			want: []string{
+				`1|[{"a":1},[2,3],null]|{"a":1}|`,
+				`1|[{"a":1},[2,3],null]|[2,3]|`,
+				`1|[{"a":1},[2,3],null]||`,
+			},
+		},
+		{
+			name:   "json not an array",
+			cfg:    ExplodeConfig{Source: "list", Target: "element", JMESPath: "items"},
+			record: `1|{"items":"a"}|x|`,
+			want:   []string{`1|{"items":"a"}||`},
+		},
+		{
+			name:   "json error",
+			cfg:    ExplodeConfig{Source: "list", Target: "element", JMESPath: "items", DropEmpty: true},
+			record: `1|{"items":||`,
+			want:   nil,
+			errors: 1,
+		},
+
+		// errors
+		{
+			name:    "unknown source",
+			cfg:     ExplodeConfig{Source: "foo", Target: "element"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown target",
+			cfg:     ExplodeConfig{Source: "list", Target: "foo"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown index field",
+			cfg:     ExplodeConfig{Source: "list", Target: "element", IndexField: "foo"},
+			wantErr: true,
+		},
+		{
+			name:    "index field is target",
+			cfg:     ExplodeConfig{Source: "list", Target: "element", IndexField: "element"},
+			wantErr: true,
+		},
+		{
+			name:    "malformed JMESPath",
+			cfg:     ExplodeConfig{Source: "list", Target: "element", JMESPath: "items[("},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			f, err := NewExplode(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName:   fieldByName,
+					DecodedConfig: &cfg,
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error = %v, want error = %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			l := &baker.LogLine{FieldSeparator: '|'}
+			if err := l.Parse([]byte(tt.record), nil); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			f.Process(l, func(r baker.Record) {
+				got = append(got, string(r.ToText(nil)))
+			})
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got records %q, want %q", got, tt.want)
+			}
+
+			stats := f.Stats()
+			if v := stats.Metrics["c:explode.truncated"]; v != tt.truncated {
+				t.Errorf("explode.truncated = %v, want %d", v, tt.truncated)
+			}
+			if v := stats.Metrics["c:explode.errors"]; v != tt.errors {
+				t.Errorf("explode.errors = %v, want %d", v, tt.errors)
+			}
+		})
+	}
+}
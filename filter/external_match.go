@@ -5,18 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net/url"
-	"os"
-	"path/filepath"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/arl/zt"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/AdRoll/baker"
@@ -57,33 +49,8 @@ func (cfg *ExternalMatchConfig) fillDefaults() error {
 		cfg.Region = "us-west-2"
 	}
 
-	// Check that Files and DateTimeLayout are coherent.
-	for _, u := range cfg.Files {
-		isFormatted := strings.Contains(u, "%s")
-		if isFormatted != (cfg.DateTimeLayout != "") {
-			if cfg.DateTimeLayout != "" {
-				return errors.New("DateTimeLayout is valid only if all strings in Files contain %s")
-			}
-			return errors.New("strings in Files may only contain %s if DateTimeLayout is set")
-		}
-	}
-
-	// Check that TimeSubtract and DateTimeLayout are coherent.
-	if (cfg.TimeSubtract != 0) && cfg.DateTimeLayout == "" {
-		return errors.New("TimeSubtract is only valid if DateTimeLayout is set")
-	}
-
-	// Validate URLs
-	for _, u := range cfg.evaluateURLs() {
-		parsed, err := url.Parse(u)
-		if err != nil {
-			return err
-		}
-		switch parsed.Scheme {
-		case "s3", "s3n", "file":
-		default:
-			return fmt.Errorf("%s: unsupported scheme %s", u, parsed.Scheme)
-		}
+	if err := checkFileURLs(cfg.Files, cfg.DateTimeLayout, cfg.TimeSubtract, "s3", "s3n", "file"); err != nil {
+		return err
 	}
 
 	if cfg.CSVColumn < 0 {
@@ -95,17 +62,7 @@ func (cfg *ExternalMatchConfig) fillDefaults() error {
 
 // evaluateURLs evaluates urls using the current configuration..
 func (cfg *ExternalMatchConfig) evaluateURLs() []string {
-	var args []interface{}
-	if cfg.DateTimeLayout != "" {
-		now := time.Now().Add(-time.Duration(cfg.TimeSubtract))
-		args = append(args, now.Format(cfg.DateTimeLayout))
-	}
-
-	ret := make([]string, 0, len(cfg.Files))
-	for _, u := range cfg.Files {
-		ret = append(ret, fmt.Sprintf(u, args...))
-	}
-	return ret
+	return evaluateFileURLs(cfg.Files, cfg.DateTimeLayout, cfg.TimeSubtract)
 }
 
 func NewExternalMatch(cfg baker.FilterParams) (baker.Filter, error) {
@@ -173,55 +130,14 @@ func valuesFromCSV(r io.Reader, colIdx int) (map[string]struct{}, error) {
 }
 
 func (f *ExternalMatch) processURL(u string) (map[string]struct{}, error) {
-	parsed, err := url.Parse(u)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing URL: %v", err)
-	}
-
-	var r io.Reader
-
 	log.WithField("url", u).Info("begin parsing file")
-	switch parsed.Scheme {
-	case "s3":
-		sess, err := session.NewSession(&aws.Config{Region: aws.String(f.cfg.Region)})
-		if err != nil {
-			return nil, fmt.Errorf("error creating aws session: %v", err)
-		}
-		resp, err := s3.New(sess).GetObject(&s3.GetObjectInput{
-			Bucket: aws.String(parsed.Host),
-			Key:    aws.String(parsed.Path),
-		})
-		if err != nil {
-			return nil, fmt.Errorf("error downloading file: %v", err)
-		}
-
-		defer resp.Body.Close()
-		r = resp.Body
-
-	case "file":
-		path := filepath.Join(parsed.Host, parsed.Path) // On Windows Host contains the drive letter.
-		f, err := os.Open(path)
-		if err != nil {
-			return nil, fmt.Errorf("error opening file: %v", err)
-		}
-
-		defer f.Close()
-		r = f
-
-	default:
-		// scheme error should be caught during the validation of configuration.
-		panic("unexpected scheme")
-	}
-
-	// Wrap the reader into a zt reader to transparently read gzip,
-	// zstd or non compressed CSV data.
-	zar, err := zt.NewReader(r)
+	r, err := openFileURL(u, f.cfg.Region)
 	if err != nil {
-		return nil, fmt.Errorf("can't read from %s: %s", u, err)
+		return nil, err
 	}
-	defer zar.Close()
+	defer r.Close()
 
-	return valuesFromCSV(zar, f.cfg.CSVColumn)
+	return valuesFromCSV(r, f.cfg.CSVColumn)
 }
 
 func (f *ExternalMatch) updateValues() error {
@@ -1,8 +1,11 @@
 package filter
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdRoll/baker"
@@ -36,6 +39,40 @@ Supported time format are:
 - ` + "`unix`" + ` unix epoch in seconds
 - ` + "`unixms`" + ` unix epoch in milliseconds
 - ` + "`unixns`" + ` unix epoch in nanoseconds
+
+Formats containing a '%' are strftime-style formats, such as "%Y-%m-%d %H:%M:%S". The supported
+directives are %Y, %y, %m, %d, %e, %H, %I, %M, %S, %f (fraction of second, after a '.' or ',';
+6 digits when formatting, any number of digits when parsing), %p, %b, %h, %B, %a, %A, %z, %Z, %F,
+%T, %D, %R and %%. Since strftime formats are converted to Go layouts, their literal text can't
+contain Go layout elements, such as digits, "Jan", "Mon", "PM" or "MST": such formats are rejected.
+
+Instead of a single ` + "`SrcFormat`" + `, ` + "`SrcFormats`" + ` can list several formats: they're tried in order
+and the first one that parses the input is used. Note that unix formats all parse any integer, so at
+most one of them is useful, at the end of the list.
+
+` + "`SrcTimezone`" + ` is the time zone of the input times whose format doesn't include one, and the
+zone unix times are converted to (UTC by default, whatever the zone of the machine). If ` + "`DstTimezone`" + ` is set, times are converted to that zone before being formatted,
+otherwise they're formatted in the zone they have been parsed in. Both are IANA time zone names,
+such as "America/New_York".
+
+With ` + "`Truncate`" + `, times are truncated to the start of their "hour", "day" or "week" (starting on
+Monday), in the destination time zone, which is handy to build partition keys.
+
+The number of records whose time couldn't be parsed is exported as the formattime.errors metric.
+
+### Example
+
+` + "```toml" + `
+[[filter]]
+name = "FormatTime"
+    [filter.config]
+    SrcField = "timestamp"
+    DstField = "day"
+    SrcFormats = ["RFC3339", "%d/%b/%Y:%H:%M:%S %z", "unix"]
+    DstFormat = "%Y-%m-%d"
+    DstTimezone = "America/New_York"
+    Truncate = "day"
+` + "```" + `
 `
 	ansic       = "ANSIC"
 	unixdate    = "UnixDate"
@@ -60,31 +97,54 @@ var FormatTimeDesc = baker.FilterDesc{
 }
 
 type FormatTimeConfig struct {
-	SrcField  string `help:"Field name of the input time" required:"true"`
-	DstField  string `help:"Field name of the output time" required:"true"`
-	SrcFormat string `help:"Format of the input time" required:"false" default:"UnixDate"`
-	DstFormat string `help:"Format of the output time" required:"false" default:"unixms"`
+	SrcField    string   `help:"Field name of the input time" required:"true"`
+	DstField    string   `help:"Field name of the output time" required:"true"`
+	SrcFormat   string   `help:"Format of the input time" required:"false" default:"UnixDate"`
+	SrcFormats  []string `help:"Formats of the input time, tried in order. Can't be used with SrcFormat" required:"false"`
+	DstFormat   string   `help:"Format of the output time" required:"false" default:"unixms"`
+	SrcTimezone string   `help:"Time zone of the input times without zone information, and of unix times" required:"false" default:"UTC"`
+	DstTimezone string   `help:"Time zone of the output time. Defaults to the zone of the input time" required:"false"`
+	Truncate    string   `help:"Truncate the time to the start of its \"hour\", \"day\" or \"week\"" required:"false"`
 }
 
-func (cfg *FormatTimeConfig) fillDefaults() {
-	if cfg.SrcFormat == "" {
+func (cfg *FormatTimeConfig) fillDefaults() error {
+	if cfg.SrcFormat != "" && len(cfg.SrcFormats) != 0 {
+		return errors.New("SrcFormat and SrcFormats can't be both set")
+	}
+	if cfg.SrcFormat == "" && len(cfg.SrcFormats) == 0 {
 		cfg.SrcFormat = unixdate
 	}
+	if cfg.SrcFormat != "" {
+		cfg.SrcFormats = []string{cfg.SrcFormat}
+	}
 	if cfg.DstFormat == "" {
 		cfg.DstFormat = unixms
 	}
+	switch cfg.Truncate {
+	case "", "hour", "day", "week":
+	default:
+		return fmt.Errorf("unsupported Truncate %q", cfg.Truncate)
+	}
+	return nil
 }
 
 type FormatTime struct {
 	src    baker.FieldIndex
 	dst    baker.FieldIndex
-	parse  func(t []byte) (time.Time, error)
+	parse  []func(t []byte) (time.Time, error)
 	format func(t time.Time) []byte
+
+	dstLoc   *time.Location // nil to keep the zone of the parsed time
+	truncate string
+
+	errors int64
 }
 
 func NewFormatTime(cfg baker.FilterParams) (baker.Filter, error) {
 	dcfg := cfg.DecodedConfig.(*FormatTimeConfig)
-	dcfg.fillDefaults()
+	if err := dcfg.fillDefaults(); err != nil {
+		return nil, err
+	}
 
 	f := &FormatTime{}
 
@@ -100,28 +160,91 @@ func NewFormatTime(cfg baker.FilterParams) (baker.Filter, error) {
 	}
 	f.dst = idx
 
-	f.parse = genParseFun(dcfg.SrcFormat)
-	f.format = genFormatFun(dcfg.DstFormat)
+	var srcLoc *time.Location
+	if dcfg.SrcTimezone != "" {
+		loc, err := time.LoadLocation(dcfg.SrcTimezone)
+		if err != nil {
+			return nil, fmt.Errorf("SrcTimezone: %v", err)
+		}
+		srcLoc = loc
+	}
+	if dcfg.DstTimezone != "" {
+		loc, err := time.LoadLocation(dcfg.DstTimezone)
+		if err != nil {
+			return nil, fmt.Errorf("DstTimezone: %v", err)
+		}
+		f.dstLoc = loc
+	}
+	f.truncate = dcfg.Truncate
+
+	for _, format := range dcfg.SrcFormats {
+		parse, err := genParseFun(format, srcLoc)
+		if err != nil {
+			return nil, fmt.Errorf("SrcFormat %q: %v", format, err)
+		}
+		f.parse = append(f.parse, parse)
+	}
+	format, err := genFormatFun(dcfg.DstFormat)
+	if err != nil {
+		return nil, fmt.Errorf("DstFormat %q: %v", dcfg.DstFormat, err)
+	}
+	f.format = format
 
 	return f, nil
 }
 
 func (f *FormatTime) Stats() baker.FilterStats {
-	return baker.FilterStats{}
+	bag := make(baker.MetricsBag)
+	bag.AddRawCounter("formattime.errors", atomic.LoadInt64(&f.errors))
+	return baker.FilterStats{Metrics: bag}
 }
 
 func (f *FormatTime) Process(l baker.Record, next func(baker.Record)) {
-	t, err := f.parse(l.Get(f.src))
+	t, err := f.parseTime(l.Get(f.src))
 	if err != nil {
+		atomic.AddInt64(&f.errors, 1)
 		log.Errorf("can't parse time: %v", err)
 		l.Set(f.dst, nil)
 	} else {
-		l.Set(f.dst, f.format(t))
+		if f.dstLoc != nil {
+			t = t.In(f.dstLoc)
+		}
+		l.Set(f.dst, f.format(truncateTime(t, f.truncate)))
 	}
 
 	next(l)
 }
 
+// parseTime parses b with the first source format that accepts it.
+func (f *FormatTime) parseTime(b []byte) (time.Time, error) {
+	var (
+		t   time.Time
+		err error
+	)
+	for _, parse := range f.parse {
+		if t, err = parse(b); err == nil {
+			return t, nil
+		}
+	}
+	return t, err
+}
+
+// truncateTime truncates t to the start of its hour, day or week (starting on
+// Monday), in the zone of t. An empty unit leaves t unchanged.
+func truncateTime(t time.Time, unit string) time.Time {
+	y, m, d := t.Date()
+	switch unit {
+	case "hour":
+		return time.Date(y, m, d, t.Hour(), 0, 0, 0, t.Location())
+	case "day":
+		return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	case "week":
+		offset := (int(t.Weekday()) + 6) % 7 // days since Monday
+		return time.Date(y, m, d-offset, 0, 0, 0, 0, t.Location())
+	}
+	return t
+}
+
 func formatToLayout(format string) string {
 	switch format {
 	case ansic:
@@ -149,62 +272,159 @@ func formatToLayout(format string) string {
 	}
 }
 
-func genParseFun(format string) func(b []byte) (time.Time, error) {
-	switch format {
-	case unix:
-		return func(b []byte) (time.Time, error) {
-			sec, err := strconv.ParseInt(string(b), 10, 64)
-			if err != nil {
-				return time.Time{}, err
-			}
-			return time.Unix(sec, 0), nil
+// strftimeDirectives maps strftime directives to Go layout elements.
+var strftimeDirectives = map[byte]string{
+	'Y': "2006",
+	'y': "06",
+	'm': "01",
+	'd': "02",
+	'e': "_2",
+	'H': "15",
+	'I': "03",
+	'M': "04",
+	'S': "05",
+	'p': "PM",
+	'b': "Jan",
+	'h': "Jan",
+	'B': "January",
+	'a': "Mon",
+	'A': "Monday",
+	'z': "-0700",
+	'Z': "MST",
+	'F': "2006-01-02",
+	'T': "15:04:05",
+	'D': "01/02/06",
+	'R': "15:04",
+	'%': "%",
+}
+
+// strftimeRefTime is used to check that the literal text of strftime
+// formats isn't interpreted as Go layout elements: every element formats
+// this time differently from its own text.
+var strftimeRefTime = time.Date(2009, time.November, 17, 20, 34, 58, 651387237, time.FixedZone("XYZ", 5*3600+1800))
+
+// strftimeToLayout converts a strftime-style format to a Go time layout, for
+// parsing or formatting times. Since Go layouts can't escape literal text,
+// formats whose literal text contains Go layout elements (such as digits,
+// "Jan", "Mon", "PM" or "MST") are rejected.
+func strftimeToLayout(format string, parse bool) (string, error) {
+	var (
+		layout strings.Builder
+		want   strings.Builder // strftimeRefTime formatted with format
+	)
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			layout.WriteByte(c)
+			want.WriteByte(c)
+			continue
 		}
-	case unixms:
-		return func(b []byte) (time.Time, error) {
-			msec, err := strconv.ParseInt(string(b), 10, 64)
-			if err != nil {
-				return time.Time{}, err
+		if i+1 == len(format) {
+			return "", errors.New("trailing '%'")
+		}
+		i++
+		if format[i] == 'f' {
+			// Go only recognizes fractions of second after a '.' or ','.
+			if i < 2 || (format[i-2] != '.' && format[i-2] != ',') {
+				return "", errors.New("%f must follow a '.' or ','")
+			}
+			// When parsing, accept any number of digits.
+			if parse {
+				layout.WriteString("999999")
+			} else {
+				layout.WriteString("000000")
 			}
-			return time.Unix(0, msec*int64(time.Millisecond)), nil
+			want.WriteString(strftimeRefTime.Format(".000000")[1:])
+			continue
 		}
-	case unixns:
-		return func(b []byte) (time.Time, error) {
-			nsec, err := strconv.ParseInt(string(b), 10, 64)
-			if err != nil {
-				return time.Time{}, err
+		elem, ok := strftimeDirectives[format[i]]
+		if !ok {
+			return "", fmt.Errorf("unsupported directive %%%c", format[i])
+		}
+		layout.WriteString(elem)
+		want.WriteString(strftimeRefTime.Format(elem))
+	}
+
+	if !parse {
+		if got := strftimeRefTime.Format(layout.String()); got != want.String() {
+			return "", errors.New("literal text contains Go layout elements (such as digits, Jan, Mon, PM or MST)")
+		}
+	}
+	return layout.String(), nil
+}
+
+// layoutOf returns the Go layout of a named, Go layout or strftime-style
+// format, for parsing or formatting times.
+func layoutOf(format string, parse bool) (string, error) {
+	if strings.IndexByte(format, '%') >= 0 {
+		if parse {
+			// Validate the format, including its literal text.
+			if _, err := strftimeToLayout(format, false); err != nil {
+				return "", err
 			}
-			return time.Unix(0, nsec), nil
 		}
-	default:
-		layout := formatToLayout(format)
+		return strftimeToLayout(format, parse)
+	}
+	return formatToLayout(format), nil
+}
+
+// genParseFun returns a function parsing times in the given format. loc is
+// the zone of times without zone information, and the zone unix times are
+// converted to, nil meaning UTC.
+func genParseFun(format string, loc *time.Location) (func(b []byte) (time.Time, error), error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	epoch := func(unit int64) func(b []byte) (time.Time, error) {
 		return func(b []byte) (time.Time, error) {
-			t, err := time.Parse(layout, string(b))
+			n, err := strconv.ParseInt(string(b), 10, 64)
 			if err != nil {
 				return time.Time{}, err
 			}
-			return t, nil
+			return time.Unix(n/(int64(time.Second)/unit), n%(int64(time.Second)/unit)*unit).In(loc), nil
 		}
 	}
+
+	switch format {
+	case unix:
+		return epoch(int64(time.Second)), nil
+	case unixms:
+		return epoch(int64(time.Millisecond)), nil
+	case unixns:
+		return epoch(1), nil
+	}
+
+	layout, err := layoutOf(format, true)
+	if err != nil {
+		return nil, err
+	}
+	return func(b []byte) (time.Time, error) {
+		return time.ParseInLocation(layout, string(b), loc)
+	}, nil
 }
 
-func genFormatFun(format string) func(t time.Time) []byte {
+func genFormatFun(format string) (func(t time.Time) []byte, error) {
 	switch format {
 	case unix:
 		return func(t time.Time) []byte {
 			return []byte(strconv.FormatInt(t.Unix(), 10))
-		}
+		}, nil
 	case unixms:
 		return func(t time.Time) []byte {
 			return []byte(strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10))
-		}
+		}, nil
 	case unixns:
 		return func(t time.Time) []byte {
 			return []byte(strconv.FormatInt(t.UnixNano(), 10))
-		}
-	default:
-		layout := formatToLayout(format)
-		return func(t time.Time) []byte {
-			return []byte(t.Format(layout))
-		}
+		}, nil
+	}
+
+	layout, err := layoutOf(format, false)
+	if err != nil {
+		return nil, err
 	}
+	return func(t time.Time) []byte {
+		return []byte(t.Format(layout))
+	}, nil
 }
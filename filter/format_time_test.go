@@ -10,7 +10,7 @@ import (
 
 func TestFormatTime(t *testing.T) {
 	timeAsFrom := func(layout string, t time.Time) time.Time {
-		out, _ := time.Parse(layout, t.Format(layout))
+		out, _ := time.ParseInLocation(layout, t.Format(layout), time.UTC)
 		return out
 	}
 
@@ -26,7 +26,7 @@ func TestFormatTime(t *testing.T) {
 		"RFC3339":     time.RFC3339,
 		"RFC3339Nano": time.RFC3339Nano,
 	}
-	refTime := time.Unix(932183424, 0)
+	refTime := time.Unix(932183424, 0).UTC()
 
 	type test struct {
 		name string
@@ -155,6 +155,70 @@ func TestFormatTime(t *testing.T) {
 	}
 }
 
+func TestFormatTimeUnixIgnoresLocalZone(t *testing.T) {
+	// Setting TZ has no effect once the local zone has been loaded, so
+	// time.Local is replaced instead.
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(local *time.Location) { time.Local = local }(time.Local)
+	time.Local = loc
+
+	tests := []struct {
+		cfg  FormatTimeConfig
+		want string
+	}{
+		{
+			cfg:  FormatTimeConfig{SrcFormat: "unix", DstFormat: "unix", Truncate: "day"},
+			want: "1593561600", // 2020-07-01T00:00:00Z
+		},
+		{
+			cfg:  FormatTimeConfig{SrcFormat: "unixms", DstFormat: "%F %T"},
+			want: "2020-07-01 02:00:00",
+		},
+		{
+			cfg:  FormatTimeConfig{SrcFormat: "unixns", DstFormat: "%F %T", SrcTimezone: "Asia/Tokyo"},
+			want: "2020-07-01 11:00:00",
+		},
+	}
+
+	// 2020-07-01T02:00:00Z, in seconds, milliseconds and nanoseconds.
+	records := map[string]string{"unix": "1593568800", "unixms": "1593568800000", "unixns": "1593568800000000000"}
+
+	for _, tt := range tests {
+		t.Run(tt.cfg.SrcFormat+"->"+tt.cfg.DstFormat, func(t *testing.T) {
+			tt.cfg.SrcField, tt.cfg.DstField = "src", "dst"
+			f, err := NewFormatTime(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName: func(name string) (baker.FieldIndex, bool) {
+						switch name {
+						case "src":
+							return 0, true
+						case "dst":
+							return 1, true
+						}
+						return 0, false
+					},
+					DecodedConfig: &tt.cfg,
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			l := &baker.LogLine{FieldSeparator: ','}
+			if err := l.Parse([]byte(records[tt.cfg.SrcFormat]+","), nil); err != nil {
+				t.Fatal(err)
+			}
+			f.Process(l, func(baker.Record) {})
+			if got := string(l.Get(1)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestFormatTimeErrors(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -292,3 +356,218 @@ func TestFormatTimeErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestFormatTimeLayoutsAndZones(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    FormatTimeConfig
+		record string
+
+		want    string
+		errors  int64
+		wantErr bool // error during filter instantiation
+	}{
+		{
+			name:   "strftime formats",
+			cfg:    FormatTimeConfig{SrcFormat: "%d/%b/%Y:%H:%M:%S %z", DstFormat: "%Y-%m-%dT%H:%M:%S.%f %%"},
+			record: "10/Oct/2020:13:55:36 -0700,",
+			want:   "2020-10-10T13:55:36.000000 %",
+		},
+		{
+			name:   "strftime shortcuts",
+			cfg:    FormatTimeConfig{SrcFormat: "%F %T", DstFormat: "%a %e %B %y, %I:%M %p"},
+			record: "2020-10-04 09:05:00,",
+			want:   "Sun  4 October 20, 09:05 AM",
+		},
+		{
+			name:   "strftime literal text",
+			cfg:    FormatTimeConfig{SrcFormat: "at %H:%M on %Y-%m-%d", DstFormat: "v/day %d of %B, year %Y"},
+			record: "at 13:55 on 2024-03-09,",
+			want:   "v/day 09 of March, year 2024",
+		},
+		{
+			name:   "strftime fraction of any length",
+			cfg:    FormatTimeConfig{SrcFormat: "%F %T.%f", DstFormat: "%T,%f"},
+			record: "2024-03-09 13:55:36.123,",
+			want:   "13:55:36,123000",
+		},
+		{
+			name:   "strftime fraction of 9 digits",
+			cfg:    FormatTimeConfig{SrcFormat: "%F %T.%f", DstFormat: "unixns"},
+			record: "2024-03-09 13:55:36.123456789,",
+			want:   "1709992536123456789",
+		},
+		{
+			name:   "source zone",
+			cfg:    FormatTimeConfig{SrcFormat: "%F %T", SrcTimezone: "America/New_York", DstFormat: "RFC3339"},
+			record: "2020-07-01 12:00:00,",
+			want:   "2020-07-01T12:00:00-04:00",
+		},
+		{
+			name:   "source zone ignored when the format has one",
+			cfg:    FormatTimeConfig{SrcFormat: "RFC3339", SrcTimezone: "America/New_York", DstFormat: "unix"},
+			record: "2020-07-01T12:00:00Z,",
+			want:   "1593604800",
+		},
+		{
+			name:   "destination zone",
+			cfg:    FormatTimeConfig{SrcFormat: "unix", DstFormat: "%F %T %Z", DstTimezone: "Europe/Paris"},
+			record: "1593604800,",
+			want:   "2020-07-01 14:00:00 CEST",
+		},
+		{
+			name:   "source and destination zones",
+			cfg:    FormatTimeConfig{SrcFormat: "%F %T", SrcTimezone: "Asia/Tokyo", DstFormat: "%F %T", DstTimezone: "UTC"},
+			record: "2020-07-01 02:00:00,",
+			want:   "2020-06-30 17:00:00",
+		},
+		{
+			name:   "truncate hour",
+			cfg:    FormatTimeConfig{SrcFormat: "RFC3339", DstFormat: "RFC3339", Truncate: "hour"},
+			record: "2020-07-01T12:34:56Z,",
+			want:   "2020-07-01T12:00:00Z",
+		},
+		{
+			name:   "truncate hour, half-hour zone",
+			cfg:    FormatTimeConfig{SrcFormat: "RFC3339", DstFormat: "RFC3339", DstTimezone: "Asia/Kolkata", Truncate: "hour"},
+			record: "2020-07-01T12:34:56Z,",
+			want:   "2020-07-01T18:00:00+05:30",
+		},
+		{
+			name:   "truncate day in destination zone",
+			cfg:    FormatTimeConfig{SrcFormat: "RFC3339", DstFormat: "unix", DstTimezone: "America/New_York", Truncate: "day"},
+			record: "2020-07-01T02:00:00Z,",
+			want:   "1593489600", // 2020-06-30T00:00:00-04:00
+		},
+		{
+			name:   "truncate week",
+			cfg:    FormatTimeConfig{SrcFormat: "%F", DstFormat: "%F", Truncate: "week"},
+			record: "2020-07-05,", // Sunday
+			want:   "2020-06-29",
+		},
+		{
+			name:   "truncate week, monday",
+			cfg:    FormatTimeConfig{SrcFormat: "%F", DstFormat: "%F", Truncate: "week"},
+			record: "2020-06-29,",
+			want:   "2020-06-29",
+		},
+		{
+			name:   "auto-detect, first format",
+			cfg:    FormatTimeConfig{SrcFormats: []string{"RFC3339", "%d/%b/%Y:%H:%M:%S %z", "unixms"}, DstFormat: "unix"},
+			record: "2020-07-01T12:00:00Z,",
+			want:   "1593604800",
+		},
+		{
+			name:   "auto-detect, second format",
+			cfg:    FormatTimeConfig{SrcFormats: []string{"RFC3339", "%d/%b/%Y:%H:%M:%S %z", "unixms"}, DstFormat: "unix"},
+			record: "01/Jul/2020:14:00:00 +0200,",
+			want:   "1593604800",
+		},
+		{
+			name:   "auto-detect, last format",
+			cfg:    FormatTimeConfig{SrcFormats: []string{"RFC3339", "%d/%b/%Y:%H:%M:%S %z", "unixms"}, DstFormat: "unix"},
+			record: "1593604800123,",
+			want:   "1593604800",
+		},
+		{
+			name:   "auto-detect, no format",
+			cfg:    FormatTimeConfig{SrcFormats: []string{"RFC3339", "unixms"}, DstFormat: "unix"},
+			record: "yesterday,not-empty",
+			want:   "",
+			errors: 1,
+		},
+
+		// errors
+		{
+			name:    "SrcFormat and SrcFormats",
+			cfg:     FormatTimeConfig{SrcFormat: "unix", SrcFormats: []string{"unixms"}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown source zone",
+			cfg:     FormatTimeConfig{SrcTimezone: "Mars/Olympus_Mons"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown destination zone",
+			cfg:     FormatTimeConfig{DstTimezone: "Mars/Olympus_Mons"},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported truncate",
+			cfg:     FormatTimeConfig{Truncate: "month"},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported strftime directive",
+			cfg:     FormatTimeConfig{SrcFormat: "%Y-%j"},
+			wantErr: true,
+		},
+		{
+			name:    "trailing percent",
+			cfg:     FormatTimeConfig{DstFormat: "%Y%"},
+			wantErr: true,
+		},
+		{
+			name:    "strftime literal digit",
+			cfg:     FormatTimeConfig{DstFormat: "v1/%Y-%m-%d"},
+			wantErr: true,
+		},
+		{
+			name:    "strftime trailing literal digit",
+			cfg:     FormatTimeConfig{DstFormat: "%Y-%m-%d day 5"},
+			wantErr: true,
+		},
+		{
+			name:    "strftime literal month name",
+			cfg:     FormatTimeConfig{SrcFormat: "Jan %d %Y"},
+			wantErr: true,
+		},
+		{
+			name:    "fraction without separator",
+			cfg:     FormatTimeConfig{DstFormat: "%S%f"},
+			wantErr: true,
+		},
+	}
+
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		switch name {
+		case "f1":
+			return 0, true
+		case "f2":
+			return 1, true
+		}
+		return 0, false
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.SrcField, cfg.DstField = "f1", "f2"
+			f, err := NewFormatTime(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName:   fieldByName,
+					DecodedConfig: &cfg,
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error = %v, want error = %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			l := &baker.LogLine{FieldSeparator: ','}
+			if err := l.Parse([]byte(tt.record), nil); err != nil {
+				t.Fatalf("parse error: %q", err)
+			}
+			f.Process(l, func(baker.Record) {})
+
+			if got := string(l.Get(1)); got != tt.want {
+				t.Errorf("got time %q, want %q", got, tt.want)
+			}
+			if v := f.Stats().Metrics["c:formattime.errors"]; v != tt.errors {
+				t.Errorf("formattime.errors = %v, want %d", v, tt.errors)
+			}
+		})
+	}
+}
@@ -0,0 +1,389 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/AdRoll/baker"
+)
+
+const geoIPHelp = `
+This filter looks up the IP address (v4 or v6) contained in a record field in a local MaxMind
+database (` + "`.mmdb`" + ` file, such as GeoIP2/GeoLite2 City or ASN), and writes geographical
+attributes of that address into other fields.
+
+` + "`Attributes`" + ` maps the destination fields to the attribute written into them, among:
+
+ - "country": ISO 3166-1 country code (e.g. "US").
+ - "country_name": country name.
+ - "subdivision": ISO 3166-2 code of the main subdivision (e.g. "CA" for California).
+ - "subdivision_name": name of the main subdivision.
+ - "city": city name.
+ - "latitude" and "longitude": approximate location.
+ - "asn": autonomous system number (ASN databases only).
+ - "as_org": autonomous system organization (ASN databases only).
+
+Names are written in the language set by ` + "`Language`" + `. Attributes that aren't available
+for an address, for example because the address is invalid or isn't in the database, are
+written as empty strings. Records are always forwarded.
+
+The database file is checked for changes every ` + "`ReloadEvery`" + `, and reloaded if it has
+been modified, so that it can be updated without restarting baker. The database is entirely loaded
+in memory, so that the file can safely be rewritten in place. Lookup results of the most
+frequent addresses are kept in an LRU cache of ` + "`CacheSize`" + ` entries.
+
+Example:
+
+` + "```toml" + `
+[[filter]]
+name = "GeoIP"
+    [filter.config]
+    Database = "/usr/share/GeoIP/GeoLite2-City.mmdb"
+    IPField = "ip"
+    Attributes = { country = "country", region = "subdivision", city = "city" }
+` + "```" + `
+`
+
+// GeoIPDesc describes the GeoIP filter
+var GeoIPDesc = baker.FilterDesc{
+	Name:   "GeoIP",
+	New:    NewGeoIP,
+	Config: &GeoIPConfig{},
+	Help:   geoIPHelp,
+}
+
+// GeoIPConfig holds config parameters of the GeoIP filter.
+type GeoIPConfig struct {
+	Database    string            `help:"Path of the MaxMind database file (.mmdb)" required:"true"`
+	IPField     string            `help:"Name of the field containing the IP address" required:"true"`
+	Attributes  map[string]string `help:"Map of destination field names to the attribute written into them (see above)" required:"true"`
+	Language    string            `help:"Language of the names (country, subdivision and city)" default:"en"`
+	CacheSize   int               `help:"Number of lookup results kept in the LRU cache. A negative value disables the cache" default:"10000"`
+	ReloadEvery time.Duration     `help:"Period at which the database file is checked for changes. A negative value disables reloading" default:"1m"`
+}
+
+func (cfg *GeoIPConfig) fillDefaults() {
+	if cfg.Language == "" {
+		cfg.Language = "en"
+	}
+	if cfg.CacheSize == 0 {
+		cfg.CacheSize = 10000
+	}
+	if cfg.ReloadEvery == 0 {
+		cfg.ReloadEvery = time.Minute
+	}
+}
+
+// geoIPRecord holds the data of a MaxMind City or ASN database record that
+// the GeoIP filter is interested in.
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// geoIPAttributes maps attribute names to functions extracting them from a
+// record.
+var geoIPAttributes = map[string]func(rec *geoIPRecord, lang string) string{
+	"country":      func(rec *geoIPRecord, _ string) string { return rec.Country.ISOCode },
+	"country_name": func(rec *geoIPRecord, lang string) string { return rec.Country.Names[lang] },
+	"subdivision": func(rec *geoIPRecord, _ string) string {
+		if len(rec.Subdivisions) == 0 {
+			return ""
+		}
+		return rec.Subdivisions[0].ISOCode
+	},
+	"subdivision_name": func(rec *geoIPRecord, lang string) string {
+		if len(rec.Subdivisions) == 0 {
+			return ""
+		}
+		return rec.Subdivisions[0].Names[lang]
+	},
+	"city":      func(rec *geoIPRecord, lang string) string { return rec.City.Names[lang] },
+	"latitude":  func(rec *geoIPRecord, _ string) string { return formatCoord(rec.Location.Latitude) },
+	"longitude": func(rec *geoIPRecord, _ string) string { return formatCoord(rec.Location.Longitude) },
+	"asn": func(rec *geoIPRecord, _ string) string {
+		if rec.ASN == 0 {
+			return ""
+		}
+		return strconv.FormatUint(uint64(rec.ASN), 10)
+	},
+	"as_org": func(rec *geoIPRecord, _ string) string { return rec.ASOrg },
+}
+
+func formatCoord(c *float64) string {
+	if c == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*c, 'f', -1, 64)
+}
+
+// GeoIP is a baker filter that adds geographical information about IP
+// addresses to records.
+type GeoIP struct {
+	cfg *GeoIPConfig
+
+	ip         baker.FieldIndex
+	fields     []baker.FieldIndex
+	attributes []func(rec *geoIPRecord, lang string) string // aligned with fields
+
+	mu      sync.RWMutex // protects db, gen, modTime and size
+	db      *maxminddb.Reader
+	gen     uint64 // incremented each time a database is loaded
+	modTime time.Time
+	size    int64
+
+	cacheMu  sync.Mutex // protects cache and cacheGen
+	cache    *lruCache  // values are []string, aligned with fields, or nil if not found
+	cacheGen uint64     // generation of the database the cached values come from
+
+	cacheHits  int64
+	notFound   int64
+	invalidIPs int64
+	reloads    int64
+
+	quit      chan struct{} // used to stop the 'reload' goroutine
+	closeOnce sync.Once
+}
+
+// NewGeoIP returns a GeoIP filter.
+func NewGeoIP(cfg baker.FilterParams) (baker.Filter, error) {
+	dcfg := cfg.DecodedConfig.(*GeoIPConfig)
+	dcfg.fillDefaults()
+
+	f := &GeoIP{cfg: dcfg, quit: make(chan struct{})}
+
+	var ok bool
+	if f.ip, ok = cfg.FieldByName(dcfg.IPField); !ok {
+		return nil, fmt.Errorf("unknown field %q", dcfg.IPField)
+	}
+
+	if len(dcfg.Attributes) == 0 {
+		return nil, fmt.Errorf("no Attributes")
+	}
+	// Sort field names so that the fields are always set in the same order.
+	names := make([]string, 0, len(dcfg.Attributes))
+	for name := range dcfg.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		idx, ok := cfg.FieldByName(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+		attr, ok := geoIPAttributes[dcfg.Attributes[name]]
+		if !ok {
+			return nil, fmt.Errorf("field %q: unknown attribute %q", name, dcfg.Attributes[name])
+		}
+		f.fields = append(f.fields, idx)
+		f.attributes = append(f.attributes, attr)
+	}
+
+	if _, err := f.reload(); err != nil {
+		return nil, err
+	}
+
+	if dcfg.ReloadEvery > 0 {
+		go func() {
+			tick := time.NewTicker(dcfg.ReloadEvery)
+			defer tick.Stop()
+			for {
+				select {
+				case <-f.quit:
+					return
+				case <-tick.C:
+					reloaded, err := f.reload()
+					if err != nil {
+						log.WithError(err).Error("GeoIP: failed reloading database")
+						continue
+					}
+					if reloaded {
+						log.WithField("file", dcfg.Database).Info("GeoIP: database reloaded")
+					}
+				}
+			}
+		}()
+	}
+
+	return f, nil
+}
+
+// reload opens the database file if it has been modified since it has last
+// been opened, and reports whether it did so.
+func (f *GeoIP) reload() (bool, error) {
+	fi, err := os.Stat(f.cfg.Database)
+	if err != nil {
+		return false, fmt.Errorf("can't open database: %v", err)
+	}
+
+	f.mu.RLock()
+	unchanged := f.db != nil && fi.ModTime().Equal(f.modTime) && fi.Size() == f.size
+	f.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	// Read the whole file rather than memory-mapping it with maxminddb.Open,
+	// since a file rewritten in place while it's mapped can crash the
+	// process (SIGBUS) or return garbage.
+	buf, err := os.ReadFile(f.cfg.Database)
+	if err != nil {
+		return false, fmt.Errorf("can't open database: %v", err)
+	}
+	db, err := maxminddb.FromBytes(buf)
+	if err != nil {
+		return false, fmt.Errorf("can't open database: %v", err)
+	}
+
+	f.mu.Lock()
+	old := f.db
+	f.db, f.modTime, f.size = db, fi.ModTime(), fi.Size()
+	f.gen++
+	gen := f.gen
+	f.mu.Unlock()
+
+	if old != nil {
+		// No lookup can be running on the old database since we had the
+		// exclusive lock when we replaced it.
+		old.Close()
+		atomic.AddInt64(&f.reloads, 1)
+	}
+
+	if f.cfg.CacheSize > 0 {
+		f.cacheMu.Lock()
+		f.cache, f.cacheGen = newLRUCache(f.cfg.CacheSize), gen
+		f.cacheMu.Unlock()
+	}
+
+	return true, nil
+}
+
+// Close stops checking the database for changes, and closes it.
+func (f *GeoIP) Close() error {
+	var err error
+	f.closeOnce.Do(func() {
+		close(f.quit)
+		f.mu.Lock()
+		err = f.db.Close()
+		f.mu.Unlock()
+	})
+	return err
+}
+
+// Stats implements baker.Filter.
+func (f *GeoIP) Stats() baker.FilterStats {
+	bag := make(baker.MetricsBag)
+	bag.AddRawCounter("geoip.cache_hits", atomic.LoadInt64(&f.cacheHits))
+	bag.AddRawCounter("geoip.not_found", atomic.LoadInt64(&f.notFound))
+	bag.AddRawCounter("geoip.invalid_ips", atomic.LoadInt64(&f.invalidIPs))
+	bag.AddRawCounter("geoip.reloads", atomic.LoadInt64(&f.reloads))
+
+	return baker.FilterStats{Metrics: bag}
+}
+
+// lookup returns the attribute values of ip, aligned with f.fields, or nil if
+// ip isn't in the database, along with the generation of the database.
+func (f *GeoIP) lookup(ip net.IP) ([]string, uint64) {
+	var rec geoIPRecord
+
+	f.mu.RLock()
+	_, ok, err := f.db.LookupNetwork(ip, &rec)
+	gen := f.gen
+	f.mu.RUnlock()
+
+	if err != nil || !ok {
+		if err != nil {
+			log.WithError(err).WithField("ip", ip).Debug("GeoIP: lookup error")
+		}
+		return nil, gen
+	}
+
+	values := make([]string, len(f.attributes))
+	for i, attr := range f.attributes {
+		values[i] = attr(&rec, f.cfg.Language)
+	}
+	return values, gen
+}
+
+// Process implements baker.Filter.
+func (f *GeoIP) Process(l baker.Record, next func(baker.Record)) {
+	values := f.values(l.Get(f.ip))
+	for i, idx := range f.fields {
+		if values == nil {
+			l.Set(idx, nil)
+		} else {
+			l.Set(idx, []byte(values[i]))
+		}
+	}
+
+	next(l)
+}
+
+// values returns the attribute values, aligned with f.fields, of the IP
+// address in buf, or nil if it's either invalid or not found.
+func (f *GeoIP) values(buf []byte) []string {
+	useCache := f.cfg.CacheSize > 0
+	if useCache {
+		f.cacheMu.Lock()
+		v, ok := f.cache.Get(string(buf))
+		f.cacheMu.Unlock()
+		if ok {
+			atomic.AddInt64(&f.cacheHits, 1)
+			return v.([]string)
+		}
+	}
+
+	var (
+		values []string
+		gen    uint64
+	)
+	if ip := net.ParseIP(string(buf)); ip == nil {
+		atomic.AddInt64(&f.invalidIPs, 1)
+		f.mu.RLock()
+		gen = f.gen
+		f.mu.RUnlock()
+	} else if values, gen = f.lookup(ip); values == nil {
+		atomic.AddInt64(&f.notFound, 1)
+	}
+
+	if useCache {
+		f.cacheAdd(string(buf), values, gen)
+	}
+	return values
+}
+
+// cacheAdd adds the values of ip, looked up in the database of the given
+// generation, to the cache. They're not added if the database has been
+// reloaded in the meantime, since the cache would then keep stale values.
+func (f *GeoIP) cacheAdd(ip string, values []string, gen uint64) {
+	f.cacheMu.Lock()
+	if gen == f.cacheGen {
+		f.cache.Add(ip, values)
+	}
+	f.cacheMu.Unlock()
+}
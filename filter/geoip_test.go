@@ -0,0 +1,395 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/baker"
+)
+
+// writeMMDB writes a minimal MaxMind DB file (IPv6 tree, 24-bit records)
+// containing the given networks, which must not overlap. IPv4 networks are
+// stored in the IPv4-mapped part of the tree, as MaxMind does.
+func writeMMDB(t *testing.T, path string, networks map[string]map[string]interface{}) {
+	t.Helper()
+
+	const (
+		empty = -1
+		leaf  = -2 // leaf records store -(leaf + data offset)
+	)
+	nodes := [][2]int{{empty, empty}}
+
+	var data bytes.Buffer
+	cidrs := make([]string, 0, len(networks))
+	for cidr := range networks {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := ipnet.Mask.Size()
+		ip := ipnet.IP.To16()
+		if ipnet.IP.To4() != nil {
+			ip = make(net.IP, 16)
+			copy(ip[12:], ipnet.IP.To4())
+			ones += 96
+		}
+
+		offset := data.Len()
+		data.Write(mmdbEncode(t, networks[cidr]))
+
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := (ip[i/8] >> (7 - i%8)) & 1
+			if i == ones-1 {
+				nodes[node][bit] = leaf - offset
+				break
+			}
+			if nodes[node][bit] == empty {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	var buf bytes.Buffer
+	nodeCount := len(nodes)
+	for _, n := range nodes {
+		for _, rec := range n {
+			v := rec
+			switch {
+			case rec == empty:
+				v = nodeCount
+			case rec <= leaf:
+				v = nodeCount + 16 + (leaf - rec)
+			}
+			buf.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	}
+	buf.Write(make([]byte, 16))
+	buf.Write(data.Bytes())
+	buf.WriteString("\xab\xcd\xefMaxMind.com")
+	buf.Write(mmdbEncode(t, map[string]interface{}{
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(24),
+		"ip_version":                  uint16(6),
+		"database_type":               "Test",
+		"languages":                   []interface{}{"en"},
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(time.Now().Unix()),
+		"description":                 map[string]interface{}{"en": "test"},
+	}))
+
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mmdbEncode encodes v in the MaxMind DB data section format.
+func mmdbEncode(t *testing.T, v interface{}) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	ctrl := func(typ, size int) {
+		sizeBits, extra := size, []byte(nil)
+		switch {
+		case size >= 285:
+			t.Fatalf("size %d not supported", size)
+		case size >= 29:
+			sizeBits, extra = 29, []byte{byte(size - 29)}
+		}
+		if typ <= 7 {
+			buf.WriteByte(byte(typ<<5 | sizeBits))
+		} else {
+			buf.Write([]byte{byte(sizeBits), byte(typ - 7)})
+		}
+		buf.Write(extra)
+	}
+
+	switch v := v.(type) {
+	case string:
+		ctrl(2, len(v))
+		buf.WriteString(v)
+	case float64:
+		ctrl(3, 8)
+		binary.Write(&buf, binary.BigEndian, math.Float64bits(v))
+	case uint16:
+		ctrl(5, 2)
+		binary.Write(&buf, binary.BigEndian, v)
+	case uint32:
+		ctrl(6, 4)
+		binary.Write(&buf, binary.BigEndian, v)
+	case uint64:
+		ctrl(9, 8)
+		binary.Write(&buf, binary.BigEndian, v)
+	case map[string]interface{}:
+		ctrl(7, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			buf.Write(mmdbEncode(t, k))
+			buf.Write(mmdbEncode(t, v[k]))
+		}
+	case []interface{}:
+		ctrl(11, len(v))
+		for _, e := range v {
+			buf.Write(mmdbEncode(t, e))
+		}
+	default:
+		t.Fatalf("unsupported type %T", v)
+	}
+	return buf.Bytes()
+}
+
+func geoIPTestNetworks(city string) map[string]map[string]interface{} {
+	return map[string]map[string]interface{}{
+		"81.2.69.0/24": {
+			"country": map[string]interface{}{
+				"iso_code": "GB",
+				"names":    map[string]interface{}{"en": "United Kingdom", "fr": "Royaume-Uni"},
+			},
+			"subdivisions": []interface{}{
+				map[string]interface{}{
+					"iso_code": "ENG",
+					"names":    map[string]interface{}{"en": "England"},
+				},
+			},
+			"city":     map[string]interface{}{"names": map[string]interface{}{"en": city}},
+			"location": map[string]interface{}{"latitude": 51.5142, "longitude": -0.0931},
+		},
+		"2001:db8::/32": {
+			"country": map[string]interface{}{
+				"iso_code": "FR",
+				"names":    map[string]interface{}{"en": "France"},
+			},
+			"autonomous_system_number":       uint32(1234),
+			"autonomous_system_organization": "ACME",
+		},
+	}
+}
+
+func TestGeoIP(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "test.mmdb")
+	writeMMDB(t, db, geoIPTestNetworks("London"))
+
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		switch name {
+		case "ip":
+			return 0, true
+		case "a":
+			return 1, true
+		case "b":
+			return 2, true
+		case "c":
+			return 3, true
+		}
+		return 0, false
+	}
+
+	tests := []struct {
+		name       string
+		attributes map[string]string
+		language   string
+		ip         string
+		want       []string // values of a, b and c
+		wantErr    bool
+	}{
+		{
+			name:       "ipv4",
+			attributes: map[string]string{"a": "country", "b": "subdivision", "c": "city"},
+			ip:         "81.2.69.160",
+			want:       []string{"GB", "ENG", "London"},
+		},
+		{
+			name:       "names",
+			attributes: map[string]string{"a": "country_name", "b": "subdivision_name"},
+			language:   "fr",
+			ip:         "81.2.69.160",
+			want:       []string{"Royaume-Uni", "", ""},
+		},
+		{
+			name:       "location",
+			attributes: map[string]string{"a": "latitude", "b": "longitude"},
+			ip:         "81.2.69.1",
+			want:       []string{"51.5142", "-0.0931", ""},
+		},
+		{
+			name:       "ipv6 and asn",
+			attributes: map[string]string{"a": "country", "b": "asn", "c": "as_org"},
+			ip:         "2001:db8::1",
+			want:       []string{"FR", "1234", "ACME"},
+		},
+		{
+			name:       "missing attributes",
+			attributes: map[string]string{"a": "city", "b": "latitude", "c": "subdivision"},
+			ip:         "2001:db8::1",
+			want:       []string{"", "", ""},
+		},
+		{
+			name:       "not found",
+			attributes: map[string]string{"a": "country"},
+			ip:         "1.2.3.4",
+			want:       []string{"", "", ""},
+		},
+		{
+			name:       "invalid ip",
+			attributes: map[string]string{"a": "country"},
+			ip:         "foo",
+			want:       []string{"", "", ""},
+		},
+
+		// errors
+		{
+			name:       "unknown attribute",
+			attributes: map[string]string{"a": "foo"},
+			wantErr:    true,
+		},
+		{
+			name:       "unknown field",
+			attributes: map[string]string{"foo": "country"},
+			wantErr:    true,
+		},
+		{
+			name:    "no attributes",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewGeoIP(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName: fieldByName,
+					DecodedConfig: &GeoIPConfig{
+						Database:   db,
+						IPField:    "ip",
+						Attributes: tt.attributes,
+						Language:   tt.language,
+					},
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error = %v, want error = %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			defer f.(*GeoIP).Close()
+
+			// Process the record twice, the second time is served from the cache.
+			for i := 0; i < 2; i++ {
+				l := &baker.LogLine{FieldSeparator: ','}
+				l.Set(0, []byte(tt.ip))
+				l.Set(1, []byte("old"))
+				f.Process(l, func(baker.Record) {})
+
+				for j, want := range tt.want {
+					idx := baker.FieldIndex(j + 1)
+					if _, ok := tt.attributes[string(rune('a'+j))]; !ok {
+						continue
+					}
+					if got := string(l.Get(idx)); got != want {
+						t.Errorf("field %c = %q, want %q", 'a'+j, got, want)
+					}
+				}
+			}
+
+			if got := f.Stats().Metrics["c:geoip.cache_hits"]; got != int64(1) {
+				t.Errorf("geoip.cache_hits = %v, want 1", got)
+			}
+		})
+	}
+}
+
+func TestGeoIPReload(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "test.mmdb")
+	writeMMDB(t, db, geoIPTestNetworks("London"))
+
+	f, err := NewGeoIP(baker.FilterParams{
+		ComponentParams: baker.ComponentParams{
+			FieldByName: func(name string) (baker.FieldIndex, bool) {
+				return map[string]baker.FieldIndex{"ip": 0, "city": 1}[name], true
+			},
+			DecodedConfig: &GeoIPConfig{
+				Database:    db,
+				IPField:     "ip",
+				Attributes:  map[string]string{"city": "city"},
+				ReloadEvery: -1,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	geoip := f.(*GeoIP)
+	defer geoip.Close()
+
+	city := func() string {
+		l := &baker.LogLine{FieldSeparator: ','}
+		l.Set(0, []byte("81.2.69.160"))
+		f.Process(l, func(baker.Record) {})
+		return string(l.Get(1))
+	}
+
+	if got := city(); got != "London" {
+		t.Fatalf("city = %q, want %q", got, "London")
+	}
+
+	// Unmodified file, nothing to reload.
+	if reloaded, err := geoip.reload(); err != nil || reloaded {
+		t.Fatalf("reload() = %t, %v, want false, nil", reloaded, err)
+	}
+
+	// Look up in the current database, as a concurrent Process would.
+	stale, gen := geoip.lookup(net.ParseIP("81.2.69.160"))
+
+	writeMMDB(t, db, geoIPTestNetworks("Londres"))
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(db, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	if reloaded, err := geoip.reload(); err != nil || !reloaded {
+		t.Fatalf("reload() = %t, %v, want true, nil", reloaded, err)
+	}
+	// Values looked up in the old database must not be cached after the reload.
+	geoip.cacheAdd("81.2.69.160", stale, gen)
+	if got := city(); got != "Londres" {
+		t.Errorf("city = %q, want %q", got, "Londres")
+	}
+	if got := f.Stats().Metrics["c:geoip.reloads"]; got != int64(1) {
+		t.Errorf("geoip.reloads = %v, want 1", got)
+	}
+}
+
+func TestGeoIPMissingDatabase(t *testing.T) {
+	_, err := NewGeoIP(baker.FilterParams{
+		ComponentParams: baker.ComponentParams{
+			FieldByName: func(string) (baker.FieldIndex, bool) { return 0, true },
+			DecodedConfig: &GeoIPConfig{
+				Database:   filepath.Join(t.TempDir(), "missing.mmdb"),
+				IPField:    "ip",
+				Attributes: map[string]string{"country": "country"},
+			},
+		},
+	})
+	if err == nil {
+		t.Fatal("got no error with a missing database")
+	}
+}
@@ -1,12 +1,24 @@
 package filter
 
 import (
+	"bytes"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"os"
 	"sync/atomic"
 
+	"github.com/cespare/xxhash/v2"
+	"github.com/spaolacci/murmur3"
+
 	"github.com/AdRoll/baker"
 	log "github.com/sirupsen/logrus"
 )
@@ -19,64 +31,119 @@ var HashDesc = baker.FilterDesc{
 	Help: `This filter hashes a field using a specified hash function and writes the value 
 to another (or the same) field. In order to have control over the set of characters
 present, the hashed value can optionally be encoded.
-	
-	
+
+Several fields can be hashed together by listing them in SrcFields instead of SrcField.
+By default, each value is prefixed with its length (as an unsigned varint) before the
+values are concatenated and hashed, so that different values, such as ("ab", "c") and
+("a", "bc"), never give the same hash. If Separator is set, the values are instead
+concatenated with Separator between them, which is useful to reproduce hashes computed
+elsewhere, but ambiguous if values can contain Separator.
+
+Plain hash functions of low-entropy values, such as user IDs or email addresses, are
+easily reversed with a dictionary. Use hmac-sha256 with a secret key to prevent that.
+The key is read from the file at KeyFile, or from the environment variable KeyEnv;
+leading and trailing whitespaces are ignored.
+
 Supported hash functions:
  - md5
+ - sha1
  - sha256
+ - sha512
+ - xxhash64 (non-cryptographic, 64-bit, big-endian)
+ - murmur3 (non-cryptographic, 128-bit x64 variant, big-endian)
+ - hmac-sha256 (keyed, requires KeyFile or KeyEnv)
 
 Supported encodings:
 - hex (hexadecimal encoding)
+- base64 (standard base64 encoding, with padding)
+- base64url (URL and file name safe base64 encoding, without padding)
+- base32 (standard base32 encoding, with padding)
+
+The hash can be truncated to its first Truncate bytes, before being encoded.
 `,
 }
 
+// HashConfig holds config parameters of the Hash filter.
 type HashConfig struct {
-	SrcField string `help:"Name of the field to hash" required:"true"`
-	DstField string `help:"Name of the field to write the result to" required:"true"`
-	Function string `help:"Name of the hash function to use" required:"true"`
-	Encoding string `help:"Name of the encoding function to use" required:"false"`
+	SrcField  string   `help:"Name of the field to hash. Either SrcField or SrcFields is required"`
+	SrcFields []string `help:"Names of the fields to hash together. Either SrcField or SrcFields is required"`
+	Separator string   `help:"Separator inserted between the values of SrcFields before hashing. By default values are length-prefixed instead" default:""`
+	DstField  string   `help:"Name of the field to write the result to" required:"true"`
+	Function  string   `help:"Name of the hash function to use" required:"true"`
+	Encoding  string   `help:"Name of the encoding function to use" required:"false"`
+	KeyFile   string   `help:"Path of the file containing the secret key of keyed hash functions"`
+	KeyEnv    string   `help:"Name of the environment variable containing the secret key of keyed hash functions"`
+	Truncate  int      `help:"Number of bytes of the hash to keep, before encoding. 0 keeps the whole hash" default:"0"`
 }
 
 type Hash struct {
 	numFilteredLines int64
 
-	src    baker.FieldIndex
+	src    []baker.FieldIndex
+	sep    []byte
 	dst    baker.FieldIndex
 	hash   func([]byte) ([]byte, error)
+	trunc  int
 	encode func([]byte) ([]byte, error)
 }
 
 func NewHash(cfg baker.FilterParams) (baker.Filter, error) {
 	dcfg := cfg.DecodedConfig.(*HashConfig)
 
-	src, ok := cfg.FieldByName(dcfg.SrcField)
-	if !ok {
-		return nil, fmt.Errorf("can't find the SrcField %s", dcfg.SrcField)
+	srcFields := dcfg.SrcFields
+	switch {
+	case dcfg.SrcField != "" && len(srcFields) != 0:
+		return nil, errors.New("only one of SrcField and SrcFields can be set")
+	case dcfg.SrcField != "":
+		srcFields = []string{dcfg.SrcField}
+	case len(srcFields) == 0:
+		return nil, errors.New("either SrcField or SrcFields is required")
+	}
+
+	h := &Hash{sep: []byte(dcfg.Separator)}
+	for _, name := range srcFields {
+		src, ok := cfg.FieldByName(name)
+		if !ok {
+			return nil, fmt.Errorf("can't find the SrcField %s", name)
+		}
+		h.src = append(h.src, src)
 	}
 
 	dst, ok := cfg.FieldByName(dcfg.DstField)
 	if !ok {
 		return nil, fmt.Errorf("can't find the DstField %s", dcfg.DstField)
 	}
+	h.dst = dst
 
-	h := &Hash{
-		src: src,
-		dst: dst,
-	}
-
-	switch dcfg.Function {
-	case "md5":
-		h.hash = func(b []byte) ([]byte, error) {
-			sum := md5.Sum(b)
-			return sum[:], nil
+	if dcfg.Function == "hmac-sha256" {
+		key, err := readSecretKey(dcfg.KeyFile, dcfg.KeyEnv)
+		if err != nil {
+			return nil, err
 		}
-	case "sha256":
 		h.hash = func(b []byte) ([]byte, error) {
-			sum := sha256.Sum256(b)
-			return sum[:], nil
+			mac := hmac.New(sha256.New, key)
+			mac.Write(b)
+			return mac.Sum(nil), nil
+		}
+	} else {
+		if dcfg.KeyFile != "" || dcfg.KeyEnv != "" {
+			return nil, fmt.Errorf("hash function %s doesn't use a key", dcfg.Function)
+		}
+		h.hash, ok = hashFuncs[dcfg.Function]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash function %s", dcfg.Function)
 		}
-	default:
-		return nil, fmt.Errorf("unsupported hash function %s", dcfg.Function)
+	}
+
+	if dcfg.Truncate < 0 {
+		return nil, fmt.Errorf("Truncate must be positive, got %d", dcfg.Truncate)
+	}
+	if dcfg.Truncate > 0 {
+		sum, _ := h.hash(nil)
+		if dcfg.Truncate > len(sum) {
+			return nil, fmt.Errorf("can't truncate %s hashes to %d bytes, they're %d bytes long", dcfg.Function, dcfg.Truncate, len(sum))
+		}
+		h.trunc = dcfg.Truncate
 	}
 
 	switch dcfg.Encoding {
@@ -86,6 +153,12 @@ func NewHash(cfg baker.FilterParams) (baker.Filter, error) {
 			hex.Encode(dst, b)
 			return dst, nil
 		}
+	case "base64":
+		h.encode = encodeWith(base64.StdEncoding)
+	case "base64url":
+		h.encode = encodeWith(base64.RawURLEncoding)
+	case "base32":
+		h.encode = encodeWith(base32.StdEncoding)
 	case "": // pass through
 		h.encode = func(b []byte) ([]byte, error) { return b, nil }
 	default:
@@ -95,6 +168,79 @@ func NewHash(cfg baker.FilterParams) (baker.Filter, error) {
 	return h, nil
 }
 
+// readSecretKey returns the secret key read from either the file at keyFile
+// or the environment variable keyEnv, without leading and trailing
+// whitespaces. It's shared by all filters using keyed hash functions.
+func readSecretKey(keyFile, keyEnv string) ([]byte, error) {
+	var key []byte
+	switch {
+	case keyFile != "" && keyEnv != "":
+		return nil, errors.New("only one of KeyFile and KeyEnv can be set")
+	case keyFile != "":
+		buf, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read KeyFile: %v", err)
+		}
+		key = buf
+	case keyEnv != "":
+		key = []byte(os.Getenv(keyEnv))
+	default:
+		return nil, errors.New("either KeyFile or KeyEnv is required")
+	}
+
+	key = bytes.TrimSpace(key)
+	if len(key) == 0 {
+		return nil, errors.New("the secret key is empty")
+	}
+	return key, nil
+}
+
+// encodeWith returns an encoding function using enc, which is either a
+// base32 or a base64 encoding.
+func encodeWith(enc interface {
+	EncodedLen(int) int
+	Encode(dst, src []byte)
+}) func([]byte) ([]byte, error) {
+	return func(b []byte) ([]byte, error) {
+		dst := make([]byte, enc.EncodedLen(len(b)))
+		enc.Encode(dst, b)
+		return dst, nil
+	}
+}
+
+// hashFuncs maps the names of the supported hash functions to their
+// implementation. It's shared by all filters hashing field values.
+var hashFuncs = map[string]func([]byte) ([]byte, error){
+	"md5": func(b []byte) ([]byte, error) {
+		sum := md5.Sum(b)
+		return sum[:], nil
+	},
+	"sha1": func(b []byte) ([]byte, error) {
+		sum := sha1.Sum(b)
+		return sum[:], nil
+	},
+	"sha256": func(b []byte) ([]byte, error) {
+		sum := sha256.Sum256(b)
+		return sum[:], nil
+	},
+	"sha512": func(b []byte) ([]byte, error) {
+		sum := sha512.Sum512(b)
+		return sum[:], nil
+	},
+	"xxhash64": func(b []byte) ([]byte, error) {
+		sum := make([]byte, 8)
+		binary.BigEndian.PutUint64(sum, xxhash.Sum64(b))
+		return sum, nil
+	},
+	"murmur3": func(b []byte) ([]byte, error) {
+		h1, h2 := murmur3.Sum128(b)
+		sum := make([]byte, 16)
+		binary.BigEndian.PutUint64(sum, h1)
+		binary.BigEndian.PutUint64(sum[8:], h2)
+		return sum, nil
+	},
+}
+
 func (h *Hash) Stats() baker.FilterStats {
 	return baker.FilterStats{
 		NumFilteredLines: atomic.LoadInt64(&h.numFilteredLines),
@@ -102,12 +248,32 @@ func (h *Hash) Stats() baker.FilterStats {
 }
 
 func (h *Hash) Process(r baker.Record, next func(baker.Record)) {
-	hashed, err := h.hash(r.Get(h.src))
+	var src []byte
+	if len(h.src) == 1 {
+		src = r.Get(h.src[0])
+	} else {
+		var n [binary.MaxVarintLen64]byte
+		for i, idx := range h.src {
+			v := r.Get(idx)
+			switch {
+			case len(h.sep) == 0:
+				src = append(src, n[:binary.PutUvarint(n[:], uint64(len(v)))]...)
+			case i != 0:
+				src = append(src, h.sep...)
+			}
+			src = append(src, v...)
+		}
+	}
+
+	hashed, err := h.hash(src)
 	if err != nil {
 		log.Errorf("can't process record, hashing failed: %v", err)
 		atomic.AddInt64(&h.numFilteredLines, 1)
 		return
 	}
+	if h.trunc != 0 {
+		hashed = hashed[:h.trunc]
+	}
 
 	encoded, err := h.encode(hashed)
 	if err != nil {
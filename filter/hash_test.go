@@ -2,6 +2,8 @@ package filter
 
 import (
 	"bytes"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/AdRoll/baker"
@@ -15,6 +17,11 @@ func TestHash(t *testing.T) {
 		dst     string
 		hash    string
 		encode  string
+		srcs    []string
+		sep     string
+		keyEnv  string
+		keyFile string
+		trunc   int
 		want    []byte
 		wantErr bool
 	}{
@@ -55,6 +62,130 @@ func TestHash(t *testing.T) {
 			want:   []byte{98, 97, 55, 56, 49, 54, 98, 102, 56, 102, 48, 49, 99, 102, 101, 97, 52, 49, 52, 49, 52, 48, 100, 101, 53, 100, 97, 101, 50, 50, 50, 51, 98, 48, 48, 51, 54, 49, 97, 51, 57, 54, 49, 55, 55, 97, 57, 99, 98, 52, 49, 48, 102, 102, 54, 49, 102, 50, 48, 48, 49, 53, 97, 100},
 		},
 
+		{
+			name:   "sha1 + hex",
+			record: "abc,def,ghi",
+			src:    "f1",
+			dst:    "f3",
+			hash:   "sha1",
+			encode: "hex",
+			want:   []byte("a9993e364706816aba3e25717850c26c9cd0d89d"),
+		},
+		{
+			name:   "sha512 + hex",
+			record: "abc,def,ghi",
+			src:    "f1",
+			dst:    "f3",
+			hash:   "sha512",
+			encode: "hex",
+			want:   []byte("ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"),
+		},
+		{
+			name:   "xxhash64 + hex",
+			record: "abc,def,ghi",
+			src:    "f1",
+			dst:    "f3",
+			hash:   "xxhash64",
+			encode: "hex",
+			want:   []byte("44bc2cf5ad770999"),
+		},
+		{
+			name:   "murmur3 + hex",
+			record: "abc,def,ghi",
+			src:    "f1",
+			dst:    "f3",
+			hash:   "murmur3",
+			encode: "hex",
+			want:   []byte("b4963f3f3fad78673ba2744126ca2d52"),
+		},
+		{
+			name:   "md5 + base64",
+			record: "abc,def,ghi",
+			src:    "f1",
+			dst:    "f3",
+			hash:   "md5",
+			encode: "base64",
+			want:   []byte("kAFQmDzST7DWlj99KOF/cg=="),
+		},
+		{
+			name:   "md5 + base64url",
+			record: "abc,def,ghi",
+			src:    "f1",
+			dst:    "f3",
+			hash:   "md5",
+			encode: "base64url",
+			want:   []byte("kAFQmDzST7DWlj99KOF_cg"),
+		},
+		{
+			name:   "md5 + base32",
+			record: "abc,def,ghi",
+			src:    "f1",
+			dst:    "f3",
+			hash:   "md5",
+			encode: "base32",
+			want:   []byte("SAAVBGB42JH3BVUWH56SRYL7OI======"),
+		},
+		{
+			name:   "hmac-sha256 + hex, key from env",
+			record: "abc,def,ghi",
+			src:    "f1",
+			dst:    "f3",
+			hash:   "hmac-sha256",
+			encode: "hex",
+			keyEnv: "BAKER_TEST_HASH_KEY",
+			want:   []byte("9946dad4e00e913fc8be8e5d3f7e110a4a9e832f83fb09c345285d78638d8a0e"),
+		},
+		{
+			name:    "hmac-sha256 + hex, key from file",
+			record:  "abc,def,ghi",
+			src:     "f1",
+			dst:     "f3",
+			hash:    "hmac-sha256",
+			encode:  "hex",
+			keyFile: "secret",
+			want:    []byte("9946dad4e00e913fc8be8e5d3f7e110a4a9e832f83fb09c345285d78638d8a0e"),
+		},
+		{
+			name:   "multiple fields",
+			record: "abc,def,ghi",
+			srcs:   []string{"f1", "f2"},
+			dst:    "f3",
+			hash:   "sha256",
+			encode: "hex",
+			want:   []byte("c9c5749dc0996fb020d8a49b23ce40b293d3014668f06f26e4e14d70f2073baf"),
+		},
+		{
+			// Values are length-prefixed, so that ("ab", "c") and ("a", "bc")
+			// have different hashes.
+			name:   "multiple fields are not ambiguous (1)",
+			record: "ab,c,ghi",
+			srcs:   []string{"f1", "f2"},
+			dst:    "f3",
+			hash:   "sha256",
+			encode: "hex",
+			want:   []byte("c150b536a0d7450f5d040d8dac8f6924ce08e5f015c594e343e9e485463ef3bb"),
+		},
+		{
+			name:   "multiple fields are not ambiguous (2)",
+			record: "a,bc,ghi",
+			srcs:   []string{"f1", "f2"},
+			dst:    "f3",
+			hash:   "sha256",
+			encode: "hex",
+			want:   []byte("ea1cc672b17a5c99d273503a298965ef39b3616dfc46fb44022907c44f4e34fa"),
+		},
+		{
+			name:   "multiple fields with separator + truncate",
+			record: "abc,def,ghi",
+			srcs:   []string{"f1", "f2"},
+			sep:    "|",
+			dst:    "f3",
+			hash:   "sha256",
+			encode: "hex",
+			trunc:  8,
+			want:   []byte("0def6826e591afbb"),
+		},
+
 		// errors
 		{
 			name:    "Function error",
@@ -88,6 +219,74 @@ func TestHash(t *testing.T) {
 			encode:  "hex",
 			wantErr: true,
 		},
+		{
+			name:    "SrcField and SrcFields",
+			src:     "f1",
+			srcs:    []string{"f2"},
+			dst:     "f3",
+			hash:    "md5",
+			wantErr: true,
+		},
+		{
+			name:    "no SrcField",
+			dst:     "f3",
+			hash:    "md5",
+			wantErr: true,
+		},
+		{
+			name:    "SrcFields error",
+			srcs:    []string{"f1", "not-exist"},
+			dst:     "f3",
+			hash:    "md5",
+			wantErr: true,
+		},
+		{
+			name:    "hmac without key",
+			src:     "f1",
+			dst:     "f3",
+			hash:    "hmac-sha256",
+			wantErr: true,
+		},
+		{
+			name:    "hmac with empty key",
+			src:     "f1",
+			dst:     "f3",
+			hash:    "hmac-sha256",
+			keyEnv:  "BAKER_TEST_HASH_KEY_NOT_SET",
+			wantErr: true,
+		},
+		{
+			name:    "hmac with missing KeyFile",
+			src:     "f1",
+			dst:     "f3",
+			hash:    "hmac-sha256",
+			keyFile: "not-exist",
+			wantErr: true,
+		},
+		{
+			name:    "key with unkeyed function",
+			src:     "f1",
+			dst:     "f3",
+			hash:    "md5",
+			keyEnv:  "BAKER_TEST_HASH_KEY",
+			wantErr: true,
+		},
+		{
+			name:    "Truncate too long",
+			src:     "f1",
+			dst:     "f3",
+			hash:    "md5",
+			trunc:   17,
+			wantErr: true,
+		},
+		{
+			name:    "negative Truncate",
+			src:     "f1",
+			dst:     "f3",
+			hash:    "md5",
+			trunc:   -1,
+			wantErr: true,
+		},
 	}
 
 	fieldByName := func(name string) (baker.FieldIndex, bool) {
@@ -102,16 +301,31 @@ func TestHash(t *testing.T) {
 		return 0, false
 	}
 
+	t.Setenv("BAKER_TEST_HASH_KEY", "secret")
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "secret"), []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			keyFile := tt.keyFile
+			if keyFile != "" {
+				keyFile = filepath.Join(dir, keyFile)
+			}
 			f, err := NewHash(baker.FilterParams{
 				ComponentParams: baker.ComponentParams{
 					FieldByName: fieldByName,
 					DecodedConfig: &HashConfig{
-						Function: tt.hash,
-						Encoding: tt.encode,
-						SrcField: tt.src,
-						DstField: tt.dst,
+						Function:  tt.hash,
+						Encoding:  tt.encode,
+						SrcField:  tt.src,
+						SrcFields: tt.srcs,
+						Separator: tt.sep,
+						DstField:  tt.dst,
+						KeyEnv:    tt.keyEnv,
+						KeyFile:   keyFile,
+						Truncate:  tt.trunc,
 					},
 				},
 			})
@@ -0,0 +1,315 @@
+package filter
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/AdRoll/baker"
+)
+
+const lookupHelp = `
+This filter enriches records with values read from a lookup table, that is one or more CSV
+(or TSV) files, possibly compressed (gzip or zstd), and possibly periodically refreshed.
+
+The value of the record field ` + "`KeyField`" + ` is looked up in the ` + "`KeyColumn`" + ` column of
+the table. When a row matches, the columns listed in ` + "`Columns`" + ` are copied into the
+corresponding record fields. For example, with:
+
+` + "```toml" + `
+[[filter]]
+name = "Lookup"
+    [filter.config]
+    Files = ["s3://bucket/path/to/campaigns.csv"]
+    KeyField = "campaign_id"
+    Columns = { advertiser_id = 1, country = 3 }
+    RefreshEvery = "1h"
+` + "```" + `
+
+the ` + "`advertiser_id`" + ` and ` + "`country`" + ` fields of each record are set to the 2nd and 4th
+columns of the row whose first column is equal to the ` + "`campaign_id`" + ` field.
+
+Files are local files (file://), S3 objects (s3://) or HTTP resources (http:// or https://).
+Like with ExternalMatch, file URLs can contain a date, see ` + "`DateTimeLayout`" + `. If several
+rows have the same key, the last one wins. Rows that don't have enough columns are ignored.
+
+` + "`OnMiss`" + ` tells what to do with records whose key isn't found in the table:
+
+ - "keep": forward the record untouched (default).
+ - "clear": clear the fields listed in Columns, and forward the record.
+ - "default": set the fields listed in Columns to their value in ` + "`Defaults`" + ` (or clear them
+   if they have no default value), and forward the record.
+ - "drop": discard the record.
+
+The number of hits and misses, as well as the number of entries in the table, are exported as metrics.
+`
+
+var LookupDesc = baker.FilterDesc{
+	Name:   "Lookup",
+	New:    NewLookup,
+	Config: &LookupConfig{},
+	Help:   lookupHelp,
+}
+
+type LookupConfig struct {
+	Region         string            `help:"AWS region to pass to S3 client (only for files with s3:// prefix)" default:"us-west-2"`
+	Files          []string          `help:"URL(s) of CSV file(s) containing the lookup table (s3[n]://, file:// or http[s]://). If %s is present, it's replaced, at download time, with the result of calling time.Now().Format(DateTimeLayout)." required:"true"`
+	DateTimeLayout string            `help:"Go date time string layout replacing %s in Files, evaluated just before downloading Files. See https://pkg.go.dev/time#Time.Format"`
+	TimeSubtract   time.Duration     `help:"Duration to subtract from time.Now() when evaluating DateTimeLayout. See https://pkg.go.dev/time#ParseDuration"`
+	RefreshEvery   time.Duration     `help:"Period at which Files are refreshed (downloaded again), if not set, Files are never refreshed"`
+	Separator      string            `help:"Character separating the columns in Files, for example \"\\t\" for TSV files" default:","`
+	SkipHeader     bool              `help:"If true, the first row of each file is ignored" default:"false"`
+	KeyColumn      int               `help:"0-based index of the CSV column containing the keys" default:"0"`
+	KeyField       string            `help:"Name of the record field containing the key to look up" required:"true"`
+	Columns        map[string]int    `help:"Map of record field names to the 0-based index of the CSV column copied into them" required:"true"`
+	OnMiss         string            `help:"What to do with records whose key isn't found: \"keep\", \"clear\", \"default\" or \"drop\"" default:"keep"`
+	Defaults       map[string]string `help:"Map of record field names to the value they're set to on miss, when OnMiss is \"default\""`
+}
+
+func (cfg *LookupConfig) fillDefaults() error {
+	if cfg.Region == "" {
+		cfg.Region = "us-west-2"
+	}
+	if cfg.Separator == "" {
+		cfg.Separator = ","
+	}
+	if cfg.OnMiss == "" {
+		cfg.OnMiss = "keep"
+	}
+	cfg.OnMiss = strings.ToLower(cfg.OnMiss)
+
+	if len(cfg.Files) == 0 {
+		return errors.New("no Files")
+	}
+	if err := checkFileURLs(cfg.Files, cfg.DateTimeLayout, cfg.TimeSubtract, "s3", "s3n", "file", "http", "https"); err != nil {
+		return err
+	}
+	if len([]rune(cfg.Separator)) != 1 {
+		return fmt.Errorf("Separator must be a single character, got %q", cfg.Separator)
+	}
+	if cfg.KeyColumn < 0 {
+		return errors.New("negative KeyColumn")
+	}
+	if len(cfg.Columns) == 0 {
+		return errors.New("no Columns")
+	}
+	for field, col := range cfg.Columns {
+		if col < 0 {
+			return fmt.Errorf("negative column for field %q", field)
+		}
+	}
+	switch cfg.OnMiss {
+	case "keep", "clear", "default", "drop":
+	default:
+		return fmt.Errorf("unsupported OnMiss %q", cfg.OnMiss)
+	}
+	for field := range cfg.Defaults {
+		if _, ok := cfg.Columns[field]; !ok {
+			return fmt.Errorf("field %q has a default value but isn't in Columns", field)
+		}
+	}
+
+	return nil
+}
+
+// Lookup is a baker filter that enriches records with values read from a
+// lookup table.
+type Lookup struct {
+	cfg *LookupConfig
+
+	key      baker.FieldIndex
+	fields   []baker.FieldIndex // fields set from the table
+	columns  []int              // columns copied into fields
+	defaults [][]byte           // values set into fields on miss
+	comma    rune
+
+	mu    sync.RWMutex
+	table map[string][]string // values are aligned with fields
+
+	hits             int64
+	misses           int64
+	numFilteredLines int64
+	quit             chan struct{} // used to stop the 'refresh' goroutine
+	closeOnce        sync.Once
+}
+
+// NewLookup returns a Lookup filter.
+func NewLookup(cfg baker.FilterParams) (baker.Filter, error) {
+	dcfg := cfg.DecodedConfig.(*LookupConfig)
+	if err := dcfg.fillDefaults(); err != nil {
+		return nil, fmt.Errorf("Lookup: invalid configuration: %v", err)
+	}
+
+	f := &Lookup{
+		cfg:   dcfg,
+		comma: []rune(dcfg.Separator)[0],
+		quit:  make(chan struct{}),
+	}
+
+	var ok bool
+	if f.key, ok = cfg.FieldByName(dcfg.KeyField); !ok {
+		return nil, fmt.Errorf("Lookup: invalid configuration: no such field %v", dcfg.KeyField)
+	}
+
+	// Sort field names so that the fields are always set in the same order.
+	names := make([]string, 0, len(dcfg.Columns))
+	for name := range dcfg.Columns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		idx, ok := cfg.FieldByName(name)
+		if !ok {
+			return nil, fmt.Errorf("Lookup: invalid configuration: no such field %v", name)
+		}
+		f.fields = append(f.fields, idx)
+		f.columns = append(f.columns, dcfg.Columns[name])
+
+		var def []byte
+		if dcfg.OnMiss == "default" {
+			def = []byte(dcfg.Defaults[name])
+		}
+		f.defaults = append(f.defaults, def)
+	}
+
+	if err := f.updateTable(); err != nil {
+		return nil, fmt.Errorf("Lookup: failed loading table: %v", err)
+	}
+
+	if dcfg.RefreshEvery != 0 {
+		go func() {
+			tick := time.NewTicker(dcfg.RefreshEvery)
+			defer tick.Stop()
+			for {
+				select {
+				case <-f.quit:
+					return
+				case <-tick.C:
+					if err := f.updateTable(); err != nil {
+						log.WithError(err).Error("Lookup: failed reloading table")
+					}
+				}
+			}
+		}()
+	}
+
+	return f, nil
+}
+
+// Close stops refreshing the lookup table.
+func (f *Lookup) Close() error {
+	f.closeOnce.Do(func() { close(f.quit) })
+	return nil
+}
+
+// readTable reads the CSV-formatted reader r and adds its rows to table.
+func (f *Lookup) readTable(r io.Reader, table map[string][]string) error {
+	csvReader := csv.NewReader(r)
+	csvReader.Comma = f.comma
+	// -1 to not raise an error if rows do not all have the same number of fields.
+	csvReader.FieldsPerRecord = -1
+
+	maxCol := f.cfg.KeyColumn
+	for _, col := range f.columns {
+		if col > maxCol {
+			maxCol = col
+		}
+	}
+
+	for i := 0; ; i++ {
+		row, err := csvReader.Read()
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return err
+		}
+		if i == 0 && f.cfg.SkipHeader {
+			continue
+		}
+		if maxCol >= len(row) {
+			continue // omit row
+		}
+
+		values := make([]string, len(f.columns))
+		for j, col := range f.columns {
+			values[j] = row[col]
+		}
+		table[row[f.cfg.KeyColumn]] = values
+	}
+}
+
+func (f *Lookup) updateTable() error {
+	table := make(map[string][]string)
+
+	for _, rurl := range evaluateFileURLs(f.cfg.Files, f.cfg.DateTimeLayout, f.cfg.TimeSubtract) {
+		log.WithField("url", rurl).Info("begin parsing file")
+		r, err := openFileURL(rurl, f.cfg.Region)
+		if err != nil {
+			return err
+		}
+		err = f.readTable(r, table)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", rurl, err)
+		}
+	}
+	log.WithField("entries", len(table)).Info("Successfully (re)loaded lookup table")
+
+	f.mu.Lock()
+	f.table = table
+	f.mu.Unlock()
+	return nil
+}
+
+// Stats implements baker.Filter.
+func (f *Lookup) Stats() baker.FilterStats {
+	bag := make(baker.MetricsBag)
+	bag.AddRawCounter("lookup.hits", atomic.LoadInt64(&f.hits))
+	bag.AddRawCounter("lookup.misses", atomic.LoadInt64(&f.misses))
+	f.mu.RLock()
+	bag.AddGauge("lookup.entries", float64(len(f.table)))
+	f.mu.RUnlock()
+
+	return baker.FilterStats{
+		NumFilteredLines: atomic.LoadInt64(&f.numFilteredLines),
+		Metrics:          bag,
+	}
+}
+
+// Process implements baker.Filter.
+func (f *Lookup) Process(l baker.Record, next func(baker.Record)) {
+	f.mu.RLock()
+	values, ok := f.table[string(l.Get(f.key))]
+	f.mu.RUnlock()
+
+	if ok {
+		atomic.AddInt64(&f.hits, 1)
+		for i, idx := range f.fields {
+			l.Set(idx, []byte(values[i]))
+		}
+		next(l)
+		return
+	}
+
+	atomic.AddInt64(&f.misses, 1)
+	switch f.cfg.OnMiss {
+	case "drop":
+		atomic.AddInt64(&f.numFilteredLines, 1)
+		return
+	case "clear", "default":
+		for i, idx := range f.fields {
+			l.Set(idx, f.defaults[i])
+		}
+	}
+	next(l)
+}
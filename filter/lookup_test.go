@@ -0,0 +1,295 @@
+package filter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestLookup(t *testing.T) {
+	const csvContent = `
+id,name,country
+1,foo,us
+2,bar,fr
+3,baz
+2,bar,it
+`
+	const tsvContent = "1\tfoo\tus\n2\tbar\tfr\n"
+
+	dir := t.TempDir()
+	csvFile := filepath.Join(dir, "table.csv")
+	if err := os.WriteFile(csvFile, []byte(csvContent), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	tsvFile := filepath.Join(dir, "table.tsv")
+	if err := os.WriteFile(tsvFile, []byte(tsvContent), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		switch name {
+		case "id":
+			return 0, true
+		case "name":
+			return 1, true
+		case "country":
+			return 2, true
+		}
+		return 0, false
+	}
+
+	columns := map[string]int{"name": 1, "country": 2}
+
+	tests := []struct {
+		name    string
+		cfg     *LookupConfig
+		records []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "hits and misses",
+			cfg:     &LookupConfig{Files: []string{pathToURI(csvFile)}, KeyField: "id", Columns: columns},
+			records: []string{"1,,", "2,x,y", "3,,", "4,x,y"},
+			want:    []string{"1,foo,us", "2,bar,it", "3,,", "4,x,y"},
+		},
+		{
+			name:    "only name",
+			cfg:     &LookupConfig{Files: []string{pathToURI(csvFile)}, KeyField: "id", Columns: map[string]int{"name": 1}},
+			records: []string{"1,,", "3,,"},
+			want:    []string{"1,foo,", "3,baz,"},
+		},
+		{
+			name:    "key column",
+			cfg:     &LookupConfig{Files: []string{pathToURI(csvFile)}, KeyField: "name", KeyColumn: 1, Columns: map[string]int{"id": 0}},
+			records: []string{",foo,", ",name,"},
+			want:    []string{"1,foo,", "id,name,"},
+		},
+		{
+			name:    "skip header",
+			cfg:     &LookupConfig{Files: []string{pathToURI(csvFile)}, SkipHeader: true, KeyField: "name", KeyColumn: 1, Columns: map[string]int{"id": 0}},
+			records: []string{",name,"},
+			want:    []string{",name,"},
+		},
+		{
+			name:    "tsv",
+			cfg:     &LookupConfig{Files: []string{pathToURI(tsvFile)}, Separator: "\t", KeyField: "id", Columns: columns},
+			records: []string{"2,,"},
+			want:    []string{"2,bar,fr"},
+		},
+		{
+			name:    "several files",
+			cfg:     &LookupConfig{Files: []string{pathToURI(tsvFile), pathToURI(csvFile)}, KeyField: "id", Columns: columns},
+			records: []string{"1,,", "2,,"},
+			want:    []string{"1,foo,us", "2,bar,it"},
+		},
+		{
+			name:    "on miss clear",
+			cfg:     &LookupConfig{Files: []string{pathToURI(csvFile)}, KeyField: "id", Columns: columns, OnMiss: "clear"},
+			records: []string{"1,,", "4,x,y"},
+			want:    []string{"1,foo,us", "4,,"},
+		},
+		{
+			name:    "on miss default",
+			cfg:     &LookupConfig{Files: []string{pathToURI(csvFile)}, KeyField: "id", Columns: columns, OnMiss: "default", Defaults: map[string]string{"country": "unknown"}},
+			records: []string{"4,x,y"},
+			want:    []string{"4,,unknown"},
+		},
+		{
+			name:    "on miss drop",
+			cfg:     &LookupConfig{Files: []string{pathToURI(csvFile)}, KeyField: "id", Columns: columns, OnMiss: "drop"},
+			records: []string{"1,,", "4,x,y", "2,,"},
+			want:    []string{"1,foo,us", "2,bar,it"},
+		},
+
+		// errors
+		{
+			name:    "unknown key field",
+			cfg:     &LookupConfig{Files: []string{pathToURI(csvFile)}, KeyField: "foo", Columns: columns},
+			wantErr: true,
+		},
+		{
+			name:    "unknown column field",
+			cfg:     &LookupConfig{Files: []string{pathToURI(csvFile)}, KeyField: "id", Columns: map[string]int{"foo": 1}},
+			wantErr: true,
+		},
+		{
+			name:    "no columns",
+			cfg:     &LookupConfig{Files: []string{pathToURI(csvFile)}, KeyField: "id"},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported scheme",
+			cfg:     &LookupConfig{Files: []string{"ftp://foo/bar"}, KeyField: "id", Columns: columns},
+			wantErr: true,
+		},
+		{
+			name:    "missing file",
+			cfg:     &LookupConfig{Files: []string{pathToURI(filepath.Join(dir, "missing.csv"))}, KeyField: "id", Columns: columns},
+			wantErr: true,
+		},
+		{
+			name:    "bad separator",
+			cfg:     &LookupConfig{Files: []string{pathToURI(csvFile)}, Separator: ",,", KeyField: "id", Columns: columns},
+			wantErr: true,
+		},
+		{
+			name:    "unknown on miss",
+			cfg:     &LookupConfig{Files: []string{pathToURI(csvFile)}, KeyField: "id", Columns: columns, OnMiss: "foo"},
+			wantErr: true,
+		},
+		{
+			name:    "default for unknown column",
+			cfg:     &LookupConfig{Files: []string{pathToURI(csvFile)}, KeyField: "id", Columns: columns, OnMiss: "default", Defaults: map[string]string{"id": "0"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewLookup(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName:   fieldByName,
+					DecodedConfig: tt.cfg,
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error = %v, want error = %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			defer f.(*Lookup).Close()
+
+			var got []string
+			for _, rec := range tt.records {
+				l := &baker.LogLine{FieldSeparator: ','}
+				if err := l.Parse([]byte(rec), nil); err != nil {
+					t.Fatal(err)
+				}
+				f.Process(l, func(r baker.Record) { got = append(got, string(r.ToText(nil))) })
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d records %q, want %d %q", len(got), got, len(tt.want), tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("record #%d = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+
+			stats := f.Stats()
+			hits, misses := stats.Metrics["c:lookup.hits"].(int64), stats.Metrics["c:lookup.misses"].(int64)
+			if hits+misses != int64(len(tt.records)) {
+				t.Errorf("hits + misses = %d, want %d", hits+misses, len(tt.records))
+			}
+		})
+	}
+}
+
+func TestLookupHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/table.csv" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("1,foo\n"))
+	}))
+	defer srv.Close()
+
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		switch name {
+		case "id":
+			return 0, true
+		case "name":
+			return 1, true
+		}
+		return 0, false
+	}
+	newLookup := func(url string) (baker.Filter, error) {
+		return NewLookup(baker.FilterParams{
+			ComponentParams: baker.ComponentParams{
+				FieldByName: fieldByName,
+				DecodedConfig: &LookupConfig{
+					Files:    []string{url},
+					KeyField: "id",
+					Columns:  map[string]int{"name": 1},
+				},
+			},
+		})
+	}
+
+	f, err := newLookup(srv.URL + "/table.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := &baker.LogLine{FieldSeparator: ','}
+	l.Set(0, []byte("1"))
+	f.Process(l, func(baker.Record) {})
+	if got := string(l.Get(1)); got != "foo" {
+		t.Errorf("name = %q, want %q", got, "foo")
+	}
+
+	if _, err := newLookup(srv.URL + "/missing.csv"); err == nil {
+		t.Errorf("got no error with a missing file")
+	}
+}
+
+func TestLookupRefresh(t *testing.T) {
+	t.Parallel()
+
+	const refreshEvery = 100 * time.Millisecond
+
+	tmpPath := filepath.Join(t.TempDir(), "table.csv")
+	if err := os.WriteFile(tmpPath, []byte("1,foo"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := NewLookup(baker.FilterParams{
+		ComponentParams: baker.ComponentParams{
+			FieldByName: func(name string) (baker.FieldIndex, bool) {
+				return map[string]baker.FieldIndex{"id": 0, "name": 1}[name], true
+			},
+			DecodedConfig: &LookupConfig{
+				Files:        []string{pathToURI(tmpPath)},
+				KeyField:     "id",
+				Columns:      map[string]int{"name": 1},
+				RefreshEvery: refreshEvery,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.(*Lookup).Close()
+
+	lookup := func() string {
+		l := &baker.LogLine{FieldSeparator: ','}
+		l.Set(0, []byte("1"))
+		f.Process(l, func(baker.Record) {})
+		return string(l.Get(1))
+	}
+
+	if got := lookup(); got != "foo" {
+		t.Fatalf("name = %q, want %q", got, "foo")
+	}
+
+	if err := os.WriteFile(tmpPath, []byte("1,bar"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for lookup() != "bar" {
+		if time.Now().After(deadline) {
+			t.Fatalf("lookup table hasn't been refreshed")
+		}
+		time.Sleep(refreshEvery)
+	}
+}
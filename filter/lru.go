@@ -0,0 +1,78 @@
+package filter
+
+import "container/list"
+
+// lruCache is a fixed-size cache evicting the least recently used entries
+// first. lruCache is not safe for concurrent use.
+type lruCache struct {
+	maxEntries int
+	evictions  int64 // evictions counts the number of evicted entries
+	keyBytes   int64 // keyBytes is the total size of the keys in the cache
+
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+// newLRUCache creates a cache holding at most maxEntries entries. If
+// maxEntries is 0, the cache is unbounded.
+func newLRUCache(maxEntries int) *lruCache {
+	return &lruCache{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// Get looks up the value associated with key, marking it as recently used.
+func (c *lruCache) Get(key string) (value interface{}, ok bool) {
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		return e.Value.(*lruEntry).value, true
+	}
+	return nil, false
+}
+
+// Add adds (or replaces) the value associated with key, evicting the least
+// recently used entry if the cache is full.
+func (c *lruCache) Add(key string, value interface{}) {
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		e.Value.(*lruEntry).value = value
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&lruEntry{key: key, value: value})
+	c.keyBytes += int64(len(key))
+	if c.maxEntries > 0 && c.ll.Len() > c.maxEntries {
+		c.RemoveOldest()
+		c.evictions++
+	}
+}
+
+// Oldest returns the least recently used entry, without marking it as
+// recently used.
+func (c *lruCache) Oldest() (key string, value interface{}, ok bool) {
+	if e := c.ll.Back(); e != nil {
+		entry := e.Value.(*lruEntry)
+		return entry.key, entry.value, true
+	}
+	return "", nil, false
+}
+
+// RemoveOldest removes the least recently used entry, if any.
+func (c *lruCache) RemoveOldest() {
+	if e := c.ll.Back(); e != nil {
+		c.ll.Remove(e)
+		key := e.Value.(*lruEntry).key
+		delete(c.items, key)
+		c.keyBytes -= int64(len(key))
+	}
+}
+
+// Len returns the number of entries in the cache.
+func (c *lruCache) Len() int { return c.ll.Len() }
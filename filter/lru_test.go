@@ -0,0 +1,67 @@
+package filter
+
+import "testing"
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(2)
+
+	c.Add("a", 1)
+	c.Add("b", 2)
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Fatalf(`Get("a") = %v, %t, want 1, true`, v, ok)
+	}
+
+	// "b" is now the least recently used entry.
+	c.Add("c", 3)
+	if _, ok := c.Get("b"); ok {
+		t.Errorf(`Get("b") found an evicted entry`)
+	}
+	if c.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", c.Len())
+	}
+	if c.evictions != 1 {
+		t.Errorf("evictions = %d, want 1", c.evictions)
+	}
+
+	// Replacing a value doesn't evict.
+	c.Add("a", 10)
+	if v, ok := c.Get("a"); !ok || v != 10 {
+		t.Errorf(`Get("a") = %v, %t, want 10, true`, v, ok)
+	}
+	if v, ok := c.Get("c"); !ok || v != 3 {
+		t.Errorf(`Get("c") = %v, %t, want 3, true`, v, ok)
+	}
+
+	if key, v, ok := c.Oldest(); !ok || key != "a" || v != 10 {
+		t.Errorf(`Oldest() = %q, %v, %t, want "a", 10, true`, key, v, ok)
+	}
+	if c.keyBytes != 2 {
+		t.Errorf("keyBytes = %d, want 2", c.keyBytes)
+	}
+
+	c.RemoveOldest()
+	c.RemoveOldest()
+	c.RemoveOldest()
+	if c.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", c.Len())
+	}
+	if c.keyBytes != 0 {
+		t.Errorf("keyBytes = %d, want 0", c.keyBytes)
+	}
+	if _, _, ok := c.Oldest(); ok {
+		t.Errorf("Oldest() found an entry in an empty cache")
+	}
+}
+
+func TestLRUCacheUnbounded(t *testing.T) {
+	c := newLRUCache(0)
+	for i := 0; i < 100; i++ {
+		c.Add(string(rune('a'+i)), i)
+	}
+	if c.Len() != 100 {
+		t.Errorf("Len() = %d, want 100", c.Len())
+	}
+	if c.evictions != 0 {
+		t.Errorf("evictions = %d, want 0", c.evictions)
+	}
+}
@@ -0,0 +1,256 @@
+package filter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/AdRoll/baker"
+)
+
+const normalizeHelp = `
+This filter normalizes the values of ` + "`Fields`" + ` by applying them a list of ` + "`Operations`" + `, in
+order. Each operation is either a name, or a name and an argument separated by a colon, such as
+"truncate:64". The supported operations are:
+
+ - "lower", "upper", "title": convert the value to lower, upper or title case.
+ - "trim": remove leading and trailing white space. With an argument, remove leading and trailing
+   characters contained in the argument instead ("trim:/" for example).
+ - "trim-prefix:PREFIX", "trim-suffix:SUFFIX": remove PREFIX, or SUFFIX, if the value has it.
+ - "collapse-whitespace": replace each sequence of white space by a single space.
+ - "truncate:N": truncate the value to at most N bytes, without cutting a UTF-8 character in the
+   middle.
+ - "valid-utf8": replace each sequence of invalid UTF-8 bytes by the Unicode replacement character
+   (U+FFFD), or by the argument if given ("valid-utf8:?" for example).
+ - "nfc": apply the Unicode normalization form C (canonical composition).
+ - "default:VALUE": set the value to VALUE if it's empty.
+
+Note that case conversions and "nfc" expect valid UTF-8, so "valid-utf8" should come first when
+values can contain invalid UTF-8.
+
+The numbers of values that were truncated, and that contained invalid UTF-8, are exported as the
+normalize.truncated and normalize.invalid_utf8 metrics.
+
+### Example
+
+` + "```toml" + `
+[[filter]]
+name = "Normalize"
+    [filter.config]
+    Fields = ["domain", "city"]
+    Operations = ["valid-utf8", "trim", "collapse-whitespace", "lower", "truncate:64", "default:unknown"]
+` + "```" + `
+`
+
+// NormalizeDesc describes the Normalize filter
+var NormalizeDesc = baker.FilterDesc{
+	Name:   "Normalize",
+	New:    NewNormalize,
+	Config: &NormalizeConfig{},
+	Help:   normalizeHelp,
+}
+
+// NormalizeConfig holds config parameters of the Normalize filter.
+type NormalizeConfig struct {
+	Fields     []string `help:"Names of the fields to normalize" required:"true"`
+	Operations []string `help:"Operations applied to each field, in order (see above)" required:"true"`
+}
+
+func (cfg *NormalizeConfig) fillDefaults() error {
+	if len(cfg.Fields) == 0 {
+		return errors.New("no Fields")
+	}
+	if len(cfg.Operations) == 0 {
+		return errors.New("no Operations")
+	}
+	return nil
+}
+
+// Normalize is a baker filter that normalizes field values.
+type Normalize struct {
+	fields []baker.FieldIndex
+	ops    []func([]byte) []byte
+
+	truncated   int64
+	invalidUTF8 int64
+}
+
+// NewNormalize returns a Normalize filter.
+func NewNormalize(cfg baker.FilterParams) (baker.Filter, error) {
+	dcfg := cfg.DecodedConfig.(*NormalizeConfig)
+	if err := dcfg.fillDefaults(); err != nil {
+		return nil, err
+	}
+
+	f := &Normalize{}
+	for _, name := range dcfg.Fields {
+		idx, ok := cfg.FieldByName(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+		f.fields = append(f.fields, idx)
+	}
+
+	for _, op := range dcfg.Operations {
+		fn, err := f.compileOp(op)
+		if err != nil {
+			return nil, fmt.Errorf("operation %q: %v", op, err)
+		}
+		f.ops = append(f.ops, fn)
+	}
+
+	return f, nil
+}
+
+// compileOp returns the function applying the operation op to a value.
+// Functions may return a slice of their argument, never modify it in place.
+func (f *Normalize) compileOp(op string) (func([]byte) []byte, error) {
+	name, arg, hasArg := strings.Cut(op, ":")
+	name = strings.ToLower(strings.TrimSpace(name))
+
+	noArg := func(fn func([]byte) []byte) (func([]byte) []byte, error) {
+		if hasArg {
+			return nil, errors.New("unexpected argument")
+		}
+		return fn, nil
+	}
+	needArg := func(fn func([]byte) []byte) (func([]byte) []byte, error) {
+		if !hasArg || arg == "" {
+			return nil, errors.New("missing argument")
+		}
+		return fn, nil
+	}
+
+	switch name {
+	case "lower":
+		return noArg(bytes.ToLower)
+	case "upper":
+		return noArg(bytes.ToUpper)
+	case "title":
+		// cases.Caser isn't safe for concurrent use, create one per call.
+		return noArg(func(v []byte) []byte {
+			return cases.Title(language.Und).Bytes(v)
+		})
+	case "trim":
+		if !hasArg {
+			return bytes.TrimSpace, nil
+		}
+		return needArg(func(v []byte) []byte { return bytes.Trim(v, arg) })
+	case "trim-prefix":
+		prefix := []byte(arg)
+		return needArg(func(v []byte) []byte { return bytes.TrimPrefix(v, prefix) })
+	case "trim-suffix":
+		suffix := []byte(arg)
+		return needArg(func(v []byte) []byte { return bytes.TrimSuffix(v, suffix) })
+	case "collapse-whitespace":
+		return noArg(collapseWhitespace)
+	case "truncate":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			return nil, errors.New("argument must be a positive integer")
+		}
+		return func(v []byte) []byte {
+			if len(v) <= n {
+				return v
+			}
+			atomic.AddInt64(&f.truncated, 1)
+			return truncateUTF8(v, n)
+		}, nil
+	case "valid-utf8":
+		repl := []byte(string(utf8.RuneError))
+		if hasArg {
+			repl = []byte(arg)
+		}
+		return func(v []byte) []byte {
+			if utf8.Valid(v) {
+				return v
+			}
+			atomic.AddInt64(&f.invalidUTF8, 1)
+			return bytes.ToValidUTF8(v, repl)
+		}, nil
+	case "nfc":
+		return noArg(func(v []byte) []byte {
+			if norm.NFC.QuickSpan(v) == len(v) {
+				return v
+			}
+			return norm.NFC.Bytes(v)
+		})
+	case "default":
+		def := []byte(arg)
+		return needArg(func(v []byte) []byte {
+			if len(v) == 0 {
+				return def
+			}
+			return v
+		})
+	}
+	return nil, errors.New("unknown operation")
+}
+
+// collapseWhitespace returns v in which each sequence of white space is
+// replaced by a single space.
+func collapseWhitespace(v []byte) []byte {
+	var (
+		buf   []byte
+		space bool
+	)
+	for i := 0; i < len(v); {
+		r, size := utf8.DecodeRune(v[i:])
+		if unicode.IsSpace(r) {
+			if !space {
+				buf = append(buf, ' ')
+			}
+			space = true
+		} else {
+			buf = append(buf, v[i:i+size]...)
+			space = false
+		}
+		i += size
+	}
+	return buf
+}
+
+// truncateUTF8 returns the longest prefix of v of at most n bytes which
+// doesn't end in the middle of a UTF-8 encoded character.
+func truncateUTF8(v []byte, n int) []byte {
+	// Back off at most utf8.UTFMax-1 continuation bytes, in case v isn't
+	// valid UTF-8.
+	for i := n; i > 0 && i > n-utf8.UTFMax; i-- {
+		if utf8.RuneStart(v[i]) {
+			return v[:i]
+		}
+	}
+	return v[:n]
+}
+
+// Stats implements baker.Filter.
+func (f *Normalize) Stats() baker.FilterStats {
+	bag := make(baker.MetricsBag)
+	bag.AddRawCounter("normalize.truncated", atomic.LoadInt64(&f.truncated))
+	bag.AddRawCounter("normalize.invalid_utf8", atomic.LoadInt64(&f.invalidUTF8))
+	return baker.FilterStats{Metrics: bag}
+}
+
+// Process implements baker.Filter.
+func (f *Normalize) Process(l baker.Record, next func(baker.Record)) {
+	for _, idx := range f.fields {
+		orig := l.Get(idx)
+		v := orig
+		for _, op := range f.ops {
+			v = op(v)
+		}
+		if !bytes.Equal(v, orig) {
+			l.Set(idx, append([]byte(nil), v...))
+		}
+	}
+	next(l)
+}
@@ -0,0 +1,200 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestNormalize(t *testing.T) {
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		switch name {
+		case "f0":
+			return 0, true
+		case "f1":
+			return 1, true
+		case "f2":
+			return 2, true
+		}
+		return 0, false
+	}
+
+	tests := []struct {
+		name        string
+		ops         []string
+		fields      []string // defaults to f0
+		record      string
+		want        string
+		truncated   int64
+		invalidUTF8 int64
+		wantErr     bool
+	}{
+		{
+			name:   "lower",
+			ops:    []string{"lower"},
+			record: "WwW.Example.COM||",
+			want:   "www.example.com||",
+		},
+		{
+			name:   "upper, multiple fields",
+			ops:    []string{"upper"},
+			fields: []string{"f0", "f2"},
+			record: "fr|it|de",
+			want:   "FR|it|DE",
+		},
+		{
+			name:   "title",
+			ops:    []string{"title"},
+			record: "new YORK city||",
+			want:   "New York City||",
+		},
+		{
+			name:   "trim",
+			ops:    []string{"trim"},
+			record: " \t a b \n||",
+			want:   "a b||",
+		},
+		{
+			name:   "trim cutset",
+			ops:    []string{"trim:/."},
+			record: "/a/b/.||",
+			want:   "a/b||",
+		},
+		{
+			name:   "trim prefix and suffix",
+			ops:    []string{"trim-prefix:www.", "trim-suffix:.com"},
+			record: "www.example.com||",
+			want:   "example||",
+		},
+		{
+			name:   "collapse whitespace",
+			ops:    []string{"collapse-whitespace"},
+			record: " a  \t b  c ||",
+			want:   " a b c ||",
+		},
+		{
+			name:      "truncate on rune boundary",
+			ops:       []string{"truncate:5"},
+			record:    "abcdé||",
+			want:      "abcd||",
+			truncated: 1,
+		},
+		{
+			name:   "truncate, short enough",
+			ops:    []string{"truncate:6"},
+			record: "abcdé||",
+			want:   "abcdé||",
+		},
+		{
+			name:      "truncate invalid utf8",
+			ops:       []string{"truncate:2"},
+			record:    "a\x80\x80\x80\x80b||",
+			want:      "a\x80||",
+			truncated: 1,
+		},
+		{
+			name:        "valid utf8",
+			ops:         []string{"valid-utf8"},
+			record:      "a\xff\xfeb||",
+			want:        "a�b||",
+			invalidUTF8: 1,
+		},
+		{
+			name:        "valid utf8 custom replacement",
+			ops:         []string{"valid-utf8:?"},
+			record:      "a\xffb||",
+			want:        "a?b||",
+			invalidUTF8: 1,
+		},
+		{
+			name:   "nfc",
+			ops:    []string{"nfc"},
+			record: "cafe\u0301||",
+			want:   "caf\u00e9||",
+		},
+		{
+			name:   "default",
+			ops:    []string{"trim", "default:unknown"},
+			fields: []string{"f0", "f1"},
+			record: "  |x|",
+			want:   "unknown|x|",
+		},
+		{
+			name:      "operations are applied in order",
+			ops:       []string{"truncate:3", "upper"},
+			record:    "abcdef||",
+			want:      "ABC||",
+			truncated: 1,
+		},
+
+		// errors
+		{
+			name:    "no operations",
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			ops:     []string{"lower"},
+			fields:  []string{"foo"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown operation",
+			ops:     []string{"reverse"},
+			wantErr: true,
+		},
+		{
+			name:    "unexpected argument",
+			ops:     []string{"lower:x"},
+			wantErr: true,
+		},
+		{
+			name:    "missing argument",
+			ops:     []string{"default"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid truncate length",
+			ops:     []string{"truncate:-1"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := NormalizeConfig{Fields: tt.fields, Operations: tt.ops}
+			if cfg.Fields == nil {
+				cfg.Fields = []string{"f0"}
+			}
+			f, err := NewNormalize(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName:   fieldByName,
+					DecodedConfig: &cfg,
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error = %v, want error = %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			l := &baker.LogLine{FieldSeparator: '|'}
+			if err := l.Parse([]byte(tt.record), nil); err != nil {
+				t.Fatal(err)
+			}
+			f.Process(l, func(baker.Record) {})
+
+			if got := string(l.ToText(nil)); got != tt.want {
+				t.Errorf("got record %q, want %q", got, tt.want)
+			}
+			stats := f.Stats()
+			if v := stats.Metrics["c:normalize.truncated"]; v != tt.truncated {
+				t.Errorf("normalize.truncated = %v, want %d", v, tt.truncated)
+			}
+			if v := stats.Metrics["c:normalize.invalid_utf8"]; v != tt.invalidUTF8 {
+				t.Errorf("normalize.invalid_utf8 = %v, want %d", v, tt.invalidUTF8)
+			}
+		})
+	}
+}
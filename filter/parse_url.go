@@ -0,0 +1,263 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/publicsuffix"
+
+	"github.com/AdRoll/baker"
+)
+
+const parseURLHelp = `
+This filter parses the URL in ` + "`SrcField`" + ` and writes its components into destination fields, in a
+single pass. Each component is only extracted if the name of its destination field is set:
+
+ - ` + "`Scheme`" + `: the URL scheme, such as "https".
+ - ` + "`Host`" + `: the host name, without port.
+ - ` + "`Domain`" + `: the registrable domain of the host, that is its public suffix plus one label
+   (for example "example.co.uk" for "www.example.co.uk"), according to the public suffix list.
+   Empty if the host is an IP address or a public suffix.
+ - ` + "`Port`" + `: the port, if explicitly present in the URL.
+ - ` + "`Path`" + `: the (unescaped) path.
+ - ` + "`Fragment`" + `: the (unescaped) fragment, without '#'.
+ - ` + "`Segments`" + `: maps field names to 0-based indexes of path segments ("a" is segment 0 of
+   "/a/b/"). Negative indexes count from the last segment (-1). Empty segments are ignored.
+ - ` + "`Params`" + `: maps field names to the name of the query parameter written into them. If a
+   parameter appears more than once, the first value is used.
+
+The parsed URL is kept in the record cache, so that other ParseURL filters parsing the same field
+don't parse it again, as long as the field isn't modified.
+
+When ` + "`SrcField`" + ` can't be parsed as a URL, all the destination fields are cleared and the
+parseurl.errors metric is incremented.
+
+### Example
+
+` + "```toml" + `
+[[filter]]
+name = "ParseURL"
+    [filter.config]
+    SrcField = "referer"
+    Host = "referer_host"
+    Domain = "referer_domain"
+    [filter.config.Segments]
+        section = 0
+        page = -1
+    [filter.config.Params]
+        utm_source = "utm_source"
+        campaign = "utm_campaign"
+` + "```" + `
+`
+
+// ParseURLDesc describes the ParseURL filter
+var ParseURLDesc = baker.FilterDesc{
+	Name:   "ParseURL",
+	New:    NewParseURL,
+	Config: &ParseURLConfig{},
+	Help:   parseURLHelp,
+}
+
+// ParseURLConfig holds config parameters of the ParseURL filter.
+type ParseURLConfig struct {
+	SrcField string            `help:"Name of the field containing the URL" required:"true"`
+	Scheme   string            `help:"Name of the field the scheme is written into"`
+	Host     string            `help:"Name of the field the host name is written into"`
+	Domain   string            `help:"Name of the field the registrable domain is written into"`
+	Port     string            `help:"Name of the field the port is written into"`
+	Path     string            `help:"Name of the field the path is written into"`
+	Fragment string            `help:"Name of the field the fragment is written into"`
+	Segments map[string]int    `help:"Map of field names to the index of the path segment written into them"`
+	Params   map[string]string `help:"Map of field names to the name of the query parameter written into them"`
+}
+
+// ParseURL is a baker filter that extracts the components of a URL.
+type ParseURL struct {
+	src      baker.FieldIndex
+	cacheKey string
+
+	fields []baker.FieldIndex
+	values []func(u *url.URL, segments []string, query url.Values) []byte
+	parts  bool // whether the path segments and the query are needed
+
+	errors int64
+}
+
+// NewParseURL returns a ParseURL filter.
+func NewParseURL(cfg baker.FilterParams) (baker.Filter, error) {
+	dcfg := cfg.DecodedConfig.(*ParseURLConfig)
+
+	src, ok := cfg.FieldByName(dcfg.SrcField)
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q", dcfg.SrcField)
+	}
+	f := &ParseURL{src: src, cacheKey: "parseurl:" + dcfg.SrcField}
+
+	assigned := make(map[string]bool)
+	add := func(name string, value func(u *url.URL, segments []string, query url.Values) []byte) error {
+		if assigned[name] {
+			return fmt.Errorf("field %q is assigned more than once", name)
+		}
+		assigned[name] = true
+
+		idx, ok := cfg.FieldByName(name)
+		if !ok {
+			return fmt.Errorf("unknown field %q", name)
+		}
+		f.fields = append(f.fields, idx)
+		f.values = append(f.values, value)
+		return nil
+	}
+
+	components := []struct {
+		name  string
+		value func(u *url.URL) string
+	}{
+		{dcfg.Scheme, func(u *url.URL) string { return u.Scheme }},
+		{dcfg.Host, (*url.URL).Hostname},
+		{dcfg.Domain, registrableDomain},
+		{dcfg.Port, (*url.URL).Port},
+		{dcfg.Path, func(u *url.URL) string { return u.Path }},
+		{dcfg.Fragment, func(u *url.URL) string { return u.Fragment }},
+	}
+	for _, c := range components {
+		if c.name == "" {
+			continue
+		}
+		value := c.value
+		err := add(c.name, func(u *url.URL, _ []string, _ url.Values) []byte {
+			return []byte(value(u))
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Sort field names so that errors are reproducible.
+	names := make([]string, 0, len(dcfg.Segments))
+	for name := range dcfg.Segments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		n := dcfg.Segments[name]
+		err := add(name, func(_ *url.URL, segments []string, _ url.Values) []byte {
+			i := n
+			if i < 0 {
+				i += len(segments)
+			}
+			if i < 0 || i >= len(segments) {
+				return nil
+			}
+			return []byte(segments[i])
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Segments: %v", err)
+		}
+		f.parts = true
+	}
+	names = names[:0]
+	for name := range dcfg.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		param := dcfg.Params[name]
+		err := add(name, func(_ *url.URL, _ []string, query url.Values) []byte {
+			return []byte(query.Get(param))
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Params: %v", err)
+		}
+		f.parts = true
+	}
+
+	if len(f.fields) == 0 {
+		return nil, errors.New("no destination fields")
+	}
+
+	return f, nil
+}
+
+// registrableDomain returns the registrable domain (eTLD+1) of the host of u,
+// or an empty string if it has none.
+func registrableDomain(u *url.URL) string {
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	// publicsuffix would take the last octets of an IPv4 address as labels.
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return ""
+	}
+	return domain
+}
+
+// parsedURL is the value of a URL stored in the record cache.
+type parsedURL struct {
+	raw string // value of the field when it was parsed
+	url *url.URL
+	err error
+
+	// Only set if needed.
+	segments []string
+	query    url.Values
+}
+
+// parse returns the parsed URL of l, from the record cache if the source
+// field hasn't changed since it was parsed.
+func (f *ParseURL) parse(l baker.Record) *parsedURL {
+	raw := l.Get(f.src)
+
+	cache := l.Cache()
+	if v, ok := cache.Get(f.cacheKey); ok {
+		if p := v.(*parsedURL); p.raw == string(raw) {
+			return p
+		}
+	}
+
+	p := &parsedURL{raw: string(raw)}
+	p.url, p.err = url.Parse(p.raw)
+	cache.Set(f.cacheKey, p)
+	return p
+}
+
+// Stats implements baker.Filter.
+func (f *ParseURL) Stats() baker.FilterStats {
+	bag := make(baker.MetricsBag)
+	bag.AddRawCounter("parseurl.errors", atomic.LoadInt64(&f.errors))
+	return baker.FilterStats{Metrics: bag}
+}
+
+// Process implements baker.Filter.
+func (f *ParseURL) Process(l baker.Record, next func(baker.Record)) {
+	p := f.parse(l)
+	if p.err != nil {
+		atomic.AddInt64(&f.errors, 1)
+		for _, idx := range f.fields {
+			l.Set(idx, nil)
+		}
+		next(l)
+		return
+	}
+
+	if f.parts && p.query == nil {
+		for _, s := range strings.Split(p.url.Path, "/") {
+			if s != "" {
+				p.segments = append(p.segments, s)
+			}
+		}
+		p.query = p.url.Query()
+	}
+
+	for i, idx := range f.fields {
+		l.Set(idx, f.values[i](p.url, p.segments, p.query))
+	}
+	next(l)
+}
@@ -0,0 +1,216 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestParseURL(t *testing.T) {
+	// Records have a URL and 3 destination fields, separated by "|".
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		switch name {
+		case "url":
+			return 0, true
+		case "f1":
+			return 1, true
+		case "f2":
+			return 2, true
+		case "f3":
+			return 3, true
+		}
+		return 0, false
+	}
+
+	const u = "https://www.Example.co.uk:8443/shop/items/42/?utm_source=news&id=a&id=b&q=a%20b#top%20part"
+
+	tests := []struct {
+		name    string
+		cfg     ParseURLConfig
+		record  string
+		want    string
+		errors  int64
+		wantErr bool
+	}{
+		{
+			name:   "scheme, host and port",
+			cfg:    ParseURLConfig{Scheme: "f1", Host: "f2", Port: "f3"},
+			record: u + "|||",
+			want:   u + "|https|www.Example.co.uk|8443",
+		},
+		{
+			name:   "domain, path and fragment",
+			cfg:    ParseURLConfig{Domain: "f1", Path: "f2", Fragment: "f3"},
+			record: u + "|||",
+			want:   u + "|example.co.uk|/shop/items/42/|top part",
+		},
+		{
+			name:   "segments",
+			cfg:    ParseURLConfig{Segments: map[string]int{"f1": 0, "f2": -1, "f3": 5}},
+			record: u + "||x|x",
+			want:   u + "|shop|42|",
+		},
+		{
+			name:   "params",
+			cfg:    ParseURLConfig{Params: map[string]string{"f1": "utm_source", "f2": "id", "f3": "q"}},
+			record: u + "|||",
+			want:   u + "|news|a|a b",
+		},
+		{
+			name:   "missing param",
+			cfg:    ParseURLConfig{Params: map[string]string{"f1": "foo"}},
+			record: u + "|x||",
+			want:   u + "|||",
+		},
+		{
+			name:   "ip address has no domain",
+			cfg:    ParseURLConfig{Host: "f1", Domain: "f2"},
+			record: "http://[::1]:80/|||",
+			want:   "http://[::1]:80/|::1||",
+		},
+		{
+			name:   "ipv4 address has no domain",
+			cfg:    ParseURLConfig{Host: "f1", Domain: "f2"},
+			record: "http://1.2.3.4/x|||",
+			want:   "http://1.2.3.4/x|1.2.3.4||",
+		},
+		{
+			name:   "public suffix has no domain",
+			cfg:    ParseURLConfig{Domain: "f1"},
+			record: "http://co.uk/|x||",
+			want:   "http://co.uk/|||",
+		},
+		{
+			name:   "relative url",
+			cfg:    ParseURLConfig{Host: "f1", Path: "f2", Params: map[string]string{"f3": "a"}},
+			record: "/a/b?a=1|||",
+			want:   "/a/b?a=1||/a/b|1",
+		},
+		{
+			name:   "empty url",
+			cfg:    ParseURLConfig{Host: "f1", Segments: map[string]int{"f2": 0}},
+			record: "|x|y|",
+			want:   "|||",
+		},
+		{
+			name:   "invalid url",
+			cfg:    ParseURLConfig{Host: "f1", Path: "f2"},
+			record: "http://a b.com:x/|x|y|z",
+			want:   "http://a b.com:x/|||z",
+			errors: 1,
+		},
+
+		// errors
+		{
+			name:    "no destination fields",
+			cfg:     ParseURLConfig{},
+			wantErr: true,
+		},
+		{
+			name:    "unknown source",
+			cfg:     ParseURLConfig{SrcField: "foo", Host: "f1"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown destination",
+			cfg:     ParseURLConfig{Host: "foo"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown segment destination",
+			cfg:     ParseURLConfig{Segments: map[string]int{"foo": 0}},
+			wantErr: true,
+		},
+		{
+			name:    "field assigned twice",
+			cfg:     ParseURLConfig{Host: "f1", Params: map[string]string{"f1": "a"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			if cfg.SrcField == "" {
+				cfg.SrcField = "url"
+			}
+			f, err := NewParseURL(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName:   fieldByName,
+					DecodedConfig: &cfg,
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error = %v, want error = %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			l := &baker.LogLine{FieldSeparator: '|'}
+			if err := l.Parse([]byte(tt.record), nil); err != nil {
+				t.Fatal(err)
+			}
+			f.Process(l, func(baker.Record) {})
+
+			if got := string(l.ToText(nil)); got != tt.want {
+				t.Errorf("got record %q, want %q", got, tt.want)
+			}
+			if v := f.Stats().Metrics["c:parseurl.errors"]; v != tt.errors {
+				t.Errorf("parseurl.errors = %v, want %d", v, tt.errors)
+			}
+		})
+	}
+}
+
+func TestParseURLCache(t *testing.T) {
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		switch name {
+		case "url":
+			return 0, true
+		case "host":
+			return 1, true
+		case "path":
+			return 2, true
+		}
+		return 0, false
+	}
+	newFilter := func(cfg *ParseURLConfig) baker.Filter {
+		cfg.SrcField = "url"
+		f, err := NewParseURL(baker.FilterParams{
+			ComponentParams: baker.ComponentParams{
+				FieldByName:   fieldByName,
+				DecodedConfig: cfg,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	host := newFilter(&ParseURLConfig{Host: "host"})
+	path := newFilter(&ParseURLConfig{Path: "path"})
+
+	l := &baker.LogLine{FieldSeparator: '|'}
+	if err := l.Parse([]byte("http://a.com/x||"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	host.Process(l, func(baker.Record) {})
+	v, ok := l.Cache().Get("parseurl:url")
+	if !ok {
+		t.Fatal("parsed url not in the record cache")
+	}
+	path.Process(l, func(baker.Record) {})
+	if v2, _ := l.Cache().Get("parseurl:url"); v2 != v {
+		t.Errorf("url parsed again while the field didn't change")
+	}
+
+	// Modifying the field invalidates the cached url.
+	l.Set(0, []byte("http://b.com/y"))
+	path.Process(l, func(baker.Record) {})
+	if got, want := string(l.ToText(nil)), "http://b.com/y|a.com|/y"; got != want {
+		t.Errorf("got record %q, want %q", got, want)
+	}
+}
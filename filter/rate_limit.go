@@ -0,0 +1,184 @@
+package filter
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/juju/ratelimit"
+
+	"github.com/AdRoll/baker"
+)
+
+const rateLimitHelp = `
+This filter limits the rate of records going through it, using a token bucket.
+
+If ` + "`KeyField`" + ` is set, there's one token bucket per value of that field, so that,
+for example, a single misbehaving advertiser can't flood the pipeline. Otherwise, the
+limit is global. Buckets are kept in an LRU of at most ` + "`MaxKeys`" + ` keys, the least
+recently seen keys being evicted first (and thus have their bucket reset).
+
+Records exceeding the rate are either discarded (` + "`Action=\"drop\"`" + `) or tagged
+(` + "`Action=\"tag\"`" + `), by setting ` + "`TagField`" + ` to ` + "`TagValue`" + `, and forwarded.
+
+The number of throttled records is exported as a metric.
+`
+
+// RateLimitDesc describes the RateLimit filter
+var RateLimitDesc = baker.FilterDesc{
+	Name:   "RateLimit",
+	New:    NewRateLimit,
+	Config: &RateLimitConfig{},
+	Help:   rateLimitHelp,
+}
+
+// RateLimitConfig holds config parameters of the RateLimit filter.
+type RateLimitConfig struct {
+	Rate     float64 `help:"Maximum number of records per second (per key, if KeyField is set)" required:"true"`
+	Burst    int64   `help:"Maximum number of records allowed in a burst, that is the capacity of the token bucket. Defaults to Rate (rounded up)"`
+	KeyField string  `help:"Name of the field used to rate limit records by key. If empty, the limit is global"`
+	MaxKeys  int     `help:"Maximum number of keys for which a token bucket is kept in memory" default:"10000"`
+	Action   string  `help:"Action to perform on throttled records, either \"drop\" or \"tag\"" default:"drop"`
+	TagField string  `help:"Name of the field set on throttled records, when Action is \"tag\""`
+	TagValue string  `help:"Value to set to TagField on throttled records, when Action is \"tag\"" default:"throttled"`
+}
+
+func (cfg *RateLimitConfig) fillDefaults() {
+	if cfg.Burst == 0 {
+		cfg.Burst = int64(math.Ceil(cfg.Rate))
+	}
+	if cfg.MaxKeys == 0 {
+		cfg.MaxKeys = 10000
+	}
+	if cfg.Action == "" {
+		cfg.Action = "drop"
+	}
+	if cfg.TagValue == "" {
+		cfg.TagValue = "throttled"
+	}
+}
+
+// RateLimit is a baker filter that limits the rate of records, globally or by key.
+type RateLimit struct {
+	rate  float64
+	burst int64
+
+	keyed  bool
+	key    baker.FieldIndex
+	global *ratelimit.Bucket
+
+	mu      sync.Mutex // protects buckets
+	buckets *lruCache
+
+	tag      bool
+	tagField baker.FieldIndex
+	tagValue []byte
+
+	throttled        int64
+	numFilteredLines int64
+}
+
+// NewRateLimit returns a RateLimit filter.
+func NewRateLimit(cfg baker.FilterParams) (baker.Filter, error) {
+	dcfg := cfg.DecodedConfig.(*RateLimitConfig)
+	dcfg.fillDefaults()
+
+	if dcfg.Rate <= 0 {
+		return nil, fmt.Errorf("Rate must be positive, got %v", dcfg.Rate)
+	}
+	if dcfg.Burst < 1 {
+		return nil, fmt.Errorf("Burst must be positive, got %v", dcfg.Burst)
+	}
+	if dcfg.MaxKeys < 1 {
+		return nil, fmt.Errorf("MaxKeys must be positive, got %v", dcfg.MaxKeys)
+	}
+
+	f := &RateLimit{
+		rate:  dcfg.Rate,
+		burst: dcfg.Burst,
+	}
+
+	if dcfg.KeyField != "" {
+		idx, ok := cfg.FieldByName(dcfg.KeyField)
+		if !ok {
+			return nil, fmt.Errorf("unknown field %q", dcfg.KeyField)
+		}
+		f.keyed, f.key = true, idx
+		f.buckets = newLRUCache(dcfg.MaxKeys)
+	} else {
+		f.global = f.newBucket()
+	}
+
+	switch strings.ToLower(dcfg.Action) {
+	case "drop":
+	case "tag":
+		if dcfg.TagField == "" {
+			return nil, fmt.Errorf("TagField is required when Action is \"tag\"")
+		}
+		idx, ok := cfg.FieldByName(dcfg.TagField)
+		if !ok {
+			return nil, fmt.Errorf("unknown field %q", dcfg.TagField)
+		}
+		f.tag, f.tagField, f.tagValue = true, idx, []byte(dcfg.TagValue)
+	default:
+		return nil, fmt.Errorf("unsupported action %q", dcfg.Action)
+	}
+
+	return f, nil
+}
+
+func (f *RateLimit) newBucket() *ratelimit.Bucket {
+	return ratelimit.NewBucketWithRate(f.rate, f.burst)
+}
+
+// bucket returns the token bucket for the given record.
+func (f *RateLimit) bucket(l baker.Record) *ratelimit.Bucket {
+	if !f.keyed {
+		return f.global
+	}
+
+	key := string(l.Get(f.key))
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if b, ok := f.buckets.Get(key); ok {
+		return b.(*ratelimit.Bucket)
+	}
+	b := f.newBucket()
+	f.buckets.Add(key, b)
+	return b
+}
+
+// Stats implements baker.Filter.
+func (f *RateLimit) Stats() baker.FilterStats {
+	bag := make(baker.MetricsBag)
+	bag.AddRawCounter("ratelimit.throttled", atomic.LoadInt64(&f.throttled))
+	if f.keyed {
+		f.mu.Lock()
+		bag.AddGauge("ratelimit.keys", float64(f.buckets.Len()))
+		bag.AddRawCounter("ratelimit.evicted_keys", f.buckets.evictions)
+		f.mu.Unlock()
+	}
+
+	return baker.FilterStats{
+		NumFilteredLines: atomic.LoadInt64(&f.numFilteredLines),
+		Metrics:          bag,
+	}
+}
+
+// Process implements baker.Filter.
+func (f *RateLimit) Process(l baker.Record, next func(baker.Record)) {
+	if f.bucket(l).TakeAvailable(1) == 0 {
+		atomic.AddInt64(&f.throttled, 1)
+		if !f.tag {
+			atomic.AddInt64(&f.numFilteredLines, 1)
+			return
+		}
+		l.Set(f.tagField, f.tagValue)
+	}
+
+	next(l)
+}
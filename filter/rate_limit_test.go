@@ -0,0 +1,116 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestRateLimit(t *testing.T) {
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		switch name {
+		case "key":
+			return 0, true
+		case "tag":
+			return 1, true
+		}
+		return 0, false
+	}
+
+	tests := []struct {
+		name    string
+		cfg     *RateLimitConfig
+		keys    []string
+		want    []string // values of the tag field of forwarded records
+		wantErr bool
+	}{
+		{
+			name: "global",
+			cfg:  &RateLimitConfig{Rate: 0.001, Burst: 2},
+			keys: []string{"a", "b", "c", "a"},
+			want: []string{"", ""},
+		},
+		{
+			name: "by key",
+			cfg:  &RateLimitConfig{Rate: 0.001, Burst: 1, KeyField: "key"},
+			keys: []string{"a", "b", "a", "c", "b"},
+			want: []string{"", "", ""},
+		},
+		{
+			name: "by key with eviction",
+			cfg:  &RateLimitConfig{Rate: 0.001, Burst: 1, KeyField: "key", MaxKeys: 1},
+			keys: []string{"a", "a", "b", "a"},
+			want: []string{"", "", ""},
+		},
+		{
+			name: "tag",
+			cfg:  &RateLimitConfig{Rate: 0.001, Burst: 1, KeyField: "key", Action: "tag", TagField: "tag"},
+			keys: []string{"a", "a", "b"},
+			want: []string{"", "throttled", ""},
+		},
+
+		// errors
+		{
+			name:    "zero rate",
+			cfg:     &RateLimitConfig{},
+			wantErr: true,
+		},
+		{
+			name:    "unknown key field",
+			cfg:     &RateLimitConfig{Rate: 1, KeyField: "unknown"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown action",
+			cfg:     &RateLimitConfig{Rate: 1, Action: "foo"},
+			wantErr: true,
+		},
+		{
+			name:    "tag without field",
+			cfg:     &RateLimitConfig{Rate: 1, Action: "tag"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewRateLimit(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName:   fieldByName,
+					DecodedConfig: tt.cfg,
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error = %v, want error = %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			var got []string
+			for _, key := range tt.keys {
+				l := &baker.LogLine{FieldSeparator: ','}
+				l.Set(0, []byte(key))
+				f.Process(l, func(r baker.Record) { got = append(got, string(r.Get(1))) })
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d records %q, want %d %q", len(got), got, len(tt.want), tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("record #%d: tag = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+
+			throttled := int64(len(tt.keys) - len(tt.want))
+			if tt.cfg.Action == "tag" {
+				throttled = 1
+			}
+			stats := f.Stats()
+			if got := stats.Metrics["c:ratelimit.throttled"]; got != throttled {
+				t.Errorf("ratelimit.throttled = %v, want %d", got, throttled)
+			}
+		})
+	}
+}
@@ -0,0 +1,417 @@
+package filter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/AdRoll/baker"
+)
+
+const redactHelp = `
+This filter scans free-text fields for personally identifiable information (PII) and replaces
+what it finds.
+
+The built-in detectors are:
+
+ - "email": email addresses.
+ - "card": credit card numbers, of 13 to 19 digits, possibly grouped with spaces or dashes,
+   whose check digit is valid (Luhn algorithm).
+ - "ipv4": IPv4 addresses.
+ - "ipv6": IPv6 addresses.
+ - "phone": phone numbers, of 7 to 15 digits, either starting with "+" or containing
+   separators (e.g. "+14155552671", "(415) 555-2671" or "415.555.2671"). Sequences of digits
+   without separators aren't considered phone numbers, since they're more likely timestamps
+   or identifiers.
+
+` + "`Detectors`" + ` lists the detectors to use, all of them by default. Additional detectors can
+be defined with regular expressions in ` + "`Patterns`" + `, a table mapping the detector names to
+their regular expression. When matches of several detectors overlap, the built-in detectors win
+over the user ones, in the order listed above, then user detectors are sorted by name.
+
+` + "`Action`" + ` tells what matches are replaced with:
+
+ - "mask": as many ` + "`MaskChar`" + ` characters as the match has (default).
+ - "token": ` + "`Token`" + `, in which "{detector}" is replaced by the name of the detector.
+ - "hmac": the first 8 bytes of the HMAC-SHA256 of the match, hex-encoded, so that the same
+   value is always replaced by the same token, without it being reversible. The secret key is
+   read from the file at ` + "`KeyFile`" + `, or from the environment variable ` + "`KeyEnv`" + `.
+
+The number of matches of each detector is exported as the redact.matches.DETECTOR metric.
+
+Example, replacing emails and phone numbers by their type:
+
+` + "```toml" + `
+[[filter]]
+name = "Redact"
+    [filter.config]
+    Fields = ["comment", "user_agent"]
+    Detectors = ["email", "phone"]
+    Action = "token"
+    Token = "<{detector}>"
+    [filter.config.Patterns]
+    ssn = '\b\d{3}-\d{2}-\d{4}\b'
+` + "```" + `
+`
+
+// RedactDesc describes the Redact filter
+var RedactDesc = baker.FilterDesc{
+	Name:   "Redact",
+	New:    NewRedact,
+	Config: &RedactConfig{},
+	Help:   redactHelp,
+}
+
+// RedactConfig holds config parameters of the Redact filter.
+type RedactConfig struct {
+	Fields    []string          `help:"Names of the fields to scan" required:"true"`
+	Detectors []string          `help:"Built-in detectors to use: \"email\", \"card\", \"ipv4\", \"ipv6\" and/or \"phone\". Defaults to all of them"`
+	Patterns  map[string]string `help:"User detectors, mapping their name to a regular expression"`
+	Action    string            `help:"What matches are replaced with: \"mask\", \"token\" or \"hmac\"" default:"mask"`
+	MaskChar  string            `help:"Character used by the \"mask\" action" default:"*"`
+	Token     string            `help:"Replacement used by the \"token\" action, \"{detector}\" is replaced by the detector name" default:"[REDACTED]"`
+	KeyFile   string            `help:"Path of the file containing the secret key of the \"hmac\" action"`
+	KeyEnv    string            `help:"Name of the environment variable containing the secret key of the \"hmac\" action"`
+}
+
+func (cfg *RedactConfig) fillDefaults() error {
+	if len(cfg.Detectors) == 0 {
+		for _, d := range redactDetectors {
+			cfg.Detectors = append(cfg.Detectors, d.name)
+		}
+	}
+	if cfg.Action == "" {
+		cfg.Action = "mask"
+	}
+	cfg.Action = strings.ToLower(cfg.Action)
+	if cfg.MaskChar == "" {
+		cfg.MaskChar = "*"
+	}
+	if cfg.Token == "" {
+		cfg.Token = "[REDACTED]"
+	}
+
+	if len(cfg.Fields) == 0 {
+		return errors.New("no Fields")
+	}
+	switch cfg.Action {
+	case "mask":
+		if utf8.RuneCountInString(cfg.MaskChar) != 1 {
+			return fmt.Errorf("MaskChar must be a single character, got %q", cfg.MaskChar)
+		}
+	case "token", "hmac":
+	default:
+		return fmt.Errorf("unsupported Action %q", cfg.Action)
+	}
+	return nil
+}
+
+// A redactDetector finds PII in field values. Candidate matches of re are
+// only reported if valid, when set, returns true; it's given the whole
+// value and the bounds of the match, and returns the end of the reported
+// match, which can be before end.
+type redactDetector struct {
+	name  string
+	re    *regexp.Regexp
+	valid func(v []byte, start, end int) (int, bool)
+
+	matches int64
+}
+
+// redactDetectors are the built-in detectors, by decreasing priority.
+var redactDetectors = []redactDetector{
+	{
+		name: "email",
+		re:   regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`),
+	},
+	{
+		name:  "card",
+		re:    regexp.MustCompile(`\d(?:[ \-]?\d){12,18}`),
+		valid: cardValid,
+	},
+	{
+		name: "ipv4",
+		re:   regexp.MustCompile(`\d{1,3}(?:\.\d{1,3}){3}`),
+		valid: func(v []byte, start, end int) (int, bool) {
+			isPart := func(c byte) bool { return isDigit(c) || c == '.' }
+			return end, redactIsolated(v, start, end, isPart) && net.ParseIP(string(v[start:end])) != nil
+		},
+	},
+	{
+		name: "ipv6",
+		re:   regexp.MustCompile(`(?i)(?:[0-9a-f]{0,4}:){2,7}(?:(?:\d{1,3}\.){3}\d{1,3}|[0-9a-f]{0,4})`),
+		valid: func(v []byte, start, end int) (int, bool) {
+			isWord := func(c byte) bool { return isAlnum(c) || c == '_' || c == ':' }
+			return end, redactIsolated(v, start, end, isWord) && net.ParseIP(string(v[start:end])) != nil
+		},
+	},
+	{
+		name: "phone",
+		re:   regexp.MustCompile(`(?:\+\d{1,3}[ .\-]?)?(?:\(\d{2,4}\)[ .\-]?|\d{2,4}[ .\-]?)?\d{3,4}[ .\-]?\d{3,4}`),
+		valid: func(v []byte, start, end int) (int, bool) {
+			if !redactIsolated(v, start, end, isAlnum) {
+				return end, false
+			}
+			m := v[start:end]
+			digits := 0
+			for _, c := range m {
+				if isDigit(c) {
+					digits++
+				}
+			}
+			if digits < 7 || digits > 15 {
+				return end, false
+			}
+			// Bare sequences of digits are more likely to be numbers than phone numbers.
+			return end, digits != len(m) || m[0] == '+'
+		},
+	},
+}
+
+// cardValid reports whether v[start:end] is a card number. Since the card
+// regular expression also matches digit groups following a card number,
+// like an expiry date or a CVV, shorter windows of 13 to 19 digits, ending
+// on a digit group, are tried from the right when the whole match isn't a
+// valid card number.
+func cardValid(v []byte, start, end int) (int, bool) {
+	if start > 0 && isDigit(v[start-1]) {
+		return end, false
+	}
+	if end < len(v) && isDigit(v[end]) {
+		return end, false
+	}
+
+	digits := 0
+	for _, c := range v[start:end] {
+		if isDigit(c) {
+			digits++
+		}
+	}
+	for ; end > start; end-- {
+		if !isDigit(v[end-1]) {
+			continue
+		}
+		if digits < 13 {
+			break
+		}
+		// The window must end a digit group.
+		if digits <= 19 && (end == len(v) || !isDigit(v[end])) && luhnValid(v[start:end]) {
+			return end, true
+		}
+		digits--
+	}
+	return end, false
+}
+
+// redactIsolated reports whether v[start:end] is neither preceded nor
+// followed by a byte for which inside returns true.
+func redactIsolated(v []byte, start, end int, inside func(byte) bool) bool {
+	return (start == 0 || !inside(v[start-1])) && (end == len(v) || !inside(v[end]))
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+
+func isAlnum(c byte) bool {
+	return isDigit(c) || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// luhnValid reports whether the digits of b, ignoring other characters, have
+// a valid Luhn check digit.
+func luhnValid(b []byte) bool {
+	sum, double := 0, false
+	for i := len(b) - 1; i >= 0; i-- {
+		if !isDigit(b[i]) {
+			continue
+		}
+		d := int(b[i] - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// Redact is a baker filter that replaces PII found in fields.
+type Redact struct {
+	cfg *RedactConfig
+
+	fields    []baker.FieldIndex
+	detectors []*redactDetector
+	key       []byte // for the hmac action
+}
+
+// NewRedact returns a Redact filter.
+func NewRedact(cfg baker.FilterParams) (baker.Filter, error) {
+	dcfg := cfg.DecodedConfig.(*RedactConfig)
+	if err := dcfg.fillDefaults(); err != nil {
+		return nil, err
+	}
+
+	f := &Redact{cfg: dcfg}
+
+	for _, name := range dcfg.Fields {
+		idx, ok := cfg.FieldByName(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+		f.fields = append(f.fields, idx)
+	}
+
+	enabled := make(map[string]bool)
+	for _, name := range dcfg.Detectors {
+		enabled[strings.ToLower(name)] = true
+	}
+	for _, d := range redactDetectors {
+		if enabled[d.name] {
+			d := d
+			f.detectors = append(f.detectors, &d)
+			delete(enabled, d.name)
+		}
+	}
+	for name := range enabled {
+		return nil, fmt.Errorf("unknown detector %q", name)
+	}
+
+	names := make([]string, 0, len(dcfg.Patterns))
+	for name := range dcfg.Patterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, d := range redactDetectors {
+			if d.name == name {
+				return nil, fmt.Errorf("pattern %q has the name of a built-in detector", name)
+			}
+		}
+		re, err := regexp.Compile(dcfg.Patterns[name])
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %v", name, err)
+		}
+		f.detectors = append(f.detectors, &redactDetector{name: name, re: re})
+	}
+
+	if len(f.detectors) == 0 {
+		return nil, errors.New("no detectors")
+	}
+
+	if dcfg.Action == "hmac" {
+		key, err := readSecretKey(dcfg.KeyFile, dcfg.KeyEnv)
+		if err != nil {
+			return nil, err
+		}
+		f.key = key
+	}
+
+	return f, nil
+}
+
+// Stats implements baker.Filter.
+func (f *Redact) Stats() baker.FilterStats {
+	bag := make(baker.MetricsBag)
+	for _, d := range f.detectors {
+		bag.AddRawCounter("redact.matches."+d.name, atomic.LoadInt64(&d.matches))
+	}
+	return baker.FilterStats{Metrics: bag}
+}
+
+// Process implements baker.Filter.
+func (f *Redact) Process(l baker.Record, next func(baker.Record)) {
+	for _, idx := range f.fields {
+		if v, ok := f.redact(l.Get(idx)); ok {
+			l.Set(idx, v)
+		}
+	}
+	next(l)
+}
+
+// A redactMatch is the location of PII, at v[start:end].
+type redactMatch struct {
+	start, end int
+	detector   *redactDetector
+}
+
+// redact returns v with its PII replaced, and whether any has been found.
+func (f *Redact) redact(v []byte) ([]byte, bool) {
+	if len(v) == 0 {
+		return nil, false
+	}
+
+	var matches []redactMatch
+	for _, d := range f.detectors {
+	candidates:
+		for pos := 0; pos < len(v); {
+			loc := d.re.FindIndex(v[pos:])
+			if loc == nil {
+				break
+			}
+			start, end := pos+loc[0], pos+loc[1]
+			if start == end {
+				pos = start + 1
+				continue
+			}
+			if d.valid != nil {
+				var ok bool
+				if end, ok = d.valid(v, start, end); !ok {
+					// The candidate may start on a nearby number, so
+					// look for a valid match from inside it.
+					pos = start + 1
+					continue
+				}
+			}
+			pos = end
+			// Matches of previous detectors have precedence.
+			for _, m := range matches {
+				if start < m.end && m.start < end {
+					continue candidates
+				}
+			}
+			matches = append(matches, redactMatch{start: start, end: end, detector: d})
+		}
+	}
+	if len(matches) == 0 {
+		return nil, false
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].start < matches[j].start })
+
+	buf := make([]byte, 0, len(v))
+	prev := 0
+	for _, m := range matches {
+		atomic.AddInt64(&m.detector.matches, 1)
+		buf = append(buf, v[prev:m.start]...)
+		buf = f.replace(buf, v[m.start:m.end], m.detector)
+		prev = m.end
+	}
+	buf = append(buf, v[prev:]...)
+	return buf, true
+}
+
+// replace appends the replacement of match, found by d, to buf.
+func (f *Redact) replace(buf, match []byte, d *redactDetector) []byte {
+	switch f.cfg.Action {
+	case "token":
+		return append(buf, strings.ReplaceAll(f.cfg.Token, "{detector}", d.name)...)
+	case "hmac":
+		mac := hmac.New(sha256.New, f.key)
+		mac.Write(match)
+		sum := mac.Sum(nil)
+		return append(buf, hex.EncodeToString(sum[:8])...)
+	}
+
+	n := utf8.RuneCount(match)
+	for i := 0; i < n; i++ {
+		buf = append(buf, f.cfg.MaskChar...)
+	}
+	return buf
+}
@@ -0,0 +1,218 @@
+package filter
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     RedactConfig
+		record  string // comma-separated "text,other" fields
+		want    string
+		metrics baker.MetricsBag
+		wantErr bool
+	}{
+		{
+			name:   "email mask",
+			cfg:    RedactConfig{Fields: []string{"text"}},
+			record: "contact: john.doe+spam@mail.example.com!,x",
+			want:   "contact: ******************************!,x",
+		},
+		{
+			name:   "cards",
+			cfg:    RedactConfig{Fields: []string{"text"}, Detectors: []string{"card"}, Action: "token"},
+			record: "paid with 4111 1111 1111 1111 or 5500-0000-0000-0004 not 4111111111111112,x",
+			want:   "paid with [REDACTED] or [REDACTED] not 4111111111111112,x",
+		},
+		{
+			name:   "card followed by an expiry date",
+			cfg:    RedactConfig{Fields: []string{"text"}, Detectors: []string{"card"}, Action: "token"},
+			record: "card 4111111111111111 12/25,x",
+			want:   "card [REDACTED] 12/25,x",
+		},
+		{
+			name:   "card followed by a cvv",
+			cfg:    RedactConfig{Fields: []string{"text"}, Detectors: []string{"card"}, Action: "token"},
+			record: "card 4111 1111 1111 1111 123 cvv,x",
+			want:   "card [REDACTED] 123 cvv,x",
+		},
+		{
+			name:   "card followed by a digit",
+			cfg:    RedactConfig{Fields: []string{"text"}, Detectors: []string{"card"}, Action: "token"},
+			record: "pay 4111-1111-1111-1111 1,x",
+			want:   "pay [REDACTED] 1,x",
+		},
+		{
+			name:   "card preceded by a number",
+			cfg:    RedactConfig{Fields: []string{"text"}, Action: "token", Token: "<{detector}>"},
+			record: "ref 12 4111111111111111,x",
+			want:   "ref 12 <card>,x",
+		},
+		{
+			name:   "grouped card preceded by a digit",
+			cfg:    RedactConfig{Fields: []string{"text"}, Action: "token", Token: "<{detector}>"},
+			record: "qty 1 4111 1111 1111 1111,x",
+			want:   "qty 1 <card>,x",
+		},
+		{
+			name:   "ips",
+			cfg:    RedactConfig{Fields: []string{"text"}, Action: "token", Token: "<{detector}>"},
+			record: "from 192.168.1.10 and 2001:db8::ff00:42:8329 and ::1 not 999.1.1.1 nor std::string,x",
+			want:   "from <ipv4> and <ipv6> and <ipv6> not 999.1.1.1 nor std::string,x",
+		},
+		{
+			name:   "phones",
+			cfg:    RedactConfig{Fields: []string{"text"}, Action: "token", Token: "<{detector}>"},
+			record: "call +14155552671 or (415) 555-2671 or +44 20 7946 0958 at 1622541600 on 2021-06-01,x",
+			want:   "call <phone> or <phone> or <phone> at 1622541600 on 2021-06-01,x",
+		},
+		{
+			name: "user patterns",
+			cfg: RedactConfig{
+				Fields:    []string{"text"},
+				Detectors: []string{"email"},
+				Patterns:  map[string]string{"ssn": `\b\d{3}-\d{2}-\d{4}\b`},
+				Action:    "token",
+				Token:     "<{detector}>",
+			},
+			record: "ssn 078-05-1120 of a@b.io,x",
+			want:   "ssn <ssn> of <email>,x",
+		},
+		{
+			name:   "several fields",
+			cfg:    RedactConfig{Fields: []string{"text", "other"}, MaskChar: "#"},
+			record: "a@b.io,10.0.0.1",
+			want:   "######,########",
+		},
+		{
+			name:   "hmac",
+			cfg:    RedactConfig{Fields: []string{"text"}, Action: "hmac", KeyEnv: "BAKER_TEST_REDACT_KEY"},
+			record: "a@b.io and a@b.io,x",
+			want:   "7c6d067a6eea2d29 and 7c6d067a6eea2d29,x",
+		},
+		{
+			name:   "nothing found",
+			cfg:    RedactConfig{Fields: []string{"text"}},
+			record: "nothing to see here,x",
+			want:   "nothing to see here,x",
+		},
+		{
+			name:   "metrics",
+			cfg:    RedactConfig{Fields: []string{"text"}, Detectors: []string{"email", "ipv4"}},
+			record: "a@b.io c@d.io 1.2.3.4,x",
+			want:   "****** ****** *******,x",
+			metrics: baker.MetricsBag{
+				"c:redact.matches.email": int64(2),
+				"c:redact.matches.ipv4":  int64(1),
+			},
+		},
+
+		// errors
+		{
+			name:    "no fields",
+			cfg:     RedactConfig{},
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			cfg:     RedactConfig{Fields: []string{"foo"}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown detector",
+			cfg:     RedactConfig{Fields: []string{"text"}, Detectors: []string{"ssn"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid pattern",
+			cfg:     RedactConfig{Fields: []string{"text"}, Patterns: map[string]string{"foo": "("}},
+			wantErr: true,
+		},
+		{
+			name:    "pattern with a built-in name",
+			cfg:     RedactConfig{Fields: []string{"text"}, Patterns: map[string]string{"email": "@"}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown action",
+			cfg:     RedactConfig{Fields: []string{"text"}, Action: "drop"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid mask",
+			cfg:     RedactConfig{Fields: []string{"text"}, MaskChar: "**"},
+			wantErr: true,
+		},
+		{
+			name:    "hmac without key",
+			cfg:     RedactConfig{Fields: []string{"text"}, Action: "hmac"},
+			wantErr: true,
+		},
+	}
+
+	t.Setenv("BAKER_TEST_REDACT_KEY", "secret")
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		switch name {
+		case "text":
+			return 0, true
+		case "other":
+			return 1, true
+		}
+		return 0, false
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			f, err := NewRedact(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName:   fieldByName,
+					DecodedConfig: &cfg,
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error = %v, want error = %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			l := &baker.LogLine{FieldSeparator: ','}
+			if err := l.Parse([]byte(tt.record), nil); err != nil {
+				t.Fatal(err)
+			}
+			f.Process(l, func(baker.Record) {})
+
+			got := string(l.Get(0)) + "," + string(l.Get(1))
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if tt.metrics != nil {
+				if metrics := f.Stats().Metrics; !reflect.DeepEqual(metrics, tt.metrics) {
+					t.Errorf("metrics = %v, want %v", metrics, tt.metrics)
+				}
+			}
+		})
+	}
+}
+
+func TestLuhnValid(t *testing.T) {
+	for _, tt := range []struct {
+		number string
+		want   bool
+	}{
+		{"4111111111111111", true},
+		{"4111-1111-1111-1111", true},
+		{"378282246310005", true},
+		{"4111111111111112", false},
+		{"1234567812345678", false},
+	} {
+		if got := luhnValid([]byte(tt.number)); got != tt.want {
+			t.Errorf("luhnValid(%q) = %v, want %v", tt.number, got, tt.want)
+		}
+	}
+}
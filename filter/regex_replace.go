@@ -0,0 +1,354 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AdRoll/baker"
+)
+
+const regexReplaceHelp = `
+This filter transforms a field with a regular expression, in one of two modes.
+
+In "replace" ` + "`Mode`" + ` (default), all the matches of ` + "`Regex`" + ` in ` + "`SrcField`" + ` are replaced
+by ` + "`Replacement`" + `, and the result is written into ` + "`DstField`" + ` (` + "`SrcField`" + ` by default).
+In ` + "`Replacement`" + `, $1 or ${1} are replaced by the text of the first capture group, $name or
+${name} by the text of the capture group named "name", and $$ by "$" (see Go regexp.Expand).
+
+In "extract" mode, ` + "`Regex`" + ` is matched once against ` + "`SrcField`" + `, and the text of each named
+capture group is written into the field with the same name, or into the field it's mapped to in
+` + "`Fields`" + `.
+
+` + "`Regex`" + ` can reference patterns, grok-style: %{NAME} is replaced by the pattern NAME, and
+%{NAME:group} by the pattern NAME in a capture group named "group". Patterns are either defined
+in ` + "`Patterns`" + `, which maps pattern names to regular expressions (that can themselves reference
+other patterns), or are one of the built-in patterns:
+
+` + "```" + `
+{{PATTERNS}}` + "```" + `
+
+When ` + "`Regex`" + ` doesn't match, ` + "`OnNoMatch`" + ` tells what to do:
+
+ - "keep": in "replace" mode, the source value is written unchanged into DstField; in "extract"
+   mode, fields are left unchanged (default).
+ - "clear": clear DstField, or all the fields written in "extract" mode.
+ - "drop": discard the record.
+
+The numbers of records that matched, and didn't, are exported as the regexreplace.matches and
+regexreplace.no_matches metrics.
+
+### Example
+
+Extracting fields from an access log line:
+
+` + "```toml" + `
+[[filter]]
+name = "RegexReplace"
+    [filter.config]
+    SrcField = "line"
+    Mode = "extract"
+    Regex = '^%{IP:client} \S+ \S+ \[%{HTTPDATE:date}\] "%{WORD:method} %{NOTSPACE:path}[^"]*" %{INT:status}'
+` + "```" + `
+`
+
+// regexReplacePatterns is the library of built-in patterns of the
+// RegexReplace filter.
+var regexReplacePatterns = map[string]string{
+	"INT":               `[+-]?\d+`,
+	"NUMBER":            `[+-]?(?:\d+(?:\.\d*)?|\.\d+)(?:[eE][+-]?\d+)?`,
+	"WORD":              `\w+`,
+	"NOTSPACE":          `\S+`,
+	"SPACE":             `\s*`,
+	"DATA":              `.*?`,
+	"GREEDYDATA":        `.*`,
+	"QUOTEDSTRING":      `"(?:[^"\\]|\\.)*"`,
+	"UUID":              `[0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12}`,
+	"IPV4":              `(?:(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\.){3}(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)`,
+	"IPV6":              `(?:[0-9A-Fa-f]{0,4}:){2,7}[0-9A-Fa-f]{0,4}`,
+	"IP":                `%{IPV4}|%{IPV6}`,
+	"HOSTNAME":          `[0-9A-Za-z](?:[0-9A-Za-z-]{0,62})(?:\.[0-9A-Za-z](?:[0-9A-Za-z-]{0,62}))*\.?`,
+	"EMAIL":             `[A-Za-z0-9._%+-]+@%{HOSTNAME}`,
+	"PATH":              `/[^\s?#]*`,
+	"URI":               `[A-Za-z][A-Za-z0-9+.-]*://[^\s/?#]+(?:/[^\s?#]*)?(?:\?[^\s#]*)?(?:#\S*)?`,
+	"TIMESTAMP_ISO8601": `\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}(?::\d{2}(?:\.\d+)?)?(?:Z|[+-]\d{2}:?\d{2})?`,
+	"HTTPDATE":          `\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}`,
+	"LOGLEVEL":          `(?i:trace|debug|info|notice|warn(?:ing)?|err(?:or)?|crit(?:ical)?|fatal|emerg(?:ency)?)`,
+}
+
+func regexReplaceHelpMsg() string {
+	names := make([]string, 0, len(regexReplacePatterns))
+	for name := range regexReplacePatterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&sb, "%-18s %s\n", name, regexReplacePatterns[name])
+	}
+	return strings.Replace(regexReplaceHelp, "{{PATTERNS}}", sb.String(), 1)
+}
+
+// RegexReplaceDesc describes the RegexReplace filter
+var RegexReplaceDesc = baker.FilterDesc{
+	Name:   "RegexReplace",
+	New:    NewRegexReplace,
+	Config: &RegexReplaceConfig{},
+	Help:   regexReplaceHelpMsg(),
+}
+
+// RegexReplaceConfig holds config parameters of the RegexReplace filter.
+type RegexReplaceConfig struct {
+	SrcField    string            `help:"Name of the field to transform" required:"true"`
+	Regex       string            `help:"Regular expression, which can reference patterns with %{NAME} or %{NAME:group}" required:"true"`
+	Mode        string            `help:"\"replace\" or \"extract\"" default:"replace"`
+	Replacement string            `help:"Replacement of the matches, in \"replace\" mode"`
+	DstField    string            `help:"Name of the field the result is written into, in \"replace\" mode. Defaults to SrcField"`
+	Fields      map[string]string `help:"Map of capture group names to the fields they're written into, in \"extract\" mode. Defaults to the fields named as the groups"`
+	Patterns    map[string]string `help:"Map of pattern names to regular expressions, in addition to the built-in ones"`
+	OnNoMatch   string            `help:"What to do when the regular expression doesn't match: \"keep\", \"clear\" or \"drop\"" default:"keep"`
+}
+
+func (cfg *RegexReplaceConfig) fillDefaults() error {
+	if cfg.Mode == "" {
+		cfg.Mode = "replace"
+	}
+	cfg.Mode = strings.ToLower(cfg.Mode)
+	if cfg.DstField == "" {
+		cfg.DstField = cfg.SrcField
+	}
+	if cfg.OnNoMatch == "" {
+		cfg.OnNoMatch = "keep"
+	}
+	cfg.OnNoMatch = strings.ToLower(cfg.OnNoMatch)
+
+	switch cfg.Mode {
+	case "replace":
+		if len(cfg.Fields) != 0 {
+			return errors.New(`Fields can only be set in "extract" mode`)
+		}
+	case "extract":
+		if cfg.Replacement != "" {
+			return errors.New(`Replacement can only be set in "replace" mode`)
+		}
+	default:
+		return fmt.Errorf("unsupported Mode %q", cfg.Mode)
+	}
+	switch cfg.OnNoMatch {
+	case "keep", "clear", "drop":
+	default:
+		return fmt.Errorf("unsupported OnNoMatch %q", cfg.OnNoMatch)
+	}
+	return nil
+}
+
+// RegexReplace is a baker filter that transforms a field with a regular
+// expression.
+type RegexReplace struct {
+	cfg *RegexReplaceConfig
+
+	re   *regexp.Regexp
+	src  baker.FieldIndex
+	dst  baker.FieldIndex
+	repl []byte
+
+	groups []int              // indexes of the capture groups, in "extract" mode
+	fields []baker.FieldIndex // fields the groups are written into
+
+	numFilteredLines int64
+	matches          int64
+	noMatches        int64
+}
+
+// NewRegexReplace returns a RegexReplace filter.
+func NewRegexReplace(cfg baker.FilterParams) (baker.Filter, error) {
+	dcfg := cfg.DecodedConfig.(*RegexReplaceConfig)
+	if err := dcfg.fillDefaults(); err != nil {
+		return nil, err
+	}
+
+	f := &RegexReplace{cfg: dcfg, repl: []byte(dcfg.Replacement)}
+
+	var ok bool
+	if f.src, ok = cfg.FieldByName(dcfg.SrcField); !ok {
+		return nil, fmt.Errorf("unknown field %q", dcfg.SrcField)
+	}
+	if f.dst, ok = cfg.FieldByName(dcfg.DstField); !ok {
+		return nil, fmt.Errorf("unknown field %q", dcfg.DstField)
+	}
+
+	expr, err := expandRegexPatterns(dcfg.Regex, dcfg.Patterns)
+	if err != nil {
+		return nil, err
+	}
+	if f.re, err = regexp.Compile(expr); err != nil {
+		return nil, fmt.Errorf("invalid Regex: %v", err)
+	}
+
+	if dcfg.Mode == "extract" {
+		for i, name := range f.re.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			fname := name
+			if mapped, ok := dcfg.Fields[name]; ok {
+				fname = mapped
+			}
+			idx, ok := cfg.FieldByName(fname)
+			if !ok {
+				return nil, fmt.Errorf("unknown field %q for capture group %q", fname, name)
+			}
+			f.groups = append(f.groups, i)
+			f.fields = append(f.fields, idx)
+		}
+		if len(f.groups) == 0 {
+			return nil, errors.New(`Regex has no named capture groups, required in "extract" mode`)
+		}
+		for name := range dcfg.Fields {
+			if f.re.SubexpIndex(name) < 0 {
+				return nil, fmt.Errorf("Fields: Regex has no capture group named %q", name)
+			}
+		}
+	}
+
+	return f, nil
+}
+
+// patternRef matches references to patterns: %{NAME} or %{NAME:group}.
+var patternRef = regexp.MustCompile(`%\{(\w+)(?::(\w+))?\}`)
+
+// expandRegexPatterns returns expr in which the references to patterns
+// (either user or built-in ones) are replaced by their regular expression.
+func expandRegexPatterns(expr string, user map[string]string) (string, error) {
+	const maxDepth = 20
+
+	var (
+		err    error
+		expand func(s string, depth int) string
+	)
+	expand = func(s string, depth int) string {
+		return patternRef.ReplaceAllStringFunc(s, func(ref string) string {
+			if err != nil {
+				return ""
+			}
+			if depth > maxDepth {
+				err = fmt.Errorf("too many nested patterns in %q, is there a cycle?", ref)
+				return ""
+			}
+
+			m := patternRef.FindStringSubmatch(ref)
+			name, group := m[1], m[2]
+			pattern, ok := user[name]
+			if !ok {
+				if pattern, ok = regexReplacePatterns[name]; !ok {
+					err = fmt.Errorf("unknown pattern %q", name)
+					return ""
+				}
+			}
+
+			pattern = expand(pattern, depth+1)
+			if group != "" {
+				return "(?P<" + group + ">" + pattern + ")"
+			}
+			return "(?:" + pattern + ")"
+		})
+	}
+
+	expr = expand(expr, 0)
+	return expr, err
+}
+
+// Stats implements baker.Filter.
+func (f *RegexReplace) Stats() baker.FilterStats {
+	bag := make(baker.MetricsBag)
+	bag.AddRawCounter("regexreplace.matches", atomic.LoadInt64(&f.matches))
+	bag.AddRawCounter("regexreplace.no_matches", atomic.LoadInt64(&f.noMatches))
+
+	return baker.FilterStats{
+		NumFilteredLines: atomic.LoadInt64(&f.numFilteredLines),
+		Metrics:          bag,
+	}
+}
+
+// Process implements baker.Filter.
+func (f *RegexReplace) Process(l baker.Record, next func(baker.Record)) {
+	src := l.Get(f.src)
+
+	var matched bool
+	if f.groups == nil {
+		matched = f.replace(l, src)
+	} else {
+		matched = f.extract(l, src)
+	}
+
+	if matched {
+		atomic.AddInt64(&f.matches, 1)
+		next(l)
+		return
+	}
+
+	atomic.AddInt64(&f.noMatches, 1)
+	switch f.cfg.OnNoMatch {
+	case "drop":
+		atomic.AddInt64(&f.numFilteredLines, 1)
+		return
+	case "clear":
+		if f.groups == nil {
+			l.Set(f.dst, nil)
+		}
+		for _, idx := range f.fields {
+			l.Set(idx, nil)
+		}
+	case "keep":
+		if f.groups == nil && f.dst != f.src {
+			l.Set(f.dst, append([]byte(nil), src...))
+		}
+	}
+	next(l)
+}
+
+// replace writes src, with all the matches replaced, into the destination
+// field, and reports whether there was any match.
+func (f *RegexReplace) replace(l baker.Record, src []byte) bool {
+	matches := f.re.FindAllSubmatchIndex(src, -1)
+	if matches == nil {
+		return false
+	}
+
+	buf := make([]byte, 0, len(src))
+	last := 0
+	for _, m := range matches {
+		buf = append(buf, src[last:m[0]]...)
+		buf = f.re.Expand(buf, f.repl, src, m)
+		last = m[1]
+	}
+	buf = append(buf, src[last:]...)
+	l.Set(f.dst, buf)
+	return true
+}
+
+// extract writes the capture groups of the first match in src into their
+// fields, and reports whether there was a match.
+func (f *RegexReplace) extract(l baker.Record, src []byte) bool {
+	m := f.re.FindSubmatchIndex(src)
+	if m == nil {
+		return false
+	}
+
+	// Read all groups before writing fields, since SrcField can be one of
+	// them.
+	values := make([][]byte, len(f.groups))
+	for i, g := range f.groups {
+		if start, end := m[2*g], m[2*g+1]; start >= 0 {
+			values[i] = append([]byte(nil), src[start:end]...)
+		}
+	}
+	for i, idx := range f.fields {
+		l.Set(idx, values[i])
+	}
+	return true
+}
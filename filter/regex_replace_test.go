@@ -0,0 +1,221 @@
+package filter
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestRegexReplace(t *testing.T) {
+	fields := []string{"src", "dst", "ip", "method", "status", "date"}
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		for i, f := range fields {
+			if f == name {
+				return baker.FieldIndex(i), true
+			}
+		}
+		return 0, false
+	}
+
+	tests := []struct {
+		name    string
+		cfg     RegexReplaceConfig
+		record  string
+		want    string // empty if the record is dropped
+		metrics baker.MetricsBag
+		wantErr bool
+	}{
+		{
+			name:   "replace in place",
+			cfg:    RegexReplaceConfig{SrcField: "src", Regex: `(\w+)@(\w+)`, Replacement: "$2/$1"},
+			record: "a@b c@d|||||",
+			want:   "b/a d/c|||||",
+			metrics: baker.MetricsBag{
+				"c:regexreplace.matches":    int64(1),
+				"c:regexreplace.no_matches": int64(0),
+			},
+		},
+		{
+			name:   "replace into dst, named groups",
+			cfg:    RegexReplaceConfig{SrcField: "src", DstField: "dst", Regex: `(?P<user>\w+)@example\.com`, Replacement: "${user}_at"},
+			record: "to bob@example.com|||||",
+			want:   "to bob@example.com|to bob_at||||",
+		},
+		{
+			name:   "replace with pattern",
+			cfg:    RegexReplaceConfig{SrcField: "src", Regex: `%{IPV4}`, Replacement: "x.x.x.x"},
+			record: "from 10.0.0.1 to 192.168.1.255|||||",
+			want:   "from x.x.x.x to x.x.x.x|||||",
+		},
+		{
+			name:   "replace with user pattern referencing a built-in one",
+			cfg:    RegexReplaceConfig{SrcField: "src", Regex: `%{ID:id}`, Replacement: "<$id>", Patterns: map[string]string{"ID": `id-%{INT}`}},
+			record: "id-42 id-x|||||",
+			want:   "<id-42> id-x|||||",
+		},
+		{
+			name:   "replace no match, keep",
+			cfg:    RegexReplaceConfig{SrcField: "src", DstField: "dst", Regex: `\d+`},
+			record: "abc|x||||",
+			want:   "abc|abc||||",
+			metrics: baker.MetricsBag{
+				"c:regexreplace.matches":    int64(0),
+				"c:regexreplace.no_matches": int64(1),
+			},
+		},
+		{
+			name:   "replace no match, clear",
+			cfg:    RegexReplaceConfig{SrcField: "src", DstField: "dst", Regex: `\d+`, OnNoMatch: "clear"},
+			record: "abc|x||||",
+			want:   "abc|||||",
+		},
+		{
+			name:   "replace no match, drop",
+			cfg:    RegexReplaceConfig{SrcField: "src", Regex: `\d+`, OnNoMatch: "drop"},
+			record: "abc|||||",
+			want:   "",
+		},
+		{
+			name: "extract",
+			cfg: RegexReplaceConfig{
+				SrcField: "src",
+				Mode:     "extract",
+				Regex:    `^%{IP:ip} \S+ \S+ \[%{HTTPDATE:date}\] "%{WORD:method} %{NOTSPACE:path}[^"]*" %{INT:code}`,
+				Fields:   map[string]string{"path": "dst", "code": "status"},
+			},
+			record: `127.0.0.1 - - [10/Oct/2020:13:55:36 -0700] "GET /index.html HTTP/1.1" 200 2326|||||`,
+			want:   `127.0.0.1 - - [10/Oct/2020:13:55:36 -0700] "GET /index.html HTTP/1.1" 200 2326|/index.html|127.0.0.1|GET|200|10/Oct/2020:13:55:36 -0700`,
+		},
+		{
+			name:   "extract overwriting the source",
+			cfg:    RegexReplaceConfig{SrcField: "src", Mode: "extract", Regex: `(?P<method>\w+) (?P<src>\S+)`},
+			record: "POST /a|||||",
+			want:   "/a|||POST||",
+		},
+		{
+			name:   "extract no match, keep",
+			cfg:    RegexReplaceConfig{SrcField: "src", Mode: "extract", Regex: `%{INT:status}`},
+			record: "abc||||x|",
+			want:   "abc||||x|",
+		},
+		{
+			name:   "extract no match, clear",
+			cfg:    RegexReplaceConfig{SrcField: "src", Mode: "extract", Regex: `%{WORD:method} %{INT:status}`, OnNoMatch: "clear"},
+			record: "abc|y||z|x|",
+			want:   "abc|y||||",
+		},
+
+		// errors
+		{
+			name:    "unknown source",
+			cfg:     RegexReplaceConfig{SrcField: "foo", Regex: `a`},
+			wantErr: true,
+		},
+		{
+			name:    "unknown destination",
+			cfg:     RegexReplaceConfig{SrcField: "src", DstField: "foo", Regex: `a`},
+			wantErr: true,
+		},
+		{
+			name:    "invalid regex",
+			cfg:     RegexReplaceConfig{SrcField: "src", Regex: `a(`},
+			wantErr: true,
+		},
+		{
+			name:    "unknown pattern",
+			cfg:     RegexReplaceConfig{SrcField: "src", Regex: `%{FOO}`},
+			wantErr: true,
+		},
+		{
+			name:    "pattern cycle",
+			cfg:     RegexReplaceConfig{SrcField: "src", Regex: `%{A}`, Patterns: map[string]string{"A": "a%{B}", "B": "b%{A}"}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown mode",
+			cfg:     RegexReplaceConfig{SrcField: "src", Regex: `a`, Mode: "split"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown OnNoMatch",
+			cfg:     RegexReplaceConfig{SrcField: "src", Regex: `a`, OnNoMatch: "ignore"},
+			wantErr: true,
+		},
+		{
+			name:    "fields in replace mode",
+			cfg:     RegexReplaceConfig{SrcField: "src", Regex: `(?P<a>a)`, Fields: map[string]string{"a": "dst"}},
+			wantErr: true,
+		},
+		{
+			name:    "replacement in extract mode",
+			cfg:     RegexReplaceConfig{SrcField: "src", Mode: "extract", Regex: `(?P<ip>a)`, Replacement: "b"},
+			wantErr: true,
+		},
+		{
+			name:    "extract without named groups",
+			cfg:     RegexReplaceConfig{SrcField: "src", Mode: "extract", Regex: `(a)`},
+			wantErr: true,
+		},
+		{
+			name:    "extract unknown group field",
+			cfg:     RegexReplaceConfig{SrcField: "src", Mode: "extract", Regex: `(?P<foo>a)`},
+			wantErr: true,
+		},
+		{
+			name:    "extract fields of unknown group",
+			cfg:     RegexReplaceConfig{SrcField: "src", Mode: "extract", Regex: `(?P<ip>a)`, Fields: map[string]string{"foo": "dst"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			f, err := NewRegexReplace(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName:   fieldByName,
+					DecodedConfig: &cfg,
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error = %v, want error = %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			l := &baker.LogLine{FieldSeparator: '|'}
+			if err := l.Parse([]byte(tt.record), nil); err != nil {
+				t.Fatal(err)
+			}
+
+			got := ""
+			f.Process(l, func(r baker.Record) { got = string(r.ToText(nil)) })
+			if got != tt.want {
+				t.Errorf("got record %q, want %q", got, tt.want)
+			}
+			if tt.metrics != nil {
+				if got := f.Stats().Metrics; !reflect.DeepEqual(got, tt.metrics) {
+					t.Errorf("metrics = %v, want %v", got, tt.metrics)
+				}
+			}
+		})
+	}
+}
+
+func TestRegexReplacePatterns(t *testing.T) {
+	// All built-in patterns must be valid, once expanded.
+	for name := range regexReplacePatterns {
+		cfg := RegexReplaceConfig{SrcField: "src", Regex: "%{" + name + ":x}"}
+		_, err := NewRegexReplace(baker.FilterParams{
+			ComponentParams: baker.ComponentParams{
+				FieldByName:   func(string) (baker.FieldIndex, bool) { return 0, true },
+				DecodedConfig: &cfg,
+			},
+		})
+		if err != nil {
+			t.Errorf("pattern %s: %v", name, err)
+		}
+	}
+}
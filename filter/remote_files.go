@@ -0,0 +1,154 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/arl/zt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// This file contains helpers shared by filters that load their data from
+// files, possibly remote and periodically refreshed, and whose URLs may
+// contain a date (see ExternalMatch and Lookup).
+
+// checkFileURLs checks that files, dateTimeLayout and timeSubtract are
+// coherent, and that file URLs have one of the supported schemes.
+func checkFileURLs(files []string, dateTimeLayout string, timeSubtract time.Duration, schemes ...string) error {
+	// Check that files and dateTimeLayout are coherent.
+	for _, u := range files {
+		isFormatted := strings.Contains(u, "%s")
+		if isFormatted != (dateTimeLayout != "") {
+			if dateTimeLayout != "" {
+				return errors.New("DateTimeLayout is valid only if all strings in Files contain %s")
+			}
+			return errors.New("strings in Files may only contain %s if DateTimeLayout is set")
+		}
+	}
+
+	// Check that timeSubtract and dateTimeLayout are coherent.
+	if (timeSubtract != 0) && dateTimeLayout == "" {
+		return errors.New("TimeSubtract is only valid if DateTimeLayout is set")
+	}
+
+	// Validate URLs
+	for _, u := range evaluateFileURLs(files, dateTimeLayout, timeSubtract) {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return err
+		}
+		supported := false
+		for _, scheme := range schemes {
+			if parsed.Scheme == scheme {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return fmt.Errorf("%s: unsupported scheme %s", u, parsed.Scheme)
+		}
+	}
+
+	return nil
+}
+
+// evaluateFileURLs replaces %s in files with the current time, minus
+// timeSubtract, formatted with dateTimeLayout, if set.
+func evaluateFileURLs(files []string, dateTimeLayout string, timeSubtract time.Duration) []string {
+	var args []interface{}
+	if dateTimeLayout != "" {
+		now := time.Now().Add(-timeSubtract)
+		args = append(args, now.Format(dateTimeLayout))
+	}
+
+	ret := make([]string, 0, len(files))
+	for _, u := range files {
+		ret = append(ret, fmt.Sprintf(u, args...))
+	}
+	return ret
+}
+
+// openFileURL opens the file at URL u, which can either be a local file
+// (file://), an S3 object (s3:// or s3n://) or an HTTP resource (http:// or
+// https://). The returned reader transparently decompresses gzip and zstd
+// compressed files.
+func openFileURL(u, region string) (io.ReadCloser, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing URL: %v", err)
+	}
+
+	var r io.ReadCloser
+
+	switch parsed.Scheme {
+	case "s3", "s3n":
+		sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+		if err != nil {
+			return nil, fmt.Errorf("error creating aws session: %v", err)
+		}
+		resp, err := s3.New(sess).GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(parsed.Host),
+			Key:    aws.String(parsed.Path),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error downloading file: %v", err)
+		}
+		r = resp.Body
+
+	case "file":
+		path := filepath.Join(parsed.Host, parsed.Path) // On Windows Host contains the drive letter.
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("error opening file: %v", err)
+		}
+		r = f
+
+	case "http", "https":
+		resp, err := http.Get(u)
+		if err != nil {
+			return nil, fmt.Errorf("error downloading file: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("error downloading file: %s", resp.Status)
+		}
+		r = resp.Body
+
+	default:
+		// scheme error should be caught during the validation of configuration.
+		panic("unexpected scheme")
+	}
+
+	// Wrap the reader into a zt reader to transparently read gzip,
+	// zstd or non compressed data.
+	zr, err := zt.NewReader(r)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("can't read from %s: %s", u, err)
+	}
+
+	return &fileURLReader{ReadCloser: zr, body: r}, nil
+}
+
+// fileURLReader closes both the decompressing reader and the underlying body.
+type fileURLReader struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (r *fileURLReader) Close() error {
+	err := r.ReadCloser.Close()
+	if berr := r.body.Close(); err == nil {
+		err = berr
+	}
+	return err
+}
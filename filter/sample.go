@@ -0,0 +1,178 @@
+package filter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdRoll/baker"
+)
+
+const sampleHelp = `
+This filter downsamples records, keeping only a given percentage of them.
+
+By default, records are kept at random. If a ` + "`KeyField`" + ` is configured, sampling
+is deterministic instead: the value of the key field is hashed (with any of the hash
+functions supported by the ` + "`Hash`" + ` filter) and records are kept or discarded based
+on the hash. This guarantees that all records sharing the same key (e.g. the same user)
+are either all kept or all discarded, even across different Baker instances.
+
+Optionally, the number of records kept can be capped to ` + "`MaxRecords`" + ` records per
+` + "`Interval`" + `: the first records selected by the sampling in each interval are kept, and
+once the cap is reached, all records are discarded until the next interval begins.
+
+The number of kept and discarded records, as well as the kept ratio, are exported as metrics.
+`
+
+// SampleDesc describes the Sample filter
+var SampleDesc = baker.FilterDesc{
+	Name:   "Sample",
+	New:    NewSample,
+	Config: &SampleConfig{},
+	Help:   sampleHelp,
+}
+
+// SampleConfig holds config parameters of the Sample filter.
+type SampleConfig struct {
+	Percentage   float64       `help:"Percentage of records to keep, in the (0, 100] range" required:"true"`
+	KeyField     string        `help:"Name of the field to hash for deterministic sampling. If empty, records are sampled at random"`
+	HashFunction string        `help:"Hash function used for deterministic sampling (see Hash filter for supported functions)" default:"md5"`
+	MaxRecords   int64         `help:"Maximum number of records kept per Interval, the first ones. 0 means no cap" default:"0"`
+	Interval     time.Duration `help:"Interval at which the count of kept records is reset, only used if MaxRecords is set" default:"1s"`
+}
+
+func (cfg *SampleConfig) fillDefaults() {
+	if cfg.HashFunction == "" {
+		cfg.HashFunction = "md5"
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = time.Second
+	}
+}
+
+// Sample is a baker filter that downsamples records.
+type Sample struct {
+	threshold uint64 // records with a sampling value below threshold are kept
+	keyed     bool
+	key       baker.FieldIndex
+	hash      func([]byte) ([]byte, error)
+
+	maxRecords    int64
+	interval      time.Duration
+	mu            sync.Mutex // protects the fields below
+	intervalStart time.Time
+	intervalKept  int64
+
+	kept    int64
+	dropped int64
+}
+
+// NewSample returns a Sample filter.
+func NewSample(cfg baker.FilterParams) (baker.Filter, error) {
+	dcfg := cfg.DecodedConfig.(*SampleConfig)
+	dcfg.fillDefaults()
+
+	if dcfg.Percentage <= 0 || dcfg.Percentage > 100 {
+		return nil, fmt.Errorf("Percentage must be in the (0, 100] range, got %v", dcfg.Percentage)
+	}
+	if dcfg.MaxRecords < 0 {
+		return nil, fmt.Errorf("MaxRecords must be positive, got %d", dcfg.MaxRecords)
+	}
+	if dcfg.Interval < 0 {
+		return nil, fmt.Errorf("Interval must be positive, got %v", dcfg.Interval)
+	}
+
+	f := &Sample{
+		threshold:  math.MaxUint64,
+		maxRecords: dcfg.MaxRecords,
+		interval:   dcfg.Interval,
+	}
+	// Percentages close to 100 give 2^64, which doesn't fit in an uint64.
+	if threshold := dcfg.Percentage / 100 * math.MaxUint64; threshold < math.MaxUint64 {
+		f.threshold = uint64(threshold)
+	}
+
+	if dcfg.KeyField != "" {
+		idx, ok := cfg.FieldByName(dcfg.KeyField)
+		if !ok {
+			return nil, fmt.Errorf("unknown field %q", dcfg.KeyField)
+		}
+		hash, ok := hashFuncs[dcfg.HashFunction]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash function %s", dcfg.HashFunction)
+		}
+		f.keyed, f.key, f.hash = true, idx, hash
+	}
+
+	return f, nil
+}
+
+// Stats implements baker.Filter.
+func (f *Sample) Stats() baker.FilterStats {
+	kept := atomic.LoadInt64(&f.kept)
+	dropped := atomic.LoadInt64(&f.dropped)
+
+	bag := make(baker.MetricsBag)
+	bag.AddRawCounter("sample.kept", kept)
+	bag.AddRawCounter("sample.dropped", dropped)
+	if total := kept + dropped; total != 0 {
+		bag.AddGauge("sample.kept_ratio", float64(kept)/float64(total))
+	}
+
+	return baker.FilterStats{
+		NumFilteredLines: dropped,
+		Metrics:          bag,
+	}
+}
+
+// Process implements baker.Filter.
+func (f *Sample) Process(l baker.Record, next func(baker.Record)) {
+	if !f.sample(l) || !f.admit() {
+		atomic.AddInt64(&f.dropped, 1)
+		return
+	}
+
+	atomic.AddInt64(&f.kept, 1)
+	next(l)
+}
+
+// sample reports whether l is selected by the sampling.
+func (f *Sample) sample(l baker.Record) bool {
+	if f.threshold == math.MaxUint64 {
+		return true
+	}
+
+	if !f.keyed {
+		return rand.Uint64() < f.threshold
+	}
+
+	// Hash functions never fail, and always return at least 8 bytes.
+	sum, _ := f.hash(l.Get(f.key))
+	return binary.BigEndian.Uint64(sum) < f.threshold
+}
+
+// admit reports whether the cap of records kept in the current interval
+// hasn't been reached yet, counting one more record if that's the case.
+func (f *Sample) admit() bool {
+	if f.maxRecords == 0 {
+		return true
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(f.intervalStart) >= f.interval {
+		f.intervalStart = now
+		f.intervalKept = 0
+	}
+	if f.intervalKept >= f.maxRecords {
+		return false
+	}
+	f.intervalKept++
+	return true
+}
@@ -0,0 +1,154 @@
+package filter
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestSample(t *testing.T) {
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		switch name {
+		case "user":
+			return 0, true
+		}
+		return 0, false
+	}
+
+	newSample := func(t *testing.T, cfg *SampleConfig) *Sample {
+		t.Helper()
+		f, err := NewSample(baker.FilterParams{
+			ComponentParams: baker.ComponentParams{
+				FieldByName:   fieldByName,
+				DecodedConfig: cfg,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f.(*Sample)
+	}
+
+	process := func(f baker.Filter, user string) bool {
+		kept := false
+		l := &baker.LogLine{FieldSeparator: ','}
+		l.Set(0, []byte(user))
+		f.Process(l, func(baker.Record) { kept = true })
+		return kept
+	}
+
+	t.Run("random", func(t *testing.T) {
+		f := newSample(t, &SampleConfig{Percentage: 25})
+
+		const n = 10000
+		kept := 0
+		for i := 0; i < n; i++ {
+			if process(f, "") {
+				kept++
+			}
+		}
+		// Allow for a large margin of error.
+		if kept < n/5 || kept > n*3/10 {
+			t.Errorf("kept %d records out of %d, want roughly 25%%", kept, n)
+		}
+
+		stats := f.Stats()
+		if stats.NumFilteredLines != int64(n-kept) {
+			t.Errorf("NumFilteredLines = %d, want %d", stats.NumFilteredLines, n-kept)
+		}
+		if got := stats.Metrics["c:sample.kept"]; got != int64(kept) {
+			t.Errorf("sample.kept = %v, want %d", got, kept)
+		}
+		if got := stats.Metrics["c:sample.dropped"]; got != int64(n-kept) {
+			t.Errorf("sample.dropped = %v, want %d", got, n-kept)
+		}
+		want := float64(kept) / n
+		if got := stats.Metrics["g:sample.kept_ratio"]; got != want {
+			t.Errorf("sample.kept_ratio = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("deterministic", func(t *testing.T) {
+		f1 := newSample(t, &SampleConfig{Percentage: 50, KeyField: "user"})
+		f2 := newSample(t, &SampleConfig{Percentage: 50, KeyField: "user"})
+
+		kept := 0
+		for i := 0; i < 1000; i++ {
+			user := fmt.Sprintf("user-%d", i)
+			k := process(f1, user)
+			if k {
+				kept++
+			}
+			// The same key must always give the same outcome.
+			if process(f1, user) != k || process(f2, user) != k {
+				t.Fatalf("user %q: inconsistent sampling", user)
+			}
+		}
+		if kept < 400 || kept > 600 {
+			t.Errorf("kept %d users out of 1000, want roughly 50%%", kept)
+		}
+	})
+
+	t.Run("keep all", func(t *testing.T) {
+		f := newSample(t, &SampleConfig{Percentage: 100, KeyField: "user"})
+		for i := 0; i < 100; i++ {
+			if !process(f, fmt.Sprintf("user-%d", i)) {
+				t.Fatalf("record discarded with Percentage=100")
+			}
+		}
+	})
+
+	t.Run("keep almost all", func(t *testing.T) {
+		// Thresholds of percentages close to 100 must not overflow.
+		for _, pct := range []float64{100, math.Nextafter(100, 0), 99.99999999999} {
+			f := newSample(t, &SampleConfig{Percentage: pct})
+			if f.threshold < math.MaxUint64-1<<32 {
+				t.Errorf("Percentage %v: threshold = %d, want close to %d", pct, f.threshold, uint64(math.MaxUint64))
+			}
+		}
+	})
+
+	t.Run("max records", func(t *testing.T) {
+		f := newSample(t, &SampleConfig{Percentage: 100, MaxRecords: 10, Interval: time.Hour})
+		kept := 0
+		for i := 0; i < 100; i++ {
+			if process(f, "") {
+				kept++
+			}
+		}
+		if kept != 10 {
+			t.Errorf("kept %d records, want 10", kept)
+		}
+
+		// Simulate the beginning of a new interval.
+		f.intervalStart = f.intervalStart.Add(-time.Hour)
+		if !process(f, "") {
+			t.Errorf("record discarded at the beginning of a new interval")
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		cfgs := []*SampleConfig{
+			{Percentage: -1},
+			{Percentage: 101},
+			{Percentage: 10, KeyField: "unknown"},
+			{Percentage: 10, KeyField: "user", HashFunction: "unknown"},
+			{Percentage: 10, MaxRecords: -1},
+			{Percentage: 10, Interval: -time.Second},
+		}
+		for _, cfg := range cfgs {
+			_, err := NewSample(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName:   fieldByName,
+					DecodedConfig: cfg,
+				},
+			})
+			if err == nil {
+				t.Errorf("config %+v: got no error", cfg)
+			}
+		}
+	})
+}
@@ -0,0 +1,291 @@
+package filter
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"go.starlark.net/starlark"
+
+	"github.com/AdRoll/baker"
+)
+
+const scriptHelp = `
+This filter runs a user-provided [Starlark](https://github.com/bazelbuild/starlark/blob/master/spec.md)
+script on each record. Starlark is a dialect of Python designed to be embedded.
+
+The script must define a ` + "`process()`" + ` function, taking no arguments, which is called once
+per record. The following builtins give access to the record being processed:
+
+ - ` + "`get(field)`" + `: returns the value of a field, as a string.
+ - ` + "`set(field, value)`" + `: sets the value of a field (value is converted to a string, None clears the field).
+ - ` + "`meta(key)`" + `: returns the record metadata associated to key, as a string, or None.
+ - ` + "`drop()`" + `: discards the record, which won't be forwarded once process() returns.
+ - ` + "`emit(fields={})`" + `: immediately forwards a copy of the record, as it is at the time of
+   the call, with the fields in the optional dictionary overridden. This can be used to create
+   new records out of the one being processed.
+
+Unless ` + "`drop()`" + ` has been called, the record is forwarded after ` + "`process()`" + ` returns.
+
+Example:
+
+` + "```python" + `
+def process():
+    if get("country") == "":
+        drop()
+        return
+    set("price_usd", str(int(get("price_micros")) / 1000000))
+` + "```" + `
+
+The script is compiled, and its top-level statements executed, once, when the topology is
+created; compile errors are thus reported at that time. Global variables are frozen after that,
+so they can be read but not modified by process(). Each filter goroutine runs the script in its
+own interpreter thread.
+
+Records for which the script fails at runtime are discarded, and the error is logged.
+`
+
+// ScriptDesc describes the Script filter
+var ScriptDesc = baker.FilterDesc{
+	Name:   "Script",
+	New:    NewScript,
+	Config: &ScriptConfig{},
+	Help:   scriptHelp,
+}
+
+// ScriptConfig holds config parameters of the Script filter.
+type ScriptConfig struct {
+	Script     string `help:"Starlark source code of the script. Either Script or ScriptFile must be set"`
+	ScriptFile string `help:"Path to a file containing the Starlark source code of the script. Either Script or ScriptFile must be set"`
+	MaxSteps   int64  `help:"Maximum number of Starlark computation steps per record, after which the script is aborted. 0 means no limit" default:"0"`
+}
+
+// scriptCallKey is the key of the thread local holding the current scriptCall.
+const scriptCallKey = "baker.call"
+
+// scriptCall holds the state of the processing of a single record.
+type scriptCall struct {
+	record  baker.Record
+	next    func(baker.Record)
+	dropped bool
+}
+
+// Script is a baker filter running a Starlark script on each record.
+type Script struct {
+	fieldByName func(string) (baker.FieldIndex, bool)
+	process     starlark.Value
+	threads     sync.Pool // type: *starlark.Thread
+	maxSteps    uint64
+
+	numFilteredLines int64
+	numErrors        int64
+}
+
+// NewScript returns a Script filter.
+func NewScript(cfg baker.FilterParams) (baker.Filter, error) {
+	dcfg := cfg.DecodedConfig.(*ScriptConfig)
+
+	var (
+		filename string
+		src      interface{}
+	)
+	switch {
+	case dcfg.Script != "" && dcfg.ScriptFile != "":
+		return nil, fmt.Errorf("Script and ScriptFile can't both be set")
+	case dcfg.Script != "":
+		filename, src = "script", dcfg.Script
+	case dcfg.ScriptFile != "":
+		buf, err := os.ReadFile(dcfg.ScriptFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read script: %v", err)
+		}
+		filename, src = dcfg.ScriptFile, buf
+	default:
+		return nil, fmt.Errorf("either Script or ScriptFile must be set")
+	}
+
+	f := &Script{fieldByName: cfg.FieldByName}
+
+	predeclared := starlark.StringDict{
+		"get":  starlark.NewBuiltin("get", f.get),
+		"set":  starlark.NewBuiltin("set", f.set),
+		"meta": starlark.NewBuiltin("meta", f.meta),
+		"drop": starlark.NewBuiltin("drop", f.drop),
+		"emit": starlark.NewBuiltin("emit", f.emit),
+	}
+
+	_, prog, err := starlark.SourceProgram(filename, src, predeclared.Has)
+	if err != nil {
+		return nil, fmt.Errorf("can't compile script: %v", err)
+	}
+
+	globals, err := prog.Init(&starlark.Thread{Name: "init"}, predeclared)
+	if err != nil {
+		return nil, fmt.Errorf("can't initialize script: %v", err)
+	}
+	globals.Freeze()
+
+	process, ok := globals["process"]
+	if !ok {
+		return nil, fmt.Errorf("script doesn't define a process() function")
+	}
+	if _, ok := process.(*starlark.Function); !ok {
+		return nil, fmt.Errorf("script process is not a function but a %s", process.Type())
+	}
+	f.process = process
+
+	if dcfg.MaxSteps > 0 {
+		f.maxSteps = uint64(dcfg.MaxSteps)
+	}
+	f.threads.New = func() interface{} {
+		thread := &starlark.Thread{Name: "baker"}
+		thread.SetMaxExecutionSteps(f.maxSteps)
+		return thread
+	}
+
+	return f, nil
+}
+
+// Stats implements baker.Filter.
+func (f *Script) Stats() baker.FilterStats {
+	bag := make(baker.MetricsBag)
+	bag.AddRawCounter("script.errors", atomic.LoadInt64(&f.numErrors))
+
+	return baker.FilterStats{
+		NumFilteredLines: atomic.LoadInt64(&f.numFilteredLines),
+		Metrics:          bag,
+	}
+}
+
+// Process implements baker.Filter.
+func (f *Script) Process(l baker.Record, next func(baker.Record)) {
+	thread := f.threads.Get().(*starlark.Thread)
+	defer f.threads.Put(thread)
+
+	// Threads are reused, while their step count and cancellation (when
+	// MaxSteps is reached) persist across calls: reset them so that
+	// MaxSteps is a per-record limit.
+	if f.maxSteps > 0 {
+		thread.Steps = 0
+		thread.Uncancel()
+	}
+
+	call := &scriptCall{record: l, next: next}
+	thread.SetLocal(scriptCallKey, call)
+	defer thread.SetLocal(scriptCallKey, nil)
+
+	if _, err := starlark.Call(thread, f.process, nil, nil); err != nil {
+		log.WithError(err).Error("Script: can't process record")
+		atomic.AddInt64(&f.numErrors, 1)
+		atomic.AddInt64(&f.numFilteredLines, 1)
+		return
+	}
+
+	if call.dropped {
+		atomic.AddInt64(&f.numFilteredLines, 1)
+		return
+	}
+	next(l)
+}
+
+func (f *Script) field(b *starlark.Builtin, name string) (baker.FieldIndex, error) {
+	idx, ok := f.fieldByName(name)
+	if !ok {
+		return 0, fmt.Errorf("%s: unknown field %q", b.Name(), name)
+	}
+	return idx, nil
+}
+
+// toBytes converts a starlark value into the bytes to set into a field.
+func toBytes(v starlark.Value) []byte {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil
+	case starlark.String:
+		return []byte(v)
+	case starlark.Bytes:
+		return []byte(v)
+	}
+	return []byte(v.String())
+}
+
+func (f *Script) get(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &name); err != nil {
+		return nil, err
+	}
+	idx, err := f.field(b, name)
+	if err != nil {
+		return nil, err
+	}
+
+	call := thread.Local(scriptCallKey).(*scriptCall)
+	return starlark.String(call.record.Get(idx)), nil
+}
+
+func (f *Script) set(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		name  string
+		value starlark.Value
+	)
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &name, &value); err != nil {
+		return nil, err
+	}
+	idx, err := f.field(b, name)
+	if err != nil {
+		return nil, err
+	}
+
+	call := thread.Local(scriptCallKey).(*scriptCall)
+	call.record.Set(idx, toBytes(value))
+	return starlark.None, nil
+}
+
+func (f *Script) meta(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var key string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &key); err != nil {
+		return nil, err
+	}
+
+	call := thread.Local(scriptCallKey).(*scriptCall)
+	if _, ok := call.record.Meta(key); !ok {
+		return starlark.None, nil
+	}
+	return starlark.String(metaOperand(key)(call.record)), nil
+}
+
+func (f *Script) drop(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+
+	call := thread.Local(scriptCallKey).(*scriptCall)
+	call.dropped = true
+	return starlark.None, nil
+}
+
+func (f *Script) emit(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	fields := &starlark.Dict{}
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0, &fields); err != nil {
+		return nil, err
+	}
+
+	call := thread.Local(scriptCallKey).(*scriptCall)
+	cpy := call.record.Copy()
+	for _, item := range fields.Items() {
+		name, ok := starlark.AsString(item[0])
+		if !ok {
+			return nil, fmt.Errorf("%s: field names must be strings, got %s", b.Name(), item[0].Type())
+		}
+		idx, err := f.field(b, name)
+		if err != nil {
+			return nil, err
+		}
+		cpy.Set(idx, toBytes(item[1]))
+	}
+
+	call.next(cpy)
+	return starlark.None, nil
+}
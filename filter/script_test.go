@@ -0,0 +1,263 @@
+package filter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestScript(t *testing.T) {
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		switch name {
+		case "f0":
+			return 0, true
+		case "f1":
+			return 1, true
+		case "f2":
+			return 2, true
+		}
+		return 0, false
+	}
+
+	tests := []struct {
+		name    string
+		script  string
+		record  string
+		meta    baker.Metadata
+		want    []string // forwarded records
+		wantErr bool
+	}{
+		{
+			name:   "pass through",
+			script: "def process(): pass",
+			record: "a,b,c",
+			want:   []string{"a,b,c"},
+		},
+		{
+			name: "get and set",
+			script: `
+def process():
+    set("f2", get("f0") + get("f1"))
+    set("f0", None)
+    set("f1", 42)`,
+			record: "a,b,c",
+			want:   []string{",42,ab"},
+		},
+		{
+			name: "drop",
+			script: `
+def process():
+    if get("f0") == "a":
+        drop()`,
+			record: "a,b,c",
+			want:   nil,
+		},
+		{
+			name: "emit",
+			script: `
+def process():
+    for v in get("f1").split("|"):
+        emit({"f1": v})
+    drop()`,
+			record: "a,x|y|z,c",
+			want:   []string{"a,x,c", "a,y,c", "a,z,c"},
+		},
+		{
+			name: "meta",
+			script: `
+def process():
+    set("f0", meta("key"))
+    if meta("missing") == None:
+        set("f1", "none")`,
+			record: "a,b,c",
+			meta:   baker.Metadata{"key": "value"},
+			want:   []string{"value,none,c"},
+		},
+		{
+			name: "globals",
+			script: `
+PREFIXES = {"a": "alpha", "b": "beta"}
+
+def process():
+    set("f0", PREFIXES.get(get("f0"), "other"))`,
+			record: "a,b,c",
+			want:   []string{"alpha,b,c"},
+		},
+		{
+			name:   "runtime error",
+			script: `def process(): set("f0", 1 // 0)`,
+			record: "a,b,c",
+			want:   nil,
+		},
+		{
+			name:   "unknown field at runtime",
+			script: `def process(): get("unknown")`,
+			record: "a,b,c",
+			want:   nil,
+		},
+
+		// errors
+		{
+			name:    "no script",
+			script:  "",
+			wantErr: true,
+		},
+		{
+			name:    "syntax error",
+			script:  "def process(:",
+			wantErr: true,
+		},
+		{
+			name:    "undefined name",
+			script:  "def process(): foo()",
+			wantErr: true,
+		},
+		{
+			name:    "missing process",
+			script:  "x = 1",
+			wantErr: true,
+		},
+		{
+			name:    "process not a function",
+			script:  "process = 1",
+			wantErr: true,
+		},
+		{
+			name:    "init error",
+			script:  "x = 1 // 0\ndef process(): pass",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewScript(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName:   fieldByName,
+					DecodedConfig: &ScriptConfig{Script: tt.script},
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error = %v, want error = %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			l := &baker.LogLine{FieldSeparator: ','}
+			if err := l.Parse([]byte(tt.record), tt.meta); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			f.Process(l, func(r baker.Record) { got = append(got, string(r.ToText(nil))) })
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d records %q, want %d %q", len(got), got, len(tt.want), tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("record #%d = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestScriptFile(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "script.star")
+	if err := os.WriteFile(fn, []byte(`def process(): set("f0", "x")`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fieldByName := func(name string) (baker.FieldIndex, bool) { return 0, name == "f0" }
+	params := baker.FilterParams{
+		ComponentParams: baker.ComponentParams{
+			FieldByName:   fieldByName,
+			DecodedConfig: &ScriptConfig{ScriptFile: fn},
+		},
+	}
+	f, err := NewScript(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := &baker.LogLine{FieldSeparator: ','}
+	f.Process(l, func(r baker.Record) {})
+	if got := string(l.Get(0)); got != "x" {
+		t.Errorf("f0 = %q, want %q", got, "x")
+	}
+
+	params.DecodedConfig = &ScriptConfig{Script: "def process(): pass", ScriptFile: fn}
+	if _, err := NewScript(params); err == nil {
+		t.Errorf("got no error with both Script and ScriptFile set")
+	}
+}
+
+func TestScriptErrorsMetric(t *testing.T) {
+	f, err := NewScript(baker.FilterParams{
+		ComponentParams: baker.ComponentParams{
+			FieldByName:   func(string) (baker.FieldIndex, bool) { return 0, false },
+			DecodedConfig: &ScriptConfig{Script: `def process(): fail("oops")`},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		f.Process(&baker.LogLine{FieldSeparator: ','}, func(r baker.Record) {
+			t.Fatalf("record shouldn't have been forwarded")
+		})
+	}
+
+	stats := f.Stats()
+	if stats.NumFilteredLines != 3 {
+		t.Errorf("NumFilteredLines = %d, want 3", stats.NumFilteredLines)
+	}
+	if got := stats.Metrics["c:script.errors"]; got != int64(3) {
+		t.Errorf("script.errors = %v, want 3", got)
+	}
+}
+
+func TestScriptMaxStepsPerRecord(t *testing.T) {
+	script := `
+def process():
+    n = 0
+    for i in range(int(get("f0"))):
+        n += i
+`
+	f, err := NewScript(baker.FilterParams{
+		ComponentParams: baker.ComponentParams{
+			FieldByName:   func(name string) (baker.FieldIndex, bool) { return 0, name == "f0" },
+			DecodedConfig: &ScriptConfig{Script: script, MaxSteps: 1000},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// MaxSteps is a per-record limit: many small records all go through,
+	// only the one doing too many steps is dropped.
+	forwarded := 0
+	for i := 0; i < 1000; i++ {
+		l := &baker.LogLine{FieldSeparator: ','}
+		l.Set(0, []byte("10"))
+		f.Process(l, func(baker.Record) { forwarded++ })
+	}
+	l := &baker.LogLine{FieldSeparator: ','}
+	l.Set(0, []byte("100000"))
+	f.Process(l, func(baker.Record) { forwarded++ })
+	l = &baker.LogLine{FieldSeparator: ','}
+	l.Set(0, []byte("10"))
+	f.Process(l, func(baker.Record) { forwarded++ })
+
+	if forwarded != 1001 {
+		t.Errorf("forwarded %d records, want 1001", forwarded)
+	}
+	if got := f.Stats().Metrics["c:script.errors"]; got != int64(1) {
+		t.Errorf("script.errors = %v, want 1", got)
+	}
+}
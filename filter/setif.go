@@ -0,0 +1,325 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AdRoll/baker"
+)
+
+const setIfHelp = `
+This filter sets fields depending on conditions. It takes a list of ` + "`Rules`" + `, each made of a
+condition, ` + "`If`" + `, written in the same format as the ClauseFilter clauses (see ClauseFilter), and of
+field assignments, applied when the record matches the condition. There are 3 kinds of assignments:
+
+ - ` + "`Set`" + `: maps field names to constant values.
+ - ` + "`Copy`" + `: maps field names to the name of the field their value is copied from.
+ - ` + "`Template`" + `: maps field names to templates, in which "{FIELD}" is replaced by the value of
+   FIELD ("{{" and "}}" are replaced by "{" and "}").
+
+All the values of a rule are read before any field is written, so a rule can swap fields for
+example. A field can't be assigned more than once by a rule.
+
+Rules are evaluated in order. In "first" ` + "`Mode`" + ` (default), only the first matching rule is
+applied. In "all" mode, all the matching rules are applied, each rule seeing the changes made by the
+previous ones. If no rule matches, the assignments of ` + "`Else`" + ` are applied.
+
+The number of records matching each rule is exported as the setif.matches.NAME metric, where NAME
+is the rule ` + "`Name`" + `, or its index in ` + "`Rules`" + ` if it has none. The records matching no rules
+are counted in setif.matches.else.
+
+### Example
+
+` + "```toml" + `
+[[filter]]
+name = "SetIf"
+    [filter.config]
+    [[filter.config.Rules]]
+    Name = "north_america"
+    If = "(or (country US) (country CA))"
+    [filter.config.Rules.Set]
+        region = "NA"
+    [filter.config.Rules.Template]
+        label = "{country}-{city}"
+
+    [[filter.config.Rules]]
+    If = "(country FR)"
+    [filter.config.Rules.Set]
+        region = "EU"
+    [filter.config.Rules.Copy]
+        label = "city"
+
+    [filter.config.Else.Set]
+        region = "other"
+        label = ""
+` + "```" + `
+`
+
+// SetIfDesc describes the SetIf filter
+var SetIfDesc = baker.FilterDesc{
+	Name:   "SetIf",
+	New:    NewSetIf,
+	Config: &SetIfConfig{},
+	Help:   setIfHelp,
+}
+
+// SetIfConfig holds config parameters of the SetIf filter.
+type SetIfConfig struct {
+	Rules []SetIfRule `help:"Conditions and the assignments applied when they match, in order (see above)" required:"true"`
+	Mode  string      `help:"Apply only the \"first\" matching rule, or \"all\" of them" default:"first"`
+	Else  SetIfRule   `help:"Assignments applied when no rule matches. Its If must be empty"`
+}
+
+// SetIfRule is a rule of the SetIf filter.
+type SetIfRule struct {
+	Name     string            // used in metrics
+	If       string            // condition, in the ClauseFilter format
+	Set      map[string]string // field name -> constant value
+	Copy     map[string]string // field name -> source field name
+	Template map[string]string // field name -> template
+}
+
+func (cfg *SetIfConfig) fillDefaults() error {
+	if cfg.Mode == "" {
+		cfg.Mode = "first"
+	}
+	cfg.Mode = strings.ToLower(cfg.Mode)
+
+	if len(cfg.Rules) == 0 {
+		return errors.New("no Rules")
+	}
+	switch cfg.Mode {
+	case "first", "all":
+	default:
+		return fmt.Errorf("unsupported Mode %q", cfg.Mode)
+	}
+	if cfg.Else.If != "" {
+		return errors.New("Else can't have a condition")
+	}
+	return nil
+}
+
+// SetIf is a baker filter that sets fields of records matching conditions.
+type SetIf struct {
+	all   bool
+	rules []*setIfRule
+	els   *setIfRule
+}
+
+// setIfRule is a compiled SetIfRule.
+type setIfRule struct {
+	cond    Clause
+	fields  []baker.FieldIndex
+	values  []func(baker.Record) []byte
+	matches int64
+	name    string
+}
+
+// NewSetIf returns a SetIf filter.
+func NewSetIf(cfg baker.FilterParams) (baker.Filter, error) {
+	dcfg := cfg.DecodedConfig.(*SetIfConfig)
+	if err := dcfg.fillDefaults(); err != nil {
+		return nil, err
+	}
+
+	f := &SetIf{all: dcfg.Mode == "all"}
+	names := make(map[string]bool)
+	for i, rule := range dcfg.Rules {
+		if rule.Name == "" {
+			rule.Name = strconv.Itoa(i)
+		}
+		if names[rule.Name] || rule.Name == "else" {
+			return nil, fmt.Errorf("duplicate rule name %q", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if strings.TrimSpace(rule.If) == "" {
+			return nil, fmt.Errorf("rule %q: no condition", rule.Name)
+		}
+		r, err := compileSetIfRule(rule, cfg.FieldByName)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %v", rule.Name, err)
+		}
+		f.rules = append(f.rules, r)
+	}
+
+	dcfg.Else.Name = "else"
+	els, err := compileSetIfRule(dcfg.Else, cfg.FieldByName)
+	if err != nil {
+		return nil, fmt.Errorf("Else: %v", err)
+	}
+	f.els = els
+
+	return f, nil
+}
+
+// compileSetIfRule compiles the condition and assignments of rule.
+func compileSetIfRule(rule SetIfRule, fieldByName func(string) (baker.FieldIndex, bool)) (*setIfRule, error) {
+	cond, err := compileClause(rule.If, fieldByName)
+	if err != nil {
+		return nil, err
+	}
+	r := &setIfRule{cond: cond, name: rule.Name}
+
+	assigned := make(map[string]bool)
+	add := func(kind string, m map[string]string, value func(string) (func(baker.Record) []byte, error)) error {
+		// Sort field names so that errors are reproducible.
+		names := make([]string, 0, len(m))
+		for name := range m {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if assigned[name] {
+				return fmt.Errorf("field %q is assigned more than once", name)
+			}
+			assigned[name] = true
+
+			idx, ok := fieldByName(name)
+			if !ok {
+				return fmt.Errorf("%s: unknown field %q", kind, name)
+			}
+			v, err := value(m[name])
+			if err != nil {
+				return fmt.Errorf("%s %q: %v", kind, name, err)
+			}
+			r.fields = append(r.fields, idx)
+			r.values = append(r.values, v)
+		}
+		return nil
+	}
+
+	err = add("Set", rule.Set, func(s string) (func(baker.Record) []byte, error) {
+		return func(baker.Record) []byte { return []byte(s) }, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = add("Copy", rule.Copy, func(s string) (func(baker.Record) []byte, error) {
+		idx, ok := fieldByName(s)
+		if !ok {
+			return nil, fmt.Errorf("unknown field %q", s)
+		}
+		return func(l baker.Record) []byte { return append([]byte(nil), l.Get(idx)...) }, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = add("Template", rule.Template, func(s string) (func(baker.Record) []byte, error) {
+		return compileFieldTemplate(s, fieldByName)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// apply applies the assignments of r to l.
+func (r *setIfRule) apply(l baker.Record) {
+	atomic.AddInt64(&r.matches, 1)
+	if len(r.fields) == 1 {
+		l.Set(r.fields[0], r.values[0](l))
+		return
+	}
+
+	values := make([][]byte, len(r.values))
+	for i, v := range r.values {
+		values[i] = v(l)
+	}
+	for i, idx := range r.fields {
+		l.Set(idx, values[i])
+	}
+}
+
+// compileFieldTemplate compiles a template, in which "{FIELD}" is replaced
+// by the value of FIELD, and "{{" and "}}" by "{" and "}".
+func compileFieldTemplate(tmpl string, fieldByName func(string) (baker.FieldIndex, bool)) (func(baker.Record) []byte, error) {
+	type part struct {
+		lit   []byte
+		field baker.FieldIndex
+		isLit bool
+	}
+
+	var (
+		parts []part
+		lit   []byte
+	)
+	for i := 0; i < len(tmpl); i++ {
+		c := tmpl[i]
+		switch {
+		case (c == '{' || c == '}') && i+1 < len(tmpl) && tmpl[i+1] == c:
+			lit = append(lit, c)
+			i++
+		case c == '{':
+			end := strings.IndexByte(tmpl[i+1:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed '{' at offset %d", i)
+			}
+			name := tmpl[i+1 : i+1+end]
+			idx, ok := fieldByName(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown field %q", name)
+			}
+			if len(lit) != 0 {
+				parts = append(parts, part{lit: lit, isLit: true})
+				lit = nil
+			}
+			parts = append(parts, part{field: idx})
+			i += end + 1
+		case c == '}':
+			return nil, fmt.Errorf("unexpected '}' at offset %d", i)
+		default:
+			lit = append(lit, c)
+		}
+	}
+	if len(lit) != 0 {
+		parts = append(parts, part{lit: lit, isLit: true})
+	}
+
+	return func(l baker.Record) []byte {
+		var buf []byte
+		for _, p := range parts {
+			if p.isLit {
+				buf = append(buf, p.lit...)
+			} else {
+				buf = append(buf, l.Get(p.field)...)
+			}
+		}
+		return buf
+	}, nil
+}
+
+// Stats implements baker.Filter.
+func (f *SetIf) Stats() baker.FilterStats {
+	bag := make(baker.MetricsBag)
+	for _, r := range f.rules {
+		bag.AddRawCounter("setif.matches."+r.name, atomic.LoadInt64(&r.matches))
+	}
+	bag.AddRawCounter("setif.matches.else", atomic.LoadInt64(&f.els.matches))
+	return baker.FilterStats{Metrics: bag}
+}
+
+// Process implements baker.Filter.
+func (f *SetIf) Process(l baker.Record, next func(baker.Record)) {
+	matched := false
+	for _, r := range f.rules {
+		if !r.cond.Match(l) {
+			continue
+		}
+		r.apply(l)
+		matched = true
+		if !f.all {
+			break
+		}
+	}
+	if !matched {
+		f.els.apply(l)
+	}
+	next(l)
+}
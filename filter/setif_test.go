@@ -0,0 +1,267 @@
+package filter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/input/inputtest"
+	"github.com/AdRoll/baker/output"
+)
+
+func TestSetIf(t *testing.T) {
+	fields := []string{"country", "city", "region", "label"}
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		for i, f := range fields {
+			if f == name {
+				return baker.FieldIndex(i), true
+			}
+		}
+		return 0, false
+	}
+
+	rules := []SetIfRule{
+		{
+			Name:     "na",
+			If:       "(or (country US) (country CA))",
+			Set:      map[string]string{"region": "NA"},
+			Template: map[string]string{"label": "{country}-{city} {{ok}}"},
+		},
+		{
+			If:   "(country FR)",
+			Set:  map[string]string{"region": "EU"},
+			Copy: map[string]string{"label": "city"},
+		},
+		{
+			If:  "(city Paris)",
+			Set: map[string]string{"label": "capital"},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		cfg     SetIfConfig
+		record  string
+		want    string
+		metrics baker.MetricsBag
+		wantErr bool
+	}{
+		{
+			name:   "first match, template",
+			cfg:    SetIfConfig{Rules: rules},
+			record: "US,Boston,,",
+			want:   "US,Boston,NA,US-Boston {ok}",
+			metrics: baker.MetricsBag{
+				"c:setif.matches.na":   int64(1),
+				"c:setif.matches.1":    int64(0),
+				"c:setif.matches.2":    int64(0),
+				"c:setif.matches.else": int64(0),
+			},
+		},
+		{
+			name:   "first match, copy",
+			cfg:    SetIfConfig{Rules: rules},
+			record: "FR,Paris,,",
+			want:   "FR,Paris,EU,Paris",
+		},
+		{
+			name:   "all matches",
+			cfg:    SetIfConfig{Rules: rules, Mode: "all"},
+			record: "FR,Paris,,",
+			want:   "FR,Paris,EU,capital",
+			metrics: baker.MetricsBag{
+				"c:setif.matches.na":   int64(0),
+				"c:setif.matches.1":    int64(1),
+				"c:setif.matches.2":    int64(1),
+				"c:setif.matches.else": int64(0),
+			},
+		},
+		{
+			name: "else",
+			cfg: SetIfConfig{
+				Rules: rules,
+				Else:  SetIfRule{Set: map[string]string{"region": "other", "label": ""}},
+			},
+			record: "DE,Berlin,x,y",
+			want:   "DE,Berlin,other,",
+			metrics: baker.MetricsBag{
+				"c:setif.matches.na":   int64(0),
+				"c:setif.matches.1":    int64(0),
+				"c:setif.matches.2":    int64(0),
+				"c:setif.matches.else": int64(1),
+			},
+		},
+		{
+			name:   "no match without else",
+			cfg:    SetIfConfig{Rules: rules},
+			record: "DE,Berlin,x,y",
+			want:   "DE,Berlin,x,y",
+		},
+		{
+			name: "values are read before being written",
+			cfg: SetIfConfig{
+				Rules: []SetIfRule{{
+					If:   "(country US)",
+					Copy: map[string]string{"country": "city", "city": "country"},
+				}},
+			},
+			record: "US,Boston,,",
+			want:   "Boston,US,,",
+		},
+
+		// errors
+		{
+			name:    "no rules",
+			cfg:     SetIfConfig{},
+			wantErr: true,
+		},
+		{
+			name:    "unknown mode",
+			cfg:     SetIfConfig{Rules: rules, Mode: "any"},
+			wantErr: true,
+		},
+		{
+			name:    "rule without condition",
+			cfg:     SetIfConfig{Rules: []SetIfRule{{Set: map[string]string{"region": "NA"}}}},
+			wantErr: true,
+		},
+		{
+			name:    "else with condition",
+			cfg:     SetIfConfig{Rules: rules, Else: SetIfRule{If: "(country US)"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid condition",
+			cfg:     SetIfConfig{Rules: []SetIfRule{{If: "(country"}}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			cfg:     SetIfConfig{Rules: []SetIfRule{{If: "(country US)", Set: map[string]string{"foo": "NA"}}}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown copied field",
+			cfg:     SetIfConfig{Rules: []SetIfRule{{If: "(country US)", Copy: map[string]string{"region": "foo"}}}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown template field",
+			cfg:     SetIfConfig{Rules: []SetIfRule{{If: "(country US)", Template: map[string]string{"region": "{foo}"}}}},
+			wantErr: true,
+		},
+		{
+			name:    "unclosed template placeholder",
+			cfg:     SetIfConfig{Rules: []SetIfRule{{If: "(country US)", Template: map[string]string{"region": "{city"}}}},
+			wantErr: true,
+		},
+		{
+			name:    "field assigned twice",
+			cfg:     SetIfConfig{Rules: []SetIfRule{{If: "(country US)", Set: map[string]string{"region": "NA"}, Copy: map[string]string{"region": "city"}}}},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate rule names",
+			cfg:     SetIfConfig{Rules: []SetIfRule{{Name: "a", If: "(country US)"}, {Name: "a", If: "(country FR)"}}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			f, err := NewSetIf(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName:   fieldByName,
+					DecodedConfig: &cfg,
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error = %v, want error = %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			l := &baker.LogLine{FieldSeparator: ','}
+			if err := l.Parse([]byte(tt.record), nil); err != nil {
+				t.Fatal(err)
+			}
+			f.Process(l, func(baker.Record) {})
+
+			if got := string(l.ToText(nil)); got != tt.want {
+				t.Errorf("got record %q, want %q", got, tt.want)
+			}
+			if tt.metrics != nil {
+				if got := f.Stats().Metrics; !reflect.DeepEqual(got, tt.metrics) {
+					t.Errorf("metrics = %v, want %v", got, tt.metrics)
+				}
+			}
+		})
+	}
+}
+
+func TestSetIfTOML(t *testing.T) {
+	toml := `
+[fields]
+names=["country", "city", "region", "label"]
+
+[input]
+name="logline"
+
+[[filter]]
+name="SetIf"
+	[filter.config]
+	[[filter.config.Rules]]
+	Name = "north_america"
+	If = "(or (country US) (country CA))"
+	[filter.config.Rules.Set]
+		region = "NA"
+	[filter.config.Rules.Template]
+		label = "{country}-{city}"
+
+	[[filter.config.Rules]]
+	If = "(country FR)"
+	[filter.config.Rules.Set]
+		region = "EU"
+	[filter.config.Rules.Copy]
+		label = "city"
+
+	[filter.config.Else.Set]
+		region = "other"
+		label = ""
+
+[output]
+name="nop"
+fields=["country"]
+`
+	components := baker.Components{
+		Inputs:  []baker.InputDesc{inputtest.LogLineDesc},
+		Filters: []baker.FilterDesc{SetIfDesc},
+		Outputs: []baker.OutputDesc{output.NopDesc},
+	}
+
+	cfg, err := baker.NewConfigFromToml(strings.NewReader(toml), components)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &strings.Builder{}
+	records := "US,Boston,,\nFR,Lyon,,\nDE,Berlin,x,y\n"
+	if err := baker.TraceFilterChain(cfg, strings.NewReader(records), buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`region: "" -> "NA"`,
+		`label: "" -> "US-Boston"`,
+		`region: "" -> "EU"`,
+		`label: "" -> "Lyon"`,
+		`region: "x" -> "other"`,
+		`label: "y" -> ""`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("trace doesn't contain %q:\n%s", want, buf)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package filter
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+
+	"github.com/AdRoll/baker"
+)
+
+const userAgentHelp = `
+This filter parses the User-Agent string contained in a record field, and writes information
+about the browser, operating system and device into other fields.
+
+` + "`Attributes`" + ` maps the destination fields to the attribute written into them, among:
+
+ - "browser_family" (e.g. "Chrome") and "browser_version" (e.g. "114.0.5735").
+ - "os_family" (e.g. "Android") and "os_version" (e.g. "13").
+ - "device_family" (e.g. "iPhone"), "device_brand" and "device_model".
+ - "device_type": one of "desktop", "mobile", "tablet", "tv", "console" or "bot".
+ - "bot": "true" if the User-Agent belongs to a bot (crawler, HTTP library, etc.), "false" otherwise.
+
+Families are "Other" when the User-Agent isn't recognized. Records are always forwarded.
+
+User-Agents are parsed with a database of regular expressions in the format used by
+[uap-core](https://github.com/ua-parser/uap-core). A small database covering the most common
+browsers, operating systems and devices is bundled; ` + "`RegexesFile`" + ` can be used to load
+another one, like the full uap-core regexes.yaml. Regular expressions that Go doesn't support
+(like lookarounds) are skipped. uap-core device parsers don't give the device type, which is
+then guessed from the device family, unless the baker-specific ` + "`type_replacement`" + ` is set.
+
+Since User-Agents have a low cardinality, parsing results are kept in an LRU cache of
+` + "`CacheSize`" + ` entries.
+`
+
+// UserAgentDesc describes the UserAgent filter
+var UserAgentDesc = baker.FilterDesc{
+	Name:   "UserAgent",
+	New:    NewUserAgent,
+	Config: &UserAgentConfig{},
+	Help:   userAgentHelp,
+}
+
+// UserAgentConfig holds config parameters of the UserAgent filter.
+type UserAgentConfig struct {
+	Field       string            `help:"Name of the field containing the User-Agent" required:"true"`
+	Attributes  map[string]string `help:"Map of destination field names to the attribute written into them (see above)" required:"true"`
+	RegexesFile string            `help:"Path of a uap-core style YAML file containing the regexes used to parse User-Agents. Defaults to the bundled regexes"`
+	CacheSize   int               `help:"Number of parsed User-Agents kept in the LRU cache. A negative value disables the cache" default:"10000"`
+}
+
+func (cfg *UserAgentConfig) fillDefaults() {
+	if cfg.CacheSize == 0 {
+		cfg.CacheSize = 10000
+	}
+}
+
+//go:embed useragent_regexes.yaml
+var userAgentRegexes []byte
+
+// userAgent holds the result of parsing a User-Agent.
+type userAgent struct {
+	browserFamily, browserVersion string
+	osFamily, osVersion           string
+	deviceFamily                  string
+	deviceBrand, deviceModel      string
+	deviceType                    string
+}
+
+// userAgentAttributes maps attribute names to functions extracting them from
+// a parsed User-Agent.
+var userAgentAttributes = map[string]func(ua *userAgent) string{
+	"browser_family":  func(ua *userAgent) string { return ua.browserFamily },
+	"browser_version": func(ua *userAgent) string { return ua.browserVersion },
+	"os_family":       func(ua *userAgent) string { return ua.osFamily },
+	"os_version":      func(ua *userAgent) string { return ua.osVersion },
+	"device_family":   func(ua *userAgent) string { return ua.deviceFamily },
+	"device_brand":    func(ua *userAgent) string { return ua.deviceBrand },
+	"device_model":    func(ua *userAgent) string { return ua.deviceModel },
+	"device_type":     func(ua *userAgent) string { return ua.deviceType },
+	"bot":             func(ua *userAgent) string { return strconv.FormatBool(ua.deviceType == "bot") },
+}
+
+// UserAgent is a baker filter that parses User-Agent strings.
+type UserAgent struct {
+	cfg *UserAgentConfig
+
+	field      baker.FieldIndex
+	fields     []baker.FieldIndex
+	attributes []func(ua *userAgent) string // aligned with fields
+	parser     *uaParser
+
+	cacheMu sync.Mutex // protects cache
+	cache   *lruCache  // values are []string, aligned with fields
+
+	cacheHits int64
+	unknown   int64
+}
+
+// NewUserAgent returns a UserAgent filter.
+func NewUserAgent(cfg baker.FilterParams) (baker.Filter, error) {
+	dcfg := cfg.DecodedConfig.(*UserAgentConfig)
+	dcfg.fillDefaults()
+
+	f := &UserAgent{cfg: dcfg}
+
+	var ok bool
+	if f.field, ok = cfg.FieldByName(dcfg.Field); !ok {
+		return nil, fmt.Errorf("unknown field %q", dcfg.Field)
+	}
+
+	if len(dcfg.Attributes) == 0 {
+		return nil, fmt.Errorf("no Attributes")
+	}
+	// Sort field names so that the fields are always set in the same order.
+	names := make([]string, 0, len(dcfg.Attributes))
+	for name := range dcfg.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		idx, ok := cfg.FieldByName(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+		attr, ok := userAgentAttributes[dcfg.Attributes[name]]
+		if !ok {
+			return nil, fmt.Errorf("field %q: unknown attribute %q", name, dcfg.Attributes[name])
+		}
+		f.fields = append(f.fields, idx)
+		f.attributes = append(f.attributes, attr)
+	}
+
+	regexes := userAgentRegexes
+	if dcfg.RegexesFile != "" {
+		buf, err := os.ReadFile(dcfg.RegexesFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read regexes: %v", err)
+		}
+		regexes = buf
+	}
+	var err error
+	if f.parser, err = newUAParser(regexes); err != nil {
+		return nil, fmt.Errorf("can't load regexes: %v", err)
+	}
+
+	if dcfg.CacheSize > 0 {
+		f.cache = newLRUCache(dcfg.CacheSize)
+	}
+
+	return f, nil
+}
+
+// Stats implements baker.Filter.
+func (f *UserAgent) Stats() baker.FilterStats {
+	bag := make(baker.MetricsBag)
+	bag.AddRawCounter("useragent.cache_hits", atomic.LoadInt64(&f.cacheHits))
+	bag.AddRawCounter("useragent.unknown", atomic.LoadInt64(&f.unknown))
+
+	return baker.FilterStats{Metrics: bag}
+}
+
+// Process implements baker.Filter.
+func (f *UserAgent) Process(l baker.Record, next func(baker.Record)) {
+	values := f.values(l.Get(f.field))
+	for i, idx := range f.fields {
+		l.Set(idx, []byte(values[i]))
+	}
+
+	next(l)
+}
+
+// values returns the attribute values of the User-Agent in buf, aligned with
+// f.fields.
+func (f *UserAgent) values(buf []byte) []string {
+	if f.cache != nil {
+		f.cacheMu.Lock()
+		v, ok := f.cache.Get(string(buf))
+		f.cacheMu.Unlock()
+		if ok {
+			atomic.AddInt64(&f.cacheHits, 1)
+			return v.([]string)
+		}
+	}
+
+	ua := f.parser.parse(string(buf))
+	if ua.browserFamily == "Other" {
+		atomic.AddInt64(&f.unknown, 1)
+	}
+
+	values := make([]string, len(f.attributes))
+	for i, attr := range f.attributes {
+		values[i] = attr(ua)
+	}
+
+	if f.cache != nil {
+		f.cacheMu.Lock()
+		f.cache.Add(string(buf), values)
+		f.cacheMu.Unlock()
+	}
+	return values
+}
+
+// uaRegexes is the uap-core regexes file format.
+type uaRegexes struct {
+	UserAgentParsers []struct {
+		Regex             string `yaml:"regex"`
+		RegexFlag         string `yaml:"regex_flag"`
+		FamilyReplacement string `yaml:"family_replacement"`
+		V1Replacement     string `yaml:"v1_replacement"`
+		V2Replacement     string `yaml:"v2_replacement"`
+		V3Replacement     string `yaml:"v3_replacement"`
+	} `yaml:"user_agent_parsers"`
+	OSParsers []struct {
+		Regex             string `yaml:"regex"`
+		RegexFlag         string `yaml:"regex_flag"`
+		OSReplacement     string `yaml:"os_replacement"`
+		OSV1Replacement   string `yaml:"os_v1_replacement"`
+		OSV2Replacement   string `yaml:"os_v2_replacement"`
+		OSV3Replacement   string `yaml:"os_v3_replacement"`
+		OSV4Replacement   string `yaml:"os_v4_replacement"`
+		FamilyReplacement string `yaml:"family_replacement"`
+	} `yaml:"os_parsers"`
+	DeviceParsers []struct {
+		Regex             string `yaml:"regex"`
+		RegexFlag         string `yaml:"regex_flag"`
+		DeviceReplacement string `yaml:"device_replacement"`
+		BrandReplacement  string `yaml:"brand_replacement"`
+		ModelReplacement  string `yaml:"model_replacement"`
+		TypeReplacement   string `yaml:"type_replacement"`
+	} `yaml:"device_parsers"`
+}
+
+// uaRule is a single parser of a uaRegexes section. replacements are the
+// replacements of the family and the version parts (or brand, model and type
+// for devices). For the first ngroups parts, an empty replacement means that
+// the capture group with the same index (starting from 1) is used instead.
+type uaRule struct {
+	re           *regexp.Regexp
+	replacements []string
+	ngroups      int
+}
+
+// match matches s against the rule, returning the family and version parts,
+// or nil if s doesn't match.
+func (r *uaRule) match(s string) []string {
+	m := r.re.FindStringSubmatch(s)
+	if m == nil {
+		return nil
+	}
+
+	parts := make([]string, len(r.replacements))
+	for i, repl := range r.replacements {
+		if repl != "" {
+			parts[i] = strings.TrimSpace(expandUAReplacement(repl, m))
+		} else if i < r.ngroups && i+1 < len(m) {
+			parts[i] = m[i+1]
+		}
+	}
+	return parts
+}
+
+// expandUAReplacement replaces $1 to $9 in repl with the corresponding
+// submatches.
+func expandUAReplacement(repl string, submatches []string) string {
+	if !strings.Contains(repl, "$") {
+		return repl
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(repl); i++ {
+		if repl[i] == '$' && i+1 < len(repl) && repl[i+1] >= '1' && repl[i+1] <= '9' {
+			if n := int(repl[i+1] - '0'); n < len(submatches) {
+				sb.WriteString(submatches[n])
+			}
+			i++
+			continue
+		}
+		sb.WriteByte(repl[i])
+	}
+	return sb.String()
+}
+
+// uaParser parses User-Agents with uap-core style regexes.
+type uaParser struct {
+	browsers, oses, devices []uaRule
+}
+
+func newUAParser(buf []byte) (*uaParser, error) {
+	var regexes uaRegexes
+	if err := yaml.Unmarshal(buf, &regexes); err != nil {
+		return nil, err
+	}
+
+	var (
+		p       uaParser
+		skipped int
+	)
+	compile := func(expr, flag string, ngroups int, replacements ...string) (uaRule, bool) {
+		if flag == "i" {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			skipped++
+			log.WithError(err).Debug("UserAgent: skipping unsupported regex")
+			return uaRule{}, false
+		}
+		return uaRule{re: re, replacements: replacements, ngroups: ngroups}, true
+	}
+
+	for _, r := range regexes.UserAgentParsers {
+		if rule, ok := compile(r.Regex, r.RegexFlag, 4, r.FamilyReplacement, r.V1Replacement, r.V2Replacement, r.V3Replacement); ok {
+			p.browsers = append(p.browsers, rule)
+		}
+	}
+	for _, r := range regexes.OSParsers {
+		family := r.OSReplacement
+		if family == "" {
+			family = r.FamilyReplacement
+		}
+		if rule, ok := compile(r.Regex, r.RegexFlag, 5, family, r.OSV1Replacement, r.OSV2Replacement, r.OSV3Replacement, r.OSV4Replacement); ok {
+			p.oses = append(p.oses, rule)
+		}
+	}
+	for _, r := range regexes.DeviceParsers {
+		if rule, ok := compile(r.Regex, r.RegexFlag, 1, r.DeviceReplacement, r.BrandReplacement, r.ModelReplacement, r.TypeReplacement); ok {
+			p.devices = append(p.devices, rule)
+		}
+	}
+
+	if skipped > 0 {
+		log.WithField("skipped", skipped).Warn("UserAgent: some regexes aren't supported and have been skipped")
+	}
+	if len(p.browsers) == 0 && len(p.oses) == 0 && len(p.devices) == 0 {
+		return nil, fmt.Errorf("no regexes")
+	}
+	return &p, nil
+}
+
+// firstMatch returns the parts matched by the first matching rule, or nil.
+func firstMatch(rules []uaRule, s string) []string {
+	for i := range rules {
+		if parts := rules[i].match(s); parts != nil {
+			return parts
+		}
+	}
+	return nil
+}
+
+// joinVersion joins the non-empty leading version parts with dots.
+func joinVersion(parts []string) string {
+	n := 0
+	for n < len(parts) && parts[n] != "" {
+		n++
+	}
+	return strings.Join(parts[:n], ".")
+}
+
+var uaTabletFamilies = regexp.MustCompile(`(?i)ipad|tablet|kindle|\btab\b`)
+
+func (p *uaParser) parse(s string) *userAgent {
+	ua := &userAgent{browserFamily: "Other", osFamily: "Other", deviceFamily: "Other"}
+
+	if parts := firstMatch(p.browsers, s); parts != nil && parts[0] != "" {
+		ua.browserFamily = parts[0]
+		ua.browserVersion = joinVersion(parts[1:])
+	}
+	if parts := firstMatch(p.oses, s); parts != nil && parts[0] != "" {
+		ua.osFamily = parts[0]
+		ua.osVersion = joinVersion(parts[1:])
+	}
+	if parts := firstMatch(p.devices, s); parts != nil {
+		if parts[0] != "" {
+			ua.deviceFamily = parts[0]
+		}
+		ua.deviceBrand, ua.deviceModel, ua.deviceType = parts[1], parts[2], parts[3]
+		if ua.deviceModel == "" && ua.deviceFamily != "Other" {
+			// Like uap-core, the model defaults to the first capture group.
+			ua.deviceModel = ua.deviceFamily
+		}
+	}
+
+	if ua.deviceType == "" {
+		// Regexes not giving the device type, guess it from the family.
+		switch {
+		case ua.deviceFamily == "Spider":
+			ua.deviceType = "bot"
+		case ua.deviceFamily == "Other":
+			ua.deviceType = "desktop"
+		case uaTabletFamilies.MatchString(ua.deviceFamily):
+			ua.deviceType = "tablet"
+		default:
+			ua.deviceType = "mobile"
+		}
+	}
+	return ua
+}
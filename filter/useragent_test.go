@@ -0,0 +1,244 @@
+package filter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestUserAgentParse(t *testing.T) {
+	p, err := newUAParser(userAgentRegexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ua   string
+		want userAgent
+	}{
+		{
+			ua: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/114.0.5735.199 Safari/537.36",
+			want: userAgent{
+				browserFamily: "Chrome", browserVersion: "114.0.5735",
+				osFamily: "Windows", osVersion: "10",
+				deviceFamily: "Other", deviceType: "desktop",
+			},
+		},
+		{
+			ua: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/114.0.0.0 Safari/537.36 Edg/114.0.1823.67",
+			want: userAgent{
+				browserFamily: "Edge", browserVersion: "114.0.1823",
+				osFamily: "Windows", osVersion: "10",
+				deviceFamily: "Other", deviceType: "desktop",
+			},
+		},
+		{
+			ua: "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.5 Safari/605.1.15",
+			want: userAgent{
+				browserFamily: "Safari", browserVersion: "16.5",
+				osFamily: "Mac OS X", osVersion: "10.15.7",
+				deviceFamily: "Other", deviceType: "desktop",
+			},
+		},
+		{
+			ua: "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/115.0",
+			want: userAgent{
+				browserFamily: "Firefox", browserVersion: "115.0",
+				osFamily:     "Ubuntu",
+				deviceFamily: "Other", deviceType: "desktop",
+			},
+		},
+		{
+			ua: "Mozilla/5.0 (iPhone; CPU iPhone OS 16_5_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.5.2 Mobile/15E148 Safari/604.1",
+			want: userAgent{
+				browserFamily: "Mobile Safari", browserVersion: "16.5.2",
+				osFamily: "iOS", osVersion: "16.5.1",
+				deviceFamily: "iPhone", deviceBrand: "Apple", deviceModel: "iPhone", deviceType: "mobile",
+			},
+		},
+		{
+			ua: "Mozilla/5.0 (iPad; CPU OS 15_7 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/114.0.5735.124 Mobile/15E148 Safari/604.1",
+			want: userAgent{
+				browserFamily: "Chrome Mobile iOS", browserVersion: "114.0.5735",
+				osFamily: "iOS", osVersion: "15.7",
+				deviceFamily: "iPad", deviceBrand: "Apple", deviceModel: "iPad", deviceType: "tablet",
+			},
+		},
+		{
+			ua: "Mozilla/5.0 (Linux; Android 13; SM-S918B Build/TP1A.220624.014) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/114.0.5735.130 Mobile Safari/537.36",
+			want: userAgent{
+				browserFamily: "Chrome Mobile", browserVersion: "114.0.5735",
+				osFamily: "Android", osVersion: "13",
+				deviceFamily: "SM-S918B", deviceModel: "SM-S918B", deviceType: "mobile",
+			},
+		},
+		{
+			ua: "Mozilla/5.0 (Linux; Android 12) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/114.0.5735.130 Safari/537.36",
+			want: userAgent{
+				browserFamily: "Chrome", browserVersion: "114.0.5735",
+				osFamily: "Android", osVersion: "12",
+				deviceFamily: "Generic Tablet", deviceBrand: "Generic", deviceModel: "Tablet", deviceType: "tablet",
+			},
+		},
+		{
+			ua: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			want: userAgent{
+				browserFamily: "Googlebot", browserVersion: "2.1",
+				osFamily:     "Other",
+				deviceFamily: "Spider", deviceModel: "Spider", deviceType: "bot",
+			},
+		},
+		{
+			ua: "curl/7.88.1",
+			want: userAgent{
+				browserFamily: "curl", browserVersion: "7.88.1",
+				osFamily:     "Other",
+				deviceFamily: "Spider", deviceModel: "Spider", deviceType: "bot",
+			},
+		},
+		{
+			ua: "",
+			want: userAgent{
+				browserFamily: "Other", osFamily: "Other",
+				deviceFamily: "Other", deviceType: "desktop",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ua, func(t *testing.T) {
+			if got := p.parse(tt.ua); *got != tt.want {
+				t.Errorf("parse() = %+v\nwant %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		switch name {
+		case "ua":
+			return 0, true
+		case "browser":
+			return 1, true
+		case "type":
+			return 2, true
+		case "bot":
+			return 3, true
+		}
+		return 0, false
+	}
+
+	tests := []struct {
+		name        string
+		attributes  map[string]string
+		regexesFile string
+		ua          string
+		want        []string // values of browser, type and bot
+		wantErr     bool
+	}{
+		{
+			name:       "browser",
+			attributes: map[string]string{"browser": "browser_family", "type": "device_type", "bot": "bot"},
+			ua:         "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:109.0) Gecko/20100101 Firefox/115.0",
+			want:       []string{"Firefox", "desktop", "false"},
+		},
+		{
+			name:       "bot",
+			attributes: map[string]string{"browser": "browser_family", "type": "device_type", "bot": "bot"},
+			ua:         "Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)",
+			want:       []string{"bingbot", "bot", "true"},
+		},
+		{
+			name:        "regexes file",
+			attributes:  map[string]string{"browser": "browser_version", "type": "device_type", "bot": "bot"},
+			regexesFile: "custom",
+			ua:          "MyApp/1.2.3 (Tablet)",
+			want:        []string{"1.2.3", "tablet", "false"},
+		},
+
+		// errors
+		{
+			name:       "unknown attribute",
+			attributes: map[string]string{"browser": "foo"},
+			wantErr:    true,
+		},
+		{
+			name:       "unknown field",
+			attributes: map[string]string{"foo": "bot"},
+			wantErr:    true,
+		},
+		{
+			name:    "no attributes",
+			wantErr: true,
+		},
+		{
+			name:        "invalid regexes file",
+			attributes:  map[string]string{"bot": "bot"},
+			regexesFile: "invalid",
+			wantErr:     true,
+		},
+		{
+			name:        "missing regexes file",
+			attributes:  map[string]string{"bot": "bot"},
+			regexesFile: "missing",
+			wantErr:     true,
+		},
+	}
+
+	dir := t.TempDir()
+	const custom = `
+user_agent_parsers:
+  - regex: '(MyApp)/(\d+)\.(\d+)\.(\d+)'
+  - regex: '(?<=lookbehind)(\d+)'
+device_parsers:
+  - regex: '\((Tablet)\)'
+    device_replacement: 'My Tablet'
+`
+	if err := os.WriteFile(filepath.Join(dir, "custom"), []byte(custom), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "invalid"), []byte("user_agent_parsers: {"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &UserAgentConfig{Field: "ua", Attributes: tt.attributes}
+			if tt.regexesFile != "" {
+				cfg.RegexesFile = filepath.Join(dir, tt.regexesFile)
+			}
+			f, err := NewUserAgent(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName:   fieldByName,
+					DecodedConfig: cfg,
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error = %v, want error = %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			// Process the record twice, the second time is served from the cache.
+			for i := 0; i < 2; i++ {
+				l := &baker.LogLine{FieldSeparator: ','}
+				l.Set(0, []byte(tt.ua))
+				f.Process(l, func(baker.Record) {})
+
+				for j, want := range tt.want {
+					if got := string(l.Get(baker.FieldIndex(j + 1))); got != want {
+						t.Errorf("field #%d = %q, want %q", j+1, got, want)
+					}
+				}
+			}
+
+			if got := f.Stats().Metrics["c:useragent.cache_hits"]; got != int64(1) {
+				t.Errorf("useragent.cache_hits = %v, want 1", got)
+			}
+		})
+	}
+}
@@ -8,6 +8,7 @@ require (
 	github.com/arl/zt v0.2.0
 	github.com/aws/aws-sdk-go v1.44.229
 	github.com/bmizerany/perks v0.0.0-20141205001514-d9a9656a3a4b
+	github.com/cespare/xxhash/v2 v2.1.2
 	github.com/charmbracelet/glamour v0.6.0
 	github.com/dustin/go-humanize v1.0.1
 	github.com/fernet/fernet-go v0.0.0-20191111064656-eff2850e6001
@@ -18,12 +19,19 @@ require (
 	github.com/klauspost/compress v1.16.3
 	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/nsf/sexp v0.0.0-20130620094510-d3d2f2591f1d
+	github.com/oschwald/maxminddb-golang v1.10.0
 	github.com/pierrec/lz4/v3 v3.3.5
+	github.com/pierrec/lz4/v4 v4.1.17
 	github.com/rasky/toml v0.1.1-0.20160309013025-90bcb678a72a
 	github.com/sirupsen/logrus v1.9.0
+	github.com/spaolacci/murmur3 v1.1.0
 	github.com/valyala/gozstd v1.18.0
 	github.com/vmware/vmware-go-kcl v1.5.0
+	go.starlark.net v0.0.0-20230302034142-4b1e35fe2254
+	golang.org/x/crypto v0.7.0
 	golang.org/x/net v0.8.0
+	golang.org/x/text v0.8.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -42,7 +50,6 @@ require (
 	github.com/muesli/reflow v0.3.0 // indirect
 	github.com/muesli/termenv v0.13.0 // indirect
 	github.com/olekukonko/tablewriter v0.0.5 // indirect
-	github.com/pierrec/lz4/v4 v4.1.17 // indirect
 	github.com/rivo/uniseg v0.2.0 // indirect
 	github.com/yuin/goldmark v1.5.2 // indirect
 	github.com/yuin/goldmark-emoji v1.0.1 // indirect
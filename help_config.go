@@ -165,6 +165,8 @@ func newHelpConfigKeyFromField(f reflect.StructField) (helpConfigKey, error) {
 			}
 		case reflect.Int:
 			h.typ = "array of ints"
+		case reflect.Struct:
+			h.typ = "array of tables"
 		default:
 			return h, fmt.Errorf("config key %q: unsupported type array of %s", f.Name, f.Type.Elem())
 		}
@@ -174,8 +176,12 @@ func newHelpConfigKeyFromField(f reflect.StructField) (helpConfigKey, error) {
 		} else {
 			h.typ = "int"
 		}
+	case reflect.Float64:
+		h.typ = "float"
 	case reflect.Bool:
 		h.typ = "bool"
+	case reflect.Struct:
+		h.typ = "table"
 	case reflect.Map:
 		switch f.Type.Key().Kind() {
 		case reflect.String:
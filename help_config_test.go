@@ -11,6 +11,7 @@ type dummyConfig struct {
 	IntField              int               `help:"int field" required:"true" default:"0"`
 	Int64Field            int64             `help:"int64 field" required:"false" default:"1"`
 	DurationField         time.Duration     `help:"duration field" required:"true" default:"2s"`
+	FloatField            float64           `help:"float field" required:"false" default:"0.5"`
 	StringField           string            `help:"string field" required:"true" default:"4"`
 	BoolField             bool              `help:"bool field" required:"true" default:"true"`
 	SliceOfStringsField   []string          `help:"strings field" required:"true" default:"[\"a\", \"b\", \"c\"]"`
@@ -18,6 +19,12 @@ type dummyConfig struct {
 	MapOfStringsToStrings map[string]string `help:"map of strings to strings field" required:"true" default:"{foo=\"bar\", bar=\"foo\"}"`
 	MapOfStringsToInt     map[string]int    `help:"map of strings to ints field" required:"true" default:"{foo=12, bar=2}"`
 	Bytes                 SizeBytes         `help:"bytes as int or string with SI or IEC unit" default:"120MB"`
+	SliceOfTables         []dummyTable      `help:"array of tables field"`
+	Table                 dummyTable        `help:"table field"`
+}
+
+type dummyTable struct {
+	Key string
 }
 
 var dummyKeys = []helpConfigKey{
@@ -42,6 +49,13 @@ var dummyKeys = []helpConfigKey{
 		required: true,
 		desc:     "duration field",
 	},
+	{
+		name:     "FloatField",
+		typ:      "float",
+		def:      "0.5",
+		required: false,
+		desc:     "float field",
+	},
 	{
 		name:     "StringField",
 		typ:      "string",
@@ -91,6 +105,16 @@ var dummyKeys = []helpConfigKey{
 		required: false,
 		desc:     "bytes as int or string with SI or IEC unit",
 	},
+	{
+		name: "SliceOfTables",
+		typ:  "array of tables",
+		desc: "array of tables field",
+	},
+	{
+		name: "Table",
+		typ:  "table",
+		desc: "table field",
+	},
 }
 
 func TestGenerateHelp(t *testing.T) {
@@ -115,6 +139,7 @@ func TestGenerateHelp(t *testing.T) {
 				IntField:              1,
 				Int64Field:            2,
 				DurationField:         3,
+				FloatField:            0.25,
 				StringField:           "5",
 				BoolField:             false,
 				SliceOfStringsField:   []string{"foo", "bar"},
@@ -0,0 +1,533 @@
+package output
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/AdRoll/baker"
+)
+
+const aggregateHelp = `
+This output groups records by the values of the ` + "`GroupBy`" + ` fields over tumbling time
+windows of ` + "`Window`" + `, and writes one row per group and per window, with the aggregates
+listed in ` + "`Aggregates`" + `:
+
+ - "count": number of records in the group.
+ - "sum:FIELD", "min:FIELD" and "max:FIELD": sum, minimum and maximum of the numeric values of FIELD.
+   Values that can't be parsed as numbers, including empty ones, are ignored.
+ - "distinct:FIELD": approximate number of distinct values of FIELD (HyperLogLog, whose accuracy
+   depends on ` + "`DistinctPrecision`" + `).
+
+Rows are written as CSV, separated by ` + "`Separator`" + `. Their columns are the start of the
+window (RFC3339, UTC), the values of the GroupBy fields, then the aggregates, in the order in
+which they're configured. For example, with:
+
+` + "```toml" + `
+[[output]]
+name = "Aggregate"
+procs = 1
+    [output.config]
+    GroupBy = ["country", "campaign_id"]
+    Aggregates = ["count", "sum:price", "distinct:user_id"]
+    Window = "5m"
+    TimestampField = "timestamp"
+    PathString = "/path/to/aggregates/{{.Year}}{{.Month}}{{.Day}}-{{.Hour}}{{.Minute}}{{.Second}}.csv.gz"
+` + "```" + `
+
+rows look like "2021-06-01T10:05:00Z,US,1234,42,12.5,37".
+
+If ` + "`TimestampField`" + ` is set, records are assigned to windows according to the time it
+contains (a POSIX timestamp in seconds, or a RFC3339 date), and a window is written once a record
+at least ` + "`AllowedLateness`" + ` past its end has been received. Records arriving after the
+window they belong to has been written are discarded, and counted in the aggregate.late_records
+metric. Otherwise, records are assigned to windows according to the time they're received, and
+windows are written as soon as they end. In both cases, windows still open are written when baker
+stops.
+
+Rows are written into files created, compressed, rotated and uploaded exactly as with the
+FileWriter output: see its documentation for the supported placeholders of ` + "`PathString`" + `
+({{.Field0}} isn't supported), as well as the other options.
+
+Each output process aggregates the records it receives on its own, so either use a single
+process (procs = 1), or shard the output on the GroupBy fields, so that all the records of a
+group are sent to the same process.
+`
+
+// AggregateDesc describes the Aggregate output
+var AggregateDesc = baker.OutputDesc{
+	Name:   "Aggregate",
+	New:    NewAggregate,
+	Config: &AggregateConfig{},
+	Raw:    true,
+	Help:   aggregateHelp,
+}
+
+// AggregateConfig holds config parameters of the Aggregate output.
+type AggregateConfig struct {
+	GroupBy           []string      `help:"Names of the fields records are grouped by. If empty, all the records of a window are in the same group"`
+	Aggregates        []string      `help:"Aggregates written for each group: \"count\", \"sum:FIELD\", \"min:FIELD\", \"max:FIELD\" or \"distinct:FIELD\"" required:"true"`
+	Window            time.Duration `help:"Duration of the tumbling windows" default:"1m"`
+	TimestampField    string        `help:"Name of the field containing the time of the records (POSIX timestamp in seconds or RFC3339 date). If empty, the reception time is used"`
+	AllowedLateness   time.Duration `help:"How long after the end of a window records belonging to it are still accepted (only with TimestampField)" default:"0s"`
+	DistinctPrecision int           `help:"Precision of the distinct counts, from 4 to 18. Each count uses 2^DistinctPrecision bytes, for a standard error of 1.04/sqrt(2^DistinctPrecision)" default:"12"`
+	Separator         string        `help:"Character separating the columns of the rows" default:","`
+
+	PathString           string          `help:"Template describing names of the generated files. See FileWriter documentation for supported placeholders" default:"/tmp/baker/ologs/aggregates/{{.Year}}/{{.Month}}/{{.Day}}/{{.Year}}{{.Month}}{{.Day}}-{{.Hour}}{{.Minute}}{{.Second}}.{{.Index}}.csv.gz"`
+	RotateInterval       time.Duration   `help:"Time interval between 2 successive file rotations. -1 disables interval-based rotation." default:"60s"`
+	RotateSize           baker.SizeBytes `help:"File size which when reached triggers a file rotation. Can be cumulated with RotateInterval. 0 to disable. Examples: 12000, 12KB, 1MB, 1MiB, etc." default:"0"`
+	DiscardEmptyFiles    bool            `help:"By default, rotation may create empty files if no rows were written. If true, then rotation is skipped if the file would be empty." default:"false"`
+	ZstdCompressionLevel int             `help:"Zstd compression level, ranging from 1 (best speed) to 19 (best compression)." default:"3"`
+	ZstdWindowLog        int             `help:"Enable zstd long distance matching. Increase memory usage for both compressor/decompressor. If more than 27 the decompressor requires special treatment. 0:disabled." default:"0"`
+}
+
+func (cfg *AggregateConfig) fillDefaults() error {
+	if cfg.Window == 0 {
+		cfg.Window = time.Minute
+	}
+	if cfg.DistinctPrecision == 0 {
+		cfg.DistinctPrecision = 12
+	}
+	if cfg.Separator == "" {
+		cfg.Separator = ","
+	}
+	if cfg.PathString == "" {
+		cfg.PathString = "/tmp/baker/ologs/aggregates/{{.Year}}/{{.Month}}/{{.Day}}/{{.Year}}{{.Month}}{{.Day}}-{{.Hour}}{{.Minute}}{{.Second}}.{{.Index}}.csv.gz"
+	}
+
+	if cfg.Window < 0 {
+		return errors.New("Window must be positive")
+	}
+	if cfg.AllowedLateness < 0 {
+		return errors.New("AllowedLateness must be positive")
+	}
+	if cfg.DistinctPrecision < hllMinPrecision || cfg.DistinctPrecision > hllMaxPrecision {
+		return fmt.Errorf("DistinctPrecision must be in [%d, %d], got %d", hllMinPrecision, hllMaxPrecision, cfg.DistinctPrecision)
+	}
+	if len([]rune(cfg.Separator)) != 1 {
+		return fmt.Errorf("Separator must be a single character, got %q", cfg.Separator)
+	}
+	if strings.Contains(cfg.PathString, "{{.Field0}}") {
+		return errors.New("{{.Field0}} isn't supported in PathString")
+	}
+	if len(cfg.Aggregates) == 0 {
+		return errors.New("no Aggregates")
+	}
+	return nil
+}
+
+// fileWriterConfig returns the configuration of the FileWriter workers
+// writing the rows.
+func (cfg *AggregateConfig) fileWriterConfig() *FileWriterConfig {
+	fwcfg := &FileWriterConfig{
+		PathString:           cfg.PathString,
+		RotateInterval:       cfg.RotateInterval,
+		RotateSize:           cfg.RotateSize,
+		DiscardEmptyFiles:    cfg.DiscardEmptyFiles,
+		ZstdCompressionLevel: cfg.ZstdCompressionLevel,
+		ZstdWindowLog:        cfg.ZstdWindowLog,
+	}
+	fwcfg.fillDefaults()
+	return fwcfg
+}
+
+// An aggregator computes an aggregate of the values of a field.
+type aggregator interface {
+	// add adds a value, and reports whether it's valid.
+	add(v []byte) bool
+	// value returns the aggregate of the values added so far.
+	value() string
+}
+
+// aggregateSpec describes an aggregate: its kind and the field it applies
+// to, if any.
+type aggregateSpec struct {
+	kind  string
+	field baker.FieldIndex
+}
+
+type countAggregator struct{ n int64 }
+
+func (a *countAggregator) add([]byte) bool { a.n++; return true }
+func (a *countAggregator) value() string   { return strconv.FormatInt(a.n, 10) }
+
+type sumAggregator struct{ sum float64 }
+
+func (a *sumAggregator) add(v []byte) bool {
+	f, err := strconv.ParseFloat(string(v), 64)
+	if err != nil {
+		return false
+	}
+	a.sum += f
+	return true
+}
+
+func (a *sumAggregator) value() string { return formatAggregate(a.sum) }
+
+// minMaxAggregator computes either the minimum or the maximum of the values.
+type minMaxAggregator struct {
+	max bool
+	set bool
+	v   float64
+}
+
+func (a *minMaxAggregator) add(v []byte) bool {
+	f, err := strconv.ParseFloat(string(v), 64)
+	if err != nil {
+		return false
+	}
+	if !a.set || (a.max && f > a.v) || (!a.max && f < a.v) {
+		a.set, a.v = true, f
+	}
+	return true
+}
+
+func (a *minMaxAggregator) value() string {
+	if !a.set {
+		return ""
+	}
+	return formatAggregate(a.v)
+}
+
+type distinctAggregator struct{ hll *hyperLogLog }
+
+func (a *distinctAggregator) add(v []byte) bool { a.hll.add(v); return true }
+func (a *distinctAggregator) value() string     { return strconv.FormatUint(a.hll.count(), 10) }
+
+func formatAggregate(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// aggregateGroup holds the aggregates of a group of records in a window.
+type aggregateGroup struct {
+	keys        []string
+	aggregators []aggregator
+}
+
+// aggregateWindow holds the groups of a window.
+type aggregateWindow struct {
+	start  time.Time
+	groups map[string]*aggregateGroup
+}
+
+// Aggregate is a baker output writing aggregates of groups of records over
+// tumbling windows.
+type Aggregate struct {
+	cfg   baker.OutputParams
+	acfg  *AggregateConfig
+	tmpl  *template.Template
+	keys  []baker.FieldIndex
+	specs []aggregateSpec
+	tsIdx baker.FieldIndex // -1 if the reception time is used
+
+	now       func() time.Time
+	windows   map[int64]*aggregateWindow // indexed by window start (unix nanoseconds)
+	watermark time.Time                  // latest record time seen (only with TimestampField)
+
+	totaln        int64
+	errn          int64
+	lateRecords   int64
+	invalidValues int64
+	rows          int64
+	groups        int64
+}
+
+// NewAggregate returns an Aggregate output.
+func NewAggregate(cfg baker.OutputParams) (baker.Output, error) {
+	dcfg := cfg.DecodedConfig.(*AggregateConfig)
+	if err := dcfg.fillDefaults(); err != nil {
+		return nil, err
+	}
+
+	a := &Aggregate{
+		cfg:     cfg,
+		acfg:    dcfg,
+		tsIdx:   -1,
+		now:     time.Now,
+		windows: make(map[int64]*aggregateWindow),
+	}
+
+	for _, name := range dcfg.GroupBy {
+		idx, ok := cfg.FieldByName(name)
+		if !ok {
+			return nil, fmt.Errorf("GroupBy: unknown field %q", name)
+		}
+		a.keys = append(a.keys, idx)
+	}
+
+	for _, agg := range dcfg.Aggregates {
+		kind, field := agg, ""
+		if i := strings.IndexByte(agg, ':'); i != -1 {
+			kind, field = agg[:i], agg[i+1:]
+		}
+		spec := aggregateSpec{kind: kind}
+		switch kind {
+		case "count":
+			if field != "" {
+				return nil, fmt.Errorf("aggregate %q: count doesn't take a field", agg)
+			}
+		case "sum", "min", "max", "distinct":
+			idx, ok := cfg.FieldByName(field)
+			if !ok {
+				return nil, fmt.Errorf("aggregate %q: unknown field %q", agg, field)
+			}
+			spec.field = idx
+		default:
+			return nil, fmt.Errorf("unknown aggregate %q", agg)
+		}
+		a.specs = append(a.specs, spec)
+	}
+
+	if dcfg.TimestampField != "" {
+		idx, ok := cfg.FieldByName(dcfg.TimestampField)
+		if !ok {
+			return nil, fmt.Errorf("TimestampField: unknown field %q", dcfg.TimestampField)
+		}
+		a.tsIdx = idx
+	}
+
+	var err error
+	if a.tmpl, err = template.New("aggregate").Parse(dcfg.PathString); err != nil {
+		return nil, fmt.Errorf("invalid PathString template: %s", err)
+	}
+
+	return a, nil
+}
+
+// Run implements baker.Output.
+func (a *Aggregate) Run(input <-chan baker.OutputRecord, upch chan<- string) error {
+	ctxlog := log.WithFields(log.Fields{"output": "Aggregate", "idx": a.cfg.Index})
+
+	w, err := newWorker(a.acfg.fileWriterConfig(), a.tmpl, "", a.cfg.Index, uuid.New().String(), upch)
+	if err != nil {
+		return fmt.Errorf("Aggregate: can't create file worker: %s", err)
+	}
+
+	// Without TimestampField, windows are written as soon as they end.
+	var (
+		timer *time.Timer
+		tick  <-chan time.Time
+	)
+	if a.tsIdx == -1 {
+		timer = time.NewTimer(a.untilNextWindow())
+		defer timer.Stop()
+		tick = timer.C
+	}
+
+	rec := a.cfg.CreateRecord()
+	for {
+		select {
+		case raw, ok := <-input:
+			if !ok {
+				ctxlog.Info("Aggregate terminating")
+				a.flush(w, time.Time{}, true)
+				return w.Close()
+			}
+			atomic.AddInt64(&a.totaln, 1)
+			if err := rec.Parse(raw.Record, nil); err != nil {
+				atomic.AddInt64(&a.errn, 1)
+				continue
+			}
+			if valid, _ := a.cfg.ValidateRecord(rec); !valid {
+				atomic.AddInt64(&a.errn, 1)
+				continue
+			}
+			a.add(rec)
+			if a.tsIdx != -1 {
+				a.flush(w, a.watermark.Add(-a.acfg.AllowedLateness), false)
+			}
+
+		case <-tick:
+			a.flush(w, a.now(), false)
+			timer.Reset(a.untilNextWindow())
+		}
+	}
+}
+
+// untilNextWindow returns the duration until the end of the current window.
+func (a *Aggregate) untilNextWindow() time.Duration {
+	now := a.now()
+	return now.Truncate(a.acfg.Window).Add(a.acfg.Window).Sub(now)
+}
+
+// recordTime returns the time of r, and whether it's valid.
+func (a *Aggregate) recordTime(r baker.Record) (time.Time, bool) {
+	if a.tsIdx == -1 {
+		return a.now(), true
+	}
+
+	buf := r.Get(a.tsIdx)
+	if ts, err := strconv.ParseInt(string(buf), 10, 64); err == nil {
+		return time.Unix(ts, 0), true
+	}
+	t, err := time.Parse(time.RFC3339, string(buf))
+	return t, err == nil
+}
+
+// add adds r to the group it belongs to.
+func (a *Aggregate) add(r baker.Record) {
+	t, ok := a.recordTime(r)
+	if !ok {
+		atomic.AddInt64(&a.errn, 1)
+		return
+	}
+
+	start := t.Truncate(a.acfg.Window)
+	if a.tsIdx != -1 {
+		if !start.Add(a.acfg.Window).After(a.watermark.Add(-a.acfg.AllowedLateness)) {
+			// The window has already been written.
+			atomic.AddInt64(&a.lateRecords, 1)
+			return
+		}
+		if t.After(a.watermark) {
+			a.watermark = t
+		}
+	}
+
+	win, ok := a.windows[start.UnixNano()]
+	if !ok {
+		win = &aggregateWindow{start: start, groups: make(map[string]*aggregateGroup)}
+		a.windows[start.UnixNano()] = win
+	}
+
+	// Build the group key by concatenating the length-prefixed values of the
+	// GroupBy fields.
+	var (
+		key []byte
+		n   [binary.MaxVarintLen64]byte
+	)
+	for _, idx := range a.keys {
+		v := r.Get(idx)
+		key = append(key, n[:binary.PutUvarint(n[:], uint64(len(v)))]...)
+		key = append(key, v...)
+	}
+
+	g, ok := win.groups[string(key)]
+	if !ok {
+		g = a.newGroup(r)
+		win.groups[string(key)] = g
+		atomic.AddInt64(&a.groups, 1)
+	}
+
+	for i, spec := range a.specs {
+		var v []byte
+		if spec.kind != "count" {
+			v = r.Get(spec.field)
+		}
+		if !g.aggregators[i].add(v) {
+			atomic.AddInt64(&a.invalidValues, 1)
+		}
+	}
+}
+
+func (a *Aggregate) newGroup(r baker.Record) *aggregateGroup {
+	g := &aggregateGroup{
+		keys:        make([]string, len(a.keys)),
+		aggregators: make([]aggregator, len(a.specs)),
+	}
+	for i, idx := range a.keys {
+		g.keys[i] = string(r.Get(idx))
+	}
+	for i, spec := range a.specs {
+		switch spec.kind {
+		case "count":
+			g.aggregators[i] = &countAggregator{}
+		case "sum":
+			g.aggregators[i] = &sumAggregator{}
+		case "min", "max":
+			g.aggregators[i] = &minMaxAggregator{max: spec.kind == "max"}
+		case "distinct":
+			g.aggregators[i] = &distinctAggregator{hll: newHyperLogLog(a.acfg.DistinctPrecision)}
+		}
+	}
+	return g
+}
+
+// flush writes, in chronological order, the windows that end before (or at)
+// until, or all of them if all is true.
+func (a *Aggregate) flush(w *fileWorker, until time.Time, all bool) {
+	var starts []int64
+	for start, win := range a.windows {
+		if all || !win.start.Add(a.acfg.Window).After(until) {
+			starts = append(starts, start)
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	for _, start := range starts {
+		win := a.windows[start]
+		delete(a.windows, start)
+		a.writeWindow(w, win)
+		atomic.AddInt64(&a.groups, -int64(len(win.groups)))
+	}
+}
+
+// writeWindow writes one row per group of win, sorted by group keys.
+func (a *Aggregate) writeWindow(w *fileWorker, win *aggregateWindow) {
+	groups := make([]*aggregateGroup, 0, len(win.groups))
+	for _, g := range win.groups {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		ki, kj := groups[i].keys, groups[j].keys
+		for n := range ki {
+			if ki[n] != kj[n] {
+				return ki[n] < kj[n]
+			}
+		}
+		return false
+	})
+
+	start := win.start.UTC().Format(time.RFC3339)
+	row := make([]string, 0, 1+len(a.keys)+len(a.specs))
+	for _, g := range groups {
+		row = append(row[:0], start)
+		row = append(row, g.keys...)
+		for _, agg := range g.aggregators {
+			row = append(row, agg.value())
+		}
+
+		var buf bytes.Buffer
+		csvw := csv.NewWriter(&buf)
+		csvw.Comma = []rune(a.acfg.Separator)[0]
+		csvw.Write(row)
+		csvw.Flush()
+		if err := csvw.Error(); err != nil {
+			log.WithError(err).Error("Aggregate: can't write row")
+			continue
+		}
+
+		// The worker adds the line separator.
+		w.write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+		atomic.AddInt64(&a.rows, 1)
+	}
+}
+
+// Stats implements baker.Output.
+func (a *Aggregate) Stats() baker.OutputStats {
+	bag := make(baker.MetricsBag)
+	bag.AddRawCounter("aggregate.late_records", atomic.LoadInt64(&a.lateRecords))
+	bag.AddRawCounter("aggregate.invalid_values", atomic.LoadInt64(&a.invalidValues))
+	bag.AddRawCounter("aggregate.rows", atomic.LoadInt64(&a.rows))
+	bag.AddGauge("aggregate.groups", float64(atomic.LoadInt64(&a.groups)))
+
+	return baker.OutputStats{
+		NumProcessedLines: atomic.LoadInt64(&a.totaln),
+		NumErrorLines:     atomic.LoadInt64(&a.errn),
+		Metrics:           bag,
+	}
+}
+
+// CanShard implements baker.Output.
+func (a *Aggregate) CanShard() bool { return true }
@@ -0,0 +1,281 @@
+package output
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arl/zt"
+
+	"github.com/AdRoll/baker"
+)
+
+var aggregateTestFields = []string{"timestamp", "country", "user", "price"}
+
+func newTestAggregate(t *testing.T, cfg *AggregateConfig) *Aggregate {
+	t.Helper()
+
+	o, err := NewAggregate(baker.OutputParams{
+		ComponentParams: baker.ComponentParams{
+			DecodedConfig: cfg,
+			FieldByName: func(name string) (baker.FieldIndex, bool) {
+				for i, f := range aggregateTestFields {
+					if f == name {
+						return baker.FieldIndex(i), true
+					}
+				}
+				return 0, false
+			},
+			FieldNames:     aggregateTestFields,
+			CreateRecord:   func() baker.Record { return &baker.LogLine{FieldSeparator: ','} },
+			ValidateRecord: func(baker.Record) (bool, baker.FieldIndex) { return true, 0 },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o.(*Aggregate)
+}
+
+// runAggregate sends records to a and returns the rows it has written, in
+// the order they've been written.
+func runAggregate(t *testing.T, a *Aggregate, records []string) []string {
+	t.Helper()
+
+	in := make(chan baker.OutputRecord)
+	upch := make(chan string, 100)
+	errc := make(chan error, 1)
+	go func() { errc <- a.Run(in, upch) }()
+
+	for _, r := range records {
+		in <- baker.OutputRecord{Record: []byte(r)}
+	}
+	close(in)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	close(upch)
+
+	var rows []string
+	for path := range upch {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zt.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := bufio.NewScanner(zr)
+		for s.Scan() {
+			rows = append(rows, s.Text())
+		}
+		if err := s.Err(); err != nil {
+			t.Fatal(err)
+		}
+		zr.Close()
+		f.Close()
+	}
+	return rows
+}
+
+func TestAggregate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     AggregateConfig
+		records []string
+		want    []string
+	}{
+		{
+			name: "group by",
+			cfg: AggregateConfig{
+				GroupBy:        []string{"country"},
+				Aggregates:     []string{"count", "sum:price", "min:price", "max:price", "distinct:user"},
+				TimestampField: "timestamp",
+			},
+			records: []string{
+				"1622541600,US,alice,1.5",
+				"1622541610,FR,bob,2",
+				"1622541620,US,bob,3",
+				"1622541630,US,alice,",
+				"1622541640,FR,bob,foo",
+			},
+			want: []string{
+				"2021-06-01T10:00:00Z,FR,2,2,2,2,1",
+				"2021-06-01T10:00:00Z,US,3,4.5,1.5,3,2",
+			},
+		},
+		{
+			name: "windows",
+			cfg: AggregateConfig{
+				Aggregates:     []string{"count"},
+				Window:         10 * time.Second,
+				TimestampField: "timestamp",
+			},
+			records: []string{
+				"1622541600,,,",
+				"1622541609,,,",
+				"1622541610,,,",
+				"1622541605,,,", // late, its window has been written
+				"1622541635,,,",
+			},
+			want: []string{
+				"2021-06-01T10:00:00Z,2",
+				"2021-06-01T10:00:10Z,1",
+				"2021-06-01T10:00:30Z,1",
+			},
+		},
+		{
+			name: "allowed lateness",
+			cfg: AggregateConfig{
+				Aggregates:      []string{"count"},
+				Window:          10 * time.Second,
+				TimestampField:  "timestamp",
+				AllowedLateness: 10 * time.Second,
+			},
+			records: []string{
+				"1622541600,,,",
+				"1622541610,,,",
+				"1622541605,,,", // still accepted
+				"1622541620,,,",
+				"1622541608,,,", // late
+			},
+			want: []string{
+				"2021-06-01T10:00:00Z,2",
+				"2021-06-01T10:00:10Z,1",
+				"2021-06-01T10:00:20Z,1",
+			},
+		},
+		{
+			name: "RFC3339 timestamps and quoting",
+			cfg: AggregateConfig{
+				GroupBy:        []string{"country", "user"},
+				Aggregates:     []string{"count"},
+				TimestampField: "timestamp",
+				Window:         time.Hour,
+				Separator:      ";",
+			},
+			records: []string{
+				"2021-06-01T10:30:00+02:00,US,a;b,",
+				"2021-06-01T08:59:59Z,US,a;b,",
+				"not a time,US,a;b,",
+			},
+			want: []string{
+				`2021-06-01T08:00:00Z;US;"a;b";2`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.PathString = filepath.Join(t.TempDir(), "{{.Rotation}}.csv.gz")
+			a := newTestAggregate(t, &cfg)
+
+			got := runAggregate(t, a, tt.records)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rows:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestAggregateWallClock(t *testing.T) {
+	cfg := &AggregateConfig{
+		GroupBy:    []string{"country"},
+		Aggregates: []string{"count"},
+		Window:     time.Hour,
+		PathString: filepath.Join(t.TempDir(), "aggregates.csv.gz"),
+	}
+	a := newTestAggregate(t, cfg)
+	a.now = func() time.Time { return time.Date(2021, 6, 1, 10, 30, 0, 0, time.UTC) }
+
+	got := runAggregate(t, a, []string{",US,,", ",FR,,", ",US,,"})
+	want := []string{
+		"2021-06-01T10:00:00Z,FR,1",
+		"2021-06-01T10:00:00Z,US,2",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rows = %q, want %q", got, want)
+	}
+
+	stats := a.Stats()
+	if stats.NumProcessedLines != 3 {
+		t.Errorf("NumProcessedLines = %d, want 3", stats.NumProcessedLines)
+	}
+	if got := stats.Metrics["c:aggregate.rows"]; got != int64(2) {
+		t.Errorf("aggregate.rows = %v, want 2", got)
+	}
+	if got := stats.Metrics["g:aggregate.groups"]; got != float64(0) {
+		t.Errorf("aggregate.groups = %v, want 0", got)
+	}
+}
+
+func TestAggregateMetrics(t *testing.T) {
+	cfg := &AggregateConfig{
+		Aggregates:     []string{"sum:price"},
+		TimestampField: "timestamp",
+		Window:         10 * time.Second,
+		PathString:     filepath.Join(t.TempDir(), "aggregates.csv.gz"),
+	}
+	a := newTestAggregate(t, cfg)
+
+	runAggregate(t, a, []string{
+		"1622541600,,,1",
+		"1622541610,,,foo",
+		"1622541601,,,1",
+		"foo,,,1",
+	})
+
+	stats := a.Stats()
+	want := baker.MetricsBag{
+		"c:aggregate.late_records":   int64(1),
+		"c:aggregate.invalid_values": int64(1),
+		"c:aggregate.rows":           int64(2),
+		"g:aggregate.groups":         float64(0),
+	}
+	if !reflect.DeepEqual(stats.Metrics, want) {
+		t.Errorf("metrics = %v, want %v", stats.Metrics, want)
+	}
+	if stats.NumErrorLines != 1 {
+		t.Errorf("NumErrorLines = %d, want 1", stats.NumErrorLines)
+	}
+}
+
+func TestAggregateConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  AggregateConfig
+	}{
+		{name: "no aggregates", cfg: AggregateConfig{}},
+		{name: "unknown aggregate", cfg: AggregateConfig{Aggregates: []string{"avg:price"}}},
+		{name: "unknown aggregate field", cfg: AggregateConfig{Aggregates: []string{"sum:foo"}}},
+		{name: "count with a field", cfg: AggregateConfig{Aggregates: []string{"count:price"}}},
+		{name: "unknown group by field", cfg: AggregateConfig{Aggregates: []string{"count"}, GroupBy: []string{"foo"}}},
+		{name: "unknown timestamp field", cfg: AggregateConfig{Aggregates: []string{"count"}, TimestampField: "foo"}},
+		{name: "invalid precision", cfg: AggregateConfig{Aggregates: []string{"count"}, DistinctPrecision: 20}},
+		{name: "invalid separator", cfg: AggregateConfig{Aggregates: []string{"count"}, Separator: ";;"}},
+		{name: "Field0", cfg: AggregateConfig{Aggregates: []string{"count"}, PathString: "/tmp/{{.Field0}}.csv.gz"}},
+		{name: "malformed template", cfg: AggregateConfig{Aggregates: []string{"count"}, PathString: "/tmp/{{.Foo}.csv.gz"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewAggregate(baker.OutputParams{
+				ComponentParams: baker.ComponentParams{
+					DecodedConfig: &tt.cfg,
+					FieldByName: func(name string) (baker.FieldIndex, bool) {
+						return 0, name == "price"
+					},
+				},
+			})
+			if err == nil {
+				t.Errorf("got no error")
+			}
+		})
+	}
+}
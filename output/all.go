@@ -7,6 +7,7 @@ import (
 
 // All is the list of all baker outputs.
 var All = []baker.OutputDesc{
+	AggregateDesc,
 	DynamoDBDesc,
 	FileWriterDesc,
 	NopDesc,
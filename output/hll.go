@@ -0,0 +1,91 @@
+package output
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// hyperLogLog is a HyperLogLog sketch, estimating the number of distinct
+// values added to it in a fixed amount of memory: 2^precision bytes. The
+// standard error of the estimation is about 1.04/sqrt(2^precision), that is
+// 1.6% with a precision of 12.
+type hyperLogLog struct {
+	p    uint8
+	regs []uint8
+}
+
+const (
+	hllMinPrecision = 4
+	hllMaxPrecision = 18
+)
+
+// newHyperLogLog returns an empty sketch. precision must be in the
+// [hllMinPrecision, hllMaxPrecision] range.
+func newHyperLogLog(precision int) *hyperLogLog {
+	return &hyperLogLog{
+		p:    uint8(precision),
+		regs: make([]uint8, 1<<precision),
+	}
+}
+
+// hllHash hashes buf into a 64-bit value whose bits are evenly distributed,
+// as HyperLogLog requires.
+func hllHash(buf []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(buf)
+	x := h.Sum64()
+
+	// FNV doesn't avalanche well on short inputs, mix its output with the
+	// murmur3 finalizer.
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// add adds a value to the sketch.
+func (h *hyperLogLog) add(buf []byte) {
+	x := hllHash(buf)
+	idx := x >> (64 - h.p)
+	// Set a sentinel bit so that rank is at most 64-p+1.
+	w := x<<h.p | 1<<(h.p-1)
+	rank := uint8(bits.LeadingZeros64(w)) + 1
+	if rank > h.regs[idx] {
+		h.regs[idx] = rank
+	}
+}
+
+// count returns the estimated number of distinct values added to the sketch.
+func (h *hyperLogLog) count() uint64 {
+	m := float64(len(h.regs))
+
+	var alpha float64
+	switch len(h.regs) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+
+	sum, zeros := 0.0, 0
+	for _, r := range h.regs {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	est := alpha * m * m / sum
+	if est <= 2.5*m && zeros != 0 {
+		// Small range correction: linear counting.
+		est = m * math.Log(m/float64(zeros))
+	}
+	return uint64(est + 0.5)
+}
@@ -0,0 +1,41 @@
+package output
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	tests := []struct {
+		precision int
+		n         int
+	}{
+		{precision: 4, n: 10},
+		{precision: 12, n: 0},
+		{precision: 12, n: 1},
+		{precision: 12, n: 100},
+		{precision: 12, n: 10000},
+		{precision: 12, n: 1000000},
+		{precision: 14, n: 100000},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.precision)+"/"+strconv.Itoa(tt.n), func(t *testing.T) {
+			h := newHyperLogLog(tt.precision)
+			for i := 0; i < tt.n; i++ {
+				v := []byte("value-" + strconv.Itoa(i))
+				// Adding the same value twice doesn't change the count.
+				h.add(v)
+				h.add(v)
+			}
+
+			// Allow 4 standard errors.
+			stderr := 1.04 / math.Sqrt(float64(uint(1)<<tt.precision))
+			got := float64(h.count())
+			if diff := math.Abs(got - float64(tt.n)); diff > 4*stderr*float64(tt.n)+0.5 {
+				t.Errorf("count() = %v, want %d ± %.1f%%", got, tt.n, 400*stderr)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package output
 import (
 	"bytes"
 	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"io"
 	"math"
@@ -23,19 +24,65 @@ var StatsDesc = baker.OutputDesc{
 	Help: "Compute various distributions of the records it " +
 		"receives and dumps that to CSV. It computes the " +
 		"distribution of record by size and the distribution " +
-		"of the values of certain fields\n",
+		"of the values of certain fields\n\n" +
+		"The distribution of the values of the fields listed in [output.fields] " +
+		"is exact, which requires keeping all their distinct values in memory. " +
+		"For high-cardinality fields, prefer DistinctFields, which gives the " +
+		"approximate number of distinct values (HyperLogLog), and TopKFields, " +
+		"which gives their approximate most frequent values (Space-Saving), " +
+		"both in a fixed amount of memory.\n\n" +
+		"The same statistics can also be written as JSON, see JSONPath.\n",
 }
 
 type StatsConfig struct {
-	CountEmptyFields bool   `help:"Whether fields with empty values are counted or not" default:"false"`
-	CSVPath          string `help:"Path of the CSV file to create" default:"stats.csv"`
-	TimestampField   string `help:"Name of a field containing a POSIX timestamp (in seconds) used to build the times stats" required:"true"`
+	CountEmptyFields  bool     `help:"Whether fields with empty values are counted or not" default:"false"`
+	CSVPath           string   `help:"Path of the CSV file to create" default:"stats.csv"`
+	JSONPath          string   `help:"Path of a JSON file to create, in addition to the CSV file, with the same statistics. If empty, no JSON file is created"`
+	TimestampField    string   `help:"Name of a field containing a POSIX timestamp (in seconds) used to build the times stats" required:"true"`
+	DistinctFields    []string `help:"Names of the fields whose approximate number of distinct values is computed"`
+	DistinctPrecision int      `help:"Precision of the distinct counts, from 4 to 18. Each count uses 2^DistinctPrecision bytes, for a standard error of 1.04/sqrt(2^DistinctPrecision)" default:"14"`
+	TopKFields        []string `help:"Names of the fields whose approximate most frequent values are computed"`
+	TopK              int      `help:"Number of most frequent values reported for each of TopKFields" default:"10"`
+	TopKCapacity      int      `help:"Number of distinct values tracked for each of TopKFields, the bigger the more accurate the counts. Defaults to 10 times TopK"`
 }
 
-func (cfg *StatsConfig) fillDefaults() {
+func (cfg *StatsConfig) fillDefaults() error {
 	if cfg.CSVPath == "" {
 		cfg.CSVPath = "stats.csv"
 	}
+	if cfg.DistinctPrecision == 0 {
+		cfg.DistinctPrecision = 14
+	}
+	if cfg.TopK == 0 {
+		cfg.TopK = 10
+	}
+	if cfg.TopKCapacity == 0 {
+		cfg.TopKCapacity = 10 * cfg.TopK
+	}
+
+	if cfg.DistinctPrecision < hllMinPrecision || cfg.DistinctPrecision > hllMaxPrecision {
+		return fmt.Errorf("DistinctPrecision must be in [%d, %d], got %d", hllMinPrecision, hllMaxPrecision, cfg.DistinctPrecision)
+	}
+	if cfg.TopK < 0 {
+		return fmt.Errorf("TopK must be positive, got %d", cfg.TopK)
+	}
+	if cfg.TopKCapacity < cfg.TopK {
+		return fmt.Errorf("TopKCapacity (%d) must be greater than or equal to TopK (%d)", cfg.TopKCapacity, cfg.TopK)
+	}
+	return nil
+}
+
+// statsQuantiles are the quantiles reported for distributions.
+var statsQuantiles = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 0.75, 0.90, 0.95, 0.99}
+
+// quantilesJSON returns the statsQuantiles of qt, indexed by percentile
+// names ("p1", "p5", etc.).
+func quantilesJSON(qt *quantile.Stream) map[string]float64 {
+	m := make(map[string]float64, len(statsQuantiles))
+	for _, q := range statsQuantiles {
+		m[fmt.Sprintf("p%g", q*100)] = qt.Query(q)
+	}
+	return m
 }
 
 type sizeStats struct {
@@ -100,6 +147,26 @@ func (s *sizeStats) print(w io.Writer) error {
 	return csvw.Error()
 }
 
+type sizeStatsJSON struct {
+	Count       int                `json:"count"`
+	Errors      uint64             `json:"errors"`
+	TotalBytes  uint64             `json:"total_bytes"`
+	Smallest    uint32             `json:"smallest"`
+	Biggest     uint32             `json:"biggest"`
+	Percentiles map[string]float64 `json:"percentiles"`
+}
+
+func (s *sizeStats) json() sizeStatsJSON {
+	return sizeStatsJSON{
+		Count:       s.qt.Count(),
+		Errors:      s.errs,
+		TotalBytes:  s.totbytes,
+		Smallest:    s.smallest,
+		Biggest:     s.biggest,
+		Percentiles: quantilesJSON(s.qt),
+	}
+}
+
 type fieldStats struct {
 	m       map[string]uint
 	field   baker.FieldIndex
@@ -115,10 +182,12 @@ func (s *fieldStats) add(ll baker.Record) {
 	s.m[string(b)]++
 }
 
-func (s *fieldStats) print(w io.Writer, fieldNames []string) error {
-	var smallest, biggest uint = math.MaxUint32, 0
+// distribution returns the distribution of the number of records per
+// distinct value.
+func (s *fieldStats) distribution() (qt *quantile.Stream, smallest, biggest uint) {
+	smallest, biggest = math.MaxUint32, 0
 
-	qt := quantile.NewTargeted(0.01, 0.05, 0.1, 0.25, 0.5, 0.75, 0.90, 0.95, 0.99)
+	qt = quantile.NewTargeted(statsQuantiles...)
 	for _, freq := range s.m {
 		qt.Insert(float64(freq))
 
@@ -130,6 +199,11 @@ func (s *fieldStats) print(w io.Writer, fieldNames []string) error {
 			smallest = freq
 		}
 	}
+	return qt, smallest, biggest
+}
+
+func (s *fieldStats) print(w io.Writer, fieldNames []string) error {
+	qt, smallest, biggest := s.distribution()
 
 	csvw := csv.NewWriter(w)
 	if err := csvw.Write(
@@ -162,6 +236,81 @@ func (s *fieldStats) print(w io.Writer, fieldNames []string) error {
 	return csvw.Error()
 }
 
+type fieldStatsJSON struct {
+	Count       int                `json:"count"`
+	Smallest    uint               `json:"smallest"`
+	Biggest     uint               `json:"biggest"`
+	Percentiles map[string]float64 `json:"percentiles"`
+}
+
+func (s *fieldStats) json() fieldStatsJSON {
+	qt, smallest, biggest := s.distribution()
+	return fieldStatsJSON{
+		Count:       qt.Count(),
+		Smallest:    smallest,
+		Biggest:     biggest,
+		Percentiles: quantilesJSON(qt),
+	}
+}
+
+// distinctStats computes the approximate number of distinct values of a
+// field.
+type distinctStats struct {
+	hll     *hyperLogLog
+	field   baker.FieldIndex
+	empties bool // count empty fields?
+}
+
+func (s *distinctStats) add(ll baker.Record) {
+	b := ll.Get(s.field)
+	if !s.empties && b == nil {
+		return
+	}
+
+	s.hll.add(b)
+}
+
+func (s *distinctStats) print(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "distinct values\n%d\n", s.hll.count())
+	return err
+}
+
+// topKStats computes the approximate most frequent values of a field.
+type topKStats struct {
+	tk      *topK
+	k       int
+	field   baker.FieldIndex
+	empties bool // count empty fields?
+}
+
+func (s *topKStats) add(ll baker.Record) {
+	b := ll.Get(s.field)
+	if !s.empties && b == nil {
+		return
+	}
+
+	s.tk.add(b)
+}
+
+func (s *topKStats) print(w io.Writer) error {
+	csvw := csv.NewWriter(w)
+	if err := csvw.Write([]string{"value", "count", "error"}); err != nil {
+		return err
+	}
+	for _, e := range s.tk.top(s.k) {
+		if err := csvw.Write([]string{
+			e.Value,
+			strconv.FormatUint(e.Count, 10),
+			strconv.FormatUint(e.Error, 10),
+		}); err != nil {
+			return err
+		}
+	}
+
+	csvw.Flush()
+	return csvw.Error()
+}
+
 type timestampStats struct {
 	nerrors     int64 // count malformed timestamps
 	nempties    int64 // count empty timestamps
@@ -230,29 +379,68 @@ func (s *timestampStats) print(w io.Writer) error {
 	return csvw.Error()
 }
 
+type timestampStatsJSON struct {
+	Count       int               `json:"count"`
+	Errors      int64             `json:"errors"`
+	Empty       int64             `json:"empty"`
+	First       *time.Time        `json:"first"`       // null without valid timestamps
+	Last        *time.Time        `json:"last"`        // null without valid timestamps
+	Percentiles map[string]string `json:"percentiles"` // null without valid timestamps
+}
+
+func (s *timestampStats) json() timestampStatsJSON {
+	js := timestampStatsJSON{
+		Count:  s.qt.Count(),
+		Errors: s.nerrors,
+		Empty:  s.nempties,
+	}
+	if js.Count == 0 {
+		// first and last are still at their initial values, which can't
+		// be marshaled.
+		return js
+	}
+
+	first, last := time.Unix(s.first, 0).UTC(), time.Unix(s.last, 0).UTC()
+	js.First, js.Last = &first, &last
+	js.Percentiles = make(map[string]string, len(statsQuantiles))
+	for k, v := range quantilesJSON(s.qt) {
+		js.Percentiles[k] = time.Unix(int64(v), 0).UTC().Format(time.RFC3339)
+	}
+	return js
+}
+
 // The Stats output gathers statistics about the sizes of log lines it sees.
 type Stats struct {
 	totaln uint64 // total processed lines
 	errn   uint64 // number of lines that were skipped because of errors
 
-	cfg     baker.OutputParams
-	csvPath string
-	sizes   sizeStats      // log line sizes stats
-	fields  []fieldStats   // per-field stats
-	times   timestampStats // timestamps stats
+	cfg      baker.OutputParams
+	dcfg     *StatsConfig
+	sizes    sizeStats       // log line sizes stats
+	fields   []fieldStats    // per-field stats
+	distinct []distinctStats // per-field distinct counts
+	topk     []topKStats     // per-field most frequent values
+	times    timestampStats  // timestamps stats
 }
 
 // NewStats returns a new Stats Baker output.
 func NewStats(cfg baker.OutputParams) (baker.Output, error) {
 	dcfg := cfg.DecodedConfig.(*StatsConfig)
-	dcfg.fillDefaults()
+	if err := dcfg.fillDefaults(); err != nil {
+		return nil, err
+	}
 
-	// Ensure output file is writable
-	outf, err := os.Create(dcfg.CSVPath)
-	if err != nil {
-		return nil, fmt.Errorf("can't create %s: %v", dcfg.CSVPath, err)
+	// Ensure output files are writable
+	for _, path := range []string{dcfg.CSVPath, dcfg.JSONPath} {
+		if path == "" {
+			continue
+		}
+		outf, err := os.Create(path)
+		if err != nil {
+			return nil, fmt.Errorf("can't create %s: %v", path, err)
+		}
+		outf.Close()
 	}
-	outf.Close()
 
 	fstats := make([]fieldStats, 0)
 	for _, field := range cfg.Fields {
@@ -263,6 +451,33 @@ func NewStats(cfg baker.OutputParams) (baker.Output, error) {
 		})
 	}
 
+	var dstats []distinctStats
+	for _, name := range dcfg.DistinctFields {
+		field, ok := cfg.FieldByName(name)
+		if !ok {
+			return nil, fmt.Errorf("cannot find field %s", name)
+		}
+		dstats = append(dstats, distinctStats{
+			hll:     newHyperLogLog(dcfg.DistinctPrecision),
+			field:   field,
+			empties: dcfg.CountEmptyFields,
+		})
+	}
+
+	var tkstats []topKStats
+	for _, name := range dcfg.TopKFields {
+		field, ok := cfg.FieldByName(name)
+		if !ok {
+			return nil, fmt.Errorf("cannot find field %s", name)
+		}
+		tkstats = append(tkstats, topKStats{
+			tk:      newTopK(dcfg.TopKCapacity),
+			k:       dcfg.TopK,
+			field:   field,
+			empties: dcfg.CountEmptyFields,
+		})
+	}
+
 	var idx baker.FieldIndex = -1
 	if dcfg.TimestampField != "" {
 		var ok bool
@@ -273,14 +488,16 @@ func NewStats(cfg baker.OutputParams) (baker.Output, error) {
 	}
 
 	return &Stats{
-		csvPath: dcfg.CSVPath,
-		cfg:     cfg,
+		cfg:  cfg,
+		dcfg: dcfg,
 		sizes: sizeStats{
 			smallest: math.MaxUint32,
 			biggest:  0,
 			qt:       quantile.NewTargeted(0.01, 0.05, 0.1, 0.25, 0.5, 0.75, 0.90, 0.95, 0.99),
 		},
-		fields: fstats,
+		fields:   fstats,
+		distinct: dstats,
+		topk:     tkstats,
 		times: timestampStats{
 			qt:       quantile.NewTargeted(0.01, 0.05, 0.1, 0.25, 0.5, 0.75, 0.90, 0.95, 0.99),
 			first:    math.MaxInt64,
@@ -305,13 +522,24 @@ func (s *Stats) Run(input <-chan baker.OutputRecord, _ chan<- string) error {
 		for i := range s.fields {
 			s.fields[i].add(ll)
 		}
+		for i := range s.distinct {
+			s.distinct[i].add(ll)
+		}
+		for i := range s.topk {
+			s.topk[i].add(ll)
+		}
 		s.sizes.add(uint32(len(raw.Record)), ll, valid)
 		if s.times.fieldIdx != -1 {
 			s.times.add(ll)
 		}
 	}
 	if err := s.createStatsCSV(); err != nil {
-		return fmt.Errorf("can't open %s: %v", s.csvPath, err)
+		return fmt.Errorf("can't open %s: %v", s.dcfg.CSVPath, err)
+	}
+	if s.dcfg.JSONPath != "" {
+		if err := s.createStatsJSON(); err != nil {
+			return fmt.Errorf("can't write %s: %v", s.dcfg.JSONPath, err)
+		}
 	}
 	return nil
 }
@@ -329,8 +557,58 @@ func (s *Stats) createStatsCSV() error {
 		fmt.Fprintf(buf, "section,%s,distribution of number of log lines per distinct %s value\n", fname, fname)
 		s.fields[i].print(buf, s.cfg.FieldNames)
 	}
-	return os.WriteFile(s.csvPath, buf.Bytes(), os.ModePerm)
+	for i := range s.distinct {
+		fname := s.cfg.FieldNames[s.distinct[i].field]
+		fmt.Fprintf(buf, "section,%s,approximate number of distinct %s values\n", fname, fname)
+		s.distinct[i].print(buf)
+	}
+	for i := range s.topk {
+		fname := s.cfg.FieldNames[s.topk[i].field]
+		fmt.Fprintf(buf, "section,%s,approximate %d most frequent %s values\n", fname, s.topk[i].k, fname)
+		s.topk[i].print(buf)
+	}
+	return os.WriteFile(s.dcfg.CSVPath, buf.Bytes(), os.ModePerm)
+
+}
+
+type statsJSON struct {
+	Sizes      sizeStatsJSON             `json:"sizes"`
+	Timestamps *timestampStatsJSON       `json:"timestamps,omitempty"`
+	Fields     map[string]fieldStatsJSON `json:"fields,omitempty"`
+	Distinct   map[string]uint64         `json:"distinct,omitempty"`
+	TopK       map[string][]topKEntry    `json:"top_k,omitempty"`
+}
 
+func (s *Stats) createStatsJSON() error {
+	stats := statsJSON{Sizes: s.sizes.json()}
+	if s.times.fieldIdx != -1 {
+		times := s.times.json()
+		stats.Timestamps = &times
+	}
+	if len(s.fields) != 0 {
+		stats.Fields = make(map[string]fieldStatsJSON, len(s.fields))
+		for i := range s.fields {
+			stats.Fields[s.cfg.FieldNames[s.fields[i].field]] = s.fields[i].json()
+		}
+	}
+	if len(s.distinct) != 0 {
+		stats.Distinct = make(map[string]uint64, len(s.distinct))
+		for i := range s.distinct {
+			stats.Distinct[s.cfg.FieldNames[s.distinct[i].field]] = s.distinct[i].hll.count()
+		}
+	}
+	if len(s.topk) != 0 {
+		stats.TopK = make(map[string][]topKEntry, len(s.topk))
+		for i := range s.topk {
+			stats.TopK[s.cfg.FieldNames[s.topk[i].field]] = s.topk[i].tk.top(s.topk[i].k)
+		}
+	}
+
+	buf, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.dcfg.JSONPath, append(buf, '\n'), os.ModePerm)
 }
 
 // Stats implements baker.Output
@@ -0,0 +1,188 @@
+package output
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestStatsDistinctAndTopK(t *testing.T) {
+	dir := t.TempDir()
+	csvPath := filepath.Join(dir, "stats.csv")
+	jsonPath := filepath.Join(dir, "stats.json")
+
+	fields := []string{"timestamp", "country", "user"}
+	o, err := NewStats(baker.OutputParams{
+		ComponentParams: baker.ComponentParams{
+			DecodedConfig: &StatsConfig{
+				CSVPath:        csvPath,
+				JSONPath:       jsonPath,
+				TimestampField: "timestamp",
+				DistinctFields: []string{"user"},
+				TopKFields:     []string{"country"},
+				TopK:           2,
+			},
+			FieldByName: func(name string) (baker.FieldIndex, bool) {
+				for i, f := range fields {
+					if f == name {
+						return baker.FieldIndex(i), true
+					}
+				}
+				return 0, false
+			},
+			FieldNames:     fields,
+			CreateRecord:   func() baker.Record { return &baker.LogLine{FieldSeparator: ','} },
+			ValidateRecord: func(baker.Record) (bool, baker.FieldIndex) { return true, 0 },
+		},
+		Fields: []baker.FieldIndex{1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := make(chan baker.OutputRecord)
+	errc := make(chan error, 1)
+	go func() { errc <- o.Run(in, nil) }()
+	for _, r := range []string{
+		"1622541600,US,alice",
+		"1622541601,FR,bob",
+		"1622541602,US,carol",
+		"1622541603,DE,alice",
+		"1622541604,US,",
+		"1622541605,FR,bob",
+	} {
+		in <- baker.OutputRecord{Record: []byte(r)}
+	}
+	close(in)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := os.ReadFile(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"section,user,approximate number of distinct user values\ndistinct values\n3\n",
+		"section,country,approximate 2 most frequent country values\nvalue,count,error\nUS,3,0\nFR,2,0\n",
+	} {
+		if !strings.Contains(string(buf), want) {
+			t.Errorf("CSV file doesn't contain %q:\n%s", want, buf)
+		}
+	}
+
+	buf, err = os.ReadFile(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got statsJSON
+	if err := json.Unmarshal(buf, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Sizes.Count != 6 {
+		t.Errorf("sizes count = %d, want 6", got.Sizes.Count)
+	}
+	if got.Timestamps == nil || got.Timestamps.Count != 6 || got.Timestamps.Last.Unix() != 1622541605 {
+		t.Errorf("timestamps = %+v, want 6 timestamps, the last at 1622541605", got.Timestamps)
+	}
+	if f := got.Fields["country"]; f.Count != 3 || f.Smallest != 1 || f.Biggest != 3 {
+		t.Errorf(`fields["country"] = %+v, want 3 values, from 1 to 3 records`, f)
+	}
+	if want := map[string]uint64{"user": 3}; !reflect.DeepEqual(got.Distinct, want) {
+		t.Errorf("distinct = %v, want %v", got.Distinct, want)
+	}
+	wantTopK := map[string][]topKEntry{"country": {{Value: "US", Count: 3}, {Value: "FR", Count: 2}}}
+	if !reflect.DeepEqual(got.TopK, wantTopK) {
+		t.Errorf("top_k = %+v, want %+v", got.TopK, wantTopK)
+	}
+}
+
+func TestStatsConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  StatsConfig
+	}{
+		{name: "unknown distinct field", cfg: StatsConfig{DistinctFields: []string{"foo"}}},
+		{name: "unknown top-k field", cfg: StatsConfig{TopKFields: []string{"foo"}}},
+		{name: "invalid precision", cfg: StatsConfig{DistinctPrecision: 2}},
+		{name: "capacity smaller than k", cfg: StatsConfig{TopK: 10, TopKCapacity: 5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.CSVPath = filepath.Join(t.TempDir(), "stats.csv")
+			_, err := NewStats(baker.OutputParams{
+				ComponentParams: baker.ComponentParams{
+					DecodedConfig: &tt.cfg,
+					FieldByName:   func(string) (baker.FieldIndex, bool) { return 0, false },
+				},
+			})
+			if err == nil {
+				t.Errorf("got no error")
+			}
+		})
+	}
+}
+
+func TestStatsJSONWithoutValidTimestamps(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "stats.json")
+
+	fields := []string{"timestamp", "country"}
+	o, err := NewStats(baker.OutputParams{
+		ComponentParams: baker.ComponentParams{
+			DecodedConfig: &StatsConfig{
+				CSVPath:        filepath.Join(dir, "stats.csv"),
+				JSONPath:       jsonPath,
+				TimestampField: "timestamp",
+			},
+			FieldByName: func(name string) (baker.FieldIndex, bool) {
+				for i, f := range fields {
+					if f == name {
+						return baker.FieldIndex(i), true
+					}
+				}
+				return 0, false
+			},
+			FieldNames:     fields,
+			CreateRecord:   func() baker.Record { return &baker.LogLine{FieldSeparator: ','} },
+			ValidateRecord: func(baker.Record) (bool, baker.FieldIndex) { return true, 0 },
+		},
+		Fields: []baker.FieldIndex{1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := make(chan baker.OutputRecord)
+	errc := make(chan error, 1)
+	go func() { errc <- o.Run(in, nil) }()
+	for _, r := range []string{",US", "yesterday,FR", "1e9,DE"} {
+		in <- baker.OutputRecord{Record: []byte(r)}
+	}
+	close(in)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := os.ReadFile(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got statsJSON
+	if err := json.Unmarshal(buf, &got); err != nil {
+		t.Fatal(err)
+	}
+	ts := got.Timestamps
+	if ts == nil || ts.Count != 0 || ts.Errors+ts.Empty != 3 {
+		t.Fatalf("timestamps = %+v, want 3 empty or malformed timestamps", ts)
+	}
+	if ts.First != nil || ts.Last != nil || ts.Percentiles != nil {
+		t.Errorf("timestamps = %+v, want null first, last and percentiles", ts)
+	}
+}
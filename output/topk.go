@@ -0,0 +1,111 @@
+package output
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// topK finds the most frequent values of a stream, in a fixed amount of
+// memory, with the Space-Saving algorithm (Metwally et al., "Efficient
+// Computation of Frequent and Top-k Elements in Data Streams").
+//
+// At most capacity values are tracked. When a value that isn't tracked is
+// seen and all counters are in use, the value with the smallest count is
+// evicted and its count inherited by the new value, which overestimates it
+// by at most that count, reported as the error of the value.
+type topK struct {
+	capacity int
+	counters map[string]*topKCounter
+	heap     topKHeap // min-heap of counters, by count
+}
+
+type topKCounter struct {
+	value string
+	count uint64
+	err   uint64
+	index int // in the heap
+}
+
+// A topKEntry is a frequent value, with its estimated count and the
+// maximum overestimation of that count.
+type topKEntry struct {
+	Value string `json:"value"`
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error"`
+}
+
+func newTopK(capacity int) *topK {
+	return &topK{
+		capacity: capacity,
+		counters: make(map[string]*topKCounter, capacity),
+		heap:     make(topKHeap, 0, capacity),
+	}
+}
+
+// add counts one occurrence of v.
+func (t *topK) add(v []byte) {
+	if c, ok := t.counters[string(v)]; ok {
+		c.count++
+		heap.Fix(&t.heap, c.index)
+		return
+	}
+
+	if len(t.heap) < t.capacity {
+		c := &topKCounter{value: string(v), count: 1}
+		t.counters[c.value] = c
+		heap.Push(&t.heap, c)
+		return
+	}
+
+	// Replace the value with the smallest count.
+	c := t.heap[0]
+	delete(t.counters, c.value)
+	c.value = string(v)
+	c.err = c.count
+	c.count++
+	t.counters[c.value] = c
+	heap.Fix(&t.heap, 0)
+}
+
+// top returns, at most, the k most frequent values, by decreasing count.
+func (t *topK) top(k int) []topKEntry {
+	entries := make([]topKEntry, 0, len(t.heap))
+	for _, c := range t.heap {
+		entries = append(entries, topKEntry{Value: c.value, Count: c.count, Error: c.err})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Value < entries[j].Value
+	})
+	if len(entries) > k {
+		entries = entries[:k]
+	}
+	return entries
+}
+
+// topKHeap implements heap.Interface.
+type topKHeap []*topKCounter
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *topKHeap) Push(x interface{}) {
+	c := x.(*topKCounter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *topKHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
@@ -0,0 +1,91 @@
+package output
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestTopK(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		k        int
+		values   []string
+		want     []topKEntry
+	}{
+		{
+			name:     "empty",
+			capacity: 3,
+			k:        2,
+			want:     []topKEntry{},
+		},
+		{
+			name:     "exact",
+			capacity: 3,
+			k:        2,
+			values:   []string{"a", "b", "a", "c", "a", "b"},
+			want: []topKEntry{
+				{Value: "a", Count: 3},
+				{Value: "b", Count: 2},
+			},
+		},
+		{
+			name:     "ties are sorted by value",
+			capacity: 3,
+			k:        5,
+			values:   []string{"c", "b", "a"},
+			want: []topKEntry{
+				{Value: "a", Count: 1},
+				{Value: "b", Count: 1},
+				{Value: "c", Count: 1},
+			},
+		},
+		{
+			name:     "eviction",
+			capacity: 2,
+			k:        2,
+			values:   []string{"a", "a", "a", "b", "c"},
+			want: []topKEntry{
+				{Value: "a", Count: 3},
+				{Value: "c", Count: 2, Error: 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tk := newTopK(tt.capacity)
+			for _, v := range tt.values {
+				tk.add([]byte(v))
+			}
+			if got := tk.top(tt.k); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("top(%d) = %+v, want %+v", tt.k, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTopKSkewed(t *testing.T) {
+	// Values 0 to 9 are frequent, the others appear only once, and are more
+	// numerous than the capacity.
+	tk := newTopK(100)
+	for i := 0; i < 10000; i++ {
+		tk.add([]byte(strconv.Itoa(i % 10)))
+		tk.add([]byte("rare-" + strconv.Itoa(i)))
+	}
+
+	top := tk.top(10)
+	seen := make(map[string]bool)
+	for _, e := range top {
+		seen[e.Value] = true
+		if e.Count-e.Error > 1000 || e.Count < 1000 {
+			t.Errorf("%q: count = %d ± %d, want 1000", e.Value, e.Count, e.Error)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if !seen[strconv.Itoa(i)] {
+			t.Errorf("%d is missing from the top values: %+v", i, top)
+		}
+	}
+}
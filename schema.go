@@ -0,0 +1,297 @@
+package baker
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Schema describes the expected type and constraints of record fields, by
+// field name. In TOML, it's set in the [schema] section, with one table per
+// field:
+//
+//	[schema.timestamp]
+//	type = "int"
+//	required = true
+//	min = 0
+//
+//	[schema.country]
+//	type = "enum"
+//	values = ["US", "FR"]
+//
+// A Schema is compiled into a SchemaValidator by NewSchemaValidator.
+type Schema map[string]SchemaField
+
+// SchemaField describes the expected type and constraints of a field.
+//
+// Empty values are valid unless Required is set, in which case the other
+// checks aren't performed.
+type SchemaField struct {
+	// Type is one of "string" (default, no type check), "int", "float",
+	// "bool", "enum", "timestamp", "uuid" or "url".
+	Type string `toml:"type"`
+	// Required reports whether the field can't be empty.
+	Required bool `toml:"required"`
+	// Min and Max are the bounds, inclusive, of "int" and "float" values.
+	// Either can be unset (nil). They're numbers (int, int64 or float64) but
+	// are declared as interface{} since TOML integers can't be decoded into
+	// floats.
+	Min interface{} `toml:"min"`
+	Max interface{} `toml:"max"`
+	// Values are the allowed values of "enum" fields.
+	Values []string `toml:"values"`
+	// Layout is the time.Parse layout of "timestamp" values, RFC3339 by
+	// default, or "unix" for a number of seconds since the Unix epoch.
+	Layout string `toml:"layout"`
+	// MaxLength is the maximum length of the value in characters, 0 meaning
+	// no limit. It applies to all types.
+	MaxLength int `toml:"max_length"`
+}
+
+// A SchemaValidator validates records against a Schema.
+type SchemaValidator struct {
+	fields []schemaFieldValidator // sorted by field index
+}
+
+type schemaFieldValidator struct {
+	idx      FieldIndex
+	required bool
+	checks   []func([]byte) bool
+}
+
+// NewSchemaValidator compiles schema into a SchemaValidator. fieldByName
+// translates the field names of the schema into field indexes.
+func NewSchemaValidator(schema Schema, fieldByName func(string) (FieldIndex, bool)) (*SchemaValidator, error) {
+	v := &SchemaValidator{}
+	for name, f := range schema {
+		idx, ok := fieldByName(name)
+		if !ok {
+			return nil, fmt.Errorf("schema field %q not exists", name)
+		}
+		checks, err := f.checks()
+		if err != nil {
+			return nil, fmt.Errorf("schema field %q: %v", name, err)
+		}
+		v.fields = append(v.fields, schemaFieldValidator{idx: idx, required: f.Required, checks: checks})
+	}
+	sort.Slice(v.fields, func(i, j int) bool { return v.fields[i].idx < v.fields[j].idx })
+	return v, nil
+}
+
+// Validate implements ValidationFunc, reporting the first field (by index)
+// that isn't valid. It can be used as Components.Validate.
+func (v *SchemaValidator) Validate(r Record) (bool, FieldIndex) {
+	for i := range v.fields {
+		if !v.fields[i].valid(r.Get(v.fields[i].idx)) {
+			return false, v.fields[i].idx
+		}
+	}
+	return true, 0
+}
+
+// InvalidFields appends the indexes of all the fields of r that aren't
+// valid to dst and returns the resulting slice. It can be used as
+// Components.InvalidFields, along with Validate.
+func (v *SchemaValidator) InvalidFields(r Record, dst []FieldIndex) []FieldIndex {
+	for i := range v.fields {
+		if !v.fields[i].valid(r.Get(v.fields[i].idx)) {
+			dst = append(dst, v.fields[i].idx)
+		}
+	}
+	return dst
+}
+
+func (f *schemaFieldValidator) valid(b []byte) bool {
+	if len(b) == 0 {
+		return !f.required
+	}
+	for _, check := range f.checks {
+		if !check(b) {
+			return false
+		}
+	}
+	return true
+}
+
+// checks returns the functions checking the non-empty values of the field.
+func (f SchemaField) checks() ([]func([]byte) bool, error) {
+	var checks []func([]byte) bool
+
+	if f.MaxLength < 0 {
+		return nil, fmt.Errorf("max_length must be positive, got %d", f.MaxLength)
+	}
+	if f.MaxLength > 0 {
+		max := f.MaxLength
+		checks = append(checks, func(b []byte) bool { return utf8.RuneCount(b) <= max })
+	}
+
+	typ := strings.ToLower(f.Type)
+	if (f.Min != nil || f.Max != nil) && typ != "int" && typ != "float" {
+		return nil, fmt.Errorf("min and max can't be set on %q fields", f.Type)
+	}
+	if len(f.Values) != 0 && typ != "enum" {
+		return nil, fmt.Errorf("values can't be set on %q fields", f.Type)
+	}
+	if f.Layout != "" && typ != "timestamp" {
+		return nil, fmt.Errorf("layout can't be set on %q fields", f.Type)
+	}
+
+	switch typ {
+	case "", "string":
+	case "int":
+		min, max, err := f.intBounds()
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, func(b []byte) bool {
+			n, err := strconv.ParseInt(string(b), 10, 64)
+			return err == nil && n >= min && n <= max
+		})
+	case "float":
+		min, max, err := f.bounds()
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, func(b []byte) bool {
+			n, err := strconv.ParseFloat(string(b), 64)
+			return err == nil && !math.IsNaN(n) && n >= min && n <= max
+		})
+	case "bool":
+		checks = append(checks, func(b []byte) bool {
+			_, err := strconv.ParseBool(string(b))
+			return err == nil
+		})
+	case "enum":
+		if len(f.Values) == 0 {
+			return nil, fmt.Errorf("enum fields require values")
+		}
+		values := make(map[string]struct{}, len(f.Values))
+		for _, s := range f.Values {
+			values[s] = struct{}{}
+		}
+		checks = append(checks, func(b []byte) bool {
+			_, ok := values[string(b)]
+			return ok
+		})
+	case "timestamp":
+		switch f.Layout {
+		case "unix":
+			checks = append(checks, func(b []byte) bool {
+				_, err := strconv.ParseInt(string(b), 10, 64)
+				return err == nil
+			})
+		default:
+			layout := f.Layout
+			if layout == "" {
+				layout = time.RFC3339
+			}
+			checks = append(checks, func(b []byte) bool {
+				_, err := time.Parse(layout, string(b))
+				return err == nil
+			})
+		}
+	case "uuid":
+		checks = append(checks, validUUID)
+	case "url":
+		checks = append(checks, func(b []byte) bool {
+			u, err := url.Parse(string(b))
+			return err == nil && u.Scheme != "" && u.Host != ""
+		})
+	default:
+		return nil, fmt.Errorf("unsupported type %q", f.Type)
+	}
+
+	return checks, nil
+}
+
+// bounds returns the bounds of float fields, which are infinite if unset.
+func (f SchemaField) bounds() (min, max float64, err error) {
+	toFloat := func(name string, v interface{}, def float64) (float64, error) {
+		switch n := v.(type) {
+		case nil:
+			return def, nil
+		case int:
+			return float64(n), nil
+		case int64:
+			return float64(n), nil
+		case float64:
+			return n, nil
+		}
+		return 0, fmt.Errorf("%s must be a number, got %v", name, v)
+	}
+
+	if min, err = toFloat("min", f.Min, math.Inf(-1)); err != nil {
+		return 0, 0, err
+	}
+	if max, err = toFloat("max", f.Max, math.Inf(1)); err != nil {
+		return 0, 0, err
+	}
+	if min > max {
+		return 0, 0, fmt.Errorf("min (%v) is greater than max (%v)", min, max)
+	}
+	return min, max, nil
+}
+
+// intBounds returns the bounds of int fields, which are the limits of int64 if
+// unset. Integer bounds are kept as is, since not all int64 can be represented
+// as float64, and float bounds are rounded towards the inside of the range.
+func (f SchemaField) intBounds() (min, max int64, err error) {
+	toInt := func(name string, v interface{}, def int64, round func(float64) float64) (int64, error) {
+		switch n := v.(type) {
+		case nil:
+			return def, nil
+		case int:
+			return int64(n), nil
+		case int64:
+			return n, nil
+		case float64:
+			switch n = round(n); {
+			case math.IsNaN(n):
+			case n >= math.MaxInt64: // float64(math.MaxInt64) is 2^63
+				return math.MaxInt64, nil
+			case n <= math.MinInt64:
+				return math.MinInt64, nil
+			default:
+				return int64(n), nil
+			}
+		}
+		return 0, fmt.Errorf("%s must be a number, got %v", name, v)
+	}
+
+	if min, err = toInt("min", f.Min, math.MinInt64, math.Ceil); err != nil {
+		return 0, 0, err
+	}
+	if max, err = toInt("max", f.Max, math.MaxInt64, math.Floor); err != nil {
+		return 0, 0, err
+	}
+	if min > max {
+		return 0, 0, fmt.Errorf("min (%v) is greater than max (%v)", f.Min, f.Max)
+	}
+	return min, max, nil
+}
+
+// validUUID reports whether b is a UUID in its canonical textual
+// representation, xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx.
+func validUUID(b []byte) bool {
+	if len(b) != 36 {
+		return false
+	}
+	for i, c := range b {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
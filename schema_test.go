@@ -0,0 +1,255 @@
+package baker_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/input/inputtest"
+	"github.com/AdRoll/baker/output"
+)
+
+func TestSchemaValidator(t *testing.T) {
+	tests := []struct {
+		name    string
+		field   baker.SchemaField
+		valid   []string
+		invalid []string
+	}{
+		{
+			name:    "string",
+			field:   baker.SchemaField{},
+			valid:   []string{"", "foo"},
+			invalid: nil,
+		},
+		{
+			name:    "required",
+			field:   baker.SchemaField{Required: true},
+			valid:   []string{"foo"},
+			invalid: []string{""},
+		},
+		{
+			name:    "max length",
+			field:   baker.SchemaField{MaxLength: 3},
+			valid:   []string{"", "foo", "été"},
+			invalid: []string{"fooo"},
+		},
+		{
+			name:    "int",
+			field:   baker.SchemaField{Type: "int", Min: 0, Max: int64(100)},
+			valid:   []string{"", "0", "42", "100"},
+			invalid: []string{"-1", "101", "4.2", "foo"},
+		},
+		{
+			// 2^53+1 can't be represented as a float64 and rounds to 2^53.
+			name:    "int above 2^53",
+			field:   baker.SchemaField{Type: "int", Min: int64(-9007199254740992), Max: int64(9007199254740992)},
+			valid:   []string{"9007199254740992", "-9007199254740992"},
+			invalid: []string{"9007199254740993", "-9007199254740993"},
+		},
+		{
+			name:    "int with float bounds",
+			field:   baker.SchemaField{Type: "int", Min: 0.5, Max: 1e100},
+			valid:   []string{"1", "9223372036854775807"},
+			invalid: []string{"0"},
+		},
+		{
+			name:    "float",
+			field:   baker.SchemaField{Type: "float", Min: -1.5},
+			valid:   []string{"-1.5", "0", "1e100"},
+			invalid: []string{"-2", "NaN", "foo"},
+		},
+		{
+			name:    "bool",
+			field:   baker.SchemaField{Type: "bool", Required: true},
+			valid:   []string{"true", "0", "F"},
+			invalid: []string{"", "yes"},
+		},
+		{
+			name:    "enum",
+			field:   baker.SchemaField{Type: "enum", Values: []string{"US", "FR"}},
+			valid:   []string{"US", "FR"},
+			invalid: []string{"us", "DE"},
+		},
+		{
+			name:    "timestamp",
+			field:   baker.SchemaField{Type: "timestamp"},
+			valid:   []string{"2021-06-01T10:00:00Z", "2021-06-01T10:00:00+02:00"},
+			invalid: []string{"2021-06-01", "1622541600"},
+		},
+		{
+			name:    "timestamp with layout",
+			field:   baker.SchemaField{Type: "timestamp", Layout: "2006-01-02"},
+			valid:   []string{"2021-06-01"},
+			invalid: []string{"2021-06-01T10:00:00Z", "2021-13-01"},
+		},
+		{
+			name:    "unix timestamp",
+			field:   baker.SchemaField{Type: "timestamp", Layout: "unix"},
+			valid:   []string{"1622541600"},
+			invalid: []string{"2021-06-01"},
+		},
+		{
+			name:    "uuid",
+			field:   baker.SchemaField{Type: "uuid"},
+			valid:   []string{"123e4567-e89b-12d3-a456-426614174000", "123E4567-E89B-12D3-A456-426614174000"},
+			invalid: []string{"123e4567e89b12d3a456426614174000", "123e4567-e89b-12d3-a456-42661417400g"},
+		},
+		{
+			name:    "url",
+			field:   baker.SchemaField{Type: "url"},
+			valid:   []string{"https://example.com/path?q=1"},
+			invalid: []string{"/path", "example.com", "http://%zz"},
+		},
+	}
+
+	fieldByName := func(name string) (baker.FieldIndex, bool) { return 0, name == "f" }
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := baker.NewSchemaValidator(baker.Schema{"f": tt.field}, fieldByName)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			check := func(value string, want bool) {
+				l := &baker.LogLine{FieldSeparator: ','}
+				l.Set(0, []byte(value))
+				if ok, _ := v.Validate(l); ok != want {
+					t.Errorf("Validate(%q) = %v, want %v", value, ok, want)
+				}
+			}
+			for _, value := range tt.valid {
+				check(value, true)
+			}
+			for _, value := range tt.invalid {
+				check(value, false)
+			}
+		})
+	}
+}
+
+func TestSchemaValidatorErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema baker.Schema
+	}{
+		{name: "unknown field", schema: baker.Schema{"foo": {}}},
+		{name: "unknown type", schema: baker.Schema{"f": {Type: "date"}}},
+		{name: "enum without values", schema: baker.Schema{"f": {Type: "enum"}}},
+		{name: "min on string", schema: baker.Schema{"f": {Min: 1}}},
+		{name: "values on int", schema: baker.Schema{"f": {Type: "int", Values: []string{"1"}}}},
+		{name: "layout on string", schema: baker.Schema{"f": {Layout: "2006"}}},
+		{name: "min greater than max", schema: baker.Schema{"f": {Type: "int", Min: 2, Max: 1}}},
+		{name: "no int between min and max", schema: baker.Schema{"f": {Type: "int", Min: 1.2, Max: 1.8}}},
+		{name: "float min greater than max", schema: baker.Schema{"f": {Type: "float", Min: 2.5, Max: 1}}},
+		{name: "min not a number", schema: baker.Schema{"f": {Type: "int", Min: "1"}}},
+		{name: "negative max length", schema: baker.Schema{"f": {MaxLength: -1}}},
+	}
+
+	fieldByName := func(name string) (baker.FieldIndex, bool) { return 0, name == "f" }
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := baker.NewSchemaValidator(tt.schema, fieldByName); err == nil {
+				t.Errorf("got no error")
+			}
+		})
+	}
+}
+
+func TestSchemaInvalidFields(t *testing.T) {
+	schema := baker.Schema{
+		"f0": {Type: "int"},
+		"f1": {Required: true},
+		"f2": {Type: "enum", Values: []string{"a", "b"}},
+	}
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		switch name {
+		case "f0":
+			return 0, true
+		case "f1":
+			return 1, true
+		case "f2":
+			return 2, true
+		}
+		return 0, false
+	}
+	v, err := baker.NewSchemaValidator(schema, fieldByName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := &baker.LogLine{FieldSeparator: ','}
+	if err := l.Parse([]byte("foo,,c"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := v.InvalidFields(l, nil), []baker.FieldIndex{0, 1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("InvalidFields() = %v, want %v", got, want)
+	}
+	if ok, idx := v.Validate(l); ok || idx != 0 {
+		t.Errorf("Validate() = %v, %v, want false, 0", ok, idx)
+	}
+
+	l.Set(0, []byte("1"))
+	l.Set(1, []byte("x"))
+	l.Set(2, []byte("a"))
+	if got := v.InvalidFields(l, nil); len(got) != 0 {
+		t.Errorf("InvalidFields() = %v, want none", got)
+	}
+}
+
+func TestSchemaTOML(t *testing.T) {
+	toml := `
+[fields]
+names=["timestamp", "country", "price"]
+
+[schema.timestamp]
+type="timestamp"
+layout="unix"
+required=true
+
+[schema.country]
+type="enum"
+values=["US", "FR"]
+
+[schema.price]
+type="float"
+min=0
+max=1000.5
+
+[input]
+name="logline"
+
+[output]
+name="nop"
+fields=["country"]
+`
+	components := baker.Components{
+		Inputs:  []baker.InputDesc{inputtest.LogLineDesc},
+		Outputs: []baker.OutputDesc{output.NopDesc},
+	}
+
+	cfg, err := baker.NewConfigFromToml(strings.NewReader(toml), components)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := "1622541600,US,9.99\n,DE,-1\n"
+	buf := &bytes.Buffer{}
+	if err := baker.TraceFilterChain(cfg, strings.NewReader(records), buf); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `record #1: "1622541600,US,9.99"
+  output: "1622541600,US,9.99"
+record #2: ",DE,-1"
+  invalid: field "timestamp" didn't pass validation
+  invalid: field "country" didn't pass validation
+  invalid: field "price" didn't pass validation
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
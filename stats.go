@@ -5,7 +5,9 @@ import (
 	"io"
 	"os"
 	"runtime"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -18,6 +20,7 @@ type StatsDumper struct {
 	w          io.Writer     // stats destination
 	metrics    MetricsClient // metrics implementation to use
 	filterTags [][]string
+	outchTags  [][]string
 
 	lock             sync.Mutex
 	prevwlines       int64
@@ -36,11 +39,18 @@ func NewStatsDumper(t *Topology) (sd *StatsDumper) {
 		ftags[i] = []string{"filter_name:" + t.filterNames[i]}
 	}
 
+	// Same for output channels, one per shard when sharding is enabled.
+	otags := make([][]string, len(t.outch))
+	for i := range otags {
+		otags[i] = []string{"shard:" + strconv.Itoa(i)}
+	}
+
 	return &StatsDumper{
 		t:          t,
 		w:          os.Stdout,
 		metrics:    t.Metrics,
 		filterTags: ftags,
+		outchTags:  otags,
 	}
 }
 
@@ -98,7 +108,7 @@ func (sd *StatsDumper) dumpNow() {
 		log.Fatalf("numUploads < prevUploads: %d < %d\n", numUploads, sd.prevUploads)
 	}
 
-	invalid := sd.countInvalid()
+	invalid := atomic.LoadInt64(&t.invalidLines)
 	parseErrors := t.malformed
 	totalErrors := invalid + parseErrors + filtered + outErrors
 	sd.metrics.RawCount("error_lines", totalErrors)
@@ -161,6 +171,8 @@ func (sd *StatsDumper) dumpNow() {
 		fmt.Fprintf(sd.w, "--- Filtered lines: %v\n", filteredMap)
 	}
 
+	sd.dumpQueues()
+
 	// Go stats
 	sd.metrics.Gauge("runtime.numgoroutines", float64(runtime.NumGoroutine()))
 
@@ -181,15 +193,38 @@ func (sd *StatsDumper) dumpNow() {
 	sd.prevUploadErrors = numUploadErrors
 }
 
-func (sd *StatsDumper) countInvalid() int64 {
-	sd.t.mu.RLock()
-	defer sd.t.mu.RUnlock()
+// dumpQueues publishes the depth and fill ratio of the channels connecting
+// topology components, as well as the total time the filter chain has spent
+// blocked while sending records to the output(s). Taken together, these
+// metrics tell whether a topology is input, filter or output bound.
+func (sd *StatsDumper) dumpQueues() {
+	t := sd.t
+
+	sd.metrics.Gauge("queue.input.depth", float64(len(t.inch)))
+	sd.metrics.Gauge("queue.input.fill", fillRatio(len(t.inch), cap(t.inch)))
+
+	for i, ch := range t.outch {
+		if ch == nil {
+			continue
+		}
+		sd.metrics.GaugeWithTags("queue.output.depth", float64(len(ch)), sd.outchTags[i])
+		sd.metrics.GaugeWithTags("queue.output.fill", fillRatio(len(ch), cap(ch)), sd.outchTags[i])
+	}
+
+	sd.metrics.Gauge("queue.upload.depth", float64(len(t.upch)))
+	sd.metrics.Gauge("queue.upload.fill", fillRatio(len(t.upch), cap(t.upch)))
+
+	blocked := time.Duration(atomic.LoadInt64(&t.outBlocked))
+	sd.metrics.RawCount("filter_chain.blocked_ms", blocked.Milliseconds())
+}
 
-	sum := int64(0)
-	for _, i := range sd.t.invalid {
-		sum = sum + i
+// fillRatio returns the ratio between the number of elements queued in a
+// channel and its capacity. Unbuffered channels are considered empty.
+func fillRatio(n, size int) float64 {
+	if size == 0 {
+		return 0
 	}
-	return sum
+	return float64(n) / float64(size)
 }
 
 // Run starts dumping stats every second on standard output. Call stop() to
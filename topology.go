@@ -3,12 +3,14 @@ package baker
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -30,10 +32,12 @@ type Topology struct {
 	rawOutput bool
 	upch      chan string
 
-	malformed int64 // count parsing errors and empty records
+	malformed    int64 // count parsing errors and empty records
+	invalidLines int64 // count records that didn't pass validation
+	outBlocked   int64 // nanoseconds spent blocked sending records to the output channels
 
 	mu      sync.RWMutex         // protects invalid map
-	invalid map[FieldIndex]int64 // tracks validation errors (by field)
+	invalid map[FieldIndex]int64 // tracks validation errors (by field), a record can have several
 
 	shard func(l Record) uint64
 	chain func(l Record)
@@ -47,19 +51,19 @@ type Topology struct {
 	wgout sync.WaitGroup
 	wgupl sync.WaitGroup
 
-	validate   ValidationFunc
-	fieldNames []string // Used by StatsDumper
+	validate      ValidationFunc
+	invalidFields func(Record, []FieldIndex) []FieldIndex // reports all invalid fields, if set
+	fieldNames    []string                                // Used by StatsDumper
 }
 
 // NewTopologyFromConfig gets a baker configuration and returns a Topology
-func NewTopologyFromConfig(cfg *Config) (*Topology, error) {
-	var err error
-
+func NewTopologyFromConfig(cfg *Config) (_ *Topology, err error) {
 	tp := &Topology{
-		filterProcs: cfg.FilterChain.Procs,
-		rawOutput:   cfg.Output.desc.Raw,
-		validate:    cfg.validate,
-		fieldNames:  cfg.fieldNames,
+		filterProcs:   cfg.FilterChain.Procs,
+		rawOutput:     cfg.Output.desc.Raw,
+		validate:      cfg.validate,
+		invalidFields: cfg.invalidFields,
+		fieldNames:    cfg.fieldNames,
 		linePool: sync.Pool{
 			New: func() interface{} {
 				return cfg.createRecord()
@@ -68,85 +72,44 @@ func NewTopologyFromConfig(cfg *Config) (*Topology, error) {
 		invalid: make(map[FieldIndex]int64),
 	}
 
-	// Create the metrics client first since it's injected into components parameters.
-	if cfg.Metrics.Name != "" {
-		tp.Metrics, err = cfg.Metrics.desc.New(cfg.Metrics.DecodedConfig)
-		if err != nil {
-			return nil, fmt.Errorf("error creating metrics interface: %q: %v", cfg.Metrics.Name, err)
-		}
-	}
+	b := newComponentBuilder(cfg)
 
-	// Assign a dummy client if no one was installed
-	if tp.Metrics == nil {
-		tp.Metrics = NopMetrics{}
+	// Create the metrics client first since it's injected into components parameters.
+	tp.Metrics, err = b.newMetrics()
+	if err != nil {
+		return nil, err
 	}
 
 	// * Create input
-	inCfg := InputParams{
-		ComponentParams{
-			DecodedConfig:  cfg.Input.DecodedConfig,
-			FieldByName:    cfg.fieldByName,
-			FieldNames:     cfg.fieldNames,
-			CreateRecord:   cfg.createRecord,
-			ValidateRecord: cfg.validate,
-			Metrics:        tp.Metrics,
-		},
-	}
-	tp.Input, err = cfg.Input.desc.New(inCfg)
+	tp.Input, err = b.newInput()
 	if err != nil {
-		return nil, fmt.Errorf("error creating input: %v", err)
+		return nil, err
 	}
 
 	// * Create filters
-	for idx := range cfg.Filter {
-		filCfg := FilterParams{
-			ComponentParams{
-				DecodedConfig:  cfg.Filter[idx].DecodedConfig,
-				FieldByName:    cfg.fieldByName,
-				FieldNames:     cfg.fieldNames,
-				CreateRecord:   cfg.createRecord,
-				ValidateRecord: cfg.validate,
-				Metrics:        tp.Metrics,
-			},
-		}
-		fil, err := cfg.Filter[idx].desc.New(filCfg)
+	tp.Filters, tp.filterNames, err = b.newFilters()
+	if err != nil {
+		return nil, err
+	}
+	// Filters may have started background goroutines, stop them if the
+	// topology can't be created.
+	defer func() {
 		if err != nil {
-			return nil, fmt.Errorf("error creating filter: %v", err)
+			closeFilters(tp.Filters, tp.filterNames)
 		}
-		tp.Filters = append(tp.Filters, fil)
-		tp.filterNames = append(tp.filterNames, strings.ToLower(cfg.Filter[idx].Name))
-	}
-	makeUnivocal(tp.filterNames)
+	}()
 
 	// * Create outputs
-	if len(cfg.Output.Fields) == 0 && !tp.rawOutput {
-		return nil, fmt.Errorf("error creating output: no \"fields\" specified in [output]")
-	}
-
-	for _, fname := range cfg.Output.Fields {
-		fidx, ok := cfg.fieldByName(fname)
-		if !ok {
-			return nil, fmt.Errorf("error creating output: unknown field: %q", fname)
-		}
-		tp.outFields = append(tp.outFields, fidx)
+	var errs []error
+	tp.outFields, errs = b.outputFields()
+	if len(errs) != 0 {
+		return nil, errs[0]
 	}
 
 	for i := 0; i < cfg.Output.Procs; i++ {
-		outCfg := OutputParams{
-			ComponentParams: ComponentParams{
-				DecodedConfig:  cfg.Output.DecodedConfig,
-				FieldByName:    cfg.fieldByName,
-				FieldNames:     cfg.fieldNames,
-				CreateRecord:   cfg.createRecord,
-				ValidateRecord: cfg.validate,
-				Metrics:        tp.Metrics,
-			},
-			Index:  i,
-			Fields: tp.outFields,
-		}
-		out, err := cfg.Output.desc.New(outCfg)
+		out, err := b.newOutput(i, tp.outFields)
 		if err != nil {
-			return nil, fmt.Errorf("error creating output: %v", err)
+			return nil, err
 		}
 		tp.Output = append(tp.Output, out)
 	}
@@ -161,21 +124,11 @@ func NewTopologyFromConfig(cfg *Config) (*Topology, error) {
 	// channel, and the output workers will all fetch from the same.
 	tp.outch = make([]chan OutputRecord, cfg.Output.Procs)
 
-	if cfg.Output.Sharding != "" {
-		field, ok := cfg.fieldByName(cfg.Output.Sharding)
-		if !ok {
-			return nil, fmt.Errorf("invalid field: %q", cfg.Output.Sharding)
-		}
-
-		tp.shard = cfg.shardingFuncs[field]
-		if tp.shard == nil {
-			return nil, fmt.Errorf("field not supported for sharding: %q", cfg.Output.Sharding)
-		}
-
-		if !tp.Output[0].CanShard() {
-			return nil, fmt.Errorf("output component %q does not support sharding", cfg.Output.Name)
-		}
-
+	tp.shard, err = b.shardingFunc(tp.Output[0])
+	if err != nil {
+		return nil, err
+	}
+	if tp.shard != nil {
 		for i := range tp.outch {
 			tp.outch[i] = make(chan OutputRecord, cfg.Output.ChanSize)
 		}
@@ -183,21 +136,9 @@ func NewTopologyFromConfig(cfg *Config) (*Topology, error) {
 		tp.outch[0] = make(chan OutputRecord, cfg.Output.ChanSize)
 	}
 
-	if cfg.Upload.Name != "" {
-		upCfg := UploadParams{
-			ComponentParams{
-				DecodedConfig:  cfg.Upload.DecodedConfig,
-				FieldByName:    cfg.fieldByName,
-				FieldNames:     cfg.fieldNames,
-				CreateRecord:   cfg.createRecord,
-				ValidateRecord: cfg.validate,
-				Metrics:        tp.Metrics,
-			},
-		}
-		tp.Upload, err = cfg.Upload.desc.New(upCfg)
-		if err != nil {
-			return nil, fmt.Errorf("error creating upload: %v", err)
-		}
+	tp.Upload, err = b.newUpload()
+	if err != nil {
+		return nil, err
 	}
 	tp.upch = make(chan string)
 
@@ -219,11 +160,171 @@ func NewTopologyFromConfig(cfg *Config) (*Topology, error) {
 	// Disable validation if required
 	if cfg.General.DontValidateFields {
 		tp.validate = nil
+		tp.invalidFields = nil
 	}
 
 	return tp, nil
 }
 
+// componentBuilder creates the components described in a configuration.
+// NewTopologyFromConfig, CheckConfig and TraceFilterChain all create
+// components through it, so that components are created the same way
+// whatever the purpose.
+type componentBuilder struct {
+	cfg         *Config
+	metrics     MetricsClient                   // passed to components, set by newMetrics
+	fieldByName func(string) (FieldIndex, bool) // passed to components as FieldByName
+	dryRun      bool                            // passed to components as DryRun
+}
+
+func newComponentBuilder(cfg *Config) *componentBuilder {
+	return &componentBuilder{
+		cfg:         cfg,
+		metrics:     NopMetrics{},
+		fieldByName: cfg.fieldByName,
+	}
+}
+
+// params returns the parameters common to all components, with dcfg as the
+// decoded configuration.
+func (b *componentBuilder) params(dcfg interface{}) ComponentParams {
+	return ComponentParams{
+		DecodedConfig:  dcfg,
+		FieldByName:    b.fieldByName,
+		FieldNames:     b.cfg.fieldNames,
+		CreateRecord:   b.cfg.createRecord,
+		ValidateRecord: b.cfg.validate,
+		Metrics:        b.metrics,
+		DryRun:         b.dryRun,
+	}
+}
+
+// newMetrics creates the metrics client and injects it into the parameters
+// of the components created afterwards. If no metrics client is configured,
+// NopMetrics is returned.
+func (b *componentBuilder) newMetrics() (MetricsClient, error) {
+	if b.cfg.Metrics.Name == "" {
+		return b.metrics, nil
+	}
+	mc, err := b.cfg.Metrics.desc.New(b.cfg.Metrics.DecodedConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error creating metrics interface: %q: %v", b.cfg.Metrics.Name, err)
+	}
+	if mc != nil {
+		b.metrics = mc
+	}
+	return b.metrics, nil
+}
+
+func (b *componentBuilder) newInput() (Input, error) {
+	in, err := b.cfg.Input.desc.New(InputParams{b.params(b.cfg.Input.DecodedConfig)})
+	if err != nil {
+		return nil, fmt.Errorf("error creating input: %v", err)
+	}
+	return in, nil
+}
+
+// newFilter creates the idx-th filter of the chain.
+func (b *componentBuilder) newFilter(idx int) (Filter, error) {
+	fc := b.cfg.Filter[idx]
+	fil, err := fc.desc.New(FilterParams{b.params(fc.DecodedConfig)})
+	if err != nil {
+		return nil, fmt.Errorf("error creating filter #%d (%s): %v", idx+1, fc.Name, err)
+	}
+	return fil, nil
+}
+
+// newFilters creates the filters of the chain, in order, and returns them
+// along with their univocal names. On error, the filters already created are
+// closed.
+func (b *componentBuilder) newFilters() ([]Filter, []string, error) {
+	var (
+		filters []Filter
+		names   []string
+	)
+	for idx := range b.cfg.Filter {
+		fil, err := b.newFilter(idx)
+		if err != nil {
+			closeFilters(filters, names)
+			return nil, nil, err
+		}
+		filters = append(filters, fil)
+		names = append(names, strings.ToLower(b.cfg.Filter[idx].Name))
+	}
+	makeUnivocal(names)
+	return filters, names, nil
+}
+
+// outputFields returns the indexes of the fields sent to the output, along
+// with all the errors found in the output fields configuration.
+func (b *componentBuilder) outputFields() ([]FieldIndex, []error) {
+	var (
+		fields []FieldIndex
+		errs   []error
+	)
+	if len(b.cfg.Output.Fields) == 0 && !b.cfg.Output.desc.Raw {
+		errs = append(errs, fmt.Errorf("error creating output: no \"fields\" specified in [output]"))
+	}
+	for _, fname := range b.cfg.Output.Fields {
+		fidx, ok := b.fieldByName(fname)
+		if !ok {
+			errs = append(errs, fmt.Errorf("error creating output: unknown field: %q", fname))
+			continue
+		}
+		fields = append(fields, fidx)
+	}
+	return fields, errs
+}
+
+// newOutput creates the output of the given index, sent the given fields.
+func (b *componentBuilder) newOutput(index int, fields []FieldIndex) (Output, error) {
+	out, err := b.cfg.Output.desc.New(OutputParams{
+		ComponentParams: b.params(b.cfg.Output.DecodedConfig),
+		Index:           index,
+		Fields:          fields,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating output: %v", err)
+	}
+	return out, nil
+}
+
+// shardingFunc returns the sharding function of the field configured for
+// sharding, or nil if sharding isn't configured. out is used to check that
+// the output supports sharding, that check is skipped if out is nil.
+func (b *componentBuilder) shardingFunc(out Output) (func(Record) uint64, error) {
+	if b.cfg.Output.Sharding == "" {
+		return nil, nil
+	}
+
+	field, ok := b.fieldByName(b.cfg.Output.Sharding)
+	if !ok {
+		return nil, fmt.Errorf("invalid field: %q", b.cfg.Output.Sharding)
+	}
+
+	shard := b.cfg.shardingFuncs[field]
+	if shard == nil {
+		return nil, fmt.Errorf("field not supported for sharding: %q", b.cfg.Output.Sharding)
+	}
+
+	if out != nil && !out.CanShard() {
+		return nil, fmt.Errorf("output component %q does not support sharding", b.cfg.Output.Name)
+	}
+	return shard, nil
+}
+
+// newUpload creates the upload, or returns nil if none is configured.
+func (b *componentBuilder) newUpload() (Upload, error) {
+	if b.cfg.Upload.Name == "" {
+		return nil, nil
+	}
+	upl, err := b.cfg.Upload.desc.New(UploadParams{b.params(b.cfg.Upload.DecodedConfig)})
+	if err != nil {
+		return nil, fmt.Errorf("error creating upload: %v", err)
+	}
+	return upl, nil
+}
+
 // Start starts the Topology, that is start all components.
 // This function also intercepts the interrupt signal (ctrl+c)
 // starting the graceful shutdown (calling Topology.Stop())
@@ -303,6 +404,7 @@ func (t *Topology) Wait() {
 	t.wginp.Wait()
 	close(t.inch)
 	t.wgfil.Wait()
+	t.closeFilters()
 	for _, ch := range t.outch {
 		if ch != nil {
 			close(ch)
@@ -313,6 +415,25 @@ func (t *Topology) Wait() {
 	t.wgupl.Wait()
 }
 
+// closeFilters closes the filters implementing io.Closer.
+func (t *Topology) closeFilters() {
+	closeFilters(t.Filters, t.filterNames)
+}
+
+// closeFilters closes the filters implementing io.Closer, names holds their
+// names, for logging.
+func closeFilters(filters []Filter, names []string) {
+	for i, f := range filters {
+		c, ok := f.(io.Closer)
+		if !ok {
+			continue
+		}
+		if err := c.Close(); err != nil {
+			log.WithError(err).WithField("filter", names[i]).Error("error closing filter")
+		}
+	}
+}
+
 // Return the global (sticky) error state of the topology.
 //
 // Calling this function makes sense after Wait() is complete (before that, it
@@ -344,11 +465,22 @@ func (t *Topology) filterChainEnd(l Record) {
 		idx := t.shard(l)
 		outch = t.outch[int(idx%uint64(len(t.outch)))]
 	}
-	outch <- OutputRecord{Record: rawOut, Fields: out}
+
+	rec := OutputRecord{Record: rawOut, Fields: out}
+	select {
+	case outch <- rec:
+	default:
+		// The output channel is full, so we're going to block: keep track of
+		// how long, since it tells whether the topology is output-bound.
+		start := time.Now()
+		outch <- rec
+		atomic.AddInt64(&t.outBlocked, int64(time.Since(start)))
+	}
 }
 
 func (t *Topology) runFilterChain() {
 	mdZero := Metadata{}
+	var invalid []FieldIndex // reused to collect invalid fields
 
 	for bakerData := range t.inch {
 		data := bakerData.Bytes
@@ -378,8 +510,17 @@ func (t *Topology) runFilterChain() {
 				// call external validation function
 				ok, idx := t.validate(record)
 				if !ok {
+					atomic.AddInt64(&t.invalidLines, 1)
 					t.mu.Lock()
-					t.invalid[idx]++
+					if t.invalidFields != nil {
+						// Count all the fields that didn't pass validation.
+						invalid = t.invalidFields(record, invalid[:0])
+						for _, idx := range invalid {
+							t.invalid[idx]++
+						}
+					} else {
+						t.invalid[idx]++
+					}
 					t.mu.Unlock()
 					continue
 				}
@@ -114,3 +114,33 @@ func Test_makeUnivocal(t *testing.T) {
 		})
 	}
 }
+
+type closerFilter struct {
+	closed int
+}
+
+func (f *closerFilter) Process(l Record, next func(Record)) { next(l) }
+func (f *closerFilter) Stats() FilterStats                  { return FilterStats{} }
+func (f *closerFilter) Close() error {
+	f.closed++
+	return nil
+}
+
+type nopFilter struct{}
+
+func (nopFilter) Process(l Record, next func(Record)) { next(l) }
+func (nopFilter) Stats() FilterStats                  { return FilterStats{} }
+
+func TestTopologyCloseFilters(t *testing.T) {
+	f1, f2 := &closerFilter{}, &closerFilter{}
+	topo := &Topology{
+		Filters:     []Filter{f1, nopFilter{}, f2},
+		filterNames: []string{"closer", "nop", "closer_2"},
+	}
+
+	topo.closeFilters()
+
+	if f1.closed != 1 || f2.closed != 1 {
+		t.Errorf("filters closed %d and %d times, want 1", f1.closed, f2.closed)
+	}
+}
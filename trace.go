@@ -0,0 +1,184 @@
+package baker
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// TraceFilterChain runs the records read from r through the filter chain
+// described in cfg, bypassing input and output, and writes to w a readable
+// trace of what happened to each record.
+//
+// Records are read one per line and parsed the same way the topology would
+// parse records coming from the input. For each record, the trace tells the
+// fields modified by each filter, whether the record has been discarded and by
+// which filter, the records that have been created by filters and finally the
+// records that would have reached the output.
+//
+// Filters are created with ComponentParams.DryRun set, so that they don't
+// persist any state, and closed once all records have been traced.
+func TraceFilterChain(cfg *Config, r io.Reader, w io.Writer) error {
+	b := newComponentBuilder(cfg)
+	b.dryRun = true
+	filters, names, err := b.newFilters()
+	if err != nil {
+		return err
+	}
+	defer closeFilters(filters, names)
+
+	tr := &chainTracer{
+		filters:    filters,
+		names:      names,
+		fieldNames: cfg.fieldNames,
+	}
+
+	validate, invalidFields := cfg.validate, cfg.invalidFields
+	if cfg.General.DontValidateFields {
+		validate, invalidFields = nil, nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	nrecord := 0
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		nrecord++
+
+		fmt.Fprintf(w, "record #%d: %q\n", nrecord, line)
+		if len(line) == 0 {
+			fmt.Fprintf(w, "  malformed: empty record\n")
+			continue
+		}
+
+		rec := cfg.createRecord()
+		if err := rec.Parse(line, nil); err != nil {
+			fmt.Fprintf(w, "  malformed: %v\n", err)
+			continue
+		}
+
+		if validate != nil {
+			if ok, idx := validate(rec); !ok {
+				invalid := []FieldIndex{idx}
+				if invalidFields != nil {
+					invalid = invalidFields(rec, nil)
+				}
+				for _, idx := range invalid {
+					fmt.Fprintf(w, "  invalid: field %q didn't pass validation\n", tr.fieldName(idx))
+				}
+				continue
+			}
+		}
+
+		for _, l := range tr.process(0, rec) {
+			fmt.Fprintf(w, "  %s\n", l)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// chainTracer runs a record through a filter chain, tracing what each filter
+// does to it.
+type chainTracer struct {
+	filters    []Filter
+	names      []string
+	fieldNames []string
+}
+
+// forwarded holds the trace of a record forwarded by a filter.
+type forwarded struct {
+	created bool     // created reports whether the record was created by the filter
+	changes []string // changes describes the fields modified by the filter
+	trace   []string // trace is the rest of the trace, for the following filters
+}
+
+// process runs rec into the i-th filter of the chain and returns the trace of
+// the outcome, one line per element, for this and the following filters.
+//
+// When a filter forwards the record it received, and only that record, the
+// trace continues at the same indentation level, otherwise the trace of each
+// forwarded record is nested one level deeper.
+func (tr *chainTracer) process(i int, rec Record) []string {
+	if i == len(tr.filters) {
+		return []string{fmt.Sprintf("output: %q", rec.ToText(nil))}
+	}
+
+	name := tr.names[i]
+	before := tr.snapshot(rec)
+
+	// Filters may modify and forward the same record multiple times, so the
+	// rest of the chain must be traced right when the record is forwarded.
+	var fwd []forwarded
+	tr.filters[i].Process(rec, func(out Record) {
+		fwd = append(fwd, forwarded{
+			created: out != rec,
+			changes: tr.changes(before, out),
+			trace:   tr.process(i+1, out),
+		})
+	})
+
+	var lines []string
+	switch {
+	case len(fwd) == 0:
+		lines = append(lines, name+": dropped")
+	case len(fwd) == 1 && !fwd[0].created:
+		if len(fwd[0].changes) == 0 {
+			lines = append(lines, name+": no changes")
+		} else {
+			lines = append(lines, name+": changed")
+			lines = append(lines, indent(fwd[0].changes)...)
+		}
+		lines = append(lines, fwd[0].trace...)
+	default:
+		for n, f := range fwd {
+			line := fmt.Sprintf("%s: forwarded record #%d", name, n+1)
+			if f.created {
+				line += " (created)"
+			}
+			lines = append(lines, line)
+			lines = append(lines, indent(f.changes)...)
+			lines = append(lines, indent(f.trace)...)
+		}
+	}
+	return lines
+}
+
+// indent returns a copy of lines, indented by one level.
+func indent(lines []string) []string {
+	indented := make([]string, len(lines))
+	for i, l := range lines {
+		indented[i] = "  " + l
+	}
+	return indented
+}
+
+// snapshot returns a copy of the values of all the known fields of rec.
+func (tr *chainTracer) snapshot(rec Record) [][]byte {
+	values := make([][]byte, len(tr.fieldNames))
+	for i := range tr.fieldNames {
+		values[i] = append([]byte(nil), rec.Get(FieldIndex(i))...)
+	}
+	return values
+}
+
+// changes returns a description of the fields of rec whose value differs
+// from the ones in the before snapshot.
+func (tr *chainTracer) changes(before [][]byte, rec Record) []string {
+	var changes []string
+	for i, old := range before {
+		cur := rec.Get(FieldIndex(i))
+		if !bytes.Equal(old, cur) {
+			changes = append(changes, fmt.Sprintf("%s: %q -> %q", tr.fieldName(FieldIndex(i)), old, cur))
+		}
+	}
+	return changes
+}
+
+func (tr *chainTracer) fieldName(idx FieldIndex) string {
+	if int(idx) < len(tr.fieldNames) {
+		return tr.fieldNames[idx]
+	}
+	return fmt.Sprintf("field #%d", idx)
+}
@@ -0,0 +1,175 @@
+package baker_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/filter"
+	"github.com/AdRoll/baker/filter/filtertest"
+	"github.com/AdRoll/baker/input/inputtest"
+	"github.com/AdRoll/baker/output"
+)
+
+// duplicateFilter forwards the incoming record, followed by a copy of it.
+type duplicateFilter struct{ filtertest.Base }
+
+func (duplicateFilter) Process(r baker.Record, next func(baker.Record)) {
+	cpy := r.Copy()
+	cpy.Set(2, []byte("copy"))
+	next(r)
+	next(cpy)
+}
+
+func TestTraceFilterChain(t *testing.T) {
+	toml := `
+[fields]
+names=["f0", "f1", "f2"]
+
+[input]
+name="logline"
+
+[[filter]]
+name="stringmatch"
+	[filter.config]
+	field="f0"
+	strings=["drop"]
+
+[[filter]]
+name="replacefields"
+	[filter.config]
+	replacefields=["bar", "f1"]
+
+[[filter]]
+name="duplicate"
+
+[output]
+name="nop"
+fields=["f0"]
+`
+	components := baker.Components{
+		Inputs: []baker.InputDesc{inputtest.LogLineDesc},
+		Filters: []baker.FilterDesc{
+			filter.StringMatchDesc,
+			filter.ReplaceFieldsDesc,
+			{
+				Name:   "duplicate",
+				Config: &struct{}{},
+				New:    func(baker.FilterParams) (baker.Filter, error) { return duplicateFilter{}, nil },
+			},
+		},
+		Outputs: []baker.OutputDesc{output.NopDesc},
+	}
+
+	cfg, err := baker.NewConfigFromToml(strings.NewReader(toml), components)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := "keep,foo,baz\ndrop,foo,baz\n\nkeep,bar,baz\n"
+	buf := &bytes.Buffer{}
+	if err := baker.TraceFilterChain(cfg, strings.NewReader(records), buf); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `record #1: "keep,foo,baz"
+  stringmatch: no changes
+  replacefields: changed
+    f1: "foo" -> "bar"
+  duplicate: forwarded record #1
+    output: "keep,bar,baz"
+  duplicate: forwarded record #2 (created)
+    f2: "baz" -> "copy"
+    output: "keep,bar,copy"
+record #2: "drop,foo,baz"
+  stringmatch: dropped
+record #3: ""
+  malformed: empty record
+record #4: "keep,bar,baz"
+  stringmatch: no changes
+  replacefields: no changes
+  duplicate: forwarded record #1
+    output: "keep,bar,baz"
+  duplicate: forwarded record #2 (created)
+    f2: "baz" -> "copy"
+    output: "keep,bar,copy"
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got trace:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// closerFilter forwards the incoming record and records whether it has been
+// created with DryRun set and whether it has been closed.
+type closerFilter struct {
+	filtertest.Base
+	dryRun bool
+	closed bool
+}
+
+func (f *closerFilter) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestTraceFilterChainDryRun(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "dedup.state")
+	toml := `
+[fields]
+names=["f0", "f1", "f2"]
+
+[input]
+name="logline"
+
+[[filter]]
+name="dedup"
+	[filter.config]
+	fields=["f0"]
+	statefile="` + stateFile + `"
+
+[[filter]]
+name="closer"
+
+[output]
+name="nop"
+fields=["f0"]
+`
+	closer := &closerFilter{}
+	components := baker.Components{
+		Inputs: []baker.InputDesc{inputtest.LogLineDesc},
+		Filters: []baker.FilterDesc{
+			filter.DedupDesc,
+			{
+				Name:   "closer",
+				Config: &struct{}{},
+				New: func(cfg baker.FilterParams) (baker.Filter, error) {
+					closer.dryRun = cfg.DryRun
+					return closer, nil
+				},
+			},
+		},
+		Outputs: []baker.OutputDesc{output.NopDesc},
+	}
+
+	cfg, err := baker.NewConfigFromToml(strings.NewReader(toml), components)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := baker.TraceFilterChain(cfg, strings.NewReader("a,b,c\na,b,c\n"), &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !closer.dryRun {
+		t.Errorf("filter created with DryRun = false, want true")
+	}
+	if !closer.closed {
+		t.Errorf("filter not closed after tracing")
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Errorf("state file %s has been written, stat error = %v", stateFile, err)
+	}
+}